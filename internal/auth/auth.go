@@ -1,11 +1,15 @@
 package auth
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,6 +18,9 @@ import (
 	"golang.org/x/oauth2"
 )
 
+// CloudPlatformScope is the OAuth scope required by the Code Assist API.
+const CloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
 type RawToken struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
@@ -31,6 +38,22 @@ func (rt RawToken) ToOAuth2Token() *oauth2.Token {
 	}
 }
 
+// HasScope reports whether the token's space-separated scope list includes
+// scope. ok is false when the token records no scopes at all, in which case
+// the grant cannot be checked locally.
+func (rt RawToken) HasScope(scope string) (has bool, ok bool) {
+	fields := strings.Fields(rt.Scope)
+	if len(fields) == 0 {
+		return false, false
+	}
+	for _, f := range fields {
+		if f == scope {
+			return true, true
+		}
+	}
+	return false, true
+}
+
 func fromOAuth2Token(tok *oauth2.Token, prev RawToken) RawToken {
 	rt := prev
 	if tok.AccessToken != "" {
@@ -68,30 +91,125 @@ func LoadRawTokenFromFile(path string) (RawToken, string, error) {
 	return rt, xp, nil
 }
 
-// persistingTokenSource wraps an oauth2.TokenSource, persisting refreshed tokens.
-type persistingTokenSource struct {
+// CredentialEntry is one token loaded from a credentials file.
+type CredentialEntry struct {
+	// Name identifies the token within a combined file: the array index or
+	// the map key. It is empty for single-token files.
+	Name string
+	Raw  RawToken
+}
+
+// rawTokenKeys are the JSON keys that identify a single-token object.
+var rawTokenKeys = []string{"access_token", "refresh_token", "token_type", "expiry_date", "scope"}
+
+// LoadRawTokensFromFile loads the tokens in a credentials file (with ~ expansion).
+// Besides the single-token format, it accepts a combined file holding either a
+// JSON array of tokens or an object mapping names to tokens; combined reports
+// which one was found. Combined entries are returned in a stable order.
+func LoadRawTokensFromFile(path string) (entries []CredentialEntry, xp string, combined bool, err error) {
+	xp, err = utils.ExpandUser(path)
+	if err != nil {
+		return nil, path, false, fmt.Errorf("expand path: %w", err)
+	}
+	b, err := os.ReadFile(xp)
+	if err != nil {
+		return nil, path, false, fmt.Errorf("read creds file: %w", err)
+	}
+	trimmed := bytes.TrimSpace(b)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var list []RawToken
+		if err := json.Unmarshal(trimmed, &list); err != nil {
+			return nil, path, false, fmt.Errorf("parse creds json array: %w", err)
+		}
+		for i, rt := range list {
+			entries = append(entries, CredentialEntry{Name: strconv.Itoa(i), Raw: rt})
+		}
+		if len(entries) == 0 {
+			return nil, path, true, fmt.Errorf("creds file contains no tokens")
+		}
+		return entries, xp, true, nil
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(trimmed, &obj); err != nil {
+		return nil, path, false, fmt.Errorf("parse creds json: %w", err)
+	}
+	for _, k := range rawTokenKeys {
+		if _, ok := obj[k]; ok {
+			var rt RawToken
+			if err := json.Unmarshal(trimmed, &rt); err != nil {
+				return nil, path, false, fmt.Errorf("parse creds json: %w", err)
+			}
+			return []CredentialEntry{{Raw: rt}}, xp, false, nil
+		}
+	}
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var rt RawToken
+		if err := json.Unmarshal(obj[name], &rt); err != nil {
+			return nil, path, true, fmt.Errorf("parse creds entry %q: %w", name, err)
+		}
+		entries = append(entries, CredentialEntry{Name: name, Raw: rt})
+	}
+	if len(entries) == 0 {
+		return nil, path, true, fmt.Errorf("creds file contains no tokens")
+	}
+	return entries, xp, true, nil
+}
+
+// PersistingTokenSource wraps an oauth2.TokenSource, persisting refreshed tokens.
+type PersistingTokenSource struct {
 	base    oauth2.TokenSource
 	current RawToken
 	path    string
 	persist bool
 	mu      sync.Mutex
+	// lastRefresh and lastRefreshErr record the latest refresh attempt
+	lastRefresh    time.Time
+	lastRefreshErr error
+}
+
+// TokenStatus is a snapshot of a PersistingTokenSource for diagnostics.
+type TokenStatus struct {
+	// Expiry is the current access token's expiry; zero if unknown.
+	Expiry time.Time
+	// LastRefresh is when a refresh last succeeded or failed; zero if no
+	// refresh has happened since startup.
+	LastRefresh time.Time
+	// LastRefreshErr is the error of the latest refresh, nil if it succeeded.
+	LastRefreshErr error
 }
 
-func NewPersistingTokenSource(base oauth2.TokenSource, initial RawToken, path string, persist bool) oauth2.TokenSource {
-	return &persistingTokenSource{base: base, current: initial, path: path, persist: persist}
+func NewPersistingTokenSource(base oauth2.TokenSource, initial RawToken, path string, persist bool) *PersistingTokenSource {
+	return &PersistingTokenSource{base: base, current: initial, path: path, persist: persist}
 }
 
-func (p *persistingTokenSource) Token() (*oauth2.Token, error) {
-	tok, err := p.base.Token()
+func (p *PersistingTokenSource) Token() (*oauth2.Token, error) {
+	p.mu.Lock()
+	base := p.base
+	p.mu.Unlock()
+	tok, err := base.Token()
 	if err != nil {
+		// A cached token never fails, so this was a refresh attempt
+		p.mu.Lock()
+		p.lastRefresh, p.lastRefreshErr = time.Now(), err
+		p.mu.Unlock()
 		return nil, err
 	}
 	// Detect change and persist atomically
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	if p.base != base {
+		// Reloaded while refreshing; keep the reloaded token
+		return tok, nil
+	}
 	updated := fromOAuth2Token(tok, p.current)
 	if updated.AccessToken != p.current.AccessToken || updated.ExpiryDateMS != p.current.ExpiryDateMS {
 		p.current = updated
+		p.lastRefresh, p.lastRefreshErr = time.Now(), nil
 		if p.persist && p.path != "" {
 			if err := SaveRawTokenAtomic(p.path, p.current); err != nil {
 				// Non-fatal; return token regardless
@@ -101,6 +219,34 @@ func (p *persistingTokenSource) Token() (*oauth2.Token, error) {
 	return tok, nil
 }
 
+// Status reports the current token expiry and the outcome of the latest
+// refresh without triggering one.
+func (p *PersistingTokenSource) Status() TokenStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := TokenStatus{LastRefresh: p.lastRefresh, LastRefreshErr: p.lastRefreshErr}
+	if p.current.ExpiryDateMS > 0 {
+		st.Expiry = time.UnixMilli(p.current.ExpiryDateMS)
+	}
+	return st
+}
+
+// Reload adopts rt, read back from disk after an external change, and
+// rebuilds the underlying source with newBase. To avoid clobbering a fresher
+// token (including the one this source just persisted itself), rt is only
+// adopted when it carries a different refresh token or a later expiry.
+// It reports whether the token was adopted.
+func (p *PersistingTokenSource) Reload(rt RawToken, newBase func(*oauth2.Token) oauth2.TokenSource) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if rt.RefreshToken == p.current.RefreshToken && rt.ExpiryDateMS <= p.current.ExpiryDateMS {
+		return false
+	}
+	p.current = rt
+	p.base = newBase(rt.ToOAuth2Token())
+	return true
+}
+
 func SaveRawTokenAtomic(path string, rt RawToken) error {
 	dir := filepath.Dir(path)
 	if err := os.MkdirAll(dir, 0o700); err != nil {
@@ -133,18 +279,31 @@ func SaveRawTokenAtomic(path string, rt RawToken) error {
 	return nil
 }
 
-// Helper to force-refresh a token if it's near expiry in the next N minutes.
-func EnsureFresh(ctx context.Context, ts oauth2.TokenSource, nearMinutes int) error {
-	tok, err := ts.Token()
+// EnsureFresh forces a refresh of p's token through cfg, even when the cached
+// access token is still valid, and adopts (and persists) the result. It fails
+// when the token endpoint rejects the refresh token, e.g. because it was
+// issued for a different client id/secret.
+func EnsureFresh(ctx context.Context, cfg oauth2.Config, p *PersistingTokenSource) error {
+	p.mu.Lock()
+	cur := p.current
+	p.mu.Unlock()
+	if cur.RefreshToken == "" {
+		return fmt.Errorf("credential has no refresh token")
+	}
+	// Without an access token oauth2 always goes to the token endpoint.
+	tok, err := cfg.TokenSource(ctx, &oauth2.Token{RefreshToken: cur.RefreshToken}).Token()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastRefresh, p.lastRefreshErr = time.Now(), err
 	if err != nil {
 		return err
 	}
-	if tok.Expiry.IsZero() {
-		return nil
-	}
-	if time.Until(tok.Expiry) < time.Duration(nearMinutes)*time.Minute {
-		// Force refresh by invalidating cached token if possible; oauth2.TokenSource
-		// generally refreshes automatically on Token(). No-op here.
+	p.current = fromOAuth2Token(tok, p.current)
+	p.base = cfg.TokenSource(context.Background(), tok)
+	if p.persist && p.path != "" {
+		if err := SaveRawTokenAtomic(p.path, p.current); err != nil {
+			return fmt.Errorf("persist refreshed token: %w", err)
+		}
 	}
 	return nil
 }
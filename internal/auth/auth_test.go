@@ -2,6 +2,7 @@ package auth
 
 import (
 	"encoding/json"
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
@@ -55,3 +56,114 @@ func (f *fakeTS) Token() (*oauth2.Token, error) {
 	f.toks = f.toks[1:]
 	return t, nil
 }
+
+func TestLoadRawTokensFromFile_Formats(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	single := write("single.json", `{"access_token":"a","refresh_token":"r"}`)
+	entries, _, combined, err := LoadRawTokensFromFile(single)
+	if err != nil || combined || len(entries) != 1 || entries[0].Raw.RefreshToken != "r" {
+		t.Fatalf("single: entries=%+v combined=%v err=%v", entries, combined, err)
+	}
+
+	array := write("array.json", ` [{"refresh_token":"r0"},{"refresh_token":"r1"}]`)
+	entries, _, combined, err = LoadRawTokensFromFile(array)
+	if err != nil || !combined || len(entries) != 2 || entries[0].Name != "0" || entries[1].Raw.RefreshToken != "r1" {
+		t.Fatalf("array: entries=%+v combined=%v err=%v", entries, combined, err)
+	}
+
+	named := write("named.json", `{"work":{"refresh_token":"rw"},"home":{"refresh_token":"rh"}}`)
+	entries, _, combined, err = LoadRawTokensFromFile(named)
+	if err != nil || !combined || len(entries) != 2 || entries[0].Name != "home" || entries[1].Raw.RefreshToken != "rw" {
+		t.Fatalf("named: entries=%+v combined=%v err=%v", entries, combined, err)
+	}
+
+	empty := write("empty.json", `[]`)
+	if _, _, _, err := LoadRawTokensFromFile(empty); err == nil {
+		t.Fatalf("expected error for empty combined file")
+	}
+}
+
+func TestRawToken_HasScope(t *testing.T) {
+	cases := []struct {
+		scope   string
+		has, ok bool
+	}{
+		{"", false, false},
+		{"openid " + CloudPlatformScope + " email", true, true},
+		{"https://www.googleapis.com/auth/userinfo.email", false, true},
+	}
+	for _, c := range cases {
+		has, ok := RawToken{Scope: c.scope}.HasScope(CloudPlatformScope)
+		if has != c.has || ok != c.ok {
+			t.Fatalf("scope %q: got has=%v ok=%v, want has=%v ok=%v", c.scope, has, ok, c.has, c.ok)
+		}
+	}
+}
+
+func TestPersistingTokenSource_ReloadRules(t *testing.T) {
+	cur := RawToken{AccessToken: "a1", RefreshToken: "r1", ExpiryDateMS: 2000}
+	p := NewPersistingTokenSource(oauth2.StaticTokenSource(cur.ToOAuth2Token()), cur, "", false)
+	newBase := func(tok *oauth2.Token) oauth2.TokenSource { return oauth2.StaticTokenSource(tok) }
+
+	if p.Reload(cur, newBase) {
+		t.Fatalf("identical token must not be adopted")
+	}
+	if p.Reload(RawToken{AccessToken: "old", RefreshToken: "r1", ExpiryDateMS: 1000}, newBase) {
+		t.Fatalf("older token with same refresh token must not clobber")
+	}
+	if !p.Reload(RawToken{AccessToken: "a2", RefreshToken: "r1", ExpiryDateMS: 3000}, newBase) {
+		t.Fatalf("fresher token should be adopted")
+	}
+	if !p.Reload(RawToken{AccessToken: "a3", RefreshToken: "r2", ExpiryDateMS: 500}, newBase) {
+		t.Fatalf("new refresh token should be adopted")
+	}
+	tok, err := p.Token()
+	if err != nil || tok.AccessToken != "a3" {
+		t.Fatalf("expected reloaded token a3, got %v err=%v", tok, err)
+	}
+}
+
+type errTS struct{ err error }
+
+func (e errTS) Token() (*oauth2.Token, error) { return nil, e.err }
+
+func TestPersistingTokenSource_Status(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	cur := RawToken{AccessToken: "a1", RefreshToken: "r", ExpiryDateMS: exp.UnixMilli()}
+	p := NewPersistingTokenSource(oauth2.StaticTokenSource(cur.ToOAuth2Token()), cur, "", false)
+	if st := p.Status(); !st.Expiry.Equal(exp) || !st.LastRefresh.IsZero() || st.LastRefreshErr != nil {
+		t.Fatalf("unexpected initial status %+v", st)
+	}
+	// A cached token is not a refresh
+	if _, err := p.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if st := p.Status(); !st.LastRefresh.IsZero() {
+		t.Fatalf("cached token counted as refresh: %+v", st)
+	}
+
+	p.base = errTS{err: errors.New("invalid_grant")}
+	if _, err := p.Token(); err == nil {
+		t.Fatal("expected refresh error")
+	}
+	if st := p.Status(); st.LastRefresh.IsZero() || st.LastRefreshErr == nil {
+		t.Fatalf("failed refresh not recorded: %+v", st)
+	}
+
+	exp2 := exp.Add(time.Hour)
+	p.base = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "a2", Expiry: exp2})
+	if _, err := p.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if st := p.Status(); st.LastRefreshErr != nil || !st.Expiry.Equal(exp2) {
+		t.Fatalf("successful refresh not recorded: %+v", st)
+	}
+}
@@ -0,0 +1,46 @@
+// Package buildinfo exposes the build version of the binary. Version, Commit
+// and Date are meant to be set at build time, e.g.
+//
+//	go build -ldflags "-X gcli2api/internal/buildinfo.Version=v1.2.3 -X gcli2api/internal/buildinfo.Commit=$(git rev-parse HEAD)"
+package buildinfo
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Set via -ldflags -X at build time.
+var (
+	Version = "dev"
+	Commit  = ""
+	Date    = ""
+)
+
+// Info describes the running build.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	GoVersion string `json:"goVersion"`
+}
+
+// Get returns the build info. A commit or date not set via -ldflags falls back
+// to the VCS stamp the Go toolchain embeds when building from a checkout.
+func Get() Info {
+	info := Info{Version: Version, Commit: Commit, Date: Date, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+				}
+			case "vcs.time":
+				if info.Date == "" {
+					info.Date = s.Value
+				}
+			}
+		}
+	}
+	return info
+}
@@ -3,12 +3,17 @@ package codeassist
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -23,6 +28,11 @@ const (
 	BaseURL   = "https://cloudcode-pa.googleapis.com"
 	APIVer    = "v1internal"
 	DefaultUA = "google-api-nodejs-client/9.15.1"
+	// DefaultPluginType is the metadata.pluginType sent during discovery.
+	DefaultPluginType = "GEMINI"
+	// DefaultDiscoveryTimeout bounds one project discovery, including
+	// onboarding polls and rate-limit waits, unless overridden.
+	DefaultDiscoveryTimeout = 2 * time.Minute
 )
 
 type CodeAssistRequest struct {
@@ -43,17 +53,78 @@ type CaClient struct {
 	// per-unit HTTP retries; MultiClient orchestrates retries across units.
 	transportRetries int
 	baseDelay        time.Duration
+	// maxResponseBytes caps generation response bodies; zero is unlimited
+	maxResponseBytes int64
+	// apiVersion is the API path segment, APIVer unless overridden
+	apiVersion string
+	// vertexLocation, when set, targets Vertex AI instead of Code Assist
+	vertexLocation string
+	// pluginType is the discovery metadata.pluginType, DefaultPluginType
+	// unless overridden
+	pluginType string
+	// discoveryTimeout bounds DiscoverProject, DefaultDiscoveryTimeout
+	// unless overridden
+	discoveryTimeout time.Duration
+	// envelopeField is the envelope key holding the generation response,
+	// DefaultEnvelopeField unless overridden
+	envelopeField string
+	// lastPing is when Ping last ran, in Unix nanoseconds
+	lastPing atomic.Int64
 }
 
 func NewCaClient(httpClient *http.Client, transportRetries int, baseDelay time.Duration) *CaClient {
-	return &CaClient{httpClient: httpClient, baseURL: BaseURL, transportRetries: transportRetries, baseDelay: baseDelay}
+	return &CaClient{httpClient: httpClient, baseURL: BaseURL, transportRetries: transportRetries, baseDelay: baseDelay, apiVersion: APIVer, pluginType: DefaultPluginType, discoveryTimeout: DefaultDiscoveryTimeout, envelopeField: DefaultEnvelopeField}
+}
+
+// DefaultEnvelopeField is the Code Assist envelope key that wraps generation
+// responses.
+const DefaultEnvelopeField = "response"
+
+// SetEnvelopeResponseField overrides the envelope key unwrapped from unary
+// and streamed responses (DefaultEnvelopeField by default), as insurance
+// against upstream renaming it. An empty value keeps the default.
+func (c *CaClient) SetEnvelopeResponseField(name string) {
+	if name != "" {
+		c.envelopeField = name
+	}
+}
+
+// SetAPIVersion overrides the API version path segment (APIVer by default)
+// for all calls. An empty value keeps the default.
+func (c *CaClient) SetAPIVersion(v string) {
+	if v != "" {
+		c.apiVersion = v
+	}
+}
+
+// SetPluginType overrides the metadata.pluginType sent by loadCodeAssist and
+// onboardUser (DefaultPluginType by default). An empty value keeps the
+// default.
+func (c *CaClient) SetPluginType(v string) {
+	if v != "" {
+		c.pluginType = v
+	}
+}
+
+// SetDiscoveryTimeout overrides the time budget of one project discovery
+// (DefaultDiscoveryTimeout by default). Zero keeps the default.
+func (c *CaClient) SetDiscoveryTimeout(d time.Duration) {
+	if d > 0 {
+		c.discoveryTimeout = d
+	}
+}
+
+// SetMaxResponseBytes caps the size of generation response bodies. Unary
+// calls fail and streams end with ErrResponseTooLarge once the cap is passed.
+// Zero means unlimited.
+func (c *CaClient) SetMaxResponseBytes(n int64) {
+	c.maxResponseBytes = n
 }
 
 func (c *CaClient) GenerateContent(ctx context.Context, model, project string, req gemini.GeminiRequest) (*gemini.GeminiAPIResponse, error) {
-	url := fmt.Sprintf("%s/%s:generateContent", c.baseURL, APIVer)
+	url := c.generationURL(model, project, "generateContent")
 	logrus.Debugf("new request %s", url)
-	body := CodeAssistRequest{Model: model, Project: project, Request: req}
-	pb, err := json.Marshal(body)
+	pb, err := c.generationBody(model, project, req)
 	if err != nil {
 		return nil, err
 	}
@@ -63,27 +134,75 @@ func (c *CaClient) GenerateContent(ctx context.Context, model, project string, r
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
 	httpReq.Header.Set("User-Agent", config.UserAgent)
+	applyForwardHeaders(ctx, httpReq)
 
 	resp, err := c.httpClient.Do(httpReq)
 	if err != nil {
-		return nil, err
+		return nil, &transportError{err}
 	}
 	defer resp.Body.Close()
+	if err := gunzipBody(resp); err != nil {
+		return nil, err
+	}
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
 		// Envelope
-		var env CodeAssistEnvelope
-		dec := json.NewDecoder(resp.Body)
-		if err := dec.Decode(&env); err != nil {
+		b, err := io.ReadAll(capResponse(resp.Body, c.maxResponseBytes))
+		if err != nil {
 			return nil, err
 		}
-		if env.Response == nil {
-			return nil, fmt.Errorf("empty response envelope")
+		if raw := RawResponseFrom(ctx); raw != nil {
+			raw.set(b)
+		}
+		if c.vertexLocation != "" {
+			var bare gemini.GeminiAPIResponse
+			if err := gemini.UnmarshalUseNumber(b, &bare); err != nil {
+				return nil, err
+			}
+			return &bare, nil
+		}
+		var env map[string]json.RawMessage
+		if err := json.Unmarshal(b, &env); err != nil {
+			return nil, err
 		}
-		return env.Response, nil
+		var response *gemini.GeminiAPIResponse
+		if raw, ok := env[c.envelopeField]; ok {
+			if err := gemini.UnmarshalUseNumber(raw, &response); err != nil {
+				return nil, err
+			}
+		}
+		if response == nil {
+			// Safety-blocked prompts may come back as a 200 carrying only
+			// promptFeedback next to the (missing) response. Surface whatever
+			// the envelope holds as an empty but valid response.
+			var bare gemini.GeminiAPIResponse
+			if err := gemini.UnmarshalUseNumber(b, &bare); err != nil {
+				return nil, err
+			}
+			if bare.Candidates == nil {
+				bare.Candidates = []gemini.Candidate{}
+			}
+			logrus.Warnf("upstream returned no %s in envelope; promptFeedback=%v", c.envelopeField, bare.PromptFeedback)
+			return &bare, nil
+		}
+		return response, nil
 	}
 	// Non-2xx
 	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
-	return nil, fmt.Errorf("upstream status %d: %s", resp.StatusCode, string(b))
+	ue := newUpstreamError(resp, b)
+	logUpstreamFailure("generateContent", model, project, ue)
+	return nil, ue
+}
+
+// logUpstreamFailure logs a failed generation call with the method, model
+// and project it targeted. Only the status and upstream's error body are
+// logged, never request bodies or credentials.
+func logUpstreamFailure(method, model, project string, err error) {
+	logrus.WithFields(logrus.Fields{
+		"upstream_method": method,
+		"model":           model,
+		"project":         project,
+		"status":          upstreamStatus(err),
+	}).Warnf("upstream call failed: %v", err)
 }
 
 // StreamClient returns a channel of responses and an error channel.
@@ -93,9 +212,8 @@ func (c *CaClient) GenerateContentStream(ctx context.Context, model, project str
 	go func() {
 		defer close(out)
 		defer close(errs)
-		url := fmt.Sprintf("%s/%s:streamGenerateContent?alt=sse", c.baseURL, APIVer)
-		body := CodeAssistRequest{Model: model, Project: project, Request: req}
-		pb, err := json.Marshal(body)
+		url := c.generationURL(model, project, "streamGenerateContent") + "?alt=sse"
+		pb, err := c.generationBody(model, project, req)
 		if err != nil {
 			errs <- err
 			return
@@ -108,26 +226,33 @@ func (c *CaClient) GenerateContentStream(ctx context.Context, model, project str
 		httpReq.Header.Set("Content-Type", "application/json")
 		httpReq.Header.Set("Accept", "text/event-stream")
 		httpReq.Header.Set("User-Agent", config.UserAgent)
+		applyForwardHeaders(ctx, httpReq)
 
 		resp, err := c.httpClient.Do(httpReq)
 		if err != nil {
-			errs <- err
+			errs <- &transportError{err}
 			return
 		}
 		defer resp.Body.Close()
+		if err := gunzipBody(resp); err != nil {
+			errs <- err
+			return
+		}
 		// logrus.Infof("response received, status = %d", resp.StatusCode)
 		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 			b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
-			err := fmt.Errorf("upstream status %d: %s", resp.StatusCode, string(b))
-			logrus.Warnf("error response: %v", err)
+			err := newUpstreamError(resp, b)
+			logUpstreamFailure("streamGenerateContent", model, project, err)
 			errs <- err
 			return
 		}
-		// Use manual SSE parsing similar to internal/sse if needed; upstream returns SSE with data: envelopes.
-		// Here, mimic with a small scanner over lines.
-		// Simpler: reuse sse.Parse by wrapping response
-		type envelope = CodeAssistEnvelope
-		readErr := parseSSEStream(ctx, resp.Body, func(env *envelope) error {
+		// Upstream returns SSE with data: envelopes for alt=sse. Fall back to
+		// incremental JSON array decoding if it answers with plain JSON instead.
+		parse := parseSSEStream
+		if isJSONContentType(resp.Header.Get("Content-Type")) {
+			parse = parseJSONArrayStream
+		}
+		readErr := parse(ctx, capResponse(resp.Body, c.maxResponseBytes), c.envelopeField, func(env *CodeAssistEnvelope) error {
 			if env != nil && env.Response != nil {
 				select {
 				case out <- *env.Response:
@@ -146,7 +271,7 @@ func (c *CaClient) GenerateContentStream(ctx context.Context, model, project str
 }
 
 // parseSSEStream is a local minimal SSE parser to avoid extra imports.
-func parseSSEStream(ctx context.Context, r io.Reader, cb func(*CodeAssistEnvelope) error) error {
+func parseSSEStream(ctx context.Context, r io.Reader, field string, cb func(*CodeAssistEnvelope) error) error {
 	// Process each data line immediately like the TypeScript version
 	br := bufio.NewScanner(r)
 	// Increase buffer size for large events
@@ -173,57 +298,18 @@ func parseSSEStream(ctx context.Context, r io.Reader, cb func(*CodeAssistEnvelop
 				continue
 			}
 
-			// Parse JSON data - handle both envelope and raw response formats
-			var response gemini.GeminiAPIResponse
-			var usageMetadata *gemini.UsageMetadata
-
-			// First try to parse as a generic map to detect envelope format
-			var raw map[string]json.RawMessage
-			if err := json.Unmarshal([]byte(data), &raw); err != nil {
+			response, err := decodeStreamEvent([]byte(data), field)
+			if err != nil {
 				// Avoid logging raw SSE payload to prevent leaking sensitive data
 				logrus.WithFields(logrus.Fields{
 					"err":        err,
 					"data_bytes": len(data),
-				}).Error("failed to unmarshal SSE data as JSON")
+				}).Error("failed to unmarshal SSE data")
 				continue
 			}
 
-			// Check if this is an envelope format with "response" field
-			if responseRaw, hasResponse := raw["response"]; hasResponse {
-				// Extract the response from the envelope
-				if err := json.Unmarshal(responseRaw, &response); err != nil {
-					logrus.WithFields(logrus.Fields{
-						"err":        err,
-						"data_bytes": len(data),
-					}).Error("failed to unmarshal envelope response")
-					continue
-				}
-
-				// Extract usage metadata from envelope if present
-				if usageRaw, hasUsage := raw["usageMetadata"]; hasUsage {
-					var usage gemini.UsageMetadata
-					if err := json.Unmarshal(usageRaw, &usage); err == nil {
-						usageMetadata = &usage
-					}
-				}
-			} else {
-				// Try to parse as raw response directly
-				if err := json.Unmarshal([]byte(data), &response); err != nil {
-					logrus.WithFields(logrus.Fields{
-						"err":        err,
-						"data_bytes": len(data),
-					}).Error("failed to unmarshal SSE data as raw response")
-					continue
-				}
-			}
-
-			// If we got usage metadata from envelope, merge it into response
-			if usageMetadata != nil && response.UsageMetadata == nil {
-				response.UsageMetadata = usageMetadata
-			}
-
 			// Wrap in envelope for callback compatibility
-			env := &CodeAssistEnvelope{Response: &response}
+			env := &CodeAssistEnvelope{Response: response}
 			// logrus.Infof("received SSE envelope: %s", utils.TruncateLongStringInObject(env, 1000))
 			if err := cb(env); err != nil {
 				return err
@@ -237,15 +323,134 @@ func parseSSEStream(ctx context.Context, r io.Reader, cb func(*CodeAssistEnvelop
 	return nil
 }
 
+// parseJSONArrayStream incrementally decodes a streamed JSON array of
+// envelopes, which upstream returns for streamGenerateContent without alt=sse.
+func parseJSONArrayStream(ctx context.Context, r io.Reader, field string, cb func(*CodeAssistEnvelope) error) error {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '[' {
+		return fmt.Errorf("unexpected stream token %v; want '['", tok)
+	}
+	for dec.More() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		response, err := decodeStreamEvent(raw, field)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"err":        err,
+				"data_bytes": len(raw),
+			}).Error("failed to unmarshal stream array element")
+			continue
+		}
+		if err := cb(&CodeAssistEnvelope{Response: response}); err != nil {
+			return err
+		}
+	}
+	// Consume the closing bracket
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// decodeStreamEvent parses a single streamed event, handling both the
+// envelope format ({"<field>": {...}}, field being "response" by default)
+// and a raw response.
+func decodeStreamEvent(data []byte, field string) (*gemini.GeminiAPIResponse, error) {
+	var response gemini.GeminiAPIResponse
+
+	// First try to parse as a generic map to detect envelope format
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	// Check if this is an envelope format with the response field
+	responseRaw, hasResponse := raw[field]
+	if !hasResponse {
+		// Try to parse as raw response directly
+		if err := gemini.UnmarshalUseNumber(data, &response); err != nil {
+			return nil, err
+		}
+		return &response, nil
+	}
+	// Extract the response from the envelope
+	if err := gemini.UnmarshalUseNumber(responseRaw, &response); err != nil {
+		return nil, err
+	}
+	// Merge usage metadata from the envelope if the response lacks it
+	if usageRaw, hasUsage := raw["usageMetadata"]; hasUsage && response.UsageMetadata == nil {
+		var usage gemini.UsageMetadata
+		if err := json.Unmarshal(usageRaw, &usage); err == nil {
+			response.UsageMetadata = &usage
+		}
+	}
+	return &response, nil
+}
+
+// gunzipBody swaps resp.Body for a decompressing reader when upstream sent gzip
+// that the transport left alone. net/http only decodes transparently when it
+// added Accept-Encoding itself, which it skips once a caller (for example a
+// forwarded header) sets one. Closing the original body is still the caller's
+// job.
+func gunzipBody(resp *http.Response) error {
+	if resp.Uncompressed || !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return nil
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return fmt.Errorf("gzip response: %w", err)
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{zr, resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.ContentLength = -1
+	return nil
+}
+
+// isJSONContentType reports whether ct denotes a JSON (non-SSE) body.
+func isJSONContentType(ct string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	return mt == "application/json"
+}
+
 // DiscoverProjectID attempts to derive the Google Cloud project ID to use with
 // Code Assist when none is provided. It mirrors the Node implementation:
-// 1) POST :loadCodeAssist {metadata:{pluginType:"GEMINI"}}
+// 1) POST :loadCodeAssist {metadata:{pluginType:"GEMINI"}} (see SetPluginType)
 //   - if response.cloudaicompanionProject is present, return it
 //     2. else determine default tier from response.allowedTiers[*].isDefault
 //     and POST :onboardUser with {tierId, metadata:{pluginType:"GEMINI"}, cloudaicompanionProject:"default"}
 //   - poll :onboardUser with same body until {done:true}
 //   - return response.cloudaicompanionProject.id
 func (c *CaClient) DiscoverProjectID(ctx context.Context) (string, error) {
+	pid, _, err := c.DiscoverProject(ctx, "")
+	return pid, err
+}
+
+// DiscoverProject is DiscoverProjectID that also reports the tier id of the
+// account. A non-empty tierID (e.g. remembered from an earlier discovery)
+// skips the loadCodeAssist lookup and onboards with that tier directly.
+func (c *CaClient) DiscoverProject(ctx context.Context, tierID string) (projectID, tier string, err error) {
+	deadline := time.Now().Add(c.discoveryTimeout)
+	if tierID != "" {
+		return c.onboard(ctx, tierID, deadline)
+	}
 	type allowedTier struct {
 		ID        string `json:"id"`
 		IsDefault bool   `json:"isDefault"`
@@ -253,38 +458,48 @@ func (c *CaClient) DiscoverProjectID(ctx context.Context) (string, error) {
 	type loadResp struct {
 		// Could be a string project id or an object; accept raw to handle both.
 		CloudAICompanionProject json.RawMessage `json:"cloudaicompanionProject"`
+		CurrentTier             *allowedTier    `json:"currentTier"`
 		AllowedTiers            []allowedTier   `json:"allowedTiers"`
 	}
 	// First: loadCodeAssist
 	var lr loadResp
-	if err := c.doJSON(ctx, "loadCodeAssist", map[string]any{
-		"metadata": map[string]any{"pluginType": "GEMINI"},
-	}, &lr, DefaultUA); err != nil {
-		return "", err
+	if err := c.discoveryJSON(ctx, deadline, "loadCodeAssist", map[string]any{
+		"metadata": map[string]any{"pluginType": c.pluginType},
+	}, &lr); err != nil {
+		return "", "", err
 	}
 	if len(lr.CloudAICompanionProject) > 0 && string(lr.CloudAICompanionProject) != "null" {
+		var current string
+		if lr.CurrentTier != nil {
+			current = lr.CurrentTier.ID
+		}
 		// Try string first
 		var asStr string
 		if err := json.Unmarshal(lr.CloudAICompanionProject, &asStr); err == nil && asStr != "" {
-			return asStr, nil
+			return asStr, current, nil
 		}
 		// Fallback to object with id
 		var obj struct {
 			ID string `json:"id"`
 		}
 		if err := json.Unmarshal(lr.CloudAICompanionProject, &obj); err == nil && obj.ID != "" {
-			return obj.ID, nil
+			return obj.ID, current, nil
 		}
 	}
 	// Determine default tier
-	tierID := "free-tier"
+	tierID = "free-tier"
 	for _, t := range lr.AllowedTiers {
 		if t.IsDefault && t.ID != "" {
 			tierID = t.ID
 			break
 		}
 	}
-	// Kick off onboarding and poll
+	return c.onboard(ctx, tierID, deadline)
+}
+
+// onboard runs :onboardUser for tierID and polls until it reports the
+// project or the discovery deadline passes.
+func (c *CaClient) onboard(ctx context.Context, tierID string, deadline time.Time) (string, string, error) {
 	type onboardResp struct {
 		Done     bool `json:"done"`
 		Response struct {
@@ -297,47 +512,103 @@ func (c *CaClient) DiscoverProjectID(ctx context.Context) (string, error) {
 	req := map[string]any{
 		"tierId": tierID,
 		"metadata": map[string]any{
-			"pluginType": "GEMINI",
+			"pluginType": c.pluginType,
 		},
 		"cloudaicompanionProject": "default",
 	}
 	// Loop with small delay similar to Node (2s)
 	// Use retries/backoff wrapper for transport errors; logical polling remains explicit
-	deadline := time.Now().Add(2 * time.Minute)
 	for {
 		if time.Now().After(deadline) {
-			return "", fmt.Errorf("discover project timeout")
+			return "", "", fmt.Errorf("discover project timeout")
 		}
 		var or onboardResp
-		if err := c.doJSON(ctx, "onboardUser", req, &or, DefaultUA); err != nil {
-			return "", err
+		if err := c.discoveryJSON(ctx, deadline, "onboardUser", req, &or); err != nil {
+			return "", "", err
 		}
 		if or.Done {
 			if id := or.Response.CloudAICompanionProject.ID; id != "" {
-				return id, nil
+				return id, tierID, nil
 			}
-			return "", fmt.Errorf("onboardUser done without project id")
+			return "", "", fmt.Errorf("onboardUser done without project id")
 		}
 		// not done yet; sleep 2s
 		t := time.NewTimer(2 * time.Second)
 		select {
 		case <-ctx.Done():
 			t.Stop()
-			return "", ctx.Err()
+			return "", "", ctx.Err()
 		case <-t.C:
 		}
 	}
 }
 
+// rateLimitedError is a 429 answered to a discovery call. retryAfter is the
+// upstream Retry-After hint, zero when absent.
+type rateLimitedError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *rateLimitedError) Error() string { return e.err.Error() }
+func (e *rateLimitedError) Unwrap() error { return e.err }
+
+// discoveryJSON is doJSON for discovery calls. A 429 is waited out, honoring
+// Retry-After (else exponential backoff), as long as the wait ends before
+// deadline; otherwise a rate-limit error is returned instead of letting
+// discovery silently eat the budget.
+func (c *CaClient) discoveryJSON(ctx context.Context, deadline time.Time, method string, body, out any) error {
+	for attempt := 0; ; attempt++ {
+		err := c.doJSON(ctx, method, body, out, DefaultUA)
+		var rl *rateLimitedError
+		if !errors.As(err, &rl) {
+			return err
+		}
+		wait := rl.retryAfter
+		if wait <= 0 {
+			wait = httpx.Backoff(c.baseDelay, attempt, 30*time.Second)
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return fmt.Errorf("%s rate limited beyond the %s discovery budget: %w", method, c.discoveryTimeout, err)
+		}
+		logrus.WithFields(logrus.Fields{"upstream_method": method, "status": http.StatusTooManyRequests}).
+			Warnf("%s rate limited; retrying in %s", method, wait.Round(time.Millisecond))
+		if err := httpx.Sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP
+// date. It returns zero when the header is absent or malformed.
+func parseRetryAfter(v string) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return max(time.Duration(secs)*time.Second, 0)
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
 // doJSON posts JSON to ":<method>" and decodes the JSON response into out.
+// A 429 is not retried here but returned as a rateLimitedError, so the
+// caller can wait it out within its own budget.
 func (c *CaClient) doJSON(ctx context.Context, method string, body any, out any, ua string) error {
-	url := fmt.Sprintf("%s/%s:%s", c.baseURL, APIVer, method)
+	url := fmt.Sprintf("%s/%s:%s", c.baseURL, c.apiVersion, method)
 	pb, err := json.Marshal(body)
 	if err != nil {
 		return err
 	}
 	var lastErr error
-	return httpx.WithRetries(ctx, c.transportRetries, c.baseDelay, func(attempt int) error {
+	// permanent holds a non-retryable upstream error; fn returns nil for it
+	// so WithRetries stops, and it is reported once retries are done.
+	var permanent error
+	err = httpx.WithRetries(ctx, c.transportRetries, c.baseDelay, func(attempt int) error {
 		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(pb))
 		if err != nil {
 			lastErr = err
@@ -351,6 +622,10 @@ func (c *CaClient) doJSON(ctx context.Context, method string, body any, out any,
 			return err
 		}
 		defer resp.Body.Close()
+		if err := gunzipBody(resp); err != nil {
+			lastErr = err
+			return err
+		}
 		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
 			dec := json.NewDecoder(resp.Body)
 			if out == nil {
@@ -365,9 +640,18 @@ func (c *CaClient) doJSON(ctx context.Context, method string, body any, out any,
 		}
 		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
 		lastErr = fmt.Errorf("upstream status %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
-		if resp.StatusCode == 401 || resp.StatusCode == 429 || (resp.StatusCode >= 500 && resp.StatusCode <= 599) {
+		if resp.StatusCode == http.StatusTooManyRequests {
+			permanent = &rateLimitedError{err: lastErr, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+			return nil
+		}
+		if resp.StatusCode == 401 || (resp.StatusCode >= 500 && resp.StatusCode <= 599) {
 			return lastErr
 		}
+		permanent = lastErr
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	return permanent
 }
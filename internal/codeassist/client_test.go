@@ -3,9 +3,13 @@ package codeassist
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"gcli2api/internal/gemini"
@@ -42,6 +46,196 @@ func TestClient_Unary_NoInternalRetry(t *testing.T) {
 	}
 }
 
+func TestClient_UpstreamErrorRateLimitInfo(t *testing.T) {
+	body := `{"error":{"code":429,"details":[{"@type":"type.googleapis.com/google.rpc.RetryInfo","retryDelay":"31.5s"}]}}`
+	rt := rtFunc(func(r *http.Request) (*http.Response, error) {
+		rs := resp(429, body, "")
+		rs.Header.Set("X-RateLimit-Remaining-Requests", "0")
+		return rs, nil
+	})
+	c := NewCaClient(mkClient(rt), 0, time.Millisecond)
+	_, err := c.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", gemini.GeminiRequest{})
+	var ue *UpstreamError
+	if !errors.As(err, &ue) {
+		t.Fatalf("expected UpstreamError, got %v", err)
+	}
+	if ue.StatusCode != 429 || ue.RetryAfter != 31500*time.Millisecond || ue.RateLimit.Get("X-Ratelimit-Remaining-Requests") != "0" {
+		t.Fatalf("unexpected rate limit info: %+v", ue)
+	}
+	if !strings.HasPrefix(err.Error(), "upstream status 429: ") {
+		t.Fatalf("error message changed: %v", err)
+	}
+
+	// Retry-After header wins over the body hint
+	rt = rtFunc(func(r *http.Request) (*http.Response, error) {
+		rs := resp(503, body, "")
+		rs.Header.Set("Retry-After", "7")
+		return rs, nil
+	})
+	c = NewCaClient(mkClient(rt), 0, time.Millisecond)
+	out, errs := c.GenerateContentStream(context.Background(), "gemini-2.5-flash", "proj", gemini.GeminiRequest{})
+	for range out {
+	}
+	if err := <-errs; !errors.As(err, &ue) || ue.RetryAfter != 7*time.Second {
+		t.Fatalf("expected stream UpstreamError with Retry-After 7s, got %v", err)
+	}
+}
+
+func TestClient_EnvelopeResponseField(t *testing.T) {
+	payload := `{"candidates":[{"content":{"parts":[{"text":"ok"}]}}]}`
+	rt := rtFunc(func(r *http.Request) (*http.Response, error) {
+		if strings.Contains(r.URL.Path, "streamGenerateContent") {
+			return resp(200, "data: {\"result\": "+payload+"}\n\n", "text/event-stream"), nil
+		}
+		return resp(200, `{"result":`+payload+`}`, ""), nil
+	})
+	c := NewCaClient(mkClient(rt), 0, time.Millisecond)
+	c.SetEnvelopeResponseField("result")
+	got, err := c.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", gemini.GeminiRequest{})
+	if err != nil || gemini.ResponseText(got) != "ok" {
+		t.Fatalf("unary: got %+v err=%v", got, err)
+	}
+	out, errs := c.GenerateContentStream(context.Background(), "gemini-2.5-flash", "proj", gemini.GeminiRequest{})
+	var text string
+	for g := range out {
+		text += gemini.ResponseText(&g)
+	}
+	if err := <-errs; err != nil || text != "ok" {
+		t.Fatalf("stream: got %q err=%v", text, err)
+	}
+}
+
+func TestClient_APIVersionOverride(t *testing.T) {
+	var paths []string
+	rt := rtFunc(func(r *http.Request) (*http.Response, error) {
+		paths = append(paths, r.URL.Path)
+		return resp(200, `{"response":{"candidates":[]}}`, ""), nil
+	})
+	c := NewCaClient(mkClient(rt), 0, time.Millisecond)
+	c.SetAPIVersion("")
+	if _, err := c.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", gemini.GeminiRequest{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.SetAPIVersion("v2internal")
+	if _, err := c.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", gemini.GeminiRequest{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(paths) != 2 || paths[0] != "/v1internal:generateContent" || paths[1] != "/v2internal:generateContent" {
+		t.Fatalf("unexpected paths: %v", paths)
+	}
+}
+
+func TestClient_DiscoveryPluginType(t *testing.T) {
+	var bodies []string
+	rt := rtFunc(func(r *http.Request) (*http.Response, error) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		if strings.HasSuffix(r.URL.Path, ":loadCodeAssist") {
+			return resp(200, `{"allowedTiers":[{"id":"free-tier","isDefault":true}]}`, "application/json"), nil
+		}
+		return resp(200, `{"done":true,"response":{"cloudaicompanionProject":{"id":"p1"}}}`, "application/json"), nil
+	})
+	c := NewCaClient(mkClient(rt), 0, time.Millisecond)
+	c.SetPluginType("GEMINI_NEXT")
+	pid, err := c.DiscoverProjectID(context.Background())
+	if err != nil || pid != "p1" {
+		t.Fatalf("discover: %q %v", pid, err)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("expected loadCodeAssist and onboardUser, got %d calls", len(bodies))
+	}
+	for _, b := range bodies {
+		if !strings.Contains(b, `"pluginType":"GEMINI_NEXT"`) {
+			t.Fatalf("configured pluginType missing from body: %s", b)
+		}
+	}
+}
+
+func TestClient_CitationMetadataPreserved(t *testing.T) {
+	cand := `{"content":{"parts":[{"text":"x"}]},"citationMetadata":{"citations":[{"startIndex":0,"endIndex":1,"uri":"https://example.com"}]}}`
+	unary := `{"response":{"candidates":[` + cand + `]}}`
+	sse := "data: " + unary + "\n\n"
+	check := func(name string, c gemini.Candidate) {
+		t.Helper()
+		b, _ := json.Marshal(c)
+		if !strings.Contains(string(b), `"citationMetadata":{"citations":[{"endIndex":1,"startIndex":0,"uri":"https://example.com"}]}`) {
+			t.Fatalf("%s: citationMetadata lost: %s", name, b)
+		}
+	}
+
+	c := NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+		return resp(200, unary, "application/json"), nil
+	})), 0, time.Millisecond)
+	g, err := c.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", gemini.GeminiRequest{})
+	if err != nil || len(g.Candidates) != 1 {
+		t.Fatalf("unary: %+v %v", g, err)
+	}
+	check("unary", g.Candidates[0])
+
+	c = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+		return resp(200, sse, "text/event-stream"), nil
+	})), 0, time.Millisecond)
+	out, errs := c.GenerateContentStream(context.Background(), "gemini-2.5-flash", "proj", gemini.GeminiRequest{})
+	var chunks []gemini.GeminiAPIResponse
+	for g := range out {
+		chunks = append(chunks, g)
+	}
+	if err := <-errs; err != nil || len(chunks) != 1 || len(chunks[0].Candidates) != 1 {
+		t.Fatalf("stream: %+v %v", chunks, err)
+	}
+	check("stream", chunks[0].Candidates[0])
+}
+
+func TestClient_DiscoveryRateLimit(t *testing.T) {
+	discovery := func(retryAfter string, limited int) (*CaClient, *int) {
+		calls := 0
+		rt := rtFunc(func(r *http.Request) (*http.Response, error) {
+			calls++
+			if calls <= limited {
+				res := resp(429, "slow down", "text/plain")
+				if retryAfter != "" {
+					res.Header.Set("Retry-After", retryAfter)
+				}
+				return res, nil
+			}
+			if strings.HasSuffix(r.URL.Path, ":loadCodeAssist") {
+				return resp(200, `{"cloudaicompanionProject":"p1"}`, "application/json"), nil
+			}
+			return resp(500, "unexpected", "text/plain"), nil
+		})
+		// Transport retries must not stack on top of the 429 handling.
+		return NewCaClient(mkClient(rt), 3, time.Millisecond), &calls
+	}
+
+	c, calls := discovery("", 2)
+	if pid, err := c.DiscoverProjectID(context.Background()); err != nil || pid != "p1" || *calls != 3 {
+		t.Fatalf("expected 429s waited out: pid=%q err=%v calls=%d", pid, err, *calls)
+	}
+
+	c, calls = discovery("3600", 1)
+	c.SetDiscoveryTimeout(time.Second)
+	start := time.Now()
+	_, err := c.DiscoverProjectID(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "rate limited beyond") || !strings.Contains(err.Error(), "status 429") {
+		t.Fatalf("expected rate-limit budget error, got %v", err)
+	}
+	if *calls != 1 || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("expected an immediate failure when Retry-After exceeds the budget, calls=%d took %s", *calls, time.Since(start))
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter("7"); d != 7*time.Second {
+		t.Fatalf("seconds: %s", d)
+	}
+	if d := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)); d < 58*time.Second || d > time.Minute {
+		t.Fatalf("http date: %s", d)
+	}
+	if d := parseRetryAfter("soon"); d != 0 {
+		t.Fatalf("malformed: %s", d)
+	}
+}
+
 func TestStream_SSEParse_Success(t *testing.T) {
 	sseBody := "data: {\"response\": {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"c1\"}]}}]}}\n\n" +
 		"data: {\"response\": {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"c2\"}]}}]}}\n\n"
@@ -63,3 +257,80 @@ func TestStream_SSEParse_Success(t *testing.T) {
 		t.Fatalf("bad parts: %+v", parts)
 	}
 }
+
+func TestStream_JSONArrayParse_Success(t *testing.T) {
+	arrayBody := "[{\"response\": {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"c1\"}]}}]}},\n" +
+		"{\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"c2\"}]}}]}]"
+	rt := rtFunc(func(r *http.Request) (*http.Response, error) {
+		// Deliver the body one byte at a time to exercise incremental decoding
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(iotest.OneByteReader(bytes.NewBufferString(arrayBody))), Header: http.Header{"Content-Type": []string{"application/json; charset=UTF-8"}}}, nil
+	})
+	c := NewCaClient(mkClient(rt), 2, 1*time.Millisecond)
+	out, errs := c.GenerateContentStream(context.Background(), "gemini-2.5-flash", "proj", gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "x"}}}}})
+	var parts []string
+	for g := range out {
+		if len(g.Candidates) > 0 && len(g.Candidates[0].Content.Parts) > 0 {
+			parts = append(parts, g.Candidates[0].Content.Parts[0].Text)
+		}
+	}
+	if err := <-errs; err != nil && err != io.EOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(parts) != 2 || parts[0] != "c1" || parts[1] != "c2" {
+		t.Fatalf("bad parts: %+v", parts)
+	}
+}
+
+func TestStream_JSONArrayParse_Truncated(t *testing.T) {
+	arrayBody := "[{\"response\": {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"c1\"}]}}]}},"
+	rt := rtFunc(func(r *http.Request) (*http.Response, error) {
+		return resp(200, arrayBody, "application/json"), nil
+	})
+	c := NewCaClient(mkClient(rt), 2, 1*time.Millisecond)
+	out, errs := c.GenerateContentStream(context.Background(), "gemini-2.5-flash", "proj", gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "x"}}}}})
+	n := 0
+	for range out {
+		n++
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 event before truncation, got %d", n)
+	}
+	if err := <-errs; err == nil {
+		t.Fatalf("expected error for truncated array")
+	}
+}
+
+func TestClient_Unary_MissingResponseEnvelope(t *testing.T) {
+	body := `{"promptFeedback":{"blockReason":"SAFETY","safetyRatings":[{"category":"HARM_CATEGORY_DANGEROUS_CONTENT","probability":"HIGH"}]}}`
+	rt := rtFunc(func(r *http.Request) (*http.Response, error) {
+		return resp(200, body, ""), nil
+	})
+	c := NewCaClient(mkClient(rt), 0, time.Millisecond)
+	got, err := c.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "hi"}}}}})
+	if err != nil {
+		t.Fatalf("expected a valid empty response, got error: %v", err)
+	}
+	b, _ := json.Marshal(got)
+	if !strings.Contains(string(b), `"candidates":[]`) || !strings.Contains(string(b), `"blockReason":"SAFETY"`) {
+		t.Fatalf("expected empty candidates with block reason, got %s", b)
+	}
+}
+
+func TestStream_SSEParse_ModelVersion(t *testing.T) {
+	sseBody := "data: {\"response\": {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"c1\"}]}}],\"modelVersion\":\"gemini-3-pro-preview-11-2025\"}}\n\n"
+	rt := rtFunc(func(r *http.Request) (*http.Response, error) {
+		return resp(200, sseBody, "text/event-stream"), nil
+	})
+	c := NewCaClient(mkClient(rt), 0, time.Millisecond)
+	out, errs := c.GenerateContentStream(context.Background(), "gemini-2.5-flash", "proj", gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "x"}}}}})
+	var versions []string
+	for g := range out {
+		versions = append(versions, g.ModelVersion)
+	}
+	if err := <-errs; err != nil && err != io.EOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(versions) != 1 || versions[0] != "gemini-3-pro-preview-11-2025" {
+		t.Fatalf("modelVersion lost in SSE parsing: %v", versions)
+	}
+}
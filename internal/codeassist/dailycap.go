@@ -0,0 +1,113 @@
+package codeassist
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrDailyCapReached is wrapped by the error returned when every unit that
+// could serve a request belongs to a credential that has used up its
+// dailyRequestCap for the current UTC day.
+var ErrDailyCapReached = errors.New("daily request cap reached")
+
+// dailyCounts tracks upstream requests per credential (token key) for the
+// current UTC day. Counts are loaded from the state store on first use each
+// day and written through on every request, so caps survive restarts.
+type dailyCounts struct {
+	mu     sync.Mutex
+	day    string
+	counts map[string]int
+	// now is the clock; tests override it to cross midnight
+	now func() time.Time
+}
+
+// rollover resets the counts when the UTC day changed. Callers hold mu.
+func (d *dailyCounts) rollover() {
+	now := time.Now
+	if d.now != nil {
+		now = d.now
+	}
+	if day := now().UTC().Format(time.DateOnly); day != d.day {
+		d.day, d.counts = day, map[string]int{}
+	}
+}
+
+// requestsToday returns e's credential request count for the current day.
+func (mc *MultiClient) requestsToday(e *entry) int {
+	mc.daily.mu.Lock()
+	defer mc.daily.mu.Unlock()
+	return mc.loadDaily(e.tokenKey)
+}
+
+// loadDaily returns the cached count for tokenKey, reading the store on the
+// first lookup of the day. Callers hold daily.mu.
+func (mc *MultiClient) loadDaily(tokenKey string) int {
+	mc.daily.rollover()
+	n, ok := mc.daily.counts[tokenKey]
+	if !ok && mc.store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if v, err := mc.store.GetDailyRequests(ctx, tokenKey, mc.daily.day); err == nil {
+			n = v
+		} else {
+			logrus.Warnf("[MultiClient] load daily request count failed: %v", err)
+		}
+		mc.daily.counts[tokenKey] = n
+	}
+	return n
+}
+
+// capReached reports whether e's credential has used up its daily cap.
+func (mc *MultiClient) capReached(e *entry) bool {
+	return e.dailyCap > 0 && mc.requestsToday(e) >= e.dailyCap
+}
+
+// reserveDaily counts one upstream request on e's credential when it has a
+// daily cap, reporting false instead when the cap is already used up. Check
+// and increment happen under one lock, so concurrent requests never
+// overshoot the cap. Uncapped credentials are not tracked.
+func (mc *MultiClient) reserveDaily(e *entry) bool {
+	if e.dailyCap <= 0 {
+		return true
+	}
+	mc.daily.mu.Lock()
+	n := mc.loadDaily(e.tokenKey) + 1
+	if n > e.dailyCap {
+		mc.daily.mu.Unlock()
+		return false
+	}
+	mc.daily.counts[e.tokenKey] = n
+	day := mc.daily.day
+	mc.daily.mu.Unlock()
+	if n == e.dailyCap {
+		logrus.Warnf("[MultiClient] credential %s reached its daily request cap of %d; skipping it until the next UTC day", e.displayName(), e.dailyCap)
+	}
+	if mc.store != nil {
+		if err := mc.store.IncrDailyRequests(context.Background(), e.tokenKey, day); err != nil {
+			logrus.Warnf("[MultiClient] persist daily request count failed: %v", err)
+		}
+	}
+	return true
+}
+
+// redraw replaces the attempts from k on after cands[k] used up its daily
+// cap between candidates and its reservation, drawing them afresh from the
+// units still under their cap. The error is returned when none is left, or
+// when the capped unit is the only one the request may use.
+func (mc *MultiClient) redraw(ctx context.Context, cands []*entry, k int) ([]*entry, error) {
+	i := k % len(cands)
+	fresh, _, err := mc.candidates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(fresh, cands[i]) {
+		return nil, fmt.Errorf("credential %s: %w", cands[i].displayName(), ErrDailyCapReached)
+	}
+	return append(cands[:i:i], fresh...), nil
+}
@@ -0,0 +1,102 @@
+package codeassist
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gcli2api/internal/gemini"
+)
+
+func gzipBytes(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// gzipServer always answers with a gzip-encoded body, regardless of what the
+// client advertised.
+func gzipServer(t *testing.T, body, ct string) *httptest.Server {
+	zb := gzipBytes(t, body)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ct)
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(zb)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+var gzipReq = gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "hi"}}}}}
+
+func TestGzip_Unary(t *testing.T) {
+	srv := gzipServer(t, `{"response":{"candidates":[{"content":{"parts":[{"text":"ok"}]}}]}}`, "application/json")
+	for name, ctx := range map[string]context.Context{
+		"transport":        context.Background(),
+		"forwarded-accept": WithForwardHeaders(context.Background(), http.Header{"Accept-Encoding": {"gzip"}}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := NewCaClient(srv.Client(), 0, time.Millisecond)
+			c.baseURL = srv.URL
+			got, err := c.GenerateContent(ctx, "gemini-2.5-flash", "proj", gzipReq)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got.Candidates) != 1 || got.Candidates[0].Content.Parts[0].Text != "ok" {
+				t.Fatalf("bad response: %+v", got)
+			}
+		})
+	}
+}
+
+func TestGzip_Stream(t *testing.T) {
+	sse := "data: {\"response\": {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"c1\"}]}}]}}\n\n" +
+		"data: {\"response\": {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"c2\"}]}}]}}\n\n"
+	srv := gzipServer(t, sse, "text/event-stream")
+	for name, ctx := range map[string]context.Context{
+		"transport":        context.Background(),
+		"forwarded-accept": WithForwardHeaders(context.Background(), http.Header{"Accept-Encoding": {"gzip"}}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := NewCaClient(srv.Client(), 0, time.Millisecond)
+			c.baseURL = srv.URL
+			out, errs := c.GenerateContentStream(ctx, "gemini-2.5-flash", "proj", gzipReq)
+			var parts []string
+			for g := range out {
+				parts = append(parts, g.Candidates[0].Content.Parts[0].Text)
+			}
+			if err := <-errs; err != nil && err != io.EOF {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(parts) != 2 || parts[0] != "c1" || parts[1] != "c2" {
+				t.Fatalf("bad parts: %+v", parts)
+			}
+		})
+	}
+}
+
+func TestGzip_ErrorBodyDecoded(t *testing.T) {
+	rt := rtFunc(func(r *http.Request) (*http.Response, error) {
+		res := resp(429, "", "text/plain")
+		res.Header.Set("Content-Encoding", "gzip")
+		res.Body = io.NopCloser(bytes.NewReader(gzipBytes(t, "quota exhausted")))
+		return res, nil
+	})
+	c := NewCaClient(mkClient(rt), 0, time.Millisecond)
+	_, err := c.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", gzipReq)
+	if err == nil || err.Error() != "upstream status 429: quota exhausted" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package codeassist
+
+import (
+	"context"
+	"net/http"
+)
+
+type forwardHeadersKey struct{}
+
+// WithForwardHeaders returns a derived context whose generation requests carry
+// the given extra headers upstream (e.g. X-Goog-User-Project for quota
+// attribution). The caller is responsible for allowlisting them.
+func WithForwardHeaders(ctx context.Context, h http.Header) context.Context {
+	if len(h) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, forwardHeadersKey{}, h.Clone())
+}
+
+// applyForwardHeaders copies headers attached via WithForwardHeaders onto req.
+// They never replace the headers CaClient sets itself.
+func applyForwardHeaders(ctx context.Context, req *http.Request) {
+	h, _ := ctx.Value(forwardHeadersKey{}).(http.Header)
+	for k, vs := range h {
+		if req.Header.Get(k) != "" {
+			continue
+		}
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package codeassist
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+)
+
+const (
+	// healthAlpha is the EWMA weight of the latest outcome.
+	healthAlpha = 0.2
+	// minHealthWeight keeps degraded units in the draw so they are still
+	// probed occasionally and can recover.
+	minHealthWeight = 0.05
+)
+
+// health is an EWMA of a unit's recent upstream success rate in [0, 1],
+// stored as float64 bits. The zero value reads as fully healthy.
+type health struct {
+	bits atomic.Uint64 // math.Float64bits(1 - rate), so zero means healthy
+}
+
+// rate returns the current success rate.
+func (h *health) rate() float64 {
+	return 1 - math.Float64frombits(h.bits.Load())
+}
+
+// record folds one outcome into the average.
+func (h *health) record(ok bool) {
+	sample := 0.0
+	if ok {
+		sample = 1
+	}
+	for {
+		old := h.bits.Load()
+		rate := 1 - math.Float64frombits(old)
+		next := rate*(1-healthAlpha) + sample*healthAlpha
+		if h.bits.CompareAndSwap(old, math.Float64bits(1-next)) {
+			return
+		}
+	}
+}
+
+// healthOrder returns units in a random order biased towards healthier ones
+// (weighted sampling without replacement), so the first pick is usually a
+// healthy unit while degraded ones are still tried now and then.
+func healthOrder(units []*entry) []*entry {
+	type keyed struct {
+		e   *entry
+		key float64
+	}
+	ks := make([]keyed, len(units))
+	for i, e := range units {
+		w := max(e.health.rate(), minHealthWeight)
+		ks[i] = keyed{e: e, key: math.Pow(rand.Float64(), 1/w)}
+	}
+	sort.SliceStable(ks, func(i, j int) bool { return ks[i].key > ks[j].key })
+	out := make([]*entry, len(ks))
+	for i, k := range ks {
+		out[i] = k.e
+	}
+	return out
+}
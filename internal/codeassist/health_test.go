@@ -0,0 +1,81 @@
+package codeassist
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"gcli2api/internal/auth"
+	"gcli2api/internal/gemini"
+)
+
+func TestHealth_EWMA(t *testing.T) {
+	var h health
+	if h.rate() != 1 {
+		t.Fatalf("zero value should be healthy, got %v", h.rate())
+	}
+	h.record(false)
+	if got := h.rate(); got < 0.79 || got > 0.81 {
+		t.Fatalf("rate after one failure = %v, want 0.8", got)
+	}
+	for i := 0; i < 50; i++ {
+		h.record(true)
+	}
+	if got := h.rate(); got < 0.99 {
+		t.Fatalf("rate should recover, got %v", got)
+	}
+}
+
+func TestHealthOrder_PrefersHealthyButProbesDegraded(t *testing.T) {
+	good, bad := &entry{idx: 0}, &entry{idx: 1}
+	for i := 0; i < 50; i++ {
+		bad.health.record(false)
+	}
+	badFirst := 0
+	for i := 0; i < 2000; i++ {
+		if healthOrder([]*entry{bad, good})[0] == bad {
+			badFirst++
+		}
+	}
+	// Expected share is minHealthWeight/(1+minHealthWeight), about 5%.
+	if badFirst == 0 || badFirst > 300 {
+		t.Fatalf("degraded unit picked first %d/2000 times", badFirst)
+	}
+}
+
+func TestMultiClient_HealthWeightedRotation(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}},
+	}
+	mc, err := NewMultiClient(oauthCfg, sources, 1, time.Millisecond, nil, nil, nil, MultiClientOptions{HealthWeighted: true})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	attempts := make([]int, 2)
+	mc.entries[0].ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+		attempts[0]++
+		return resp(429, "quota", "text/plain"), nil
+	})), 0, time.Millisecond)
+	mc.entries[1].ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+		attempts[1]++
+		return resp(200, `{"response":{"candidates":[]}}`, "application/json"), nil
+	})), 0, time.Millisecond)
+	for i := 0; i < 100; i++ {
+		if _, err := mc.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", gemini.GeminiRequest{}); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	if r := mc.entries[0].health.rate(); r > 0.5 {
+		t.Fatalf("failing unit health = %v, expected it to drop", r)
+	}
+	// Round-robin would hit the failing unit on about half the requests.
+	if attempts[0] > 30 {
+		t.Fatalf("failing unit tried %d times in 100 requests", attempts[0])
+	}
+}
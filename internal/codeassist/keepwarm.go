@@ -0,0 +1,93 @@
+package codeassist
+
+import (
+	"cmp"
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"gcli2api/internal/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+// pingTimeout bounds one keep-warm ping.
+const pingTimeout = 10 * time.Second
+
+// Ping sends a HEAD request to the upstream host over the client's transport,
+// so an idle keep-alive connection is reused (or re-established) without
+// spending generation quota. Any HTTP answer counts as success; only
+// transport failures are returned.
+func (c *CaClient) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.baseURL+"/", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", config.UserAgent)
+	c.lastPing.Store(time.Now().UnixNano())
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// KeepWarm pings each credential's upstream connection pool every interval
+// until ctx is done or the client is closed. A credential that served a
+// request within the last interval is already warm and is skipped, so the
+// pinger adds at most one request per idle credential per interval, and at
+// most maxPings (when positive) per interval overall.
+func (mc *MultiClient) KeepWarm(ctx context.Context, interval time.Duration, maxPings int) {
+	if interval <= 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(mc.closing, cancel)()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		mc.pingIdle(ctx, interval, maxPings)
+	}
+}
+
+// pingIdle pings, one at a time, the credentials (whose units share a
+// client) with no upstream attempt in the last interval. With maxPings
+// positive only that many are pinged, least recently pinged first, so every
+// idle credential gets its turn over successive intervals.
+func (mc *MultiClient) pingIdle(ctx context.Context, interval time.Duration, maxPings int) {
+	lastUse := map[*CaClient]int64{}
+	var order []*CaClient
+	for _, e := range mc.entries {
+		last, seen := lastUse[e.ca]
+		if !seen {
+			order = append(order, e.ca)
+		}
+		lastUse[e.ca] = max(last, e.lastAttempt.Load())
+	}
+	idleSince := time.Now().Add(-interval).UnixNano()
+	order = slices.DeleteFunc(order, func(ca *CaClient) bool { return lastUse[ca] > idleSince })
+	if maxPings > 0 && len(order) > maxPings {
+		slices.SortStableFunc(order, func(a, b *CaClient) int { return cmp.Compare(a.lastPing.Load(), b.lastPing.Load()) })
+		order = order[:maxPings]
+	}
+	for _, ca := range order {
+		pctx, cancel := context.WithTimeout(ctx, pingTimeout)
+		err := ca.Ping(pctx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logrus.Debugf("[MultiClient] keep-warm ping failed: %v", err)
+		}
+	}
+}
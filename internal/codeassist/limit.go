@@ -0,0 +1,48 @@
+package codeassist
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrResponseTooLarge is returned when an upstream generation response grows
+// past the configured maxResponseBytes.
+var ErrResponseTooLarge = errors.New("upstream response too large")
+
+// cappedReader passes through up to limit bytes and then fails with
+// ErrResponseTooLarge, so oversized bodies are cut off instead of buffered.
+type cappedReader struct {
+	r         io.Reader
+	limit     int64
+	remaining int64
+}
+
+// capResponse wraps r with the byte cap; limit <= 0 leaves r unlimited.
+func capResponse(r io.Reader, limit int64) io.Reader {
+	if limit <= 0 {
+		return r
+	}
+	return &cappedReader{r: r, limit: limit, remaining: limit}
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if c.remaining < 0 {
+		return 0, c.err()
+	}
+	// Read one byte past the cap so a body of exactly limit bytes still ends
+	// with the underlying reader's EOF.
+	if int64(len(p)) > c.remaining+1 {
+		p = p[:c.remaining+1]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if c.remaining < 0 {
+		return n - 1, c.err()
+	}
+	return n, err
+}
+
+func (c *cappedReader) err() error {
+	return fmt.Errorf("%w: exceeds maxResponseBytes %d", ErrResponseTooLarge, c.limit)
+}
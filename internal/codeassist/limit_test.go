@@ -0,0 +1,66 @@
+package codeassist
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"gcli2api/internal/gemini"
+)
+
+func TestCappedReader_Boundary(t *testing.T) {
+	for _, tc := range []struct {
+		size    int
+		wantErr bool
+	}{{9, false}, {10, false}, {11, true}} {
+		body := strings.Repeat("x", tc.size)
+		// OneByteReader exercises the cap across many short reads.
+		b, err := io.ReadAll(capResponse(iotest.OneByteReader(strings.NewReader(body)), 10))
+		if tc.wantErr {
+			if !errors.Is(err, ErrResponseTooLarge) || len(b) != 10 {
+				t.Fatalf("size %d: got %d bytes, err %v", tc.size, len(b), err)
+			}
+			continue
+		}
+		if err != nil || string(b) != body {
+			t.Fatalf("size %d: got %d bytes, err %v", tc.size, len(b), err)
+		}
+	}
+}
+
+func TestClient_MaxResponseBytes(t *testing.T) {
+	unary := `{"response":{"candidates":[{"content":{"parts":[{"text":"hello"}]}}]}}`
+	event := "data: " + unary + "\n\n"
+	for _, tc := range []struct {
+		limit   int64
+		wantErr bool
+	}{{0, false}, {int64(len(unary)), false}, {int64(len(unary)) - 1, true}} {
+		c := NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+			return resp(200, unary, ""), nil
+		})), 0, time.Millisecond)
+		c.SetMaxResponseBytes(tc.limit)
+		_, err := c.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", gemini.GeminiRequest{})
+		if tc.wantErr != errors.Is(err, ErrResponseTooLarge) || (!tc.wantErr && err != nil) {
+			t.Fatalf("unary limit %d: unexpected error %v", tc.limit, err)
+		}
+	}
+
+	// Two events fit under a cap of two and a half events; the third is cut.
+	c := NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+		return resp(200, strings.Repeat(event, 3), "text/event-stream"), nil
+	})), 0, time.Millisecond)
+	c.SetMaxResponseBytes(int64(len(event))*2 + int64(len(event))/2)
+	out, errs := c.GenerateContentStream(context.Background(), "gemini-2.5-flash", "proj", gemini.GeminiRequest{})
+	n := 0
+	for range out {
+		n++
+	}
+	if err := <-errs; !errors.Is(err, ErrResponseTooLarge) || n != 2 {
+		t.Fatalf("stream: got %d chunks, err %v", n, err)
+	}
+}
@@ -0,0 +1,123 @@
+package codeassist
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"gcli2api/internal/gemini"
+)
+
+// MockClient answers generation requests locally without any network calls.
+// It echoes the latest user prompt and, when streaming, emits it word by word.
+// It is intended for load tests and demos (config: mockUpstream).
+type MockClient struct {
+	// latency is applied before a unary response and between stream chunks.
+	latency time.Duration
+}
+
+// mockUnit is reported as the unit serving every mock request, so request
+// summaries and credentialHeaders behave as they would against upstream.
+var mockUnit = &entry{name: "mock"}
+
+func NewMockClient(latency time.Duration) *MockClient {
+	return &MockClient{latency: latency}
+}
+
+func (m *MockClient) GenerateContent(ctx context.Context, model, project string, req gemini.GeminiRequest) (*gemini.GeminiAPIResponse, error) {
+	requestInfoFrom(ctx).record(0, mockUnit, "mock")
+	if err := m.wait(ctx); err != nil {
+		return nil, err
+	}
+	text := mockReply(model, req)
+	return mockResponse(text, &gemini.UsageMetadata{
+		PromptTokenCount:     mockTokenCount(lastUserText(req)),
+		CandidatesTokenCount: mockTokenCount(text),
+		TotalTokenCount:      mockTokenCount(lastUserText(req)) + mockTokenCount(text),
+	}), nil
+}
+
+func (m *MockClient) GenerateContentStream(ctx context.Context, model, project string, req gemini.GeminiRequest) (<-chan gemini.GeminiAPIResponse, <-chan error) {
+	out := make(chan gemini.GeminiAPIResponse, 16)
+	errs := make(chan error, 1)
+	requestInfoFrom(ctx).record(0, mockUnit, "mock")
+	go func() {
+		defer close(out)
+		defer close(errs)
+		words := strings.SplitAfter(mockReply(model, req), " ")
+		for i, w := range words {
+			if err := m.wait(ctx); err != nil {
+				errs <- err
+				return
+			}
+			g := mockResponse(w, nil)
+			if i == len(words)-1 {
+				prompt := mockTokenCount(lastUserText(req))
+				g.UsageMetadata = &gemini.UsageMetadata{
+					PromptTokenCount:     prompt,
+					CandidatesTokenCount: len(words),
+					TotalTokenCount:      prompt + len(words),
+				}
+			}
+			select {
+			case out <- *g:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+	}()
+	return out, errs
+}
+
+func (m *MockClient) wait(ctx context.Context) error {
+	if m.latency <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(m.latency)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func mockReply(model string, req gemini.GeminiRequest) string {
+	prompt := lastUserText(req)
+	if prompt == "" {
+		prompt = "(empty prompt)"
+	}
+	return fmt.Sprintf("[mock %s] %s", model, prompt)
+}
+
+// lastUserText returns the concatenated text of the latest user turn.
+func lastUserText(req gemini.GeminiRequest) string {
+	for i := len(req.Contents) - 1; i >= 0; i-- {
+		c := req.Contents[i]
+		if c.Role != "" && c.Role != "user" {
+			continue
+		}
+		var sb strings.Builder
+		for _, p := range c.Parts {
+			sb.WriteString(p.Text)
+		}
+		if sb.Len() > 0 {
+			return sb.String()
+		}
+	}
+	return ""
+}
+
+// mockTokenCount is a rough whitespace-based token estimate.
+func mockTokenCount(s string) int {
+	return len(strings.Fields(s))
+}
+
+func mockResponse(text string, usage *gemini.UsageMetadata) *gemini.GeminiAPIResponse {
+	var c gemini.Candidate
+	c.Content.Parts = []gemini.GeminiPart{{Text: text}}
+	return &gemini.GeminiAPIResponse{Candidates: []gemini.Candidate{c}, UsageMetadata: usage}
+}
@@ -2,12 +2,15 @@ package codeassist
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -18,6 +21,7 @@ import (
 	"gcli2api/internal/auth"
 	"gcli2api/internal/gemini"
 	"gcli2api/internal/httpx"
+	"gcli2api/internal/metrics"
 	"gcli2api/internal/state"
 )
 
@@ -26,8 +30,90 @@ type CredSource struct {
 	Path    string
 	Raw     auth.RawToken
 	Persist bool
+	// Backup places the credential's units in the backup tier.
+	Backup bool
+	// Shadow reserves the credential's units for requests made with
+	// WithShadowCredentials; other requests never use them.
+	Shadow bool
+	// Timeout bounds each upstream call made with this credential (the whole
+	// response, including streaming). Zero leaves only the request deadline.
+	Timeout time.Duration
+	// Name is a friendly label used in logs and admin output instead of the
+	// path. Empty falls back to the path with the home directory masked.
+	Name string
+	// VertexLocation routes the credential's units to Vertex AI in this
+	// location instead of Code Assist. Such units need configured projects.
+	VertexLocation string
+	// DailyRequestCap is the most upstream requests the credential may make
+	// per UTC day; its units are skipped once it is reached. Zero is
+	// unlimited.
+	DailyRequestCap int
+	// Priority places the credential's units in a fixed try order: units
+	// with a lower positive Priority are tried first, and zero ones after
+	// every prioritized unit. Equal priorities rotate as usual.
+	Priority int
 }
 
+// MultiClientOptions holds optional MultiClient tuning. The zero value keeps
+// the defaults.
+type MultiClientOptions struct {
+	// DiscoveryRetries is the transport retry budget for discovery and
+	// onboarding JSON calls. Nil uses the default of 2.
+	DiscoveryRetries *int
+	// DiscoveryBaseDelay is the backoff base delay for those retries.
+	// Zero uses the MultiClient baseDelay.
+	DiscoveryBaseDelay time.Duration
+	// DiscoveryTimeout bounds one project discovery, including waits on
+	// rate-limited (429) discovery calls. Zero uses DefaultDiscoveryTimeout.
+	DiscoveryTimeout time.Duration
+	// MaxRotations lets a request try up to this many distinct primary units
+	// even when the retry budget is smaller. Zero keeps retries as the only
+	// limit.
+	MaxRotations int
+	// RotationBackoff is the base delay before each rotation to another
+	// unit, doubled per rotation with jitter. Zero rotates immediately.
+	RotationBackoff time.Duration
+	// RotationBackoffMax caps the rotation delay. Zero leaves it uncapped.
+	RotationBackoffMax time.Duration
+	// MaxResponseBytes caps each generation response body. Zero is unlimited.
+	MaxResponseBytes int64
+	// APIVersion overrides the Code Assist API path segment. Empty keeps
+	// APIVer.
+	APIVersion string
+	// PluginType overrides the discovery metadata.pluginType. Empty keeps
+	// DefaultPluginType.
+	PluginType string
+	// EnvelopeResponseField overrides the envelope key of generation
+	// responses. Empty keeps DefaultEnvelopeField.
+	EnvelopeResponseField string
+	// RetryOnEmptyCandidates rotates a unary request to another unit when
+	// upstream answers 200 with no candidates and no safety block.
+	RetryOnEmptyCandidates bool
+	// HealthWeighted orders primary units by a random draw weighted by each
+	// unit's recent success rate instead of strict round-robin.
+	HealthWeighted bool
+	// NonRetryableReasons are upstream error statuses or ErrorInfo reasons
+	// (case-insensitive) that mark a permanent failure: matching errors are
+	// returned at once instead of rotating to another unit.
+	NonRetryableReasons []string
+	// DedupeProjects skips configured units whose project id was already
+	// given to an earlier unit, so one GCP project's quota is not rotated
+	// through more than once.
+	DedupeProjects bool
+	// LogSampleRate writes the routine per-attempt info logs (attempt and
+	// status=ok lines) for only 1 in LogSampleRate requests. Rotations and
+	// failures are always logged. Zero or one logs every request.
+	LogSampleRate int
+	// MaxDiscoveryAttempts caps how many units a single request may run
+	// project discovery for; units still lacking a project id are then
+	// skipped. Zero is unlimited.
+	MaxDiscoveryAttempts int
+}
+
+// defaultDiscoveryRetries is the transport retry budget used for discovery
+// when MultiClientOptions.DiscoveryRetries is nil.
+const defaultDiscoveryRetries = 2
+
 // MultiClient fans out requests across a pool of per-credential clients.
 type MultiClient struct {
 	entries []*entry
@@ -37,14 +123,37 @@ type MultiClient struct {
 	// immutable configuration
 	provider string
 	clientID string
+	oauthCfg oauth2.Config
+	// sources tracks each credential's token source for file watching
+	sources []*sourceToken
 
 	// factory for unit tests
 	mkCaClient func(httpCli *http.Client, retries int, baseDelay time.Duration) *CaClient
 	// retries is the MultiClient cross-unit retry budget. Total attempts
 	// per request = 1 + retries.
-	retries   int
-	baseDelay time.Duration
-	proxyURL  *url.URL
+	retries      int
+	maxRotations int
+	baseDelay    time.Duration
+	proxyURL     *url.URL
+	// rotationBackoff and rotationBackoffMax pace rotations between units
+	rotationBackoff    time.Duration
+	rotationBackoffMax time.Duration
+	healthWeighted     bool
+	retryOnEmpty       bool
+	// nonRetryable holds the uppercased NonRetryableReasons
+	nonRetryable map[string]bool
+	// closing is canceled by Close to abort in-flight discovery
+	closing context.Context
+	close   context.CancelFunc
+	// daily counts requests per credential for DailyRequestCap
+	daily dailyCounts
+	// logSampleRate and logSeq drive LogSampleRate
+	logSampleRate int
+	logSeq        atomic.Uint64
+	// maxDiscoveries is MaxDiscoveryAttempts
+	maxDiscoveries int
+	// prioritized is set when any unit has a Priority
+	prioritized bool
 }
 
 type entry struct {
@@ -53,38 +162,99 @@ type entry struct {
 	tokenKey  string
 	ca        *CaClient
 	projectID atomic.Value // string
+	// tierID is the Code Assist tier learned during discovery, if any
+	tierID atomic.Value // string
+	// discovery marks units without a configured project id
+	discovery bool
+	// backup units are only used after the primary units fail
+	backup bool
+	// shadow units only serve WithShadowCredentials requests
+	shadow bool
+	// timeout bounds each upstream call on this unit; zero means none
+	timeout time.Duration
+	// name is the configured credential label, if any
+	name string
+	// health tracks the unit's recent upstream success rate
+	health health
+	// ts is the credential's token source, shared by all of its units
+	ts *auth.PersistingTokenSource
+	// draining units get no new requests; in-flight ones run to completion
+	draining atomic.Bool
+	// dailyCap is the credential's DailyRequestCap
+	dailyCap int
+	// priority is the credential's Priority
+	priority int
+	// lastAttempt is when the unit last sent an upstream request (unix nanos)
+	lastAttempt atomic.Int64
+	// projectTouched is when the unit's stored project mapping was last
+	// marked as used (unix nanos)
+	projectTouched atomic.Int64
 }
 
 // NewMultiClient constructs a MultiClient. It does not perform network calls.
 // projectMap maps expanded credential paths to ordered project IDs to use.
-func NewMultiClient(oauthCfg oauth2.Config, sources []CredSource, retries int, baseDelay time.Duration, st *state.Store, proxyURL *url.URL, projectMap map[string][]string) (*MultiClient, error) {
+func NewMultiClient(oauthCfg oauth2.Config, sources []CredSource, retries int, baseDelay time.Duration, st *state.Store, proxyURL *url.URL, projectMap map[string][]string, opts MultiClientOptions) (*MultiClient, error) {
+	// Keep a small transport retry budget for discovery-only JSON calls.
+	// Generation paths do not use per-unit retries.
+	discoveryRetries := defaultDiscoveryRetries
+	if opts.DiscoveryRetries != nil {
+		discoveryRetries = *opts.DiscoveryRetries
+	}
+	discoveryDelay := baseDelay
+	if opts.DiscoveryBaseDelay > 0 {
+		discoveryDelay = opts.DiscoveryBaseDelay
+	}
 	mc := &MultiClient{
 		store:    st,
 		provider: "gemini-cli-oauth",
 		clientID: oauthCfg.ClientID,
+		oauthCfg: oauthCfg,
 		mkCaClient: func(httpCli *http.Client, retries int, baseDelay time.Duration) *CaClient {
-			// Keep a small transport retry budget for discovery-only JSON calls.
-			// Generation paths do not use per-unit retries.
-			transportRetries := 2
-			return NewCaClient(httpCli, transportRetries, baseDelay)
+			ca := NewCaClient(httpCli, discoveryRetries, discoveryDelay)
+			ca.SetMaxResponseBytes(opts.MaxResponseBytes)
+			ca.SetAPIVersion(opts.APIVersion)
+			ca.SetPluginType(opts.PluginType)
+			ca.SetEnvelopeResponseField(opts.EnvelopeResponseField)
+			ca.SetDiscoveryTimeout(opts.DiscoveryTimeout)
+			return ca
 		},
-		retries:   retries,
-		baseDelay: baseDelay,
-		proxyURL:  proxyURL,
+		retries:      retries,
+		maxRotations: opts.MaxRotations,
+		baseDelay:    baseDelay,
+		proxyURL:     proxyURL,
+
+		rotationBackoff:    opts.RotationBackoff,
+		rotationBackoffMax: opts.RotationBackoffMax,
+		healthWeighted:     opts.HealthWeighted,
+		retryOnEmpty:       opts.RetryOnEmptyCandidates,
+		logSampleRate:      opts.LogSampleRate,
+		maxDiscoveries:     opts.MaxDiscoveryAttempts,
+	}
+	for _, r := range opts.NonRetryableReasons {
+		if mc.nonRetryable == nil {
+			mc.nonRetryable = make(map[string]bool)
+		}
+		mc.nonRetryable[strings.ToUpper(r)] = true
 	}
+	mc.closing, mc.close = context.WithCancel(context.Background())
 	idx := 0
+	// projectOwner records which credential first configured each project
+	projectOwner := map[string]string{}
 	for _, src := range sources {
 		// Build a TokenSource without forcing network calls.
 		baseTS := oauthCfg.TokenSource(context.Background(), src.Raw.ToOAuth2Token())
 		ts := auth.NewPersistingTokenSource(baseTS, src.Raw, src.Path, src.Persist)
+		mc.sources = append(mc.sources, &sourceToken{path: src.Path, ts: ts})
 		httpCli := httpx.NewOAuthHTTPClient(ts, proxyURL)
 		ca := mc.mkCaClient(httpCli, retries, baseDelay)
+		ca.SetVertex(src.VertexLocation)
+		firstUnit := len(mc.entries)
 		identity := src.Raw.RefreshToken
 		tokenKey := state.ComputeTokenKey(mc.provider, mc.clientID, identity)
 		if units, ok := projectMap[src.Path]; ok {
 			if len(units) == 0 {
 				logrus.Warnf("[MultiClient] empty projectIds list for credential %s; falling back to discovery", src.Path)
-				e := &entry{idx: idx, path: src.Path, tokenKey: tokenKey, ca: ca}
+				e := &entry{idx: idx, path: src.Path, tokenKey: tokenKey, ca: ca, ts: ts, discovery: true}
 				mc.entries = append(mc.entries, e)
 				idx++
 			} else {
@@ -96,27 +266,47 @@ func NewMultiClient(oauthCfg oauth2.Config, sources []CredSource, retries int, b
 						includeAuto = true
 						continue
 					}
-					e := &entry{idx: idx, path: src.Path, tokenKey: tokenKey, ca: ca}
+					if owner, dup := projectOwner[pid]; dup && opts.DedupeProjects {
+						logrus.Warnf("[MultiClient] skipping duplicate project %s for credential %s (already used by %s)", pid, src.Path, owner)
+						continue
+					}
+					projectOwner[pid] = src.Path
+					e := &entry{idx: idx, path: src.Path, tokenKey: tokenKey, ca: ca, ts: ts}
 					e.projectID.Store(pid)
 					mc.entries = append(mc.entries, e)
 					idx++
 				}
 				if includeAuto {
 					// Add one discovery-based unit for this credential
-					e := &entry{idx: idx, path: src.Path, tokenKey: tokenKey, ca: ca}
+					e := &entry{idx: idx, path: src.Path, tokenKey: tokenKey, ca: ca, ts: ts, discovery: true}
 					mc.entries = append(mc.entries, e)
 					idx++
 				}
 			}
 		} else {
-			e := &entry{idx: idx, path: src.Path, tokenKey: tokenKey, ca: ca}
+			e := &entry{idx: idx, path: src.Path, tokenKey: tokenKey, ca: ca, ts: ts, discovery: true}
 			mc.entries = append(mc.entries, e)
 			idx++
 		}
+		for _, e := range mc.entries[firstUnit:] {
+			e.backup = src.Backup
+			e.shadow = src.Shadow
+			e.timeout = src.Timeout
+			e.name = src.Name
+			e.dailyCap = src.DailyRequestCap
+			e.priority = src.Priority
+			mc.prioritized = mc.prioritized || src.Priority > 0
+			if src.VertexLocation != "" && e.discovery {
+				return nil, fmt.Errorf("vertex credential %s needs explicit projectIds; project discovery is Code Assist only", src.Path)
+			}
+		}
 	}
 	if len(mc.entries) == 0 {
 		return nil, fmt.Errorf("no valid credentials provided")
 	}
+	for _, e := range mc.entries {
+		e.exportInfo()
+	}
 	// Load persisted round-robin counter, if available, so we continue from
 	// the next account on restart instead of defaulting to index 0.
 	if mc.store != nil {
@@ -128,96 +318,447 @@ func NewMultiClient(oauthCfg oauth2.Config, sources []CredSource, retries int, b
 	return mc, nil
 }
 
-func (mc *MultiClient) pickStart() int {
-	n := len(mc.entries)
-	if n == 0 {
-		return 0
+// logEscalation notes the first attempt that moves into the backup tier.
+func logEscalation(cands []*entry, k int) {
+	if k > 0 && cands[k%len(cands)].backup && !cands[(k-1)%len(cands)].backup {
+		logrus.Warnf("[MultiClient] primary units exhausted; escalating to backup tier")
 	}
+}
+
+// nextRR advances the round-robin counter and returns its previous value.
+func (mc *MultiClient) nextRR() uint64 {
 	v := atomic.AddUint64(&mc.rr, 1) - 1
 	// Best-effort persistence of the incremented counter (v+1). This allows
 	// the next process start to pick the next account in sequence.
 	if mc.store != nil {
 		_ = mc.store.SetRRCounter(context.Background(), mc.provider, mc.clientID, v+1)
 	}
-	return int(v % uint64(n))
+	return v
 }
 
-func (mc *MultiClient) GenerateContent(ctx context.Context, model, project string, req gemini.GeminiRequest) (*gemini.GeminiAPIResponse, error) {
+type pinnedCredentialKey struct{}
+
+// WithPinnedCredential returns a context that restricts the MultiClient to the
+// unit at index idx for a single attempt, without rotation. Intended for
+// debugging a specific credential.
+func WithPinnedCredential(ctx context.Context, idx int) context.Context {
+	return context.WithValue(ctx, pinnedCredentialKey{}, idx)
+}
+
+type shadowCredentialsKey struct{}
+
+// WithShadowCredentials returns a context that restricts the MultiClient to
+// the units of Shadow credentials, which no other request uses.
+func WithShadowCredentials(ctx context.Context) context.Context {
+	return context.WithValue(ctx, shadowCredentialsKey{}, true)
+}
+
+// Close aborts in-flight project discovery and onboarding polls, so that a
+// shutdown is not held up by them. Generation calls are left to their own
+// contexts. The MultiClient must not be used for discovery afterwards.
+func (mc *MultiClient) Close() {
+	mc.close()
+}
+
+// NumUnits returns the number of (credential, project) units in the pool.
+func (mc *MultiClient) NumUnits() int {
+	return len(mc.entries)
+}
+
+// candidates returns the units to try for a request, in order, along with the
+// attempt budget. Attempts wrap around the list when the budget exceeds it.
+func (mc *MultiClient) candidates(ctx context.Context) ([]*entry, int, error) {
 	n := len(mc.entries)
 	if n == 0 {
-		return nil, fmt.Errorf("no credentials configured")
+		return nil, 0, fmt.Errorf("no credentials configured")
+	}
+	if idx, ok := ctx.Value(pinnedCredentialKey{}).(int); ok {
+		if idx < 0 || idx >= n {
+			return nil, 0, fmt.Errorf("credential index %d out of range (have %d units)", idx, n)
+		}
+		return []*entry{mc.entries[idx]}, 1, nil
+	}
+	// Primary units rotate round-robin within the attempt budget: retries+1,
+	// raised to maxRotations distinct units for large pools. Backup units are
+	// only reached once that budget is spent, each tried at most once.
+	var primary, backup []*entry
+	capped := 0
+	shadow, _ := ctx.Value(shadowCredentialsKey{}).(bool)
+	for _, e := range mc.entries {
+		if e.shadow != shadow || e.draining.Load() {
+			continue
+		}
+		if mc.capReached(e) {
+			capped++
+			continue
+		}
+		if e.backup {
+			backup = append(backup, e)
+		} else {
+			primary = append(primary, e)
+		}
+	}
+	if len(primary) == 0 {
+		primary, backup = backup, nil
+	}
+	if len(primary) == 0 && capped > 0 {
+		return nil, 0, fmt.Errorf("%w on all %d available unit(s)", ErrDailyCapReached, capped)
+	}
+	if len(primary) == 0 && shadow {
+		return nil, 0, fmt.Errorf("no shadow credential units available")
+	}
+	if len(primary) == 0 {
+		return nil, 0, fmt.Errorf("all %d credential units are draining", n)
 	}
-	start := mc.pickStart()
+	v := mc.nextRR()
+	budget := max(mc.retries+1, min(mc.maxRotations, len(primary)))
+	order, start := primary, int(v%uint64(len(primary)))
+	if mc.healthWeighted {
+		order, start = healthOrder(primary), 0
+	}
+	bstart := 0
+	if len(backup) > 0 {
+		bstart = int(v % uint64(len(backup)))
+	}
+	if mc.prioritized {
+		order, start = prioritize(order, start), 0
+		backup, bstart = prioritize(backup, bstart), 0
+	}
+	out := make([]*entry, 0, budget+len(backup))
+	for k := 0; k < budget; k++ {
+		out = append(out, order[(start+k)%len(order)])
+	}
+	if len(backup) > 0 {
+		for k := 0; k < min(budget, len(backup)); k++ {
+			out = append(out, backup[(bstart+k)%len(backup)])
+		}
+	}
+	return out, len(out), nil
+}
+
+// prioritize returns units rotated to start, then stably ordered by
+// priority: lower positive priorities first, unprioritized units last, and
+// units of equal priority in their rotated (round-robin) order.
+func prioritize(units []*entry, start int) []*entry {
+	out := make([]*entry, 0, len(units))
+	out = append(out, units[start:]...)
+	out = append(out, units[:start]...)
+	sort.SliceStable(out, func(i, j int) bool {
+		pi, pj := out[i].priority, out[j].priority
+		return pi > 0 && (pj == 0 || pi < pj)
+	})
+	return out
+}
+
+// ErrDiscoveryFailed is wrapped by the error returned when a request never
+// reached upstream because project discovery failed on every unit it tried.
+var ErrDiscoveryFailed = errors.New("project discovery failed")
+
+// maxDiscoveryErrLen bounds each per-unit message in a discovery summary so
+// upstream error bodies are not echoed to clients at length.
+const maxDiscoveryErrLen = 120
+
+// discoveryFailures records the latest discovery error per unit during one
+// request.
+type discoveryFailures []discoveryFailure
+
+type discoveryFailure struct {
+	e   *entry
+	err error
+}
+
+func (d *discoveryFailures) add(e *entry, err error) {
+	for i := range *d {
+		if (*d)[i].e == e {
+			(*d)[i].err = err
+			return
+		}
+	}
+	*d = append(*d, discoveryFailure{e: e, err: err})
+}
+
+// err summarizes every unit's outcome, e.g. to tell a network problem from a
+// missing scope or unavailable onboarding.
+func (d discoveryFailures) err() error {
+	return fmt.Errorf("%w on all %d unit(s): %s", ErrDiscoveryFailed, len(d), d.summary())
+}
+
+// capped reports a request that gave up after limit discovery attempts,
+// with the failures seen so far.
+func (d discoveryFailures) capped(limit int) error {
+	return fmt.Errorf("%w: gave up after %d discovery attempt(s) (maxDiscoveryAttemptsPerRequest): %s", ErrDiscoveryFailed, limit, d.summary())
+}
+
+func (d discoveryFailures) summary() string {
+	var sb strings.Builder
+	for i, f := range d {
+		if i > 0 {
+			sb.WriteString("; ")
+		}
+		msg := f.err.Error()
+		if len(msg) > maxDiscoveryErrLen {
+			msg = strings.ToValidUTF8(msg[:maxDiscoveryErrLen], "") + "..."
+		}
+		fmt.Fprintf(&sb, "idx=%d cred=%s: %s", f.e.idx, f.e.displayName(), msg)
+	}
+	return sb.String()
+}
+
+// errDiscoveryBudget marks a unit skipped because the request already ran
+// maxDiscoveryAttemptsPerRequest discoveries.
+var errDiscoveryBudget = errors.New("discovery attempt budget exhausted")
+
+// emptyCandidates reports a response without candidates that is not explained
+// by a safety block (promptFeedback.blockReason), which upstream occasionally
+// returns transiently.
+func emptyCandidates(resp *gemini.GeminiAPIResponse) bool {
+	if resp == nil || len(resp.Candidates) > 0 {
+		return false
+	}
+	if pf, ok := resp.PromptFeedback.(map[string]any); ok && pf["blockReason"] != nil {
+		return false
+	}
+	return true
+}
+
+// pinnedError annotates errors from a pinned request with the unit used.
+func pinnedError(ctx context.Context, e *entry, err error) error {
+	if _, ok := ctx.Value(pinnedCredentialKey{}).(int); !ok || err == nil {
+		return err
+	}
+	return fmt.Errorf("pinned credential idx=%d cred=%s: %w", e.idx, e.displayName(), err)
+}
+
+func (mc *MultiClient) GenerateContent(ctx context.Context, model, project string, req gemini.GeminiRequest) (*gemini.GeminiAPIResponse, error) {
+	cands, total, err := mc.candidates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	info := requestInfoFrom(ctx)
+	sampled := mc.logSampled()
 	var lastErr error
-	total := mc.retries + 1
+	var discoveryErrs discoveryFailures
+	discoveries, skipped := 0, false
+	reached, redrawn := false, false
 	for k := 0; k < total; k++ {
-		j := (start + k) % n
-		e := mc.entries[j]
+		// Stop rotating once the caller is gone; further attempts would only
+		// burn quota and hold connections for nobody.
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !redrawn {
+			if err := mc.rotationPause(ctx, k); err != nil {
+				return nil, err
+			}
+		}
+		redrawn = false
+		e := cands[k%len(cands)]
 		prj := project
 		if prj == "" {
-			pid, err := mc.getOrDiscoverProjectID(ctx, e)
+			pid, err := mc.projectFor(ctx, e, &discoveries)
+			if errors.Is(err, errDiscoveryBudget) {
+				skipped = true
+				continue
+			}
 			if err != nil {
-				lastErr = err
-				logrus.Warnf("[MultiClient] discovery failed; rotating attempt=%d idx=%d err=%v", k+1, e.idx, err)
+				lastErr = pinnedError(ctx, e, err)
+				discoveryErrs.add(e, err)
+				e.observe(ctx, err)
+				logrus.WithFields(attemptFields(e, "discovery", model, "", k+1, err)).Warn("[MultiClient] discovery failed; rotating")
 				// rotate on discovery failure
 				continue
 			}
 			prj = pid
 		}
+		// candidates checked the cap without reserving; concurrent requests
+		// may have used it up since
+		if !mc.reserveDaily(e) {
+			next, err := mc.redraw(ctx, cands, k)
+			if err != nil {
+				if lastErr == nil {
+					lastErr = err
+				}
+				break
+			}
+			// The capped unit did not spend attempt k; retry it on the next
+			// unit still under its cap.
+			cands, redrawn = next, true
+			k--
+			continue
+		}
 		credName := e.displayName()
-		logrus.Infof("[MultiClient] attempt=%d idx=%d cred=%s model=%s project=%s", k+1, e.idx, credName, model, prj)
-		resp, err := e.ca.GenerateContent(ctx, model, prj, req)
+		info.record(k, e, prj)
+		logEscalation(cands, k)
+		if sampled || k > 0 {
+			logrus.Infof("[MultiClient] attempt=%d idx=%d cred=%s model=%s project=%s", k+1, e.idx, credName, model, prj)
+		}
+		reached = true
+		mc.touchProject(ctx, e)
+		var resp *gemini.GeminiAPIResponse
+		// A transport failure is retried once on the same unit, within
+		// this attempt
+		for retried := false; ; retried = true {
+			e.lastAttempt.Store(time.Now().UnixNano())
+			actx, cancel := e.attemptContext(ctx)
+			resp, err = e.ca.GenerateContent(actx, model, prj, req)
+			err = e.attemptError(ctx, actx, err)
+			cancel()
+			e.observe(ctx, err)
+			if retried || !mc.retrySameUnit(ctx, e, "generateContent", model, prj, k, err) {
+				break
+			}
+		}
 		if err == nil {
-			logrus.Infof("[MultiClient] status=ok idx=%d cred=%s project=%s", e.idx, credName, prj)
+			// On the last attempt an empty answer is still returned as-is.
+			if mc.retryOnEmpty && k < total-1 && emptyCandidates(resp) {
+				logrus.Warnf("[MultiClient] rotating on empty candidates idx=%d cred=%s project=%s", e.idx, credName, prj)
+				lastErr = fmt.Errorf("upstream returned no candidates")
+				continue
+			}
+			if sampled || k > 0 {
+				logrus.Infof("[MultiClient] status=ok idx=%d cred=%s project=%s", e.idx, credName, prj)
+			}
 			return resp, nil
 		}
 		lastErr = err
-		if k == total-1 || !isRetryable(err) {
-			logrus.Warnf("[MultiClient] non-retryable or budget exhausted idx=%d cred=%s project=%s err=%v", e.idx, credName, prj, err)
-			return nil, err
+		if k == total-1 || !isRetryable(err, mc.nonRetryable) {
+			fields := attemptFields(e, "generateContent", model, prj, k+1, err)
+			if r := nonRetryableReason(err, mc.nonRetryable); r != "" {
+				fields["nonRetryableReason"] = r
+			}
+			logrus.WithFields(fields).Warn("[MultiClient] non-retryable or budget exhausted")
+			return nil, pinnedError(ctx, e, err)
 		}
-		logrus.Warnf("[MultiClient] rotating on error idx=%d cred=%s project=%s err=%v", e.idx, credName, prj, err)
+		logrus.WithFields(attemptFields(e, "generateContent", model, prj, k+1, err)).Warn("[MultiClient] rotating on error")
 		continue
 	}
+	if !reached && skipped && ctx.Err() == nil {
+		return nil, discoveryErrs.capped(discoveries)
+	}
+	if !reached && len(discoveryErrs) > 0 && ctx.Err() == nil {
+		return nil, discoveryErrs.err()
+	}
 	return nil, lastErr
 }
 
+// attemptFields are the structured fields logged with a failed attempt. The
+// unit is identified by index and display name, never by token material.
+func attemptFields(e *entry, method, model, project string, attempt int, err error) logrus.Fields {
+	return logrus.Fields{
+		"upstream_method": method,
+		"model":           model,
+		"project":         project,
+		"credential":      e.displayName(),
+		"idx":             e.idx,
+		"attempt":         attempt,
+		"status":          upstreamStatus(err),
+		"err":             err,
+	}
+}
+
+// logSampled reports whether a new request writes the routine per-attempt
+// info logs: every request, or 1 in logSampleRate when that is above one.
+func (mc *MultiClient) logSampled() bool {
+	if mc.logSampleRate <= 1 {
+		return true
+	}
+	return (mc.logSeq.Add(1)-1)%uint64(mc.logSampleRate) == 0
+}
+
+// rotationPause waits before attempt k when rotation backoff is enabled, so a
+// pool-wide upstream blip is not burned through in microseconds. The first
+// attempt never waits.
+func (mc *MultiClient) rotationPause(ctx context.Context, k int) error {
+	if k == 0 || mc.rotationBackoff <= 0 {
+		return nil
+	}
+	return httpx.Sleep(ctx, httpx.Backoff(mc.rotationBackoff, k-1, mc.rotationBackoffMax))
+}
+
 func (mc *MultiClient) GenerateContentStream(ctx context.Context, model, project string, req gemini.GeminiRequest) (<-chan gemini.GeminiAPIResponse, <-chan error) {
 	out := make(chan gemini.GeminiAPIResponse, 16)
-	// Unbuffered error channel ensures consumers observe error before out closes
-	errs := make(chan error)
+	// errs is buffered so the terminal error never blocks on a consumer that
+	// has already gone away. It is always sent before out closes, so consumers
+	// that drain errs after out closes reliably observe it.
+	errs := make(chan error, 1)
 	go func() {
-		n := len(mc.entries)
-		if n == 0 {
-			// Close out first so receivers break their loops, then send error
-			close(out)
-			errs <- fmt.Errorf("no credentials configured")
-			close(errs)
+		defer close(out)
+		defer close(errs)
+		cands, total, err := mc.candidates(ctx)
+		if err != nil {
+			errs <- err
 			return
 		}
-		start := mc.pickStart()
-		total := mc.retries + 1
+		info := requestInfoFrom(ctx)
+		sampled := mc.logSampled()
 		var lastErr error
+		var discoveryErrs discoveryFailures
+		discoveries, skipped := 0, false
+		reached, redrawn := false, false
 		for k := 0; k < total; k++ {
-			j := (start + k) % n
-			e := mc.entries[j]
+			if !redrawn {
+				if err := mc.rotationPause(ctx, k); err != nil {
+					errs <- err
+					return
+				}
+			}
+			redrawn = false
+			e := cands[k%len(cands)]
 			prj := project
 			if prj == "" {
-				pid, err := mc.getOrDiscoverProjectID(ctx, e)
+				pid, err := mc.projectFor(ctx, e, &discoveries)
+				if errors.Is(err, errDiscoveryBudget) {
+					skipped = true
+					continue
+				}
 				if err != nil {
-					lastErr = err
-					logrus.Warnf("[MultiClient] discovery failed (stream); rotating attempt=%d idx=%d err=%v", k+1, e.idx, err)
+					lastErr = pinnedError(ctx, e, err)
+					discoveryErrs.add(e, err)
+					e.observe(ctx, err)
+					logrus.WithFields(attemptFields(e, "discovery", model, "", k+1, err)).Warn("[MultiClient] discovery failed (stream); rotating")
 					// rotate on discovery failure
 					continue
 				}
 				prj = pid
 			}
+			if !mc.reserveDaily(e) {
+				next, err := mc.redraw(ctx, cands, k)
+				if err != nil {
+					if lastErr == nil {
+						lastErr = err
+					}
+					break
+				}
+				cands, redrawn = next, true
+				k--
+				continue
+			}
 			credName := e.displayName()
-			logrus.Infof("[MultiClient] streaming attempt=%d idx=%d cred=%s model=%s project=%s", k+1, e.idx, credName, model, prj)
-			upOut, upErrs := e.ca.GenerateContentStream(ctx, model, prj, req)
+			info.record(k, e, prj)
+			logEscalation(cands, k)
+			if sampled || k > 0 {
+				logrus.Infof("[MultiClient] streaming attempt=%d idx=%d cred=%s model=%s project=%s", k+1, e.idx, credName, model, prj)
+			}
+			reached = true
+			mc.touchProject(ctx, e)
+			// A transport failure is retried once on the same unit, within
+			// this attempt
+			retried := false
+		startStream:
+			e.lastAttempt.Store(time.Now().UnixNano())
+			actx, cancel := e.attemptContext(ctx)
+			// Released at nextAttempt on rotation, before a retry, and on
+			// every return below.
+			upOut, upErrs := e.ca.GenerateContentStream(actx, model, prj, req)
 			sentAny := false
 			// Inner loop for this upstream stream
 			for {
+				// Cancellation wins over chunks that are already pending upstream
+				if ctx.Err() != nil {
+					cancel()
+					errs <- ctx.Err()
+					return
+				}
 				select {
 				case g, ok := <-upOut:
 					if !ok {
@@ -227,26 +768,33 @@ func (mc *MultiClient) GenerateContentStream(ctx context.Context, model, project
 							select {
 							case e2, ok2 := <-upErrs:
 								if ok2 && e2 != nil {
-									// Deliver error first so consumer sees it before out closes
+									e2 = e.attemptError(ctx, actx, e2)
+									e.observe(ctx, e2)
+									cancel()
 									errs <- e2
-									close(out)
-									close(errs)
 									return
 								}
 							case <-ctx.Done():
+								cancel()
 								errs <- ctx.Err()
-								close(out)
-								close(errs)
 								return
 							}
 						}
 						// No error pending; close cleanly
-						close(out)
-						close(errs)
+						cancel()
 						return
 					}
+					if !sentAny {
+						e.observe(ctx, nil)
+					}
 					sentAny = true
-					out <- g
+					select {
+					case out <- g:
+					case <-ctx.Done():
+						cancel()
+						errs <- ctx.Err()
+						return
+					}
 				case err, ok := <-upErrs:
 					if !ok || err == nil {
 						// Treat closed errs channel as normal end; continue
@@ -254,46 +802,79 @@ func (mc *MultiClient) GenerateContentStream(ctx context.Context, model, project
 						upErrs = nil
 						continue
 					}
-					if err != nil {
-						if !sentAny && k < total-1 && isRetryable(err) {
-							logrus.Warnf("[MultiClient] rotating stream on early error idx=%d cred=%s err=%v", e.idx, credName, err)
-							// break inner loop to next attempt
-							lastErr = err
-							goto nextAttempt
+					err = e.attemptError(ctx, actx, err)
+					e.observe(ctx, err)
+					if !sentAny && !retried && mc.retrySameUnit(ctx, e, "streamGenerateContent", model, prj, k, err) {
+						cancel()
+						retried = true
+						goto startStream
+					}
+					if !sentAny && k < total-1 && isRetryable(err, mc.nonRetryable) {
+						logrus.WithFields(attemptFields(e, "streamGenerateContent", model, prj, k+1, err)).Warn("[MultiClient] rotating stream on early error")
+						// break inner loop to next attempt
+						lastErr = err
+						goto nextAttempt
+					}
+					// either after first event or not retryable/budget exhausted
+					if ctx.Err() == nil {
+						fields := attemptFields(e, "streamGenerateContent", model, prj, k+1, err)
+						if r := nonRetryableReason(err, mc.nonRetryable); r != "" {
+							fields["nonRetryableReason"] = r
 						}
-						// either after first event or not retryable/budget exhausted
-						// Deliver error first so consumer sees it before out closes
-						errs <- err
-						close(out)
-						close(errs)
-						return
+						logrus.WithFields(fields).Warn("[MultiClient] stream failed")
 					}
+					cancel()
+					errs <- pinnedError(ctx, e, err)
+					return
 				case <-ctx.Done():
+					cancel()
 					errs <- ctx.Err()
-					close(out)
-					close(errs)
 					return
 				}
 			}
 		nextAttempt:
+			cancel()
 			continue
 		}
-		// All attempts exhausted or only discovery failures
+		// All attempts exhausted or only discovery failures; otherwise clean
+		// completion without error
+		if !reached && skipped && ctx.Err() == nil {
+			errs <- discoveryErrs.capped(discoveries)
+			return
+		}
+		if !reached && len(discoveryErrs) > 0 && ctx.Err() == nil {
+			errs <- discoveryErrs.err()
+			return
+		}
 		if lastErr != nil {
-			// Close out first so receivers break their loops, then deliver the error
-			close(out)
 			errs <- lastErr
-			close(errs)
-			return
 		}
-		// Otherwise clean completion without error
-		close(out)
-		close(errs)
 	}()
 	return out, errs
 }
 
+// attemptContext derives the context for one upstream call on e, applying
+// the unit's timeout when configured.
+func (e *entry) attemptContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if e.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, e.timeout)
+}
+
+// attemptError marks errors caused by the unit's own timeout so they are not
+// mistaken for the request deadline. They stay retryable.
+func (e *entry) attemptError(ctx, actx context.Context, err error) error {
+	if err != nil && ctx.Err() == nil && errors.Is(actx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("credential timeout %s exceeded: %w", e.timeout, err)
+	}
+	return err
+}
+
 func (e *entry) displayName() string {
+	if e.name != "" {
+		return e.name
+	}
 	if e.path == "" {
 		return fmt.Sprintf("idx-%d", e.idx)
 	}
@@ -308,47 +889,283 @@ func (e *entry) displayName() string {
 	return e.path
 }
 
-func (mc *MultiClient) getOrDiscoverProjectID(ctx context.Context, e *entry) (string, error) {
-	if v := e.projectID.Load(); v != nil {
-		if s, ok := v.(string); ok && s != "" {
-			return s, nil
+// observe folds an attempt's outcome into the unit's health. Errors that say
+// nothing about the unit, such as client errors or caller cancellation, are
+// ignored.
+func (e *entry) observe(ctx context.Context, err error) {
+	if err == nil {
+		e.health.record(true)
+		return
+	}
+	if ctx.Err() == nil && isRetryable(err, nil) {
+		e.health.record(false)
+	}
+}
+
+// setProjectID records the resolved project for a discovery-based unit and
+// logs it once per change so the assignment is auditable without debug logs.
+func (e *entry) setProjectID(pid, source string) {
+	if old, _ := e.projectID.Swap(pid).(string); old != pid {
+		logrus.Infof("[MultiClient] resolved project for idx=%d cred=%s: %s (from %s)", e.idx, e.displayName(), pid, source)
+		credentialInfo.Delete(strconv.Itoa(e.idx), e.displayName(), old)
+		e.exportInfo()
+	}
+}
+
+// credentialInfo exports one series per unit joining the credential's
+// display name (home directory masked as ~, never token material) to its
+// project id, so usage can be attributed to GCP billing projects.
+var credentialInfo = metrics.NewGaugeVec("gcli2api_credential_info",
+	"Pool units with their credential and configured or resolved project id (always 1).",
+	"index", "credential", "project")
+
+// exportInfo publishes the unit's current credential/project series.
+func (e *entry) exportInfo() {
+	pid, _ := e.projectID.Load().(string)
+	credentialInfo.Set(1, strconv.Itoa(e.idx), e.displayName(), pid)
+}
+
+// CredentialStatus describes one pool unit for the admin API.
+type CredentialStatus struct {
+	Index      int    `json:"index"`
+	Credential string `json:"credential"`
+	// Project is the configured or resolved project id; empty until discovery succeeds.
+	Project string `json:"project"`
+	// Discovered is true for units whose project comes from discovery rather than config.
+	Discovered bool `json:"discovered"`
+	// Backup is true for units in the backup tier.
+	Backup bool `json:"backup"`
+	// Shadow is true for units reserved for shadow calls.
+	Shadow bool `json:"shadow,omitempty"`
+	// TierID is the Code Assist tier (e.g. "free-tier") learned during
+	// discovery; empty for configured projects or before discovery.
+	TierID string `json:"tierId,omitempty"`
+	// Draining is true while the unit is excluded from new requests.
+	Draining bool `json:"draining"`
+	// DailyRequestCap is the credential's daily cap (zero when unlimited);
+	// RequestsToday is its upstream request count for the current UTC day.
+	DailyRequestCap int `json:"dailyRequestCap,omitempty"`
+	RequestsToday   int `json:"requestsToday,omitempty"`
+	// TokenExpiry is when the cached access token expires.
+	TokenExpiry *time.Time `json:"tokenExpiry,omitempty"`
+	// LastRefresh is when the credential's token was last refreshed (or a
+	// refresh failed); LastRefreshError is set when that refresh failed.
+	LastRefresh      *time.Time `json:"lastRefresh,omitempty"`
+	LastRefreshError string     `json:"lastRefreshError,omitempty"`
+}
+
+// Credentials returns the current unit-to-project mapping.
+func (mc *MultiClient) Credentials() []CredentialStatus {
+	out := make([]CredentialStatus, 0, len(mc.entries))
+	for _, e := range mc.entries {
+		pid, _ := e.projectID.Load().(string)
+		tier, _ := e.tierID.Load().(string)
+		cs := CredentialStatus{Index: e.idx, Credential: e.displayName(), Project: pid, Discovered: e.discovery, Backup: e.backup, Shadow: e.shadow, TierID: tier, Draining: e.draining.Load()}
+		if e.dailyCap > 0 {
+			cs.DailyRequestCap, cs.RequestsToday = e.dailyCap, mc.requestsToday(e)
 		}
+		if e.ts != nil {
+			st := e.ts.Status()
+			if !st.Expiry.IsZero() {
+				cs.TokenExpiry = &st.Expiry
+			}
+			if !st.LastRefresh.IsZero() {
+				cs.LastRefresh = &st.LastRefresh
+			}
+			if st.LastRefreshErr != nil {
+				cs.LastRefreshError = st.LastRefreshErr.Error()
+			}
+		}
+		out = append(out, cs)
+	}
+	return out
+}
+
+// SetDraining excludes the unit at idx from new requests (or restores it),
+// letting requests already using it finish. Pinned requests still reach it.
+func (mc *MultiClient) SetDraining(idx int, draining bool) error {
+	if idx < 0 || idx >= len(mc.entries) {
+		return fmt.Errorf("credential index %d out of range (have %d units)", idx, len(mc.entries))
+	}
+	e := mc.entries[idx]
+	if e.draining.Swap(draining) != draining {
+		logrus.Infof("[MultiClient] unit idx=%d cred=%s draining=%v", idx, e.displayName(), draining)
+	}
+	return nil
+}
+
+// projectTouchInterval throttles marking a discovered project mapping as
+// used. Units serve their project from memory, so without this the store
+// would see busy mappings as stale and prune them.
+const projectTouchInterval = time.Hour
+
+// touchProject refreshes the last-used time of e's stored project mapping,
+// at most once per projectTouchInterval.
+func (mc *MultiClient) touchProject(ctx context.Context, e *entry) {
+	if mc.store == nil || !e.discovery {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := e.projectTouched.Load()
+	if now-last < int64(projectTouchInterval) || !e.projectTouched.CompareAndSwap(last, now) {
+		return
+	}
+	_ = mc.store.TouchProjectID(ctx, e.tokenKey)
+}
+
+// projectFor returns e's project id for a request, discovering it when it is
+// not cached. Discoveries are counted in *discoveries; once the request has
+// run maxDiscoveries of them, uncached units fail with errDiscoveryBudget.
+func (mc *MultiClient) projectFor(ctx context.Context, e *entry, discoveries *int) (string, error) {
+	if pid, ok := mc.cachedProjectID(ctx, e); ok {
+		return pid, nil
+	}
+	if mc.discoveryCapped(*discoveries) {
+		logrus.Debugf("[MultiClient] skipping idx=%d cred=%s: discovery budget of %d exhausted", e.idx, e.displayName(), mc.maxDiscoveries)
+		return "", errDiscoveryBudget
+	}
+	*discoveries++
+	return mc.getOrDiscoverProjectID(ctx, e)
+}
+
+// discoveryCapped reports whether n discoveries use up the per-request cap.
+func (mc *MultiClient) discoveryCapped(n int) bool {
+	return mc.maxDiscoveries > 0 && n >= mc.maxDiscoveries
+}
+
+// cachedProjectID returns e's project id when it is known without discovery,
+// in memory or in the store.
+func (mc *MultiClient) cachedProjectID(ctx context.Context, e *entry) (string, bool) {
+	if s, _ := e.projectID.Load().(string); s != "" {
+		return s, true
 	}
-	// Lookup in store
 	if mc.store != nil {
 		if pid, ok, err := mc.store.GetProjectID(ctx, e.tokenKey); err == nil && ok {
-			e.projectID.Store(pid)
-			return pid, nil
+			e.setProjectID(pid, "cache")
+			// The persisted tier lets responses report it without discovery
+			if tier, ok, err := mc.store.GetTierID(ctx, e.tokenKey); err == nil && ok {
+				e.tierID.Store(tier)
+			}
+			return pid, true
 		}
 	}
-	// Discover via client
+	return "", false
+}
+
+func (mc *MultiClient) getOrDiscoverProjectID(ctx context.Context, e *entry) (string, error) {
+	if pid, ok := mc.cachedProjectID(ctx, e); ok {
+		return pid, nil
+	}
+	cachedTier, _ := e.tierID.Load().(string)
+	if mc.store != nil && cachedTier == "" {
+		if tier, ok, err := mc.store.GetTierID(ctx, e.tokenKey); err == nil && ok {
+			cachedTier = tier
+			e.tierID.Store(tier)
+		}
+	}
+	// Discover via client. A remembered tier skips the loadCodeAssist lookup;
+	// if onboarding with it fails, fall back to a full discovery.
 	logrus.Infof("[MultiClient] project id not found in cache for %s, attempting discovery", e.displayName())
-	pid, err := e.ca.DiscoverProjectID(ctx)
+	// Discovery may poll onboarding for minutes; let Close cut it short.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(mc.closing, cancel)()
+	discoveryStart := time.Now()
+	pid, tier, err := e.ca.DiscoverProject(ctx, cachedTier)
+	if err != nil && cachedTier != "" && ctx.Err() == nil {
+		logrus.Warnf("[MultiClient] discovery with cached tier %s failed for %s, retrying full discovery: %v", cachedTier, e.displayName(), err)
+		pid, tier, err = e.ca.DiscoverProject(ctx, "")
+	}
+	requestInfoFrom(ctx).addDiscovery(time.Since(discoveryStart))
 	if err != nil {
 		return "", err
 	}
 	if pid == "" {
 		return "", fmt.Errorf("fail to discovered project")
 	}
-	e.projectID.Store(pid)
+	e.setProjectID(pid, "discovery")
+	if tier != "" {
+		e.tierID.Store(tier)
+	}
 	if mc.store != nil {
 		// Best-effort persistence
 		_ = mc.store.UpsertProjectID(ctx, e.tokenKey, mc.provider, mc.clientID, pid)
+		if tier != "" && tier != cachedTier {
+			_ = mc.store.UpsertTierID(ctx, e.tokenKey, tier)
+		}
 	}
 	return pid, nil
 }
 
+// transportRetryDelay is the pause before retrying a unit whose attempt
+// failed at the transport level.
+var transportRetryDelay = 250 * time.Millisecond
+
+// retrySameUnit reports whether attempt k, which failed with err before any
+// HTTP response arrived (e.g. a TLS handshake error on a flaky network),
+// should be tried once more on the same unit, after waiting
+// transportRetryDelay. It returns false when the wait is cut short. The
+// retry is exempt from dailyRequestCap: the failed call never reached
+// upstream, so the attempt's one reservation covers both calls.
+func (mc *MultiClient) retrySameUnit(ctx context.Context, e *entry, method, model, project string, k int, err error) bool {
+	if !isTransportFailure(err) || ctx.Err() != nil {
+		return false
+	}
+	logrus.WithFields(attemptFields(e, method, model, project, k+1, err)).Warn("[MultiClient] transport failure; retrying same unit")
+	return httpx.Sleep(ctx, transportRetryDelay) == nil
+}
+
+// isTransportFailure reports an error raised before any HTTP response
+// arrived: connection and TLS handshake failures. Errors reading a response
+// body and the attempt's own deadline or cancellation are not transport
+// failures.
+func isTransportFailure(err error) bool {
+	if err == nil || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var te *transportError
+	return errors.As(err, &te)
+}
+
+// isTLSHandshakeError reports a failed or timed-out TLS handshake, including
+// a malformed record header from a middlebox answering in plain text.
+func isTLSHandshakeError(err error) bool {
+	var rhe tls.RecordHeaderError
+	if errors.As(err, &rhe) {
+		return true
+	}
+	ls := strings.ToLower(err.Error())
+	return strings.Contains(ls, "tls handshake") || strings.Contains(ls, "tls: handshake") || strings.Contains(ls, "remote error: tls")
+}
+
+// nonRetryableReason returns the status or reason of the UpstreamError in
+// err's chain that nonRetryable lists, or "" when there is none.
+func nonRetryableReason(err error, nonRetryable map[string]bool) string {
+	var ue *UpstreamError
+	if len(nonRetryable) == 0 || !errors.As(err, &ue) {
+		return ""
+	}
+	for _, r := range []string{ue.Status, ue.Reason} {
+		if r != "" && nonRetryable[strings.ToUpper(r)] {
+			return r
+		}
+	}
+	return ""
+}
+
 // isRetryable determines if an error should trigger rotation/retry.
 // It treats HTTP 401, 403, 429, and all 5xx as retryable, as well as
-// common transport timeouts. Context cancellations are not retried.
-func isRetryable(err error) bool {
-	if err == nil {
+// common transport timeouts and TLS handshake failures. Context
+// cancellations and upstream errors whose status or reason is in
+// nonRetryable (uppercased) are not retried.
+func isRetryable(err error, nonRetryable map[string]bool) bool {
+	if err == nil || nonRetryableReason(err, nonRetryable) != "" {
 		return false
 	}
 	if errors.Is(err, context.DeadlineExceeded) {
 		return true
 	}
-	if errors.Is(err, io.EOF) {
+	if errors.Is(err, io.EOF) || isTLSHandshakeError(err) {
 		return true
 	}
 	s := err.Error()
@@ -1,18 +1,33 @@
 package codeassist
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"gcli2api/internal/auth"
 	"gcli2api/internal/gemini"
+	"gcli2api/internal/metrics"
+	"gcli2api/internal/state"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 )
 
 // Focused test: rotation behavior on 401 vs 500.
@@ -22,7 +37,7 @@ func TestMultiClient_RotationPolicy_Unary(t *testing.T) {
 		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}, Persist: false},
 		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}, Persist: false},
 	}
-	mc, err := NewMultiClient(oauthCfg, sources, 1, 1*time.Millisecond, nil, nil, nil)
+	mc, err := NewMultiClient(oauthCfg, sources, 1, 1*time.Millisecond, nil, nil, nil, MultiClientOptions{})
 	if err != nil {
 		t.Fatalf("init multiclient: %v", err)
 	}
@@ -88,7 +103,7 @@ func TestMultiClient_ProjectUnits_RoundRobin(t *testing.T) {
 	projectMap := map[string][]string{
 		"a.json": {"p1", "p2"},
 	}
-	mc, err := NewMultiClient(oauthCfg, sources, 1, 1*time.Millisecond, nil, nil, projectMap)
+	mc, err := NewMultiClient(oauthCfg, sources, 1, 1*time.Millisecond, nil, nil, projectMap, MultiClientOptions{})
 	if err != nil {
 		t.Fatalf("init multiclient: %v", err)
 	}
@@ -139,7 +154,7 @@ func TestMultiClient_ProjectUnits_WithAuto_DiscoveryIncluded(t *testing.T) {
 	projectMap := map[string][]string{
 		"a.json": {"_auto", "p1"},
 	}
-	mc, err := NewMultiClient(oauthCfg, sources, 0, 1*time.Millisecond, nil, nil, projectMap)
+	mc, err := NewMultiClient(oauthCfg, sources, 0, 1*time.Millisecond, nil, nil, projectMap, MultiClientOptions{})
 	if err != nil {
 		t.Fatalf("init multiclient: %v", err)
 	}
@@ -161,6 +176,26 @@ func TestMultiClient_ProjectUnits_WithAuto_DiscoveryIncluded(t *testing.T) {
 	if configured != 1 || discovery != 1 {
 		t.Fatalf("expected 1 configured and 1 discovery entry, got configured=%d discovery=%d", configured, discovery)
 	}
+	creds := mc.Credentials()
+	if len(creds) != 2 || creds[0].Project != "p1" || creds[0].Discovered || creds[1].Project != "" || !creds[1].Discovered {
+		t.Fatalf("unexpected credential status: %+v", creds)
+	}
+}
+
+func TestMultiClient_CredentialNames(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "/home/u/creds/a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}, Name: "work-account-3"},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}},
+	}
+	mc, err := NewMultiClient(oauthCfg, sources, 0, time.Millisecond, nil, nil, nil, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	creds := mc.Credentials()
+	if creds[0].Credential != "work-account-3" || creds[1].Credential != "b.json" {
+		t.Fatalf("unexpected credential names: %+v", creds)
+	}
 }
 
 // When projectIds is ["_auto"] only, we include just one discovery-based unit.
@@ -172,7 +207,7 @@ func TestMultiClient_ProjectUnits_AutoOnly(t *testing.T) {
 	projectMap := map[string][]string{
 		"a.json": {"_auto"},
 	}
-	mc, err := NewMultiClient(oauthCfg, sources, 0, 1*time.Millisecond, nil, nil, projectMap)
+	mc, err := NewMultiClient(oauthCfg, sources, 0, 1*time.Millisecond, nil, nil, projectMap, MultiClientOptions{})
 	if err != nil {
 		t.Fatalf("init multiclient: %v", err)
 	}
@@ -194,7 +229,7 @@ func TestMultiClient_EmptyProjectList_FallsBackToDiscovery(t *testing.T) {
 	projectMap := map[string][]string{
 		"a.json": {},
 	}
-	mc, err := NewMultiClient(oauthCfg, sources, 0, 1*time.Millisecond, nil, nil, projectMap)
+	mc, err := NewMultiClient(oauthCfg, sources, 0, 1*time.Millisecond, nil, nil, projectMap, MultiClientOptions{})
 	if err != nil {
 		t.Fatalf("init multiclient: %v", err)
 	}
@@ -232,7 +267,7 @@ func TestMultiClient_StreamRotation_BeforeFirstEvent(t *testing.T) {
 		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}, Persist: false},
 		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}, Persist: false},
 	}
-	mc, err := NewMultiClient(oauthCfg, sources, 1, 1*time.Millisecond, nil, nil, nil)
+	mc, err := NewMultiClient(oauthCfg, sources, 1, 1*time.Millisecond, nil, nil, nil, MultiClientOptions{})
 	if err != nil {
 		t.Fatalf("init multiclient: %v", err)
 	}
@@ -268,7 +303,7 @@ func TestMultiClient_Stream_NoRotation_AfterFirstEvent(t *testing.T) {
 		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}, Persist: false},
 		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}, Persist: false},
 	}
-	mc, err := NewMultiClient(oauthCfg, sources, 1, 1*time.Millisecond, nil, nil, nil)
+	mc, err := NewMultiClient(oauthCfg, sources, 1, 1*time.Millisecond, nil, nil, nil, MultiClientOptions{})
 	if err != nil {
 		t.Fatalf("init multiclient: %v", err)
 	}
@@ -291,6 +326,8 @@ func TestMultiClient_Stream_NoRotation_AfterFirstEvent(t *testing.T) {
 		select {
 		case g, ok := <-out:
 			if !ok {
+				// The error is delivered before out closes
+				streamErr = <-errs
 				done = true
 				break
 			}
@@ -309,3 +346,1197 @@ func TestMultiClient_Stream_NoRotation_AfterFirstEvent(t *testing.T) {
 		t.Fatalf("expected error after first event")
 	}
 }
+
+func TestMultiClient_PinnedCredential_NoRotation(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}, Persist: false},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}, Persist: false},
+	}
+	mc, err := NewMultiClient(oauthCfg, sources, 3, 1*time.Millisecond, nil, nil, nil, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	attempts := []int{0, 0}
+	mc.entries[0].ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+		attempts[0]++
+		return resp(500, "boom", "text/plain"), nil
+	})), 0, 1*time.Millisecond)
+	mc.entries[1].ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+		attempts[1]++
+		return resp(200, `{"response": {"candidates":[{"content":{"parts":[{"text":"ok"}]}}]}}`, "application/json"), nil
+	})), 0, 1*time.Millisecond)
+	req := gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "hi"}}}}}
+
+	_, err = mc.GenerateContent(WithPinnedCredential(context.Background(), 0), "gemini-2.5-flash", "proj", req)
+	if err == nil || !strings.Contains(err.Error(), "pinned credential idx=0") {
+		t.Fatalf("expected pinned error from idx 0, got %v", err)
+	}
+	if attempts[0] != 1 || attempts[1] != 0 {
+		t.Fatalf("expected only pinned unit to be tried once, got %v", attempts)
+	}
+
+	if _, err := mc.GenerateContent(WithPinnedCredential(context.Background(), 1), "gemini-2.5-flash", "proj", req); err != nil {
+		t.Fatalf("unexpected error pinned to idx 1: %v", err)
+	}
+	if _, err := mc.GenerateContent(WithPinnedCredential(context.Background(), 2), "gemini-2.5-flash", "proj", req); err == nil {
+		t.Fatalf("expected out-of-range error")
+	}
+}
+
+// Canceling mid-stream while an upstream chunk is pending must surface the
+// cancellation on errs (before out closes) rather than a silent close.
+func TestMultiClient_Stream_CancelWithPendingChunk(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}, Persist: false},
+	}
+	mc, err := NewMultiClient(oauthCfg, sources, 0, 1*time.Millisecond, nil, nil, nil, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	mc.entries[0].ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: pr, Header: http.Header{"Content-Type": []string{"text/event-stream"}}}, nil
+	})), 0, 1*time.Millisecond)
+	chunk := func(text string) string {
+		return "data: {\"response\": {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"" + text + "\"}]}}]}}\n\n"
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out, errs := mc.GenerateContentStream(ctx, "gemini-2.5-flash", "proj", gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "x"}}}}})
+	go func() { _, _ = io.WriteString(pw, chunk("first")) }()
+	if g, ok := <-out; !ok || g.Candidates[0].Content.Parts[0].Text != "first" {
+		t.Fatalf("expected first chunk, got %+v ok=%v", g, ok)
+	}
+	cancel()
+	go func() { _, _ = io.WriteString(pw, chunk("pending")) }()
+
+	done := make(chan error, 1)
+	go func() {
+		for range out {
+		}
+		done <- <-errs
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("stream did not terminate after cancellation")
+	}
+}
+
+// When every attempt fails, the final error is delivered before out closes.
+func TestMultiClient_Stream_ExhaustedErrorBeforeClose(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}, Persist: false},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}, Persist: false},
+	}
+	mc, err := NewMultiClient(oauthCfg, sources, 1, 1*time.Millisecond, nil, nil, nil, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	for _, e := range mc.entries {
+		e.ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+			return resp(503, "unavailable", "text/plain"), nil
+		})), 0, 1*time.Millisecond)
+	}
+	out, errs := mc.GenerateContentStream(context.Background(), "gemini-2.5-flash", "proj", gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "x"}}}}})
+	for range out {
+		t.Fatalf("expected no events")
+	}
+	if err := <-errs; err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("expected final 503 error, got %v", err)
+	}
+}
+
+func TestMultiClient_DiscoveryRetriesOption(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}, Persist: false},
+	}
+	mc, err := NewMultiClient(oauthCfg, sources, 0, 10*time.Millisecond, nil, nil, nil, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	if ca := mc.entries[0].ca; ca.transportRetries != defaultDiscoveryRetries || ca.baseDelay != 10*time.Millisecond {
+		t.Fatalf("expected defaults, got retries=%d delay=%v", ca.transportRetries, ca.baseDelay)
+	}
+	zero := 0
+	mc, err = NewMultiClient(oauthCfg, sources, 0, 10*time.Millisecond, nil, nil, nil, MultiClientOptions{DiscoveryRetries: &zero, DiscoveryBaseDelay: time.Second})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	if ca := mc.entries[0].ca; ca.transportRetries != 0 || ca.baseDelay != time.Second {
+		t.Fatalf("expected configured values, got retries=%d delay=%v", ca.transportRetries, ca.baseDelay)
+	}
+}
+
+func TestMultiClient_PriorityOrder(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}, Priority: 2},
+		{Path: "c.json", Raw: auth.RawToken{AccessToken: "xc", RefreshToken: "rc"}, Priority: 1},
+		{Path: "d.json", Raw: auth.RawToken{AccessToken: "xd", RefreshToken: "rd"}},
+	}
+	mc, err := NewMultiClient(oauthCfg, sources, 3, time.Millisecond, nil, nil, nil, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	tails := map[string]bool{}
+	for k := 0; k < 4; k++ {
+		cands, _, err := mc.candidates(context.Background())
+		if err != nil {
+			t.Fatalf("candidates: %v", err)
+		}
+		var paths []string
+		for _, e := range cands {
+			paths = append(paths, e.path)
+		}
+		if paths[0] != "c.json" || paths[1] != "b.json" {
+			t.Fatalf("expected prioritized units first, got %v", paths)
+		}
+		tails[paths[2]] = true
+	}
+	// Unprioritized units still rotate among themselves
+	if !tails["a.json"] || !tails["d.json"] {
+		t.Fatalf("expected round-robin among unprioritized units, got %v", tails)
+	}
+}
+
+func TestMultiClient_TLSHandshakeRetry(t *testing.T) {
+	defer func(d time.Duration) { transportRetryDelay = d }(transportRetryDelay)
+	transportRetryDelay = time.Millisecond
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}},
+	}
+	handshakeErr := tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}
+	for _, tc := range []struct {
+		name     string
+		failures int // handshake failures on the first unit before it recovers
+		want     []int
+	}{
+		{"recovers on same unit", 1, []int{2, 0}},
+		{"rotates after retry", 2, []int{2, 1}},
+	} {
+		mc, err := NewMultiClient(oauthCfg, sources, 1, time.Millisecond, nil, nil, nil, MultiClientOptions{})
+		if err != nil {
+			t.Fatalf("init multiclient: %v", err)
+		}
+		for _, stream := range []bool{false, true} {
+			mc.rr = 0
+			attempts := make([]int, 2)
+			for i, e := range mc.entries {
+				e.ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+					attempts[i]++
+					if i == 0 && attempts[i] <= tc.failures {
+						return nil, handshakeErr
+					}
+					if stream {
+						return resp(200, "data: {\"response\":{\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"ok\"}]}}]}}\n\n", "text/event-stream"), nil
+					}
+					return resp(200, `{"response":{"candidates":[{"content":{"parts":[{"text":"ok"}]}}]}}`, "application/json"), nil
+				})), 0, time.Millisecond)
+			}
+			req := gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "hi"}}}}}
+			if stream {
+				out, errs := mc.GenerateContentStream(context.Background(), "gemini-2.5-flash", "proj", req)
+				n := 0
+				for range out {
+					n++
+				}
+				if err := <-errs; err != nil || n != 1 {
+					t.Fatalf("%s (stream): chunks=%d err=%v", tc.name, n, err)
+				}
+			} else if _, err := mc.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", req); err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			if !slices.Equal(attempts, tc.want) {
+				t.Fatalf("%s (stream=%v): attempts %v, want %v", tc.name, stream, attempts, tc.want)
+			}
+		}
+	}
+	if !isRetryable(&url.Error{Op: "Post", URL: "https://x", Err: errors.New("net/http: TLS handshake timeout")}, nil) {
+		t.Fatal("expected a handshake timeout to be retryable")
+	}
+}
+
+func TestMultiClient_TransportRetryWithinAttempt(t *testing.T) {
+	defer func(d time.Duration) { transportRetryDelay = d }(transportRetryDelay)
+	transportRetryDelay = time.Millisecond
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}, DailyRequestCap: 5}}
+	mc, err := NewMultiClient(oauthCfg, sources, 1, time.Millisecond, nil, nil, nil, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	req := gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "hi"}}}}}
+	attempts := 0
+	mc.entries[0].ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+		attempts++
+		if attempts == 1 {
+			return nil, tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}
+		}
+		return resp(200, `{"response":{"candidates":[]}}`, "application/json"), nil
+	})), 0, time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := mc.GenerateContent(ctx, "gemini-2.5-flash", "proj", req); err != nil {
+		t.Fatalf("expected the same-unit retry to succeed: %v", err)
+	}
+	// The retried call never reached upstream, so the cap counts one request
+	if attempts != 2 || mc.requestsToday(mc.entries[0]) != 1 {
+		t.Fatalf("expected 2 calls counted once against the daily cap, got %d calls and %d counted", attempts, mc.requestsToday(mc.entries[0]))
+	}
+
+	// A body read failure after a 200 is not a transport failure
+	attempts = 0
+	mc.entries[0].ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+		attempts++
+		return &http.Response{StatusCode: 200, Body: &failingBody{err: &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}}, Header: http.Header{"Content-Type": []string{"application/json"}}}, nil
+	})), 0, time.Millisecond)
+	mc.retries = 0
+	if _, err := mc.GenerateContent(ctx, "gemini-2.5-flash", "proj", req); err == nil {
+		t.Fatal("expected the body read error")
+	}
+	if attempts != 1 {
+		t.Fatalf("body read failure retried on the same unit: %d calls", attempts)
+	}
+}
+
+func TestMultiClient_BackupTier_OnlyAfterPrimariesFail(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "backup.json", Raw: auth.RawToken{AccessToken: "xc", RefreshToken: "rc"}, Backup: true},
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}},
+	}
+	mc, err := NewMultiClient(oauthCfg, sources, 1, 1*time.Millisecond, nil, nil, nil, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	attempts := make([]int, 3)
+	status := []int{200, 500, 500}
+	for i := range mc.entries {
+		mc.entries[i].ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+			attempts[i]++
+			if status[i] != 200 {
+				return resp(status[i], "boom", "text/plain"), nil
+			}
+			return resp(200, `{"response": {"candidates":[{"content":{"parts":[{"text":"ok"}]}}]}}`, "application/json"), nil
+		})), 0, 1*time.Millisecond)
+	}
+	req := gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "hi"}}}}}
+
+	// Primaries fail: escalate to the backup unit
+	if _, err := mc.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", req); err != nil {
+		t.Fatalf("expected backup to serve the request: %v", err)
+	}
+	if attempts[0] != 1 || attempts[1] != 1 || attempts[2] != 1 {
+		t.Fatalf("expected both primaries then backup, got %v", attempts)
+	}
+
+	// A healthy primary keeps the backup untouched
+	status[1] = 200
+	for k := 0; k < 4; k++ {
+		if _, err := mc.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", req); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if attempts[0] != 1 {
+		t.Fatalf("backup must not be used while a primary succeeds, got %v", attempts)
+	}
+	if creds := mc.Credentials(); !creds[0].Backup || creds[1].Backup {
+		t.Fatalf("unexpected backup flags: %+v", creds)
+	}
+}
+
+func TestMultiClient_ShadowCredentials(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}},
+		{Path: "shadow.json", Raw: auth.RawToken{AccessToken: "xs", RefreshToken: "rs"}, Shadow: true},
+	}
+	mc, err := NewMultiClient(oauthCfg, sources, 1, time.Millisecond, nil, nil, nil, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	attempts := make([]int, 2)
+	status := []int{200, 200}
+	for i := range mc.entries {
+		mc.entries[i].ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+			attempts[i]++
+			if status[i] != 200 {
+				return resp(status[i], "boom", "text/plain"), nil
+			}
+			return resp(200, `{"response":{"candidates":[]}}`, "application/json"), nil
+		})), 0, time.Millisecond)
+	}
+	req := gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "hi"}}}}}
+
+	// Regular requests never fall through to the shadow unit
+	status[0] = 500
+	if _, err := mc.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", req); err == nil {
+		t.Fatal("expected the failing primary's error")
+	}
+	if attempts[1] != 0 {
+		t.Fatalf("shadow unit used by a regular request: %v", attempts)
+	}
+	// Shadow requests only use the shadow unit
+	before := attempts[0]
+	if _, err := mc.GenerateContent(WithShadowCredentials(context.Background()), "gemini-2.5-pro", "proj", req); err != nil {
+		t.Fatalf("shadow request: %v", err)
+	}
+	if attempts[0] != before || attempts[1] != 1 {
+		t.Fatalf("expected only the shadow unit, got %v", attempts)
+	}
+	if creds := mc.Credentials(); creds[0].Shadow || !creds[1].Shadow {
+		t.Fatalf("unexpected shadow flags: %+v", creds)
+	}
+}
+
+func TestMultiClient_FailureLogFields(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "secret-access", RefreshToken: "secret-refresh"}, Name: "acct-a"},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}},
+	}
+	mc, err := NewMultiClient(oauthCfg, sources, 1, time.Millisecond, nil, nil, nil, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	for _, e := range mc.entries {
+		e.ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+			return resp(503, "unavailable", "text/plain"), nil
+		})), 0, time.Millisecond)
+	}
+	req := gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "hi"}}}}}
+	if _, err := mc.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", req); err == nil {
+		t.Fatal("expected failure")
+	}
+	var rotation, upstream *logrus.Entry
+	for _, entry := range hook.AllEntries() {
+		switch entry.Message {
+		case "[MultiClient] rotating on error":
+			rotation = entry
+		case "upstream call failed: upstream status 503: unavailable":
+			upstream = entry
+		}
+		for k, v := range entry.Data {
+			if s := fmt.Sprint(v); strings.Contains(s, "secret-") {
+				t.Fatalf("log field %s leaks token material: %s", k, s)
+			}
+		}
+	}
+	if rotation == nil || upstream == nil {
+		t.Fatalf("missing failure logs: %+v", hook.AllEntries())
+	}
+	want := logrus.Fields{"upstream_method": "generateContent", "project": "proj", "status": 503, "model": "gemini-2.5-flash"}
+	for k, v := range want {
+		if rotation.Data[k] != v || upstream.Data[k] != v {
+			t.Fatalf("field %s: rotation=%v upstream=%v, want %v", k, rotation.Data[k], upstream.Data[k], v)
+		}
+	}
+	if cred := rotation.Data["credential"]; cred != "acct-a" && cred != "b.json" {
+		t.Fatalf("unexpected credential field %v", cred)
+	}
+}
+
+func TestMultiClient_LogSampleRate(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}},
+	}
+	mc, err := NewMultiClient(oauthCfg, sources, 1, time.Millisecond, nil, nil, nil, MultiClientOptions{LogSampleRate: 3})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	var fail atomic.Bool
+	for _, e := range mc.entries {
+		e.ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+			if fail.Load() {
+				return resp(503, "unavailable", "text/plain"), nil
+			}
+			return resp(200, `{"response":{"candidates":[]}}`, "application/json"), nil
+		})), 0, time.Millisecond)
+	}
+	req := gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "hi"}}}}}
+	count := func(prefix string) int {
+		n := 0
+		for _, entry := range hook.AllEntries() {
+			if strings.HasPrefix(entry.Message, prefix) {
+				n++
+			}
+		}
+		return n
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := mc.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", req); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	if n := count("[MultiClient] status=ok"); n != 2 {
+		t.Fatalf("expected 2 of 5 successes logged, got %d", n)
+	}
+	// The next request is not sampled, but its failures and rotation are
+	// still logged, including the attempt after the rotation.
+	hook.Reset()
+	fail.Store(true)
+	if _, err := mc.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", req); err == nil {
+		t.Fatal("expected failure")
+	}
+	if count("[MultiClient] rotating on error") != 1 || count("[MultiClient] non-retryable or budget exhausted") != 1 || count("[MultiClient] attempt=2") != 1 {
+		t.Fatalf("failure logs were sampled out: %+v", hook.AllEntries())
+	}
+	if count("[MultiClient] attempt=1") != 0 {
+		t.Fatalf("unsampled first attempt was logged")
+	}
+}
+
+func TestMultiClient_DrainedUnitSkipped(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}},
+	}
+	mc, err := NewMultiClient(oauthCfg, sources, 1, 1*time.Millisecond, nil, nil, nil, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	attempts := make([]int, 2)
+	for i := range mc.entries {
+		mc.entries[i].ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+			attempts[i]++
+			return resp(200, `{"response": {"candidates":[{"content":{"parts":[{"text":"ok"}]}}]}}`, "application/json"), nil
+		})), 0, 1*time.Millisecond)
+	}
+	req := gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "hi"}}}}}
+
+	if err := mc.SetDraining(0, true); err != nil {
+		t.Fatalf("drain: %v", err)
+	}
+	for k := 0; k < 4; k++ {
+		if _, err := mc.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", req); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if attempts[0] != 0 || attempts[1] != 4 {
+		t.Fatalf("drained unit must get no requests, got %v", attempts)
+	}
+	if creds := mc.Credentials(); !creds[0].Draining || creds[1].Draining {
+		t.Fatalf("unexpected draining flags: %+v", creds)
+	}
+
+	_ = mc.SetDraining(1, true)
+	if _, err := mc.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", req); err == nil || !strings.Contains(err.Error(), "draining") {
+		t.Fatalf("expected all-draining error, got %v", err)
+	}
+	_ = mc.SetDraining(0, false)
+	if _, err := mc.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", req); err != nil || attempts[0] != 1 {
+		t.Fatalf("undrained unit should serve again: %v %v", err, attempts)
+	}
+	if err := mc.SetDraining(2, true); err == nil {
+		t.Fatalf("expected out-of-range error")
+	}
+}
+
+func TestMultiClient_CredentialInfoMetric(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "/tmp/metric-a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}},
+	}
+	mc, err := NewMultiClient(oauthCfg, sources, 0, 1*time.Millisecond, nil, nil, map[string][]string{"/tmp/metric-a.json": {"p-cfg", "_auto"}}, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	mc.entries[1].setProjectID("p-found", "discovery")
+
+	var buf bytes.Buffer
+	metrics.Default.WriteText(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		`gcli2api_credential_info{index="0",credential="/tmp/metric-a.json",project="p-cfg"} 1`,
+		`gcli2api_credential_info{index="1",credential="/tmp/metric-a.json",project="p-found"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `gcli2api_credential_info{index="1",credential="/tmp/metric-a.json",project=""}`) {
+		t.Fatalf("stale unresolved series should be removed:\n%s", out)
+	}
+}
+
+func TestMultiClient_Unary_StopsRotatingWhenCanceled(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}},
+	}
+	mc, err := NewMultiClient(oauthCfg, sources, 3, time.Millisecond, nil, nil, nil, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var attempts atomic.Int32
+	for _, e := range mc.entries {
+		e.ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+			attempts.Add(1)
+			// The client goes away while upstream answers with a retryable error.
+			cancel()
+			return resp(500, "boom", "text/plain"), nil
+		})), 0, time.Millisecond)
+	}
+	_, err = mc.GenerateContent(ctx, "gemini-2.5-flash", "proj", gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "hi"}}}}})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Fatalf("expected rotation to stop after cancel, got %d attempts", n)
+	}
+}
+
+func TestMultiClient_DailyRequestCap(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}, DailyRequestCap: 2},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}, DailyRequestCap: 1},
+	}
+	st, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	defer st.Close()
+	now := time.Date(2026, 3, 1, 23, 0, 0, 0, time.UTC)
+	attempts := make([]int, 2)
+	build := func() *MultiClient {
+		mc, err := NewMultiClient(oauthCfg, sources, 1, time.Millisecond, st, nil, nil, MultiClientOptions{})
+		if err != nil {
+			t.Fatalf("init multiclient: %v", err)
+		}
+		mc.daily.now = func() time.Time { return now }
+		for i := range mc.entries {
+			mc.entries[i].ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+				attempts[i]++
+				return resp(200, `{"response": {"candidates":[{"content":{"parts":[{"text":"ok"}]}}]}}`, "application/json"), nil
+			})), 0, time.Millisecond)
+		}
+		return mc
+	}
+	mc := build()
+	req := gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "hi"}}}}}
+	for k := 0; k < 3; k++ {
+		if _, err := mc.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", req); err != nil {
+			t.Fatalf("request %d: %v", k, err)
+		}
+	}
+	if attempts[0] != 2 || attempts[1] != 1 {
+		t.Fatalf("expected each credential to stop at its cap, got %v", attempts)
+	}
+	if creds := mc.Credentials(); creds[0].RequestsToday != 2 || creds[0].DailyRequestCap != 2 {
+		t.Fatalf("unexpected admin counts: %+v", creds[0])
+	}
+
+	// Counts survive a restart through the state store
+	mc = build()
+	_, err = mc.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", req)
+	if !errors.Is(err, ErrDailyCapReached) {
+		t.Fatalf("expected daily cap error after restart, got %v", err)
+	}
+	if attempts[0] != 2 || attempts[1] != 1 {
+		t.Fatalf("capped request must not reach upstream, got %v", attempts)
+	}
+
+	// A new UTC day resets the caps
+	now = now.Add(2 * time.Hour)
+	if _, err := mc.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", req); err != nil {
+		t.Fatalf("expected caps reset on the next day: %v", err)
+	}
+}
+
+func TestMultiClient_DailyRequestCapConcurrent(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}, DailyRequestCap: 3}}
+	mc, err := NewMultiClient(oauthCfg, sources, 0, time.Millisecond, nil, nil, nil, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	var attempts atomic.Int32
+	release := make(chan struct{})
+	mc.entries[0].ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+		attempts.Add(1)
+		<-release
+		return resp(200, `{"response":{"candidates":[]}}`, "application/json"), nil
+	})), 0, time.Millisecond)
+	req := gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "hi"}}}}}
+	var capped atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := mc.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", req); errors.Is(err, ErrDailyCapReached) {
+				capped.Add(1)
+			}
+		}()
+	}
+	// Let the admitted requests finish only once every request has started
+	for attempts.Load()+capped.Load() < 10 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if attempts.Load() != 3 || capped.Load() != 7 {
+		t.Fatalf("expected 3 upstream calls and 7 capped requests, got %d and %d", attempts.Load(), capped.Load())
+	}
+}
+
+func TestMultiClient_DailyCapReachedMidRequest(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}, DailyRequestCap: 1},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}, DailyRequestCap: 1},
+	}
+	req := gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "hi"}}}}}
+	for _, stream := range []bool{false, true} {
+		mc, err := NewMultiClient(oauthCfg, sources, 0, time.Millisecond, nil, nil, nil, MultiClientOptions{})
+		if err != nil {
+			t.Fatalf("init multiclient: %v", err)
+		}
+		var raced atomic.Bool
+		calls := make([]atomic.Int32, 2)
+		for i := range mc.entries {
+			mc.entries[i].ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+				if strings.HasSuffix(r.URL.Path, ":loadCodeAssist") {
+					// A concurrent request takes the unit's last slot while
+					// its project is being discovered
+					if raced.CompareAndSwap(false, true) {
+						mc.reserveDaily(mc.entries[i])
+					}
+					return resp(200, `{"cloudaicompanionProject":"p1"}`, ""), nil
+				}
+				calls[i].Add(1)
+				if stream {
+					return resp(200, "data: {\"response\":{\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"ok\"}]}}]}}\n\n", "text/event-stream"), nil
+				}
+				return resp(200, `{"response": {"candidates":[{"content":{"parts":[{"text":"ok"}]}}]}}`, "application/json"), nil
+			})), 0, time.Millisecond)
+		}
+		if stream {
+			out, errs := mc.GenerateContentStream(context.Background(), "gemini-2.5-flash", "", req)
+			for range out {
+			}
+			err = <-errs
+		} else {
+			_, err = mc.GenerateContent(context.Background(), "gemini-2.5-flash", "", req)
+		}
+		if err != nil {
+			t.Fatalf("stream=%v: expected the other unit to serve the request, got %v", stream, err)
+		}
+		if n := calls[0].Load() + calls[1].Load(); n != 1 {
+			t.Fatalf("stream=%v: expected exactly one upstream call, got %d", stream, n)
+		}
+	}
+}
+
+func TestMultiClient_DiscoveryReusesCachedTier(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}}}
+	st, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	defer st.Close()
+	ctx := context.Background()
+
+	var loads, onboards atomic.Int32
+	var onboardTier atomic.Value
+	rt := rtFunc(func(r *http.Request) (*http.Response, error) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, ":loadCodeAssist"):
+			loads.Add(1)
+			return resp(200, `{"allowedTiers":[{"id":"free-tier"},{"id":"standard-tier","isDefault":true}]}`, ""), nil
+		case strings.HasSuffix(r.URL.Path, ":onboardUser"):
+			onboards.Add(1)
+			var body struct {
+				TierID string `json:"tierId"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			onboardTier.Store(body.TierID)
+			return resp(200, `{"done":true,"response":{"cloudaicompanionProject":{"id":"p1"}}}`, ""), nil
+		}
+		return resp(404, "unexpected", "text/plain"), nil
+	})
+	discover := func() *MultiClient {
+		mc, err := NewMultiClient(oauthCfg, sources, 0, time.Millisecond, st, nil, nil, MultiClientOptions{})
+		if err != nil {
+			t.Fatalf("init multiclient: %v", err)
+		}
+		mc.entries[0].ca = NewCaClient(mkClient(rt), 0, time.Millisecond)
+		if pid, err := mc.getOrDiscoverProjectID(ctx, mc.entries[0]); err != nil || pid != "p1" {
+			t.Fatalf("discover: pid=%q err=%v", pid, err)
+		}
+		return mc
+	}
+
+	mc := discover()
+	if loads.Load() != 1 || onboards.Load() != 1 || onboardTier.Load() != "standard-tier" {
+		t.Fatalf("first discovery: loads=%d onboards=%d tier=%v", loads.Load(), onboards.Load(), onboardTier.Load())
+	}
+	if got := mc.Credentials()[0].TierID; got != "standard-tier" {
+		t.Fatalf("expected tier in credential status, got %q", got)
+	}
+
+	// Drop the project mapping; rediscovery should onboard with the stored
+	// tier without another loadCodeAssist round-trip.
+	if _, err := st.Cleanup(ctx, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("cleanup: %v", err)
+	}
+	mc = discover()
+	if loads.Load() != 1 || onboards.Load() != 2 || onboardTier.Load() != "standard-tier" {
+		t.Fatalf("rediscovery: loads=%d onboards=%d tier=%v", loads.Load(), onboards.Load(), onboardTier.Load())
+	}
+	if got := mc.Credentials()[0].TierID; got != "standard-tier" {
+		t.Fatalf("expected tier in credential status after rediscovery, got %q", got)
+	}
+}
+
+func TestMultiClient_RequestInfoTier(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}}}
+	st, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	defer st.Close()
+	mc, err := NewMultiClient(oauthCfg, sources, 0, time.Millisecond, st, nil, nil, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	ctx := context.Background()
+	e := mc.entries[0]
+	if err := st.UpsertProjectID(ctx, e.tokenKey, "google", "test", "p1"); err != nil {
+		t.Fatalf("upsert project: %v", err)
+	}
+	if err := st.UpsertTierID(ctx, e.tokenKey, "free-tier"); err != nil {
+		t.Fatalf("upsert tier: %v", err)
+	}
+	e.ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+		return resp(200, `{"response":{"candidates":[]}}`, "application/json"), nil
+	})), 0, time.Millisecond)
+	ctx, info := WithRequestInfo(ctx)
+	req := gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "hi"}}}}}
+	if _, err := mc.GenerateContent(ctx, "gemini-2.5-flash", "", req); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if d := info.Details(); d.Project != "p1" || d.Tier != "free-tier" {
+		t.Fatalf("expected cached project and tier in request details, got %+v", d)
+	}
+	if e.projectTouched.Load() == 0 {
+		t.Fatal("expected the stored project mapping to be marked as used")
+	}
+}
+
+func TestMultiClient_MaxRotations(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	var sources []CredSource
+	for i := 0; i < 5; i++ {
+		sources = append(sources, CredSource{Path: fmt.Sprintf("%d.json", i), Raw: auth.RawToken{AccessToken: "x", RefreshToken: fmt.Sprintf("r%d", i)}})
+	}
+	for _, tc := range []struct {
+		maxRotations int
+		want         []int
+	}{
+		{0, []int{1, 1, 0, 0, 0}},
+		{4, []int{1, 1, 1, 1, 0}},
+		{10, []int{1, 1, 1, 1, 1}},
+	} {
+		mc, err := NewMultiClient(oauthCfg, sources, 1, time.Millisecond, nil, nil, nil, MultiClientOptions{MaxRotations: tc.maxRotations})
+		if err != nil {
+			t.Fatalf("init multiclient: %v", err)
+		}
+		attempts := make([]int, len(sources))
+		for i, e := range mc.entries {
+			e.ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+				attempts[i]++
+				return resp(500, "boom", "text/plain"), nil
+			})), 0, time.Millisecond)
+		}
+		if _, err := mc.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", gemini.GeminiRequest{}); err == nil {
+			t.Fatalf("maxRotations=%d: expected error", tc.maxRotations)
+		}
+		if !slices.Equal(attempts, tc.want) {
+			t.Fatalf("maxRotations=%d: attempts %v, want %v", tc.maxRotations, attempts, tc.want)
+		}
+	}
+}
+
+func TestMultiClient_RotationBackoff(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}},
+		{Path: "c.json", Raw: auth.RawToken{AccessToken: "xc", RefreshToken: "rc"}},
+	}
+	opts := MultiClientOptions{RotationBackoff: 20 * time.Millisecond, RotationBackoffMax: 30 * time.Millisecond}
+	mc, err := NewMultiClient(oauthCfg, sources, 2, time.Millisecond, nil, nil, nil, opts)
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	var times []time.Time
+	for _, e := range mc.entries {
+		e.ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+			times = append(times, time.Now())
+			return resp(503, "busy", "text/plain"), nil
+		})), 0, time.Millisecond)
+	}
+	if _, err := mc.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", gemini.GeminiRequest{}); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(times) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(times))
+	}
+	// 20ms (+jitter) then 40ms capped to 30ms
+	if d := times[1].Sub(times[0]); d < 20*time.Millisecond {
+		t.Fatalf("first rotation waited only %v", d)
+	}
+	if d := times[2].Sub(times[1]); d < 30*time.Millisecond {
+		t.Fatalf("second rotation waited only %v", d)
+	}
+
+	// A canceled caller is not kept waiting for the backoff.
+	mc.rotationBackoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := mc.GenerateContent(ctx, "gemini-2.5-flash", "proj", gemini.GeminiRequest{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("backoff ignored context cancellation")
+	}
+}
+
+func TestMultiClient_DedupeProjects(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}},
+	}
+	projectMap := map[string][]string{"a.json": {"p1", "p2"}, "b.json": {"p2", "p3"}}
+	projects := func(opts MultiClientOptions) []string {
+		mc, err := NewMultiClient(oauthCfg, sources, 0, time.Millisecond, nil, nil, projectMap, opts)
+		if err != nil {
+			t.Fatalf("init multiclient: %v", err)
+		}
+		var out []string
+		for _, c := range mc.Credentials() {
+			out = append(out, c.Project)
+		}
+		return out
+	}
+	if got := projects(MultiClientOptions{}); !slices.Equal(got, []string{"p1", "p2", "p2", "p3"}) {
+		t.Fatalf("without dedupe: %v", got)
+	}
+	if got := projects(MultiClientOptions{DedupeProjects: true}); !slices.Equal(got, []string{"p1", "p2", "p3"}) {
+		t.Fatalf("with dedupe: %v", got)
+	}
+}
+
+func TestMultiClient_StreamRotationBackoff(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}},
+		{Path: "c.json", Raw: auth.RawToken{AccessToken: "xc", RefreshToken: "rc"}},
+	}
+	opts := MultiClientOptions{RotationBackoff: 20 * time.Millisecond, RotationBackoffMax: 30 * time.Millisecond}
+	mc, err := NewMultiClient(oauthCfg, sources, 2, time.Millisecond, nil, nil, nil, opts)
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	var times []time.Time
+	for _, e := range mc.entries {
+		e.ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+			times = append(times, time.Now())
+			return resp(503, "busy", "text/plain"), nil
+		})), 0, time.Millisecond)
+	}
+	req := gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "x"}}}}}
+	out, errs := mc.GenerateContentStream(context.Background(), "gemini-2.5-flash", "proj", req)
+	for range out {
+	}
+	if err := <-errs; err == nil {
+		t.Fatal("expected error")
+	}
+	if len(times) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(times))
+	}
+	if d := times[1].Sub(times[0]); d < 20*time.Millisecond {
+		t.Fatalf("first stream rotation waited only %v", d)
+	}
+	if d := times[2].Sub(times[1]); d < 30*time.Millisecond {
+		t.Fatalf("second stream rotation waited only %v", d)
+	}
+
+	// Cancellation ends the wait instead of sleeping it out.
+	mc.rotationBackoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	out, errs = mc.GenerateContentStream(ctx, "gemini-2.5-flash", "proj", req)
+	for range out {
+	}
+	if err := <-errs; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("stream backoff ignored context cancellation")
+	}
+}
+
+func TestMultiClient_RetryOnEmptyCandidates(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}},
+	}
+	ok := `{"response":{"candidates":[{"content":{"parts":[{"text":"hi"}]}}]}}`
+	for _, tc := range []struct {
+		name     string
+		enabled  bool
+		first    string
+		attempts int
+		wantText bool
+	}{
+		{"empty retried", true, `{"response":{"candidates":[]}}`, 2, true},
+		{"disabled", false, `{"response":{"candidates":[]}}`, 1, false},
+		{"safety block kept", true, `{"response":{"promptFeedback":{"blockReason":"SAFETY"}}}`, 1, false},
+		{"missing envelope safety block kept", true, `{"promptFeedback":{"blockReason":"OTHER"}}`, 1, false},
+	} {
+		mc, err := NewMultiClient(oauthCfg, sources, 1, time.Millisecond, nil, nil, nil, MultiClientOptions{RetryOnEmptyCandidates: tc.enabled})
+		if err != nil {
+			t.Fatalf("init multiclient: %v", err)
+		}
+		attempts := 0
+		for _, e := range mc.entries {
+			e.ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+				attempts++
+				if attempts == 1 {
+					return resp(200, tc.first, ""), nil
+				}
+				return resp(200, ok, ""), nil
+			})), 0, time.Millisecond)
+		}
+		got, err := mc.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", gemini.GeminiRequest{})
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tc.name, err)
+		}
+		if attempts != tc.attempts || (len(got.Candidates) > 0) != tc.wantText {
+			t.Fatalf("%s: attempts=%d candidates=%d", tc.name, attempts, len(got.Candidates))
+		}
+	}
+
+	// With no budget left the empty response is returned rather than an error.
+	mc, _ := NewMultiClient(oauthCfg, sources[:1], 0, time.Millisecond, nil, nil, nil, MultiClientOptions{RetryOnEmptyCandidates: true})
+	mc.entries[0].ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+		return resp(200, `{"response":{"candidates":[]}}`, ""), nil
+	})), 0, time.Millisecond)
+	if got, err := mc.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", gemini.GeminiRequest{}); err != nil || len(got.Candidates) != 0 {
+		t.Fatalf("expected empty response on exhausted budget, got %v %v", got, err)
+	}
+}
+
+func TestMultiClient_DiscoveryFailuresAggregated(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}},
+	}
+	zero := 0
+	mc, err := NewMultiClient(oauthCfg, sources, 3, time.Millisecond, nil, nil, nil, MultiClientOptions{DiscoveryRetries: &zero})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	mc.entries[0].ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+		return resp(403, "insufficient scopes "+strings.Repeat("x", 500), "text/plain"), nil
+	})), 0, time.Millisecond)
+	mc.entries[1].ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("dial tcp: connection refused")
+	})), 0, time.Millisecond)
+
+	check := func(err error) {
+		t.Helper()
+		if !errors.Is(err, ErrDiscoveryFailed) {
+			t.Fatalf("expected ErrDiscoveryFailed, got %v", err)
+		}
+		msg := err.Error()
+		for _, want := range []string{"2 unit(s)", "idx=0 cred=a.json: upstream status 403: insufficient scopes", "idx=1 cred=b.json:", "connection refused"} {
+			if !strings.Contains(msg, want) {
+				t.Fatalf("missing %q in %q", want, msg)
+			}
+		}
+		if strings.Contains(msg, strings.Repeat("x", maxDiscoveryErrLen)) {
+			t.Fatalf("per-unit message not truncated: %q", msg)
+		}
+	}
+	req := gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "hi"}}}}}
+	_, err = mc.GenerateContent(context.Background(), "gemini-2.5-flash", "", req)
+	check(err)
+
+	out, errs := mc.GenerateContentStream(context.Background(), "gemini-2.5-flash", "", req)
+	for range out {
+	}
+	check(<-errs)
+}
+
+func TestMultiClient_MaxDiscoveryAttempts(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}},
+		{Path: "c.json", Raw: auth.RawToken{AccessToken: "xc", RefreshToken: "rc"}},
+	}
+	zero := 0
+	mc, err := NewMultiClient(oauthCfg, sources, 2, time.Millisecond, nil, nil, nil, MultiClientOptions{DiscoveryRetries: &zero, MaxDiscoveryAttempts: 1})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	var discoveries atomic.Int32
+	for _, e := range mc.entries {
+		e.ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+			discoveries.Add(1)
+			return nil, errors.New("dial tcp: connection refused")
+		})), 0, time.Millisecond)
+	}
+	req := gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "hi"}}}}}
+	check := func(err error) {
+		t.Helper()
+		if !errors.Is(err, ErrDiscoveryFailed) || !strings.Contains(err.Error(), "gave up after 1 discovery attempt(s)") {
+			t.Fatalf("expected capped discovery error, got %v", err)
+		}
+		if n := discoveries.Swap(0); n != 1 {
+			t.Fatalf("expected 1 discovery call, got %d", n)
+		}
+	}
+	_, err = mc.GenerateContent(context.Background(), "gemini-2.5-flash", "", req)
+	check(err)
+
+	out, errs := mc.GenerateContentStream(context.Background(), "gemini-2.5-flash", "", req)
+	for range out {
+	}
+	check(<-errs)
+
+	// A unit with a known project is still used once the budget is spent.
+	mc.entries[2].setProjectID("proj-c", "config")
+	mc.entries[2].ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+		return resp(200, `{"response":{"candidates":[]}}`, "application/json"), nil
+	})), 0, time.Millisecond)
+	if _, err := mc.GenerateContent(context.Background(), "gemini-2.5-flash", "", req); err != nil {
+		t.Fatalf("expected the cached unit to serve the request, got %v", err)
+	}
+}
+
+func TestMultiClient_CredentialTimeoutRotates(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "slow.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}, Timeout: 20 * time.Millisecond},
+		{Path: "fast.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}},
+	}
+	mc, err := NewMultiClient(oauthCfg, sources, 1, time.Millisecond, nil, nil, nil, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	mc.entries[0].ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	})), 0, time.Millisecond)
+	mc.entries[1].ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+		if _, ok := r.Context().Deadline(); ok {
+			t.Errorf("unit without a timeout should not get a deadline")
+		}
+		if strings.Contains(r.URL.RawQuery, "alt=sse") {
+			return resp(200, "data: {\"response\": {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"ok\"}]}}]}}\n\n", "text/event-stream"), nil
+		}
+		return resp(200, `{"response": {"candidates":[{"content":{"parts":[{"text":"ok"}]}}]}}`, ""), nil
+	})), 0, time.Millisecond)
+	req := gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "hi"}}}}}
+
+	atomic.StoreUint64(&mc.rr, 0)
+	g, err := mc.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", req)
+	if err != nil || g.Candidates[0].Content.Parts[0].Text != "ok" {
+		t.Fatalf("expected rotation to the fast unit, got %+v, %v", g, err)
+	}
+
+	atomic.StoreUint64(&mc.rr, 0)
+	out, errs := mc.GenerateContentStream(context.Background(), "gemini-2.5-flash", "proj", req)
+	var got []string
+	for g := range out {
+		got = append(got, g.Candidates[0].Content.Parts[0].Text)
+	}
+	if err := <-errs; err != nil || len(got) != 1 {
+		t.Fatalf("expected stream rotation to the fast unit, got %v, %v", got, err)
+	}
+
+	// With no other unit to rotate to, the error names the credential timeout.
+	mc.retries = 0
+	atomic.StoreUint64(&mc.rr, 0)
+	if _, err := mc.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", req); err == nil || !strings.Contains(err.Error(), "credential timeout 20ms exceeded") {
+		t.Fatalf("expected credential timeout error, got %v", err)
+	}
+}
+
+func TestMultiClient_NonRetryableReasons(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}},
+	}
+	denied := `{"error":{"code":403,"message":"User location is not supported for the API use.","status":"PERMISSION_DENIED","details":[{"@type":"type.googleapis.com/google.rpc.ErrorInfo","reason":"USER_LOCATION_INVALID"}]}}`
+	ok := `{"response":{"candidates":[{"content":{"parts":[{"text":"hi"}]}}]}}`
+	for _, tc := range []struct {
+		name     string
+		reasons  []string
+		attempts int
+		wantErr  bool
+	}{
+		{"rotates by default", nil, 2, false},
+		{"matching status stops", []string{"permission_denied"}, 1, true},
+		{"matching reason stops", []string{"USER_LOCATION_INVALID"}, 1, true},
+		{"other reason rotates", []string{"FAILED_PRECONDITION"}, 2, false},
+		{"message text is not matched", []string{"User location is not supported"}, 2, false},
+	} {
+		mc, err := NewMultiClient(oauthCfg, sources, 1, time.Millisecond, nil, nil, nil, MultiClientOptions{NonRetryableReasons: tc.reasons})
+		if err != nil {
+			t.Fatalf("init multiclient: %v", err)
+		}
+		attempts := 0
+		for _, e := range mc.entries {
+			e.ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+				attempts++
+				if attempts == 1 {
+					return resp(403, denied, "application/json"), nil
+				}
+				return resp(200, ok, "application/json"), nil
+			})), 0, time.Millisecond)
+		}
+		_, err = mc.GenerateContent(context.Background(), "gemini-2.5-flash", "proj", gemini.GeminiRequest{})
+		if attempts != tc.attempts || (err != nil) != tc.wantErr {
+			t.Fatalf("%s: attempts=%d err=%v", tc.name, attempts, err)
+		}
+	}
+}
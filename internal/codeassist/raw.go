@@ -0,0 +1,40 @@
+package codeassist
+
+import (
+	"context"
+	"sync"
+)
+
+type rawResponseKey struct{}
+
+// RawResponse captures the unmodified upstream body of a unary generation
+// call, so fields the typed structs drop can be inspected.
+type RawResponse struct {
+	mu   sync.Mutex
+	body []byte
+}
+
+// WithRawResponse returns a derived context whose unary generation calls
+// record the raw upstream envelope. Retrieve it with RawResponseFrom.
+func WithRawResponse(ctx context.Context) context.Context {
+	return context.WithValue(ctx, rawResponseKey{}, &RawResponse{})
+}
+
+// RawResponseFrom returns the capture attached by WithRawResponse, or nil.
+func RawResponseFrom(ctx context.Context) *RawResponse {
+	r, _ := ctx.Value(rawResponseKey{}).(*RawResponse)
+	return r
+}
+
+// Bytes returns the last captured body, or nil if nothing was captured.
+func (r *RawResponse) Bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.body
+}
+
+func (r *RawResponse) set(b []byte) {
+	r.mu.Lock()
+	r.body = b
+	r.mu.Unlock()
+}
@@ -0,0 +1,83 @@
+package codeassist
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RequestDetails describes how the MultiClient served a single request.
+type RequestDetails struct {
+	// Attempts is the number of units tried, including the final one.
+	Attempts int
+	// Credential is the display name of the last unit tried.
+	Credential string
+	// TokenKey is the state-store key of the last unit's credential.
+	TokenKey string
+	// Project is the project id used by the last unit tried.
+	Project string
+	// Tier is the Code Assist tier (e.g. "free-tier") of the last unit
+	// tried, when it is known.
+	Tier string
+	// Discovery is the time spent resolving project ids upstream (zero when
+	// every unit's project was configured or cached).
+	Discovery time.Duration
+}
+
+// RequestInfo collects RequestDetails for one request. Handlers attach it to
+// the request context via WithRequestInfo and read it back with Details once
+// the call has completed. It is safe for concurrent use, since a streaming
+// handler may give up while the MultiClient goroutine is still working.
+type RequestInfo struct {
+	mu      sync.Mutex
+	details RequestDetails
+}
+
+type requestInfoKey struct{}
+
+// WithRequestInfo returns a derived context carrying a fresh RequestInfo.
+func WithRequestInfo(ctx context.Context) (context.Context, *RequestInfo) {
+	info := &RequestInfo{}
+	return context.WithValue(ctx, requestInfoKey{}, info), info
+}
+
+// requestInfoFrom returns the RequestInfo attached to ctx, or nil.
+func requestInfoFrom(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
+
+// Details returns a snapshot of the collected details. A nil RequestInfo
+// yields the zero value.
+func (info *RequestInfo) Details() RequestDetails {
+	if info == nil {
+		return RequestDetails{}
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	return info.details
+}
+
+// record notes the unit used for attempt k (0-based).
+func (info *RequestInfo) record(k int, e *entry, project string) {
+	if info == nil {
+		return
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.details.Attempts = k + 1
+	info.details.Credential = e.displayName()
+	info.details.TokenKey = e.tokenKey
+	info.details.Project = project
+	info.details.Tier, _ = e.tierID.Load().(string)
+}
+
+// addDiscovery accumulates time spent in project discovery.
+func (info *RequestInfo) addDiscovery(d time.Duration) {
+	if info == nil {
+		return
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.details.Discovery += d
+}
@@ -0,0 +1,42 @@
+package codeassist
+
+import (
+	"context"
+	"sync"
+
+	"gcli2api/internal/auth"
+)
+
+// TokenCheck is the outcome of a forced token refresh for one credential.
+type TokenCheck struct {
+	Credential string
+	Err        error
+}
+
+// CheckTokens forces one token refresh per credential source, concurrently,
+// and returns the results in source order. A failure usually means the
+// refresh token was revoked or issued for a different client id/secret.
+func (mc *MultiClient) CheckTokens(ctx context.Context) []TokenCheck {
+	out := make([]TokenCheck, len(mc.sources))
+	var wg sync.WaitGroup
+	for i, st := range mc.sources {
+		out[i].Credential = mc.sourceName(st.path)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out[i].Err = auth.EnsureFresh(ctx, mc.oauthCfg, st.ts)
+		}()
+	}
+	wg.Wait()
+	return out
+}
+
+// sourceName returns the display name of the first unit built from path.
+func (mc *MultiClient) sourceName(path string) string {
+	for _, e := range mc.entries {
+		if e.path == path {
+			return e.displayName()
+		}
+	}
+	return path
+}
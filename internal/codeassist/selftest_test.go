@@ -0,0 +1,57 @@
+package codeassist
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gcli2api/internal/auth"
+	"golang.org/x/oauth2"
+)
+
+func TestMultiClient_CheckTokens(t *testing.T) {
+	var refreshes atomic.Int32
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		refreshes.Add(1)
+		if r.Form.Get("refresh_token") != "good" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"unauthorized_client"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"fresh","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer tokenSrv.Close()
+
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Endpoint: oauth2.Endpoint{TokenURL: tokenSrv.URL, AuthStyle: oauth2.AuthStyleInParams}}
+	// Both access tokens are still valid, so only a forced refresh reaches the endpoint.
+	valid := time.Now().Add(time.Hour).UnixMilli()
+	sources := []CredSource{
+		{Path: "a.json", Name: "alpha", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "good", ExpiryDateMS: valid}},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "bad", ExpiryDateMS: valid}},
+	}
+	mc, err := NewMultiClient(oauthCfg, sources, 0, time.Millisecond, nil, nil, nil, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	got := mc.CheckTokens(context.Background())
+	if refreshes.Load() != 2 || len(got) != 2 {
+		t.Fatalf("expected 2 forced refreshes and results, got %d and %+v", refreshes.Load(), got)
+	}
+	if got[0].Credential != "alpha" || got[0].Err != nil {
+		t.Fatalf("expected alpha to refresh, got %+v", got[0])
+	}
+	if got[1].Err == nil || !strings.Contains(got[1].Err.Error(), "unauthorized_client") {
+		t.Fatalf("expected b.json to fail, got %+v", got[1])
+	}
+	tok, err := mc.sources[0].ts.Token()
+	if err != nil || tok.AccessToken != "fresh" {
+		t.Fatalf("expected refreshed token adopted, got %v %v", tok, err)
+	}
+}
@@ -0,0 +1,81 @@
+package codeassist
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"gcli2api/internal/auth"
+)
+
+// pendingOnboarding answers discovery as an account whose onboarding never
+// completes, signalling polled on every onboardUser call.
+func pendingOnboarding(polled chan<- struct{}) rtFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(r.URL.Path, ":loadCodeAssist") {
+			return resp(200, `{"allowedTiers":[{"id":"free-tier","isDefault":true}]}`, ""), nil
+		}
+		select {
+		case polled <- struct{}{}:
+		default:
+		}
+		return resp(200, `{"done":false}`, ""), nil
+	}
+}
+
+func TestDiscoverProject_CancelDuringOnboardingPoll(t *testing.T) {
+	polled := make(chan struct{}, 1)
+	c := NewCaClient(mkClient(pendingOnboarding(polled)), 0, time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := c.DiscoverProject(ctx, "")
+		done <- err
+	}()
+	<-polled
+	start := time.Now()
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+		if d := time.Since(start); d > 500*time.Millisecond {
+			t.Fatalf("discovery took %v to notice cancellation", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("discovery did not return after cancellation")
+	}
+}
+
+func TestMultiClient_CloseAbortsDiscovery(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}}}
+	mc, err := NewMultiClient(oauthCfg, sources, 0, time.Millisecond, nil, nil, nil, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	polled := make(chan struct{}, 1)
+	mc.entries[0].ca = NewCaClient(mkClient(pendingOnboarding(polled)), 0, time.Millisecond)
+	done := make(chan error, 1)
+	go func() {
+		_, err := mc.getOrDiscoverProjectID(context.Background(), mc.entries[0])
+		done <- err
+	}()
+	<-polled
+	mc.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not abort discovery")
+	}
+}
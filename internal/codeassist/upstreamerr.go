@@ -0,0 +1,120 @@
+package codeassist
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// UpstreamError is a non-2xx answer to a generation call. Its message keeps
+// the "upstream status <code>: <body>" form that error classification
+// matches on.
+type UpstreamError struct {
+	StatusCode int
+	Body       string
+	// RetryAfter is upstream's retry hint, from the Retry-After header or a
+	// google.rpc.RetryInfo error detail; zero when absent.
+	RetryAfter time.Duration
+	// RateLimit holds upstream's X-RateLimit-* headers, if any.
+	RateLimit http.Header
+	// Status is the google.rpc status of a Google API error body (e.g.
+	// "FAILED_PRECONDITION") and Reason its google.rpc.ErrorInfo reason
+	// (e.g. "SERVICE_DISABLED"); either is empty when absent.
+	Status string
+	Reason string
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("upstream status %d: %s", e.StatusCode, e.Body)
+}
+
+// transportError is a generation call that failed before any HTTP response
+// arrived, such as a refused connection or a failed TLS handshake. Failures
+// while reading a response body are not wrapped.
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string { return e.err.Error() }
+func (e *transportError) Unwrap() error { return e.err }
+
+// upstreamStatus returns the HTTP status of the UpstreamError in err's chain,
+// or zero when the call failed without an HTTP answer.
+func upstreamStatus(err error) int {
+	var ue *UpstreamError
+	if errors.As(err, &ue) {
+		return ue.StatusCode
+	}
+	return 0
+}
+
+// newUpstreamError builds an UpstreamError from a failed response and its
+// (already read) body.
+func newUpstreamError(resp *http.Response, body []byte) *UpstreamError {
+	e := &UpstreamError{StatusCode: resp.StatusCode, Body: string(body)}
+	e.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	if e.RetryAfter == 0 {
+		e.RetryAfter = retryDelayFromBody(body)
+	}
+	e.Status, e.Reason = statusFromBody(body)
+	for k, v := range resp.Header {
+		if strings.HasPrefix(http.CanonicalHeaderKey(k), "X-Ratelimit-") {
+			if e.RateLimit == nil {
+				e.RateLimit = http.Header{}
+			}
+			e.RateLimit[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+	return e
+}
+
+// statusFromBody extracts the status and the first google.rpc.ErrorInfo
+// reason from a Google API error body.
+func statusFromBody(b []byte) (status, reason string) {
+	var body struct {
+		Error struct {
+			Status  string `json:"status"`
+			Details []struct {
+				Type   string `json:"@type"`
+				Reason string `json:"reason"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(b, &body) != nil {
+		return "", ""
+	}
+	for _, d := range body.Error.Details {
+		if strings.HasSuffix(d.Type, "google.rpc.ErrorInfo") && d.Reason != "" {
+			reason = d.Reason
+			break
+		}
+	}
+	return body.Error.Status, reason
+}
+
+// retryDelayFromBody extracts the retryDelay of a google.rpc.RetryInfo detail
+// (e.g. "31s") from a Google API error body. It returns zero when absent.
+func retryDelayFromBody(b []byte) time.Duration {
+	var body struct {
+		Error struct {
+			Details []struct {
+				Type       string `json:"@type"`
+				RetryDelay string `json:"retryDelay"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(b, &body) != nil {
+		return 0
+	}
+	for _, d := range body.Error.Details {
+		if strings.HasSuffix(d.Type, "google.rpc.RetryInfo") && d.RetryDelay != "" {
+			if v, err := time.ParseDuration(d.RetryDelay); err == nil && v > 0 {
+				return v
+			}
+		}
+	}
+	return 0
+}
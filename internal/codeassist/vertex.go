@@ -0,0 +1,49 @@
+package codeassist
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"gcli2api/internal/gemini"
+)
+
+// vertexBaseURL returns the Vertex AI API host for a location; "global" uses
+// the non-regional host.
+func vertexBaseURL(location string) string {
+	if location == "global" {
+		return "https://aiplatform.googleapis.com"
+	}
+	return fmt.Sprintf("https://%s-aiplatform.googleapis.com", location)
+}
+
+// SetVertex points generation calls at the Vertex AI publisher model
+// endpoint in location instead of Code Assist. Vertex takes the bare Gemini
+// request and returns bare responses, and needs an explicit project since
+// there is no discovery. An empty location keeps Code Assist.
+func (c *CaClient) SetVertex(location string) {
+	if location == "" {
+		return
+	}
+	c.vertexLocation = location
+	c.baseURL = vertexBaseURL(location)
+}
+
+// generationURL returns the endpoint for a generation method on the
+// configured backend.
+func (c *CaClient) generationURL(model, project, method string) string {
+	if c.vertexLocation == "" {
+		return fmt.Sprintf("%s/%s:%s", c.baseURL, c.apiVersion, method)
+	}
+	return fmt.Sprintf("%s/v1/projects/%s/locations/%s/publishers/google/models/%s:%s",
+		c.baseURL, url.PathEscape(project), url.PathEscape(c.vertexLocation), url.PathEscape(model), method)
+}
+
+// generationBody encodes req for the configured backend: wrapped in the Code
+// Assist envelope, or as-is for Vertex.
+func (c *CaClient) generationBody(model, project string, req gemini.GeminiRequest) ([]byte, error) {
+	if c.vertexLocation != "" {
+		return json.Marshal(&req)
+	}
+	return json.Marshal(CodeAssistRequest{Model: model, Project: project, Request: req})
+}
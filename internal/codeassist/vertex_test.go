@@ -0,0 +1,77 @@
+package codeassist
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"gcli2api/internal/auth"
+	"gcli2api/internal/gemini"
+)
+
+func TestVertex_RequestAndResponseMapping(t *testing.T) {
+	var urls []string
+	var bodies []map[string]any
+	rt := rtFunc(func(r *http.Request) (*http.Response, error) {
+		urls = append(urls, r.URL.String())
+		var m map[string]any
+		b, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(b, &m)
+		bodies = append(bodies, m)
+		if strings.Contains(r.URL.Path, "streamGenerateContent") {
+			return resp(200, "data: {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"s\"}]}}]}\n\n", "text/event-stream"), nil
+		}
+		return resp(200, `{"candidates":[{"content":{"parts":[{"text":"u"}]}}],"modelVersion":"gemini-2.5-flash-001"}`, ""), nil
+	})
+	c := NewCaClient(mkClient(rt), 0, time.Millisecond)
+	c.SetVertex("europe-west4")
+	req := gemini.GeminiRequest{Contents: []gemini.GeminiContent{{Role: "user", Parts: []gemini.GeminiPart{{Text: "hi"}}}}}
+
+	got, err := c.GenerateContent(context.Background(), "gemini-2.5-flash", "my-proj", req)
+	if err != nil {
+		t.Fatalf("unary: %v", err)
+	}
+	if got.Candidates[0].Content.Parts[0].Text != "u" || got.ModelVersion != "gemini-2.5-flash-001" {
+		t.Fatalf("unexpected unary response: %+v", got)
+	}
+	out, errs := c.GenerateContentStream(context.Background(), "gemini-2.5-flash", "my-proj", req)
+	var texts []string
+	for g := range out {
+		texts = append(texts, g.Candidates[0].Content.Parts[0].Text)
+	}
+	if err := <-errs; err != nil || len(texts) != 1 || texts[0] != "s" {
+		t.Fatalf("stream: texts=%v err=%v", texts, err)
+	}
+
+	base := "https://europe-west4-aiplatform.googleapis.com/v1/projects/my-proj/locations/europe-west4/publishers/google/models/gemini-2.5-flash"
+	if len(urls) != 2 || urls[0] != base+":generateContent" || urls[1] != base+":streamGenerateContent?alt=sse" {
+		t.Fatalf("unexpected urls: %v", urls)
+	}
+	for _, b := range bodies {
+		if _, ok := b["contents"]; !ok || b["project"] != nil || b["request"] != nil {
+			t.Fatalf("expected bare Gemini request body, got %v", b)
+		}
+	}
+}
+
+func TestMultiClient_VertexNeedsProject(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}, VertexLocation: "us-central1"}}
+	if _, err := NewMultiClient(oauthCfg, sources, 0, time.Millisecond, nil, nil, nil, MultiClientOptions{}); err == nil {
+		t.Fatal("expected error for vertex credential without projects")
+	}
+	mc, err := NewMultiClient(oauthCfg, sources, 0, time.Millisecond, nil, nil, map[string][]string{"a.json": {"p1"}}, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	if mc.entries[0].ca.vertexLocation != "us-central1" {
+		t.Fatalf("vertex location not applied")
+	}
+}
@@ -0,0 +1,47 @@
+package codeassist
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// WarmProjects resolves the project of every discovery unit ahead of the
+// first request, one unit at a time. It first sleeps a random duration in
+// [0, jitter) so replicas started together stagger their onboarding calls;
+// units already in the project cache are resolved without upstream calls.
+// It returns early when ctx is done or the client is closed.
+func (mc *MultiClient) WarmProjects(ctx context.Context, jitter time.Duration) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(mc.closing, cancel)()
+	if jitter > 0 {
+		delay := time.Duration(rand.Int63n(int64(jitter)))
+		logrus.Infof("[MultiClient] warming projects in %s", delay.Round(time.Millisecond))
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+	warmed, failed := 0, 0
+	for _, e := range mc.entries {
+		if !e.discovery {
+			continue
+		}
+		if _, err := mc.getOrDiscoverProjectID(ctx, e); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failed++
+			logrus.Warnf("[MultiClient] warm-up discovery failed for %s: %v", e.displayName(), err)
+			continue
+		}
+		warmed++
+	}
+	logrus.Infof("[MultiClient] project warm-up done: %d resolved, %d failed", warmed, failed)
+}
@@ -0,0 +1,141 @@
+package codeassist
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gcli2api/internal/auth"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+func TestMultiClient_WarmProjects(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}},
+	}
+	projectMap := map[string][]string{"b.json": {"configured"}}
+	mc, err := NewMultiClient(oauthCfg, sources, 0, time.Millisecond, nil, nil, projectMap, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	var calls atomic.Int32
+	for _, e := range mc.entries {
+		e.ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+			calls.Add(1)
+			if strings.HasSuffix(r.URL.Path, ":loadCodeAssist") {
+				return resp(200, `{"cloudaicompanionProject":"p1","currentTier":{"id":"free-tier"}}`, ""), nil
+			}
+			return resp(404, "unexpected", "text/plain"), nil
+		})), 0, time.Millisecond)
+	}
+	start := time.Now()
+	mc.WarmProjects(context.Background(), 20*time.Millisecond)
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("warm-up took too long")
+	}
+	if got := mc.Credentials()[0].Project; got != "p1" {
+		t.Fatalf("discovery unit not warmed: project %q", got)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected one discovery call (configured units skipped), got %d", calls.Load())
+	}
+
+	// A closed client stops during the jitter wait
+	mc.Close()
+	done := make(chan struct{})
+	go func() {
+		mc.WarmProjects(context.Background(), time.Hour)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("warm-up ignored Close")
+	}
+}
+
+func TestMultiClient_KeepWarmPingsIdleCredentials(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}},
+	}
+	// a.json has two units sharing one client; it must be pinged once
+	projectMap := map[string][]string{"a.json": {"p1", "p2"}}
+	mc, err := NewMultiClient(oauthCfg, sources, 0, time.Millisecond, nil, nil, projectMap, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	var pings [2]atomic.Int32
+	clients := make([]*CaClient, 2)
+	for i := range clients {
+		clients[i] = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+			if r.Method != http.MethodHead {
+				return resp(404, "unexpected", "text/plain"), nil
+			}
+			pings[i].Add(1)
+			return resp(404, "", "text/plain"), nil
+		})), 0, time.Millisecond)
+	}
+	mc.entries[0].ca, mc.entries[1].ca, mc.entries[2].ca = clients[0], clients[0], clients[1]
+
+	mc.pingIdle(context.Background(), time.Minute, 0)
+	if pings[0].Load() != 1 || pings[1].Load() != 1 {
+		t.Fatalf("expected one ping per credential, got %d/%d", pings[0].Load(), pings[1].Load())
+	}
+	// A credential used within the interval is already warm
+	mc.entries[1].lastAttempt.Store(time.Now().UnixNano())
+	mc.pingIdle(context.Background(), time.Minute, 0)
+	if pings[0].Load() != 1 || pings[1].Load() != 2 {
+		t.Fatalf("expected only the idle credential pinged, got %d/%d", pings[0].Load(), pings[1].Load())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		mc.KeepWarm(context.Background(), time.Hour, 0)
+		close(done)
+	}()
+	mc.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("KeepWarm did not stop on Close")
+	}
+}
+
+func TestMultiClient_KeepWarmMaxPings(t *testing.T) {
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	sources := []CredSource{
+		{Path: "a.json", Raw: auth.RawToken{AccessToken: "xa", RefreshToken: "ra"}},
+		{Path: "b.json", Raw: auth.RawToken{AccessToken: "xb", RefreshToken: "rb"}},
+		{Path: "c.json", Raw: auth.RawToken{AccessToken: "xc", RefreshToken: "rc"}},
+	}
+	mc, err := NewMultiClient(oauthCfg, sources, 0, time.Millisecond, nil, nil, nil, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	var pings [3]atomic.Int32
+	for i, e := range mc.entries {
+		e.ca = NewCaClient(mkClient(rtFunc(func(r *http.Request) (*http.Response, error) {
+			pings[i].Add(1)
+			return resp(404, "", "text/plain"), nil
+		})), 0, time.Millisecond)
+	}
+	mc.pingIdle(context.Background(), time.Minute, 2)
+	if n := pings[0].Load() + pings[1].Load() + pings[2].Load(); n != 2 {
+		t.Fatalf("expected 2 pings under the cap, got %d", n)
+	}
+	mc.pingIdle(context.Background(), time.Minute, 2)
+	for i := range pings {
+		if pings[i].Load() == 0 {
+			t.Fatalf("credential %d never pinged across two intervals", i)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package codeassist
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"gcli2api/internal/auth"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// sourceToken ties a credential source path to its token source.
+type sourceToken struct {
+	// path is the expanded file path, or "<path>#<name>" for an entry of a
+	// combined credentials file.
+	path string
+	ts   *auth.PersistingTokenSource
+}
+
+// fileState is the stat fingerprint used to detect rewrites.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// WatchCredentialFiles polls credential files every interval and reloads a
+// source's token when its file is rewritten externally (e.g. by another tool
+// refreshing it). Reloads never replace a fresher in-memory token; see
+// auth.PersistingTokenSource.Reload. The project cache key of a unit keeps
+// using its original refresh token. Runs until ctx is done.
+func (mc *MultiClient) WatchCredentialFiles(ctx context.Context, interval time.Duration) {
+	states := map[string]fileState{}
+	for _, st := range mc.sources {
+		file, _ := splitSourcePath(st.path)
+		if fi, err := os.Stat(file); err == nil {
+			states[file] = fileState{fi.ModTime(), fi.Size()}
+		}
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				mc.pollCredentialFiles(states)
+			}
+		}
+	}()
+}
+
+// pollCredentialFiles reloads the sources of every file whose fingerprint
+// changed since the last poll.
+func (mc *MultiClient) pollCredentialFiles(states map[string]fileState) {
+	changed := map[string]bool{}
+	for _, st := range mc.sources {
+		file, _ := splitSourcePath(st.path)
+		if _, seen := changed[file]; seen {
+			continue
+		}
+		fi, err := os.Stat(file)
+		if err != nil {
+			changed[file] = false
+			continue
+		}
+		cur := fileState{fi.ModTime(), fi.Size()}
+		changed[file] = states[file] != cur
+		states[file] = cur
+	}
+	for file, ok := range changed {
+		if ok {
+			mc.reloadCredentialFile(file)
+		}
+	}
+}
+
+// reloadCredentialFile re-reads file and offers each token to the matching source.
+func (mc *MultiClient) reloadCredentialFile(file string) {
+	entries, _, combined, err := auth.LoadRawTokensFromFile(file)
+	if err != nil {
+		logrus.Warnf("[MultiClient] credential file %s changed but could not be loaded: %v", file, err)
+		return
+	}
+	byName := make(map[string]auth.RawToken, len(entries))
+	for _, ce := range entries {
+		byName[ce.Name] = ce.Raw
+	}
+	newBase := func(tok *oauth2.Token) oauth2.TokenSource {
+		return mc.oauthCfg.TokenSource(context.Background(), tok)
+	}
+	for _, st := range mc.sources {
+		f, name := splitSourcePath(st.path)
+		if f != file || (name != "") != combined {
+			continue
+		}
+		rt, ok := byName[name]
+		if !ok || rt.RefreshToken == "" {
+			continue
+		}
+		if st.ts.Reload(rt, newBase) {
+			logrus.Infof("[MultiClient] reloaded credential %s after external change", st.path)
+		}
+	}
+}
+
+// splitSourcePath splits "<path>#<name>" into file path and entry name.
+func splitSourcePath(p string) (file, name string) {
+	if i := strings.LastIndex(p, "#"); i > 0 {
+		return p[:i], p[i+1:]
+	}
+	return p, ""
+}
@@ -0,0 +1,48 @@
+package codeassist
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gcli2api/internal/auth"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+func TestPollCredentialFiles_ReloadsExternalChange(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "creds.json")
+	expiry := time.Now().Add(time.Hour).UnixMilli()
+	initial := auth.RawToken{AccessToken: "a1", RefreshToken: "r1", TokenType: "Bearer", ExpiryDateMS: expiry}
+	if err := auth.SaveRawTokenAtomic(path, initial); err != nil {
+		t.Fatalf("write creds: %v", err)
+	}
+	oauthCfg := oauth2.Config{ClientID: "test", ClientSecret: "s", Scopes: []string{"s"}, Endpoint: google.Endpoint}
+	mc, err := NewMultiClient(oauthCfg, []CredSource{{Path: path, Raw: initial, Persist: true}}, 0, time.Millisecond, nil, nil, nil, MultiClientOptions{})
+	if err != nil {
+		t.Fatalf("init multiclient: %v", err)
+	}
+	states := map[string]fileState{}
+	mc.pollCredentialFiles(states)
+
+	// Another tool re-authenticates and rewrites the file
+	updated := auth.RawToken{AccessToken: "a2", RefreshToken: "r2", TokenType: "Bearer", ExpiryDateMS: expiry}
+	if err := auth.SaveRawTokenAtomic(path, updated); err != nil {
+		t.Fatalf("rewrite creds: %v", err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	mc.pollCredentialFiles(states)
+
+	tok, err := mc.sources[0].ts.Token()
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+	if tok.AccessToken != "a2" || tok.RefreshToken != "r2" {
+		t.Fatalf("expected reloaded token, got access=%q refresh=%q", tok.AccessToken, tok.RefreshToken)
+	}
+}
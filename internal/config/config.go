@@ -2,13 +2,21 @@ package config
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"maps"
+	"net"
 	"net/url"
 	"os"
 	"reflect"
+	"regexp"
+	"slices"
+	"sort"
 	"strings"
 
+	"gcli2api/internal/gemini"
 	"gcli2api/internal/utils"
 	"github.com/sirupsen/logrus"
 	json5 "github.com/yosuke-furukawa/json5/encoding/json5"
@@ -25,6 +33,31 @@ type Config struct {
 	GeminiCredsFilePaths []string `json:"geminiOauthCredsFiles"`
 	// Optional user agent for upstream requests; if empty, a default is used.
 	UserAgent string `json:"userAgent"`
+	// SelfTestOnStartup forces one token refresh per credential at startup
+	// and logs which ones fail, catching revoked tokens or client id/secret
+	// mismatches before the first request.
+	SelfTestOnStartup bool `json:"selfTestOnStartup"`
+	// SelfTestStrict makes the server exit when every credential fails the
+	// startup self-test.
+	SelfTestStrict bool `json:"selfTestStrict"`
+	// WarmOnStartup resolves the projects of discovery units in the
+	// background at startup instead of on their first request.
+	WarmOnStartup bool `json:"warmOnStartup"`
+	// DiscoveryWarmJitterMs delays the warm-up by a random 0 to this many
+	// milliseconds, so replicas deployed together stagger their discovery.
+	DiscoveryWarmJitterMs int `json:"discoveryWarmJitterMs"`
+	// KeepWarmSeconds pings each credential's upstream connection pool with
+	// a lightweight HEAD request when it has been idle this long, so bursts
+	// after quiet periods skip the TLS handshake. Zero disables the pinger.
+	KeepWarmSeconds int `json:"keepWarmSeconds"`
+	// KeepWarmMaxPings caps the pings sent per keep-warm interval; idle
+	// credentials pinged least recently go first. If zero, a default of 8
+	// is applied.
+	KeepWarmMaxPings int `json:"keepWarmMaxPings"`
+	// StrictConfig rejects unknown top-level config keys. Nil keeps the
+	// default (strict); false downgrades unknown keys to warnings so a config
+	// written for a newer build still loads during rolling upgrades.
+	StrictConfig *bool `json:"strictConfig"`
 	// ProjectIds maps a credential path to an ordered list of project IDs.
 	// Keys must match one of the entries in geminiOauthCredsFiles after ~ expansion.
 	// If a key exists with an empty list, it is treated as not configured and
@@ -33,17 +66,492 @@ type Config struct {
 	RequestMaxRetries      int                 `json:"requestMaxRetries"`
 	RequestBaseDelayMillis int                 `json:"requestBaseDelay"`
 	SQLitePath             string              `json:"sqlitePath"`
+	// MaxRotations lets a request try up to this many distinct credential/project
+	// units (each once) even when requestMaxRetries is smaller. Zero disables it.
+	MaxRotations int `json:"maxRotations"`
+	// DedupeProjectIds keeps only the first unit of a project id listed more
+	// than once in projectIds (across or within credentials). Duplicates are
+	// warned about either way.
+	DedupeProjectIds bool `json:"dedupeProjectIds"`
+	// RetryOnEmptyCandidates rotates non-streaming requests to another unit
+	// when upstream answers 200 with no candidates (and no safety block),
+	// within the retry budget.
+	RetryOnEmptyCandidates bool `json:"retryOnEmptyCandidates"`
+	// NonRetryableReasons lists upstream error statuses (e.g.
+	// "FAILED_PRECONDITION") or google.rpc.ErrorInfo reasons (e.g.
+	// "SERVICE_DISABLED"), case-insensitive, that are permanent: matching
+	// errors are returned at once instead of rotating across credentials.
+	NonRetryableReasons []string `json:"nonRetryableReasons"`
+	// RotationBackoffMillis is the base delay before rotating to another
+	// credential/project unit, doubled per rotation with jitter. Zero rotates
+	// immediately.
+	RotationBackoffMillis int `json:"rotationBackoffMillis"`
+	// RotationBackoffMaxMillis caps the rotation delay. If zero, a default of
+	// 2000 is applied.
+	RotationBackoffMaxMillis int `json:"rotationBackoffMaxMillis"`
+	// RotationStrategy picks the first unit for each request: "round-robin"
+	// (default) or "health", which favours units with a better recent success
+	// rate while still probing degraded ones now and then.
+	RotationStrategy string `json:"rotationStrategy"`
+	// WatchCredentialFiles polls credential files and reloads tokens that are
+	// rewritten externally (e.g. by another tool refreshing them).
+	WatchCredentialFiles bool `json:"watchCredentialFiles"`
+	// CredentialWatchIntervalSeconds is the polling interval for
+	// watchCredentialFiles. If zero, a default of 10 seconds is applied.
+	CredentialWatchIntervalSeconds int `json:"credentialWatchIntervalSeconds"`
+	// DiscoveryTransportRetries is the transport retry budget for project
+	// discovery/onboarding calls. Nil keeps the default (2); 0 fails fast.
+	DiscoveryTransportRetries *int `json:"discoveryTransportRetries"`
+	// DiscoveryBaseDelayMillis is the backoff base delay for those retries.
+	// If zero, requestBaseDelay is used.
+	DiscoveryBaseDelayMillis int `json:"discoveryBaseDelay"`
+	// DiscoveryTimeoutSeconds bounds one project discovery, including
+	// onboarding polls and waits on rate-limited (429) discovery calls,
+	// which honor Retry-After. If zero, a default of 120 seconds is applied.
+	DiscoveryTimeoutSeconds int `json:"discoveryTimeoutSeconds"`
+	// MaxDiscoveryAttemptsPerRequest caps how many credentials a single
+	// request without a project may run project discovery for; after that
+	// only units with a known project id are tried. This bounds the latency
+	// of requests against a cold pool. Zero is unlimited.
+	MaxDiscoveryAttemptsPerRequest int `json:"maxDiscoveryAttemptsPerRequest"`
+	// CredentialTiers marks credentials (keyed like projectIds) as "primary"
+	// (default), "backup" or "shadow". Backup units are only tried after
+	// every primary unit has failed for a request; shadow units serve only
+	// shadowModel calls.
+	CredentialTiers map[string]string `json:"credentialTiers"`
+	// CredentialTimeouts overrides, per credential (keyed like projectIds), the
+	// timeout in seconds for each upstream call made with that credential.
+	// Unlisted credentials are bounded only by the request deadline.
+	CredentialTimeouts map[string]int `json:"credentialTimeouts"`
+	// DailyRequestCap is the most upstream requests each credential may make
+	// per UTC day (counted in the state store); capped credentials are
+	// skipped until the next day. Zero is unlimited.
+	DailyRequestCap int `json:"dailyRequestCap"`
+	// CredentialDailyRequestCaps overrides dailyRequestCap per credential
+	// (keyed like projectIds).
+	CredentialDailyRequestCaps map[string]int `json:"credentialDailyRequestCaps"`
+	// CredentialBackends selects, per credential (keyed like projectIds), the
+	// upstream API: "codeassist" (default) or "vertex". Vertex credentials
+	// need explicit projectIds under the same key since discovery is Code
+	// Assist only.
+	CredentialBackends map[string]string `json:"credentialBackends"`
+	// VertexLocation is the Vertex AI region (or "global") used by vertex
+	// credentials. If empty, "us-central1" is applied.
+	VertexLocation string `json:"vertexLocation"`
+	// CredentialNames assigns a friendly name per credential (keyed like
+	// projectIds) used in logs and admin output instead of the file path.
+	CredentialNames map[string]string `json:"credentialNames"`
+	// PriorityOrder lists credentials (paths keyed like projectIds, or
+	// credentialNames) to try first, in this order, e.g. during a
+	// maintenance window. Unlisted credentials follow in round-robin order.
+	// Empty keeps plain round-robin.
+	PriorityOrder []string `json:"priorityOrder"`
 	// Proxy is an optional upstream proxy URL. Must be http or socks5.
 	// Example: "http://127.0.0.1:8080" or "socks5://127.0.0.1:1080"
 	Proxy string `json:"proxy"`
+	// FailFastOnProxy makes the startup proxy TCP check synchronous and aborts
+	// startup when the proxy is unreachable. By default the check is async and
+	// only logs a warning.
+	FailFastOnProxy bool `json:"failFastOnProxy"`
+	// ProxyCheckIntervalSeconds is how often the proxy is re-probed for /readyz.
+	// If zero, a default of 30 seconds is applied.
+	ProxyCheckIntervalSeconds int `json:"proxyCheckIntervalSeconds"`
 	// RequestMaxBodyBytes limits incoming request size to mitigate DoS via large payloads.
-	// If zero, a safe default is applied.
+	// If zero, a safe default is applied. -1 disables the limit entirely; only do
+	// that for trusted clients.
 	RequestMaxBodyBytes int64 `json:"requestMaxBodyBytes"`
+	// MaxResponseBytes caps the size of each upstream generation response;
+	// unary calls fail and streams end with an error event past it. Zero
+	// means unlimited.
+	MaxResponseBytes int64 `json:"maxResponseBytes"`
 	// MaxConcurrentRequests limits concurrent in-flight requests for lightweight backpressure.
+	// Only the /v1beta/models routes count; probes, cancels and admin do not.
 	// If zero, a default value is applied.
 	MaxConcurrentRequests int `json:"maxConcurrentRequests"`
+	// QueueTimeoutMillis lets requests over maxConcurrentRequests wait up to
+	// this long for a slot before getting 429. Zero rejects them immediately.
+	QueueTimeoutMillis int `json:"queueTimeoutMillis"`
+	// PerModelConcurrency caps concurrent requests per model (e.g.
+	// {"gemini-2.5-pro": 4}) on top of maxConcurrentRequests; requests over
+	// a model's limit get 429. Models not listed are only globally limited.
+	PerModelConcurrency map[string]int `json:"perModelConcurrency"`
+	// LogRequestsToDb records one request_log row per generation request
+	// (credential, model, status, token usage, latency) in the SQLite store.
+	LogRequestsToDb bool `json:"logRequestsToDb"`
+	// RequestLogRetentionDays prunes request_log rows older than this many days
+	// on startup. Zero keeps rows indefinitely.
+	RequestLogRetentionDays int `json:"requestLogRetentionDays"`
+	// StateRetentionDays enables cleanup of state rows (project mappings not
+	// used and request logs older than this many days). Zero disables cleanup.
+	StateRetentionDays int `json:"stateRetentionDays"`
+	// StateCleanupIntervalMinutes repeats the cleanup periodically while the
+	// server runs. Zero runs it at startup only.
+	StateCleanupIntervalMinutes int `json:"stateCleanupIntervalMinutes"`
+	// StateVacuumThresholdMB checkpoints the WAL and vacuums the database during
+	// cleanup once it grows beyond this size. Zero never vacuums.
+	StateVacuumThresholdMB int `json:"stateVacuumThresholdMB"`
+	// MockUpstream serves canned echo responses without any upstream calls
+	// (no credentials needed). Intended for load tests and demos.
+	MockUpstream bool `json:"mockUpstream"`
+	// MockLatencyMillis adds artificial latency to mock responses (per chunk when streaming).
+	MockLatencyMillis int `json:"mockLatencyMillis"`
+	// DebugHeaders enables debug-only request headers such as X-Credential-Index
+	// (pin a request to one pool unit). Keep disabled in production.
+	DebugHeaders bool `json:"debugHeaders"`
+	// CredentialHeaders adds X-Credential-Used, X-Project-Used and X-Attempts
+	// response headers naming the pool unit that served the request. They
+	// reveal credential names, so they are off by default.
+	CredentialHeaders bool `json:"credentialHeaders"`
+	// VersionRequiresAuth guards /version with authKey. By default it is
+	// public so deployments can be checked without credentials.
+	VersionRequiresAuth bool `json:"versionRequiresAuth"`
+	// RoutePrefix mounts every route of the main listener under this path
+	// (e.g. "/gemini"), for shared ingresses without path rewriting. It must
+	// start with "/" and have no trailing slash. The adminListen listener is
+	// not affected.
+	RoutePrefix string `json:"routePrefix"`
+	// RoutePrefixExemptProbes also serves /health and /readyz without
+	// routePrefix, for orchestrator probes that hit the pod directly.
+	RoutePrefixExemptProbes bool `json:"routePrefixExemptProbes"`
+	// TLSCertFile and TLSKeyFile (PEM) serve the main listener over HTTPS.
+	// Both or neither must be set.
+	TLSCertFile string `json:"tlsCertFile"`
+	TLSKeyFile  string `json:"tlsKeyFile"`
+	// InboundTLSMinVersion is the lowest TLS version the HTTPS listener
+	// accepts: "1.2" or "1.3". If empty, a default of "1.2" is applied.
+	InboundTLSMinVersion string `json:"inboundTlsMinVersion"`
+	// InboundClientCAFile (PEM) makes the HTTPS listener require client
+	// certificates signed by one of these CAs (mutual TLS). Needs
+	// tlsCertFile.
+	InboundClientCAFile string `json:"inboundClientCAFile"`
+	// MTLSOnly lets authKey be empty when inboundClientCAFile is set, so a
+	// verified client certificate is the only authentication. With authKey
+	// set, both are required.
+	MTLSOnly bool `json:"mtlsOnly"`
+	// RejectHTTP10 answers HTTP/1.0 requests with 505.
+	RejectHTTP10 bool `json:"rejectHttp10"`
+	// AdminListen serves /admin/* and /metrics on a dedicated listener at
+	// this address (e.g. "127.0.0.1:9090") instead of the main one.
+	AdminListen string `json:"adminListen"`
+	// AdminOnPublicListener keeps /admin/* and /metrics on the main
+	// listener when adminListen is unset and host is not loopback. Without
+	// it those routes are not served publicly.
+	AdminOnPublicListener bool `json:"adminOnPublicListener"`
+	// MetricsAuthKey, when set, is required by /admin/* and /metrics
+	// instead of authKey.
+	MetricsAuthKey string `json:"metricsAuthKey"`
+	// StartPaused starts the proxy in maintenance mode: generation requests
+	// get 503 until POST /admin/resume. /health and /admin keep working.
+	StartPaused bool `json:"startPaused"`
+	// PausedMessage is the error message returned while paused.
+	// If empty, a default of "service paused for maintenance" is applied.
+	PausedMessage string `json:"pausedMessage"`
+	// PausedRetryAfterSeconds is sent as Retry-After on paused responses.
+	// If zero, a default of 60 seconds is applied.
+	PausedRetryAfterSeconds int `json:"pausedRetryAfterSeconds"`
+	// SSEEventName labels streamed data events with "event: <name>". Empty keeps
+	// bare "data:" lines. Error events are always named "error".
+	SSEEventName string `json:"sseEventName"`
+	// SSEDoneEvent emits a final "event: done" / "data: [DONE]" when a stream
+	// completes normally (OpenAI-style consumers).
+	SSEDoneEvent bool `json:"sseDoneEvent"`
+	// CoalesceEmptyParts drops empty text parts from responses and merges
+	// adjacent text parts within each candidate (unary and per streamed chunk).
+	CoalesceEmptyParts bool `json:"coalesceEmptyParts"`
+	// CandidateSelection reduces non-streaming responses with several
+	// candidates to one: "first", or "best" (highest avgLogprobs, falling
+	// back to the first). Empty returns every candidate unchanged.
+	CandidateSelection string `json:"candidateSelection"`
+	// PrettyResponses indents non-streaming generation responses. Clients
+	// can also ask for it per request with ?pretty=1.
+	PrettyResponses bool `json:"prettyResponses"`
+	// ResponseFieldAllowlist, when set, limits generation responses (and
+	// each stream chunk) to these top-level fields, e.g. ["candidates",
+	// "usageMetadata"]. ResponseFieldDenylist instead drops the listed
+	// fields, e.g. ["automaticFunctionCallingHistory"]. Only one may be set.
+	ResponseFieldAllowlist []string `json:"responseFieldAllowlist"`
+	ResponseFieldDenylist  []string `json:"responseFieldDenylist"`
+	// StreamUsagePerChunk attaches the latest cumulative usageMetadata to every
+	// streamed chunk once upstream has reported any. Totals never decrease.
+	StreamUsagePerChunk bool `json:"streamUsagePerChunk"`
+	// FlushEveryNChunks batches SSE flushes to every N chunks. Zero or one
+	// flushes every chunk. Terminal events always flush immediately.
+	FlushEveryNChunks int `json:"flushEveryNChunks"`
+	// FlushIntervalMs bounds how long a batched chunk may wait unflushed when
+	// flushEveryNChunks > 1. Zero waits for the batch to fill.
+	FlushIntervalMs int `json:"flushIntervalMs"`
+	// CoalesceStreamMs merges consecutive text-only stream chunks for up to
+	// this many milliseconds into one SSE event. Chunks with non-text parts
+	// and the final chunk are still sent at once. Zero streams every chunk.
+	CoalesceStreamMs int `json:"coalesceStreamMs"`
+	// EmptyStreamMode decides how a stream that ends cleanly without any
+	// candidate content (e.g. an immediate safety block) is closed: "event"
+	// (default) sends a final "event: empty" carrying the finishReason and
+	// blockReason, "error" sends the "event: error" trailer with code 502,
+	// and "none" just closes the stream.
+	EmptyStreamMode string `json:"emptyStreamMode"`
+	// StreamIdleTimeoutSeconds replaces the server write timeout for streaming
+	// responses: the write deadline is pushed this far ahead at the start of
+	// the stream and on every flush, so long streams are only cut off when
+	// they stall. If zero, a default of 300 seconds is applied.
+	StreamIdleTimeoutSeconds int `json:"streamIdleTimeoutSeconds"`
+	// SlowClientTimeoutSeconds, when positive, bounds how long a single
+	// streaming write may wait for the client to read. A client that falls
+	// this far behind is dropped and the upstream stream canceled. Zero
+	// disables the check.
+	SlowClientTimeoutSeconds int `json:"slowClientTimeoutSeconds"`
+	// StreamBufferChunks is how many chunks of a stream are read ahead from
+	// upstream while the client catches up. With slowClientTimeoutSeconds,
+	// a client that leaves the buffer full that long is also dropped. If
+	// zero, a default of 64 is applied.
+	StreamBufferChunks int `json:"streamBufferChunks"`
+	// ShutdownGraceSeconds is how long a shutdown (SIGINT/SIGTERM) waits for
+	// in-flight requests, including project discovery, before aborting them.
+	// If zero, a default of 30 seconds is applied.
+	ShutdownGraceSeconds int `json:"shutdownGraceSeconds"`
+	// LogFile additionally writes logs to this file, rotated by size. Empty
+	// logs to the console only.
+	LogFile string `json:"logFile"`
+	// LogFileMaxSizeMB is the size at which the log file is rotated.
+	// If zero, a default of 100 MB is applied.
+	LogFileMaxSizeMB int `json:"logFileMaxSizeMB"`
+	// LogFileMaxBackups is how many rotated files (logFile.1, .2, ...) are
+	// kept. If zero, a default of 5 is applied.
+	LogFileMaxBackups int `json:"logFileMaxBackups"`
+	// LogFileOnly stops mirroring logs to the console when logFile is set.
+	LogFileOnly bool `json:"logFileOnly"`
+	// LogSampleRate writes the routine per-attempt MultiClient info logs
+	// (attempt and status=ok lines) for only 1 in N requests. Rotations and
+	// failures are always logged. Zero or one logs every request.
+	LogSampleRate int `json:"logSampleRate"`
+	// ForwardHeaders is an allowlist of client request headers copied onto
+	// upstream generation requests (e.g. "X-Goog-User-Project"). Credentials,
+	// framing and hop-by-hop headers are rejected (see unforwardableHeaders).
+	ForwardHeaders []string `json:"forwardHeaders"`
+	// APIVersion overrides the Code Assist API version path segment
+	// ("v1internal" by default) in case upstream moves to a new version.
+	APIVersion string `json:"apiVersion"`
+	// DiscoveryPluginType overrides the metadata.pluginType sent during
+	// project discovery and onboarding ("GEMINI" by default).
+	DiscoveryPluginType string `json:"discoveryPluginType"`
+	// EnvelopeResponseField overrides the upstream envelope key that wraps
+	// generation responses ("response" by default) in case upstream renames
+	// it.
+	EnvelopeResponseField string `json:"envelopeResponseField"`
+	// UserProject is sent upstream as X-Goog-User-Project for quota attribution
+	// unless the client supplies an allowlisted value of its own.
+	UserProject string `json:"userProject"`
+	// ForceHeaderOverride lets X-Gemini-Temperature / X-Gemini-Max-Output-Tokens
+	// replace values already present in the request body.
+	ForceHeaderOverride bool `json:"forceHeaderOverride"`
+	// MaxContents caps the number of contents entries per request. Zero disables the cap.
+	MaxContents int `json:"maxContents"`
+	// MaxContentsMode is "reject" (default, 400) or "trim" (keep the most recent entries).
+	MaxContentsMode string `json:"maxContentsMode"`
+	// MaxPartsPerContent caps the parts of each contents entry (and of
+	// systemInstruction); requests over it get 400. Zero disables the cap.
+	MaxPartsPerContent int `json:"maxPartsPerContent"`
+	// AllowedMimeTypes restricts inlineData/fileData parts to these MIME
+	// types (e.g. "image/png", or "image/*"); others get 400. Empty allows
+	// every type.
+	AllowedMimeTypes []string `json:"allowedMimeTypes"`
+	// ContentFilters lists regular expressions (Go RE2 syntax) matched against
+	// request text parts before they are forwarded, e.g. to keep PII from
+	// reaching upstream. Empty disables filtering.
+	ContentFilters []string `json:"contentFilters"`
+	// ContentFilterMode is "redact" (default: matches become [REDACTED]) or
+	// "reject" (the request fails with 400).
+	ContentFilterMode string `json:"contentFilterMode"`
+	// ValidateModelCapabilities rejects requests with image parts for models
+	// without vision support with a 400 before they reach upstream. Nil
+	// keeps the default (on).
+	ValidateModelCapabilities *bool `json:"validateModelCapabilities"`
+	// TextOnlyModels marks models (aliases allowed) as not accepting image
+	// input, overriding the built-in model metadata for
+	// validateModelCapabilities.
+	TextOnlyModels []string `json:"textOnlyModels"`
+	// AllowedModels restricts the served models to this subset of the
+	// supported ones (aliases accepted). Empty serves every supported model.
+	AllowedModels []string `json:"allowedModels"`
+	// AutoModel names a virtual model (e.g. "gemini-auto") whose requests are
+	// routed to autoModelShort or autoModelLong by estimated prompt tokens.
+	// Empty disables routing.
+	AutoModel string `json:"autoModel"`
+	// AutoModelThresholdTokens is the prompt size above which autoModelLong is
+	// used. If zero, a default of 32000 is applied.
+	AutoModelThresholdTokens int `json:"autoModelThresholdTokens"`
+	// AutoModelShort is the model for prompts at or below the threshold
+	// (default gemini-2.5-flash).
+	AutoModelShort string `json:"autoModelShort"`
+	// AutoModelLong is the model for prompts above the threshold (default
+	// gemini-2.5-pro).
+	AutoModelLong string `json:"autoModelLong"`
+	// ShadowModel, when set, receives a background copy of sampled
+	// generation requests; both outputs are logged for offline comparison
+	// and clients only ever see the primary response. Shadow calls run only
+	// on credentials in the "shadow" tier, so they never spend the quota of
+	// the primary pool.
+	ShadowModel string `json:"shadowModel"`
+	// ShadowSampleRate is the fraction (0-1) of requests that are shadowed.
+	ShadowSampleRate float64 `json:"shadowSampleRate"`
+	// ShadowMaxConcurrent caps in-flight shadow calls; sampled requests over
+	// the cap are not shadowed. If zero, a default of 2 is applied.
+	ShadowMaxConcurrent int `json:"shadowMaxConcurrent"`
+	// ShadowMaxPerMinute rate-limits shadow calls; sampled requests arriving
+	// sooner than 60s/ShadowMaxPerMinute after the last shadow call are not
+	// shadowed. If zero, a default of 10 is applied.
+	ShadowMaxPerMinute int `json:"shadowMaxPerMinute"`
+	// ShadowLogMaxChars truncates each logged output. If zero, a default of
+	// 2000 is applied; negative logs them whole.
+	ShadowLogMaxChars int `json:"shadowLogMaxChars"`
 }
 
+// unforwardableHeaders may never be listed in forwardHeaders: they carry the
+// client's proxy credentials or describe the client connection rather than
+// the upstream request.
+var unforwardableHeaders = []string{
+	"Authorization", "Proxy-Authorization", "X-Goog-Api-Key", "Cookie",
+	"Host", "Content-Length", "Content-Type", "Transfer-Encoding",
+	"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Upgrade",
+}
+
+// Rotation strategies for RotationStrategy.
+const (
+	RotationRoundRobin = "round-robin"
+	RotationHealth     = "health"
+)
+
+// authKeyPlaceholder is the authKey of example configs; Validate rejects it.
+const authKeyPlaceholder = "UNSAFE-KEY-REPLACE"
+
+// Candidate selection modes for CandidateSelection.
+const (
+	CandidateFirst = "first"
+	CandidateBest  = "best"
+)
+
+// Empty stream handling modes for EmptyStreamMode.
+const (
+	EmptyStreamEvent = "event"
+	EmptyStreamError = "error"
+	EmptyStreamNone  = "none"
+)
+
+// CheckModelCapabilities reports whether validateModelCapabilities is on.
+func (c Config) CheckModelCapabilities() bool {
+	return c.ValidateModelCapabilities == nil || *c.ValidateModelCapabilities
+}
+
+// SupportsVision reports whether model accepts image input: false for
+// textOnlyModels entries, otherwise per the built-in model metadata.
+// Unknown models are assumed to support it.
+func (c Config) SupportsVision(model string) bool {
+	model = gemini.ResolveModel(model)
+	for _, m := range c.TextOnlyModels {
+		if gemini.ResolveModel(m) == model {
+			return false
+		}
+	}
+	info, ok := gemini.LookupModel(model)
+	return !ok || info.SupportsVision
+}
+
+// ModelAllowed reports whether model passes the allowedModels filter. Aliases
+// on either side are resolved first. It does not check that model is
+// supported.
+func (c Config) ModelAllowed(model string) bool {
+	if len(c.AllowedModels) == 0 {
+		return true
+	}
+	model = gemini.ResolveModel(model)
+	for _, m := range c.AllowedModels {
+		if gemini.ResolveModel(m) == model {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsVersions maps inboundTlsMinVersion values to tls versions.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// InboundTLSVersion returns the tls version for InboundTLSMinVersion,
+// falling back to TLS 1.2.
+func (c Config) InboundTLSVersion() uint16 {
+	if v, ok := tlsVersions[c.InboundTLSMinVersion]; ok {
+		return v
+	}
+	return tls.VersionTLS12
+}
+
+// CompiledContentFilters compiles ContentFilters. Validate has already
+// rejected invalid patterns, so entries that fail to compile are skipped.
+func (c Config) CompiledContentFilters() []*regexp.Regexp {
+	var out []*regexp.Regexp
+	for _, p := range c.ContentFilters {
+		if re, err := regexp.Compile(p); err == nil {
+			out = append(out, re)
+		}
+	}
+	return out
+}
+
+// ClientCAPool loads InboundClientCAFile into a pool for verifying client
+// certificates.
+func (c Config) ClientCAPool() (*x509.CertPool, error) {
+	pem, err := os.ReadFile(c.InboundClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("read inboundClientCAFile: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("inboundClientCAFile %s contains no PEM certificates", c.InboundClientCAFile)
+	}
+	return pool, nil
+}
+
+// IsLoopbackHost reports whether host (a name or IP, without port) only
+// accepts local connections. An empty host listens on every interface.
+func IsLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// isPathToken reports whether s is safe to splice into a URL path as a single
+// segment.
+func isPathToken(s string) bool {
+	if s == "." || s == ".." {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Upstream backends for CredentialBackends.
+const (
+	BackendCodeAssist = "codeassist"
+	BackendVertex     = "vertex"
+)
+
+// Credential tiers for CredentialTiers.
+const (
+	TierPrimary = "primary"
+	TierBackup  = "backup"
+	TierShadow  = "shadow"
+)
+
 func LoadConfig(path string) (Config, error) {
 	var cfg Config
 	b, err := os.ReadFile(path)
@@ -81,14 +589,16 @@ func LoadConfig(path string) (Config, error) {
 		allowed[f.Name] = struct{}{}
 		allowedLower[strings.ToLower(f.Name)] = struct{}{}
 	}
+	var unknown []string
 	for k := range raw {
 		if _, ok := allowed[k]; ok {
 			continue
 		}
 		if _, ok := allowedLower[strings.ToLower(k)]; !ok {
-			return cfg, fmt.Errorf("unknown config key: %s", k)
+			unknown = append(unknown, k)
 		}
 	}
+	sort.Strings(unknown)
 	// Second pass: decode into the strongly-typed struct.
 	if err := json5.NewDecoder(bytes.NewReader(b)).Decode(&cfg); err != nil {
 		// Keep error semantics consistent
@@ -98,18 +608,32 @@ func LoadConfig(path string) (Config, error) {
 		}
 		return cfg, fmt.Errorf("parse config: %w", err)
 	}
+	if len(unknown) > 0 {
+		if cfg.StrictConfig == nil || *cfg.StrictConfig {
+			return cfg, fmt.Errorf("unknown config key: %s", unknown[0])
+		}
+		logrus.Warnf("ignoring unknown config keys (strictConfig is false): %s", strings.Join(unknown, ", "))
+	}
 	// Log user agent if provided
 	if strings.TrimSpace(cfg.UserAgent) != "" {
 		logrus.Infof("using user agent: %s", cfg.UserAgent)
 		UserAgent = cfg.UserAgent
 	}
-	// Defaults
+	applyDefaults(&cfg)
+	return cfg, nil
+}
+
+// applyDefaults fills zero-valued fields with their defaults.
+func applyDefaults(cfg *Config) {
 	if cfg.Host == "" {
 		cfg.Host = "127.0.0.1"
 	}
 	if cfg.ServerPort == 0 {
 		cfg.ServerPort = 8085
 	}
+	if cfg.InboundTLSMinVersion == "" {
+		cfg.InboundTLSMinVersion = "1.2"
+	}
 	if cfg.RequestMaxRetries == 0 {
 		cfg.RequestMaxRetries = 3
 	}
@@ -126,17 +650,306 @@ func LoadConfig(path string) (Config, error) {
 	if cfg.MaxConcurrentRequests == 0 {
 		cfg.MaxConcurrentRequests = 64
 	}
-	return cfg, nil
+	if cfg.CredentialWatchIntervalSeconds == 0 {
+		cfg.CredentialWatchIntervalSeconds = 10
+	}
+	if cfg.StreamBufferChunks == 0 {
+		cfg.StreamBufferChunks = 64
+	}
+	if cfg.KeepWarmMaxPings == 0 {
+		cfg.KeepWarmMaxPings = 8
+	}
+	if cfg.ProxyCheckIntervalSeconds == 0 {
+		cfg.ProxyCheckIntervalSeconds = 30
+	}
+	if cfg.DiscoveryTimeoutSeconds == 0 {
+		cfg.DiscoveryTimeoutSeconds = 120
+	}
+	if cfg.ShutdownGraceSeconds == 0 {
+		cfg.ShutdownGraceSeconds = 30
+	}
+	if cfg.StreamIdleTimeoutSeconds == 0 {
+		cfg.StreamIdleTimeoutSeconds = 300
+	}
+	if cfg.LogFileMaxSizeMB == 0 {
+		cfg.LogFileMaxSizeMB = 100
+	}
+	if cfg.LogFileMaxBackups == 0 {
+		cfg.LogFileMaxBackups = 5
+	}
+	if cfg.PausedMessage == "" {
+		cfg.PausedMessage = "service paused for maintenance"
+	}
+	if cfg.PausedRetryAfterSeconds == 0 {
+		cfg.PausedRetryAfterSeconds = 60
+	}
+	if cfg.VertexLocation == "" {
+		cfg.VertexLocation = "us-central1"
+	}
+	if cfg.RotationStrategy == "" {
+		cfg.RotationStrategy = RotationRoundRobin
+	}
+	if cfg.RotationBackoffMaxMillis == 0 {
+		cfg.RotationBackoffMaxMillis = 2000
+	}
+	if cfg.AutoModelThresholdTokens == 0 {
+		cfg.AutoModelThresholdTokens = 32000
+	}
+	if cfg.AutoModelShort == "" {
+		cfg.AutoModelShort = "gemini-2.5-flash"
+	}
+	if cfg.AutoModelLong == "" {
+		cfg.AutoModelLong = "gemini-2.5-pro"
+	}
+	if cfg.ShadowMaxConcurrent == 0 {
+		cfg.ShadowMaxConcurrent = 2
+	}
+	if cfg.ShadowMaxPerMinute == 0 {
+		cfg.ShadowMaxPerMinute = 10
+	}
+	if cfg.ShadowLogMaxChars == 0 {
+		cfg.ShadowLogMaxChars = 2000
+	}
 }
 
 func (c Config) Validate(cfgPath string) error {
-	if c.AuthKey == "" {
+	if c.AuthKey == "" && !(c.MTLSOnly && c.InboundClientCAFile != "") {
 		return fmt.Errorf("authKey must be set in config file %s", cfgPath)
 	}
 	// Fail when authKey equals the default placeholder from example file.
-	if c.AuthKey == "UNSAFE-KEY-REPLACE" {
+	if c.AuthKey == authKeyPlaceholder {
 		return fmt.Errorf("authKey must be changed from default placeholder")
 	}
+	if c.RequestLogRetentionDays < 0 {
+		return fmt.Errorf("requestLogRetentionDays must not be negative")
+	}
+	if c.StateRetentionDays < 0 || c.StateCleanupIntervalMinutes < 0 || c.StateVacuumThresholdMB < 0 {
+		return fmt.Errorf("stateRetentionDays, stateCleanupIntervalMinutes and stateVacuumThresholdMB must not be negative")
+	}
+	if c.RequestMaxBodyBytes < -1 {
+		return fmt.Errorf("requestMaxBodyBytes must be positive, or -1 for unlimited")
+	}
+	if c.MaxResponseBytes < 0 {
+		return fmt.Errorf("maxResponseBytes must not be negative")
+	}
+	if c.MaxRotations < 0 {
+		return fmt.Errorf("maxRotations must not be negative")
+	}
+	if c.RotationBackoffMillis < 0 || c.RotationBackoffMaxMillis < 0 {
+		return fmt.Errorf("rotationBackoffMillis and rotationBackoffMaxMillis must not be negative")
+	}
+	switch c.RotationStrategy {
+	case "", RotationRoundRobin, RotationHealth:
+	default:
+		return fmt.Errorf("rotationStrategy must be %q or %q", RotationRoundRobin, RotationHealth)
+	}
+	switch c.CandidateSelection {
+	case "", CandidateFirst, CandidateBest:
+	default:
+		return fmt.Errorf("candidateSelection must be %q or %q", CandidateFirst, CandidateBest)
+	}
+	switch c.EmptyStreamMode {
+	case "", EmptyStreamEvent, EmptyStreamError, EmptyStreamNone:
+	default:
+		return fmt.Errorf("emptyStreamMode must be %q, %q or %q", EmptyStreamEvent, EmptyStreamError, EmptyStreamNone)
+	}
+	if c.MockLatencyMillis < 0 {
+		return fmt.Errorf("mockLatencyMillis must not be negative")
+	}
+	if c.DiscoveryTransportRetries != nil && *c.DiscoveryTransportRetries < 0 {
+		return fmt.Errorf("discoveryTransportRetries must not be negative")
+	}
+	if c.MaxDiscoveryAttemptsPerRequest < 0 {
+		return fmt.Errorf("maxDiscoveryAttemptsPerRequest must not be negative")
+	}
+	if c.DiscoveryTimeoutSeconds < 0 {
+		return fmt.Errorf("discoveryTimeoutSeconds must not be negative")
+	}
+	if c.DiscoveryBaseDelayMillis < 0 {
+		return fmt.Errorf("discoveryBaseDelay must not be negative")
+	}
+	if c.StreamIdleTimeoutSeconds < 0 || c.ShutdownGraceSeconds < 0 {
+		return fmt.Errorf("streamIdleTimeoutSeconds and shutdownGraceSeconds must not be negative")
+	}
+	if c.RoutePrefix != "" && (!strings.HasPrefix(c.RoutePrefix, "/") || strings.HasSuffix(c.RoutePrefix, "/")) {
+		return fmt.Errorf("routePrefix %q must start with / and have no trailing slash", c.RoutePrefix)
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("tlsCertFile and tlsKeyFile must be set together")
+	}
+	if c.InboundClientCAFile != "" {
+		if c.TLSCertFile == "" {
+			return fmt.Errorf("inboundClientCAFile requires tlsCertFile and tlsKeyFile")
+		}
+		if _, err := c.ClientCAPool(); err != nil {
+			return err
+		}
+	}
+	if c.MTLSOnly && c.InboundClientCAFile == "" {
+		return fmt.Errorf("mtlsOnly requires inboundClientCAFile")
+	}
+	if _, ok := tlsVersions[c.InboundTLSMinVersion]; c.InboundTLSMinVersion != "" && !ok {
+		return fmt.Errorf("inboundTlsMinVersion must be \"1.2\" or \"1.3\", got %q", c.InboundTLSMinVersion)
+	}
+	if c.AdminListen != "" {
+		host, _, err := net.SplitHostPort(c.AdminListen)
+		if err != nil {
+			return fmt.Errorf("adminListen %q must be host:port: %v", c.AdminListen, err)
+		}
+		// The admin listener is plain HTTP: with mtlsOnly and no authKey
+		// nothing else would authenticate it.
+		if c.MTLSOnly && c.AuthKey == "" && !IsLoopbackHost(host) && c.MetricsAuthKey == "" {
+			return fmt.Errorf("mtlsOnly without authKey requires metricsAuthKey or a loopback adminListen, since adminListen %s does not check client certificates", c.AdminListen)
+		}
+		if !IsLoopbackHost(host) && c.MetricsAuthKey == "" {
+			logrus.Warnf("adminListen %s is not loopback and metricsAuthKey is unset; admin and metrics endpoints are only protected by authKey", c.AdminListen)
+		}
+	} else if c.AdminOnPublicListener && !IsLoopbackHost(c.Host) && c.MetricsAuthKey == "" {
+		logrus.Warnf("adminOnPublicListener exposes admin and metrics endpoints on %s without metricsAuthKey", c.Host)
+	}
+	if c.DiscoveryWarmJitterMs < 0 {
+		return fmt.Errorf("discoveryWarmJitterMs must not be negative")
+	}
+	if c.KeepWarmSeconds < 0 || c.KeepWarmMaxPings < 0 {
+		return fmt.Errorf("keepWarmSeconds and keepWarmMaxPings must not be negative")
+	}
+	if c.SlowClientTimeoutSeconds < 0 || c.StreamBufferChunks < 0 {
+		return fmt.Errorf("slowClientTimeoutSeconds and streamBufferChunks must not be negative")
+	}
+	if c.LogFileMaxSizeMB < 0 || c.LogFileMaxBackups < 0 {
+		return fmt.Errorf("logFileMaxSizeMB and logFileMaxBackups must not be negative")
+	}
+	if c.LogSampleRate < 0 {
+		return fmt.Errorf("logSampleRate must not be negative")
+	}
+	if c.PausedRetryAfterSeconds < 0 {
+		return fmt.Errorf("pausedRetryAfterSeconds must not be negative")
+	}
+	if c.FlushEveryNChunks < 0 || c.FlushIntervalMs < 0 {
+		return fmt.Errorf("flushEveryNChunks and flushIntervalMs must not be negative")
+	}
+	if c.CoalesceStreamMs < 0 {
+		return fmt.Errorf("coalesceStreamMs must not be negative")
+	}
+	if c.MaxContents < 0 {
+		return fmt.Errorf("maxContents must not be negative")
+	}
+	if c.MaxPartsPerContent < 0 {
+		return fmt.Errorf("maxPartsPerContent must not be negative")
+	}
+	switch c.MaxContentsMode {
+	case "", "reject", "trim":
+	default:
+		return fmt.Errorf("maxContentsMode must be \"reject\" or \"trim\"")
+	}
+	for _, mt := range c.AllowedMimeTypes {
+		if typ, sub, ok := strings.Cut(mt, "/"); !ok || typ == "" || sub == "" || strings.ContainsAny(mt, " ;") {
+			return fmt.Errorf("allowedMimeTypes entry %q must be type/subtype or type/*", mt)
+		}
+	}
+	for _, p := range c.ContentFilters {
+		if p == "" {
+			return fmt.Errorf("contentFilters entries must not be empty")
+		}
+		if _, err := regexp.Compile(p); err != nil {
+			return fmt.Errorf("contentFilters entry %q: %w", p, err)
+		}
+	}
+	switch c.ContentFilterMode {
+	case "", "redact", "reject":
+	default:
+		return fmt.Errorf("contentFilterMode must be \"redact\" or \"reject\"")
+	}
+	if c.CredentialWatchIntervalSeconds < 0 {
+		return fmt.Errorf("credentialWatchIntervalSeconds must not be negative")
+	}
+	if c.ProxyCheckIntervalSeconds < 0 {
+		return fmt.Errorf("proxyCheckIntervalSeconds must not be negative")
+	}
+	for _, m := range c.AllowedModels {
+		if !gemini.IsSupportedModel(m) {
+			return fmt.Errorf("allowedModels entry %q is not a supported model", m)
+		}
+	}
+	for _, m := range c.TextOnlyModels {
+		if !gemini.IsSupportedModel(m) {
+			return fmt.Errorf("textOnlyModels entry %q is not a supported model", m)
+		}
+	}
+	if len(c.ResponseFieldAllowlist) > 0 && len(c.ResponseFieldDenylist) > 0 {
+		return fmt.Errorf("responseFieldAllowlist and responseFieldDenylist cannot both be set")
+	}
+	for _, f := range slices.Concat(c.ResponseFieldAllowlist, c.ResponseFieldDenylist) {
+		if strings.TrimSpace(f) == "" {
+			return fmt.Errorf("responseFieldAllowlist and responseFieldDenylist entries must not be empty")
+		}
+	}
+	if c.QueueTimeoutMillis < 0 {
+		return fmt.Errorf("queueTimeoutMillis must not be negative")
+	}
+	for m, n := range c.PerModelConcurrency {
+		if !gemini.IsSupportedModel(m) {
+			return fmt.Errorf("perModelConcurrency key %q is not a supported model", m)
+		}
+		if n <= 0 {
+			return fmt.Errorf("perModelConcurrency[%q] must be positive", m)
+		}
+	}
+	if c.ShadowModel != "" && !gemini.IsSupportedModel(c.ShadowModel) {
+		return fmt.Errorf("shadowModel %q is not a supported model", c.ShadowModel)
+	}
+	if c.ShadowSampleRate < 0 || c.ShadowSampleRate > 1 {
+		return fmt.Errorf("shadowSampleRate must be between 0 and 1")
+	}
+	if c.ShadowMaxConcurrent < 0 || c.ShadowMaxPerMinute < 0 {
+		return fmt.Errorf("shadowMaxConcurrent and shadowMaxPerMinute must not be negative")
+	}
+	if c.ShadowModel != "" && !c.MockUpstream && !slices.Contains(slices.Collect(maps.Values(c.CredentialTiers)), TierShadow) {
+		return fmt.Errorf("shadowModel requires at least one credential in the %q tier (credentialTiers)", TierShadow)
+	}
+	for _, r := range c.NonRetryableReasons {
+		if strings.TrimSpace(r) == "" {
+			return fmt.Errorf("nonRetryableReasons entries must not be empty")
+		}
+	}
+	if c.AutoModelThresholdTokens < 0 {
+		return fmt.Errorf("autoModelThresholdTokens must not be negative")
+	}
+	if c.AutoModel != "" {
+		if gemini.IsSupportedModel(c.AutoModel) {
+			return fmt.Errorf("autoModel %q must not be a real model name", c.AutoModel)
+		}
+		if !gemini.IsSupportedModel(c.AutoModelShort) {
+			return fmt.Errorf("autoModelShort %q is not a supported model", c.AutoModelShort)
+		}
+		if !gemini.IsSupportedModel(c.AutoModelLong) {
+			return fmt.Errorf("autoModelLong %q is not a supported model", c.AutoModelLong)
+		}
+		for _, target := range []string{c.AutoModelShort, c.AutoModelLong} {
+			if !c.ModelAllowed(target) {
+				return fmt.Errorf("autoModel target %q is not in allowedModels", target)
+			}
+		}
+	}
+	if c.APIVersion != "" && !isPathToken(c.APIVersion) {
+		return fmt.Errorf("apiVersion %q must be a single path segment of letters, digits, '.', '_' or '-'", c.APIVersion)
+	}
+	if c.EnvelopeResponseField != "" && strings.TrimSpace(c.EnvelopeResponseField) != c.EnvelopeResponseField {
+		return fmt.Errorf("envelopeResponseField %q must not have surrounding whitespace", c.EnvelopeResponseField)
+	}
+	for _, h := range c.ForwardHeaders {
+		if h == "" || strings.ContainsAny(h, " \t\r\n:") {
+			return fmt.Errorf("forwardHeaders entry %q is not a valid header name", h)
+		}
+		for _, deny := range unforwardableHeaders {
+			if strings.EqualFold(h, deny) {
+				return fmt.Errorf("forwardHeaders must not include %s", deny)
+			}
+		}
+	}
+	if strings.ContainsAny(c.SSEEventName, "\r\n:") {
+		return fmt.Errorf("sseEventName must not contain newlines or colons")
+	}
 	// Validate proxy scheme if provided
 	if c.Proxy != "" {
 		u, err := url.Parse(c.Proxy)
@@ -153,31 +966,171 @@ func (c Config) Validate(cfgPath string) error {
 			return fmt.Errorf("proxy URL must include host:port")
 		}
 	}
-	// Validate that projectIds keys (after ~ expansion) match one of the
+	// Validate that credential-keyed maps (after ~ expansion) match one of the
 	// configured credential paths (also after ~ expansion). Do not resolve symlinks.
-	if len(c.ProjectIds) > 0 {
-		// Build set of expanded credential paths
-		expanded := make(map[string]struct{}, len(c.GeminiCredsFilePaths))
-		for _, p := range c.GeminiCredsFilePaths {
-			if p == "" {
-				continue
-			}
-			xp, err := utils.ExpandUser(p)
-			if err != nil {
-				return fmt.Errorf("expand creds path %q: %w", p, err)
+	if err := c.validateCredKeys("projectIds", mapKeys(c.ProjectIds)); err != nil {
+		return err
+	}
+	if dups := c.duplicateProjectIds(); len(dups) > 0 {
+		action := "rotation will hit their quota once per listing; set dedupeProjectIds to drop the duplicates"
+		if c.DedupeProjectIds {
+			action = "only the first listing is used"
+		}
+		logrus.Warnf("projectIds lists %s more than once; %s", strings.Join(dups, ", "), action)
+	}
+	if err := c.validateCredKeys("credentialTiers", mapKeys(c.CredentialTiers)); err != nil {
+		return err
+	}
+	if err := c.validateCredKeys("credentialTimeouts", mapKeys(c.CredentialTimeouts)); err != nil {
+		return err
+	}
+	if err := c.validateCredKeys("credentialNames", mapKeys(c.CredentialNames)); err != nil {
+		return err
+	}
+	// Names stand in for paths in logs and priorityOrder, so each must
+	// identify one credential
+	named := make(map[string]string, len(c.CredentialNames))
+	for _, k := range mapKeys(c.CredentialNames) {
+		name := c.CredentialNames[k]
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("credentialNames[%q] must not be empty", k)
+		}
+		if prev, ok := named[name]; ok {
+			return fmt.Errorf("credentialNames: name %q is used for both %q and %q", name, prev, k)
+		}
+		named[name] = k
+	}
+	for k, secs := range c.CredentialTimeouts {
+		if secs <= 0 {
+			return fmt.Errorf("credentialTimeouts[%q] must be a positive number of seconds", k)
+		}
+	}
+	if err := c.validatePriorityOrder(); err != nil {
+		return err
+	}
+	if c.DailyRequestCap < 0 {
+		return fmt.Errorf("dailyRequestCap must not be negative")
+	}
+	if err := c.validateCredKeys("credentialDailyRequestCaps", mapKeys(c.CredentialDailyRequestCaps)); err != nil {
+		return err
+	}
+	for k, n := range c.CredentialDailyRequestCaps {
+		if n <= 0 {
+			return fmt.Errorf("credentialDailyRequestCaps[%q] must be positive", k)
+		}
+	}
+	if err := c.validateCredKeys("credentialBackends", mapKeys(c.CredentialBackends)); err != nil {
+		return err
+	}
+	for k, backend := range c.CredentialBackends {
+		switch backend {
+		case BackendCodeAssist:
+		case BackendVertex:
+			ids := c.ProjectIds[k]
+			if len(ids) == 0 || slices.Contains(ids, "_auto") {
+				return fmt.Errorf("credentialBackends[%q] is vertex and needs explicit projectIds under the same key (no \"_auto\")", k)
 			}
-			expanded[xp] = struct{}{}
+		default:
+			return fmt.Errorf("credentialBackends[%q] must be %q or %q", k, BackendCodeAssist, BackendVertex)
 		}
-		// Validate each projectIds key
-		for k := range c.ProjectIds {
-			xp, err := utils.ExpandUser(k)
-			if err != nil {
-				return fmt.Errorf("expand projectIds key %q: %w", k, err)
+	}
+	if c.VertexLocation != "" && !isPathToken(c.VertexLocation) {
+		return fmt.Errorf("vertexLocation %q is not a valid region", c.VertexLocation)
+	}
+	for k, tier := range c.CredentialTiers {
+		if tier != TierPrimary && tier != TierBackup && tier != TierShadow {
+			return fmt.Errorf("credentialTiers[%q] must be %q, %q or %q", k, TierPrimary, TierBackup, TierShadow)
+		}
+	}
+	return nil
+}
+
+// duplicateProjectIds returns, sorted, the project ids listed more than once
+// in projectIds. "_auto" is not a project id and is ignored.
+func (c Config) duplicateProjectIds() []string {
+	seen := map[string]int{}
+	for _, ids := range c.ProjectIds {
+		for _, id := range ids {
+			if id != "_auto" {
+				seen[id]++
 			}
-			if _, ok := expanded[xp]; !ok {
-				return fmt.Errorf("projectIds key %q does not match any geminiOauthCredsFiles entry", k)
+		}
+	}
+	var dups []string
+	for id, n := range seen {
+		if n > 1 {
+			dups = append(dups, id)
+		}
+	}
+	sort.Strings(dups)
+	return dups
+}
+
+// validatePriorityOrder checks that each priorityOrder entry is listed once
+// and names a credential path or a credentialNames value.
+func (c Config) validatePriorityOrder() error {
+	names := make(map[string]bool, len(c.CredentialNames))
+	for _, name := range c.CredentialNames {
+		names[name] = true
+	}
+	seen := make(map[string]bool, len(c.PriorityOrder))
+	for _, k := range c.PriorityOrder {
+		if seen[k] {
+			return fmt.Errorf("priorityOrder lists %q more than once", k)
+		}
+		seen[k] = true
+		if names[k] {
+			continue
+		}
+		if err := c.validateCredKeys("priorityOrder", []string{k}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateCredKeys checks that every key of a credential-keyed config map
+// matches a geminiOauthCredsFiles entry after ~ expansion. Entries of
+// combined credential files are addressed as "<path>#<name>".
+func (c Config) validateCredKeys(field string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	// Build set of expanded credential paths
+	expanded := make(map[string]struct{}, len(c.GeminiCredsFilePaths))
+	for _, p := range c.GeminiCredsFilePaths {
+		if p == "" {
+			continue
+		}
+		xp, err := utils.ExpandUser(p)
+		if err != nil {
+			return fmt.Errorf("expand creds path %q: %w", p, err)
+		}
+		expanded[xp] = struct{}{}
+	}
+	for _, k := range keys {
+		xp, err := utils.ExpandUser(k)
+		if err != nil {
+			return fmt.Errorf("expand %s key %q: %w", field, k, err)
+		}
+		if _, ok := expanded[xp]; ok {
+			continue
+		}
+		if i := strings.LastIndex(xp, "#"); i > 0 {
+			if _, ok := expanded[xp[:i]]; ok {
+				continue
 			}
 		}
+		return fmt.Errorf("%s key %q does not match any geminiOauthCredsFiles entry", field, k)
 	}
 	return nil
 }
+
+func mapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,6 +1,21 @@
 package config
 
-import "testing"
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestConfig_ProjectIds_UnknownKey_Fails(t *testing.T) {
 	cfg := Config{
@@ -14,3 +29,434 @@ func TestConfig_ProjectIds_UnknownKey_Fails(t *testing.T) {
 		t.Fatalf("expected validation to fail for unknown projectIds key")
 	}
 }
+
+func TestConfig_ProjectIds_CombinedEntryKey(t *testing.T) {
+	cfg := Config{
+		AuthKey:              "k",
+		GeminiCredsFilePaths: []string{"all.json"},
+		ProjectIds: map[string][]string{
+			"all.json#work": {"p1"},
+		},
+	}
+	if err := cfg.Validate("test.json"); err != nil {
+		t.Fatalf("expected combined entry key to validate, got %v", err)
+	}
+}
+
+func TestConfig_CredentialTiers_Validation(t *testing.T) {
+	base := Config{AuthKey: "k", GeminiCredsFilePaths: []string{"/tmp/a.json"}}
+	ok := base
+	ok.CredentialTiers = map[string]string{"/tmp/a.json": "backup"}
+	if err := ok.Validate("cfg"); err != nil {
+		t.Fatalf("expected valid tiers: %v", err)
+	}
+	bad := base
+	bad.CredentialTiers = map[string]string{"/tmp/a.json": "reserve"}
+	if err := bad.Validate("cfg"); err == nil {
+		t.Fatalf("expected error for unknown tier")
+	}
+	unknown := base
+	unknown.CredentialTiers = map[string]string{"/tmp/other.json": "backup"}
+	if err := unknown.Validate("cfg"); err == nil || !strings.Contains(err.Error(), "credentialTiers") {
+		t.Fatalf("expected unmatched key error, got %v", err)
+	}
+}
+
+func TestConfig_ShadowModel_RequiresShadowTier(t *testing.T) {
+	base := Config{AuthKey: "k", GeminiCredsFilePaths: []string{"/tmp/a.json", "/tmp/b.json"}, ShadowModel: "gemini-2.5-pro", ShadowSampleRate: 0.1}
+	if err := base.Validate("cfg"); err == nil || !strings.Contains(err.Error(), "shadow") {
+		t.Fatalf("expected error without a shadow credential, got %v", err)
+	}
+	ok := base
+	ok.CredentialTiers = map[string]string{"/tmp/b.json": TierShadow}
+	if err := ok.Validate("cfg"); err != nil {
+		t.Fatalf("expected valid shadow tier: %v", err)
+	}
+}
+
+func TestConfig_TextOnlyModels(t *testing.T) {
+	c := Config{AuthKey: "k", GeminiCredsFilePaths: []string{"/tmp/a.json"}, TextOnlyModels: []string{"gemini-2.0-flash-lite-001"}}
+	if err := c.Validate("cfg"); err != nil {
+		t.Fatalf("expected valid textOnlyModels: %v", err)
+	}
+	if c.SupportsVision("gemini-2.0-flash-lite") || !c.SupportsVision("gemini-2.0-flash") {
+		t.Fatal("expected only the listed model (via its alias) to be text-only")
+	}
+	c.TextOnlyModels = []string{"not-a-model"}
+	if err := c.Validate("cfg"); err == nil || !strings.Contains(err.Error(), "textOnlyModels") {
+		t.Fatalf("expected unknown model error, got %v", err)
+	}
+}
+
+func TestConfig_RequestMaxBodyBytes_Validation(t *testing.T) {
+	base := Config{AuthKey: "k", GeminiCredsFilePaths: []string{"/tmp/a.json"}}
+	for v, wantErr := range map[int64]bool{-2: true, -1: false, 1 << 30: false} {
+		c := base
+		c.RequestMaxBodyBytes = v
+		if err := c.Validate("cfg"); (err != nil) != wantErr {
+			t.Fatalf("requestMaxBodyBytes=%d: unexpected result %v", v, err)
+		}
+	}
+}
+
+func TestConfig_RotationBackoff_Validation(t *testing.T) {
+	base := Config{AuthKey: "k", GeminiCredsFilePaths: []string{"/tmp/a.json"}}
+	for _, tc := range []struct {
+		base, max int
+		wantErr   bool
+	}{{0, 0, false}, {100, 2000, false}, {-1, 0, true}, {100, -1, true}} {
+		c := base
+		c.RotationBackoffMillis, c.RotationBackoffMaxMillis = tc.base, tc.max
+		if err := c.Validate("cfg"); (err != nil) != tc.wantErr {
+			t.Fatalf("rotationBackoff=%d/%d: unexpected result %v", tc.base, tc.max, err)
+		}
+	}
+}
+
+func TestConfig_AutoModel_Validation(t *testing.T) {
+	base := Config{AuthKey: "k", GeminiCredsFilePaths: []string{"/tmp/a.json"}, AutoModelShort: "gemini-2.5-flash", AutoModelLong: "gemini-2.5-pro"}
+	ok := base
+	ok.AutoModel = "gemini-auto"
+	if err := ok.Validate("cfg"); err != nil {
+		t.Fatalf("expected valid autoModel: %v", err)
+	}
+	shadow := ok
+	shadow.AutoModel = "gemini-2.5-pro"
+	if err := shadow.Validate("cfg"); err == nil {
+		t.Fatalf("expected error when autoModel shadows a real model")
+	}
+	badTarget := ok
+	badTarget.AutoModelLong = "gemini-9-ultra"
+	if err := badTarget.Validate("cfg"); err == nil || !strings.Contains(err.Error(), "autoModelLong") {
+		t.Fatalf("expected autoModelLong error, got %v", err)
+	}
+}
+
+func TestConfig_AllowedModels_Validation(t *testing.T) {
+	base := Config{AuthKey: "k", GeminiCredsFilePaths: []string{"/tmp/a.json"}, AutoModelShort: "gemini-2.5-flash", AutoModelLong: "gemini-2.5-pro"}
+	ok := base
+	ok.AllowedModels = []string{"gemini-2.5-flash", "gemini-2.0-flash-001"}
+	if err := ok.Validate("cfg"); err != nil {
+		t.Fatalf("expected valid allowedModels: %v", err)
+	}
+	unknown := base
+	unknown.AllowedModels = []string{"gemini-9-ultra"}
+	if err := unknown.Validate("cfg"); err == nil {
+		t.Fatal("expected error for unsupported model")
+	}
+	auto := ok
+	auto.AutoModel = "gemini-auto"
+	if err := auto.Validate("cfg"); err == nil || !strings.Contains(err.Error(), "gemini-2.5-pro") {
+		t.Fatalf("expected autoModel target error, got %v", err)
+	}
+}
+
+func TestConfig_CredentialBackends_Validation(t *testing.T) {
+	base := Config{AuthKey: "k", GeminiCredsFilePaths: []string{"/tmp/a.json"}}
+	for _, tc := range []struct {
+		backend  string
+		projects []string
+		wantErr  bool
+	}{
+		{"codeassist", nil, false},
+		{"vertex", []string{"p1"}, false},
+		{"vertex", nil, true},
+		{"vertex", []string{"p1", "_auto"}, true},
+		{"bedrock", nil, true},
+	} {
+		c := base
+		c.CredentialBackends = map[string]string{"/tmp/a.json": tc.backend}
+		if tc.projects != nil {
+			c.ProjectIds = map[string][]string{"/tmp/a.json": tc.projects}
+		}
+		if err := c.Validate("cfg"); (err != nil) != tc.wantErr {
+			t.Fatalf("backend=%s projects=%v: unexpected result %v", tc.backend, tc.projects, err)
+		}
+	}
+}
+
+func TestConfig_DailyRequestCaps_Validation(t *testing.T) {
+	base := Config{AuthKey: "k", GeminiCredsFilePaths: []string{"/tmp/a.json"}}
+	ok := base
+	ok.DailyRequestCap, ok.CredentialDailyRequestCaps = 100, map[string]int{"/tmp/a.json": 50}
+	if err := ok.Validate("cfg"); err != nil {
+		t.Fatalf("expected valid caps: %v", err)
+	}
+	neg := base
+	neg.DailyRequestCap = -1
+	if err := neg.Validate("cfg"); err == nil {
+		t.Fatalf("expected error for negative dailyRequestCap")
+	}
+	zero := base
+	zero.CredentialDailyRequestCaps = map[string]int{"/tmp/a.json": 0}
+	if err := zero.Validate("cfg"); err == nil {
+		t.Fatalf("expected error for non-positive credential cap")
+	}
+}
+
+func TestConfig_CredentialTimeouts_Validation(t *testing.T) {
+	base := Config{AuthKey: "k", GeminiCredsFilePaths: []string{"/tmp/a.json"}}
+	ok := base
+	ok.CredentialTimeouts = map[string]int{"/tmp/a.json": 30}
+	if err := ok.Validate("cfg"); err != nil {
+		t.Fatalf("expected valid timeouts: %v", err)
+	}
+	zero := base
+	zero.CredentialTimeouts = map[string]int{"/tmp/a.json": 0}
+	if err := zero.Validate("cfg"); err == nil {
+		t.Fatalf("expected error for non-positive timeout")
+	}
+	unknown := base
+	unknown.CredentialTimeouts = map[string]int{"/tmp/other.json": 30}
+	if err := unknown.Validate("cfg"); err == nil || !strings.Contains(err.Error(), "credentialTimeouts") {
+		t.Fatalf("expected unmatched key error, got %v", err)
+	}
+}
+
+func TestConfig_CredentialNames_Validation(t *testing.T) {
+	base := Config{AuthKey: "k", GeminiCredsFilePaths: []string{"/tmp/a.json", "/tmp/b.json"}}
+	for _, tc := range []struct {
+		names   map[string]string
+		wantErr bool
+	}{
+		{map[string]string{"/tmp/a.json": "work"}, false},
+		{map[string]string{"/tmp/a.json": " "}, true},
+		{map[string]string{"/tmp/other.json": "work"}, true},
+		{map[string]string{"/tmp/a.json": "work", "/tmp/b.json": "home"}, false},
+		{map[string]string{"/tmp/a.json": "work", "/tmp/b.json": "work"}, true},
+	} {
+		c := base
+		c.CredentialNames = tc.names
+		if err := c.Validate("cfg"); (err != nil) != tc.wantErr {
+			t.Fatalf("credentialNames=%v: unexpected result %v", tc.names, err)
+		}
+	}
+}
+
+func TestConfig_PriorityOrder_Validation(t *testing.T) {
+	base := Config{AuthKey: "k", GeminiCredsFilePaths: []string{"/tmp/a.json", "/tmp/b.json"}, CredentialNames: map[string]string{"/tmp/b.json": "work"}}
+	for _, tc := range []struct {
+		order   []string
+		wantErr bool
+	}{
+		{[]string{"/tmp/a.json", "work"}, false},
+		{[]string{"/tmp/a.json#acct"}, false},
+		{[]string{"/tmp/other.json"}, true},
+		{[]string{"play"}, true},
+		{[]string{"work", "work"}, true},
+	} {
+		c := base
+		c.PriorityOrder = tc.order
+		if err := c.Validate("cfg"); (err != nil) != tc.wantErr {
+			t.Fatalf("priorityOrder=%v: unexpected result %v", tc.order, err)
+		}
+	}
+}
+
+func TestConfig_APIVersion_Validation(t *testing.T) {
+	base := Config{AuthKey: "k", GeminiCredsFilePaths: []string{"/tmp/a.json"}}
+	for v, wantErr := range map[string]bool{"": false, "v1internal": false, "v2beta_1": false, "v1/../x": true, "..": true, "v1?x=1": true} {
+		c := base
+		c.APIVersion = v
+		if err := c.Validate("cfg"); (err != nil) != wantErr {
+			t.Fatalf("apiVersion=%q: unexpected result %v", v, err)
+		}
+	}
+}
+
+func TestConfig_RoutePrefix_Validation(t *testing.T) {
+	base := Config{AuthKey: "k", GeminiCredsFilePaths: []string{"/tmp/a.json"}}
+	for p, wantErr := range map[string]bool{"": false, "/gemini": false, "/a/b": false, "gemini": true, "/gemini/": true, "/": true} {
+		c := base
+		c.RoutePrefix = p
+		if err := c.Validate("cfg"); (err != nil) != wantErr {
+			t.Fatalf("routePrefix=%q: unexpected result %v", p, err)
+		}
+	}
+}
+
+func TestConfig_InboundTLS_Validation(t *testing.T) {
+	base := Config{AuthKey: "k", GeminiCredsFilePaths: []string{"/tmp/a.json"}}
+	for _, tc := range []struct {
+		cert, key, min string
+		wantErr        bool
+	}{
+		{"", "", "", false},
+		{"c.pem", "k.pem", "1.3", false},
+		{"c.pem", "", "", true},
+		{"", "k.pem", "", true},
+		{"c.pem", "k.pem", "1.1", true},
+		{"c.pem", "k.pem", "tls1.2", true},
+	} {
+		c := base
+		c.TLSCertFile, c.TLSKeyFile, c.InboundTLSMinVersion = tc.cert, tc.key, tc.min
+		if err := c.Validate("cfg"); (err != nil) != tc.wantErr {
+			t.Fatalf("%+v: unexpected result %v", tc, err)
+		}
+	}
+	if v := (Config{}).InboundTLSVersion(); v != tls.VersionTLS12 {
+		t.Fatalf("expected TLS 1.2 by default, got %x", v)
+	}
+}
+
+func TestConfig_InboundClientCA(t *testing.T) {
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "test CA"}, NotAfter: time.Now().Add(time.Hour), IsCA: true, BasicConstraintsValid: true}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create cert: %v", err)
+	}
+	caFile := filepath.Join(dir, "ca.pem")
+	_ = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	junkFile := filepath.Join(dir, "junk.pem")
+	_ = os.WriteFile(junkFile, []byte("not a certificate"), 0o600)
+
+	base := Config{AuthKey: "k", GeminiCredsFilePaths: []string{"/tmp/a.json"}, TLSCertFile: "c.pem", TLSKeyFile: "k.pem"}
+	for _, tc := range []struct {
+		name    string
+		mutate  func(*Config)
+		wantErr bool
+	}{
+		{"valid CA", func(c *Config) { c.InboundClientCAFile = caFile }, false},
+		{"missing file", func(c *Config) { c.InboundClientCAFile = filepath.Join(dir, "none.pem") }, true},
+		{"no certificates", func(c *Config) { c.InboundClientCAFile = junkFile }, true},
+		{"without TLS", func(c *Config) { c.InboundClientCAFile, c.TLSCertFile, c.TLSKeyFile = caFile, "", "" }, true},
+		{"mtls only", func(c *Config) { c.InboundClientCAFile, c.MTLSOnly, c.AuthKey = caFile, true, "" }, false},
+		{"no authKey without mtlsOnly", func(c *Config) { c.InboundClientCAFile, c.AuthKey = caFile, "" }, true},
+		{"mtlsOnly without CA", func(c *Config) { c.MTLSOnly = true }, true},
+		{"mtlsOnly with open adminListen", func(c *Config) {
+			c.InboundClientCAFile, c.MTLSOnly, c.AuthKey, c.AdminListen = caFile, true, "", "0.0.0.0:9090"
+		}, true},
+		{"mtlsOnly with loopback adminListen", func(c *Config) {
+			c.InboundClientCAFile, c.MTLSOnly, c.AuthKey, c.AdminListen = caFile, true, "", "127.0.0.1:9090"
+		}, false},
+		{"mtlsOnly with keyed adminListen", func(c *Config) {
+			c.InboundClientCAFile, c.MTLSOnly, c.AuthKey, c.AdminListen, c.MetricsAuthKey = caFile, true, "", "0.0.0.0:9090", "m"
+		}, false},
+	} {
+		c := base
+		tc.mutate(&c)
+		if err := c.Validate("cfg"); (err != nil) != tc.wantErr {
+			t.Fatalf("%s: unexpected result %v", tc.name, err)
+		}
+	}
+	pool, err := (Config{InboundClientCAFile: caFile}).ClientCAPool()
+	if err != nil || pool == nil {
+		t.Fatalf("load pool: %v", err)
+	}
+}
+
+func TestConfig_AllowedMimeTypes_Validation(t *testing.T) {
+	base := Config{AuthKey: "k", GeminiCredsFilePaths: []string{"/tmp/a.json"}}
+	for mt, wantErr := range map[string]bool{"image/png": false, "image/*": false, "image": true, "/png": true, "image/": true, "image/png; q=1": true} {
+		c := base
+		c.AllowedMimeTypes = []string{mt}
+		if err := c.Validate("cfg"); (err != nil) != wantErr {
+			t.Fatalf("allowedMimeTypes=%q: unexpected result %v", mt, err)
+		}
+	}
+}
+
+func TestConfig_ContentFilters_Validation(t *testing.T) {
+	base := Config{AuthKey: "k", GeminiCredsFilePaths: []string{"/tmp/a.json"}}
+	for _, tc := range []struct {
+		filters []string
+		mode    string
+		wantErr bool
+	}{
+		{[]string{`\b\d{3}-\d{2}-\d{4}\b`}, "", false},
+		{[]string{`secret`}, "reject", false},
+		{[]string{`(unclosed`}, "", true},
+		{[]string{""}, "", true},
+		{nil, "drop", true},
+	} {
+		c := base
+		c.ContentFilters, c.ContentFilterMode = tc.filters, tc.mode
+		if err := c.Validate("cfg"); (err != nil) != tc.wantErr {
+			t.Fatalf("contentFilters=%q mode=%q: unexpected result %v", tc.filters, tc.mode, err)
+		}
+	}
+	if res := (Config{ContentFilters: []string{"a+", "b"}}).CompiledContentFilters(); len(res) != 2 || res[0].String() != "a+" {
+		t.Fatalf("unexpected compiled filters: %v", res)
+	}
+}
+
+func TestConfig_DuplicateProjectIds(t *testing.T) {
+	c := Config{ProjectIds: map[string][]string{
+		"/tmp/a.json": {"p1", "p2", "_auto"},
+		"/tmp/b.json": {"p2", "p3", "_auto"},
+		"/tmp/c.json": {"p3"},
+	}}
+	if got := c.duplicateProjectIds(); !slices.Equal(got, []string{"p2", "p3"}) {
+		t.Fatalf("duplicates = %v", got)
+	}
+}
+
+func TestConfig_ForwardHeaders_Validation(t *testing.T) {
+	base := Config{AuthKey: "k", GeminiCredsFilePaths: []string{"/tmp/a.json"}}
+	ok := base
+	ok.ForwardHeaders = []string{"X-Goog-User-Project", "x-goog-request-reason"}
+	if err := ok.Validate("cfg"); err != nil {
+		t.Fatalf("expected valid forwardHeaders: %v", err)
+	}
+	for _, h := range []string{"authorization", "X-Goog-Api-Key", "Host", "Bad Header", ""} {
+		bad := base
+		bad.ForwardHeaders = []string{h}
+		if err := bad.Validate("cfg"); err == nil || !strings.Contains(err.Error(), "forwardHeaders") {
+			t.Fatalf("expected forwardHeaders error for %q, got %v", h, err)
+		}
+	}
+}
+
+func TestLoadConfig_UnknownKeys(t *testing.T) {
+	dir := t.TempDir()
+	load := func(body string) error {
+		path := filepath.Join(dir, "config.json")
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadConfig(path)
+		return err
+	}
+	if err := load(`{"port": 8085, "futureKey": 1}`); err == nil || !strings.Contains(err.Error(), "futureKey") {
+		t.Fatalf("expected unknown key to fail by default, got %v", err)
+	}
+	if err := load(`{"port": 8085, "futureKey": 1, "strictConfig": true}`); err == nil {
+		t.Fatalf("expected unknown key to fail with strictConfig true")
+	}
+	if err := load(`{"port": 8085, "futureKey": 1, "strictConfig": false}`); err != nil {
+		t.Fatalf("expected unknown key to be ignored with strictConfig false, got %v", err)
+	}
+}
+
+func TestWriteExample_RoundTrips(t *testing.T) {
+	var b strings.Builder
+	if err := WriteExample(&b); err != nil {
+		t.Fatalf("write example: %v", err)
+	}
+	out := b.String()
+	for _, want := range []string{`"authKey": "UNSAFE-KEY-REPLACE"`, `"port": 8085`, "// strictConfig rejects unknown top-level config keys."} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("example missing %q:\n%s", want, out)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "config.json5")
+	if err := os.WriteFile(path, []byte(out), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("generated example does not load: %v", err)
+	}
+	if err := cfg.Validate(path); err == nil || !strings.Contains(err.Error(), "placeholder") {
+		t.Fatalf("expected the placeholder authKey to be rejected, got %v", err)
+	}
+	cfg.AuthKey = "k"
+	if err := cfg.Validate(path); err != nil {
+		t.Fatalf("generated example is otherwise invalid: %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// configSource is this package's Config definition; its field doc comments
+// double as the descriptions in the generated example config.
+//
+//go:embed config.go
+var configSource []byte
+
+// WriteExample writes a commented JSON5 example config listing every field
+// with its description and default value. authKey is set to the placeholder
+// that Validate rejects, so the file has to be edited before use.
+func WriteExample(w io.Writer) error {
+	cfg := Config{AuthKey: authKeyPlaceholder, GeminiCredsFilePaths: []string{"~/.gemini/oauth_creds.json"}}
+	applyDefaults(&cfg)
+	docs, err := fieldDocs()
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	b.WriteString("// gcli2api example configuration (JSON5). Every key is listed with its\n")
+	b.WriteString("// default value; remove the ones you do not need.\n{\n")
+	v := reflect.ValueOf(cfg)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := jsonKey(f)
+		if key == "" {
+			continue
+		}
+		if doc := docs[f.Name]; doc != "" {
+			// Doc comments open with the Go field name; show the JSON key
+			if rest, ok := strings.CutPrefix(doc, f.Name+" "); ok {
+				doc = key + " " + rest
+			}
+			for _, line := range strings.Split(doc, "\n") {
+				fmt.Fprintf(&b, "  // %s\n", line)
+			}
+		}
+		val, err := json.Marshal(exampleValue(v.Field(i)))
+		if err != nil {
+			return fmt.Errorf("encode %s: %w", key, err)
+		}
+		fmt.Fprintf(&b, "  %q: %s,\n", key, val)
+	}
+	b.WriteString("}\n")
+	_, err = w.Write(b.Bytes())
+	return err
+}
+
+// jsonKey returns the config key of a Config field, or "" if it has none.
+func jsonKey(f reflect.StructField) string {
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return ""
+	}
+	if name := strings.Split(tag, ",")[0]; name != "" {
+		return name
+	}
+	return f.Name
+}
+
+// exampleValue renders nil maps and slices as empty ones, so the example
+// shows the expected shape instead of null.
+func exampleValue(v reflect.Value) any {
+	switch {
+	case v.Kind() == reflect.Map && v.IsNil():
+		return reflect.MakeMap(v.Type()).Interface()
+	case v.Kind() == reflect.Slice && v.IsNil():
+		return reflect.MakeSlice(v.Type(), 0, 0).Interface()
+	}
+	return v.Interface()
+}
+
+// fieldDocs returns the doc comment of each Config field keyed by Go field
+// name, parsed from the embedded source.
+func fieldDocs() (map[string]string, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), "config.go", configSource, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("parse config source: %w", err)
+	}
+	docs := map[string]string{}
+	ast.Inspect(f, func(n ast.Node) bool {
+		ts, ok := n.(*ast.TypeSpec)
+		if !ok || ts.Name.Name != "Config" {
+			return true
+		}
+		if st, ok := ts.Type.(*ast.StructType); ok {
+			for _, field := range st.Fields.List {
+				doc := field.Doc.Text()
+				if doc == "" {
+					doc = field.Comment.Text()
+				}
+				for _, name := range field.Names {
+					docs[name.Name] = strings.TrimSpace(doc)
+				}
+			}
+		}
+		return false
+	})
+	return docs, nil
+}
@@ -2,26 +2,63 @@ package gemini
 
 // ModelInfo describes a supported model for discovery and validation.
 type ModelInfo struct {
-	Name        string
-	DisplayName string
-	Description string
+	Name             string
+	DisplayName      string
+	Description      string
+	InputTokenLimit  int
+	OutputTokenLimit int
+	// SupportsVision marks models that accept image input.
+	SupportsVision bool
 }
 
 // SupportedModels is the canonical list of supported model identifiers.
 var SupportedModels = []ModelInfo{
-	{Name: "gemini-2.5-flash", DisplayName: "Gemini 2.5 Flash", Description: "Fast multimodal generation"},
-	{Name: "gemini-2.5-pro", DisplayName: "Gemini 2.5 Pro", Description: "Accurate multimodal generation"},
-	{Name: "gemini-2.5-pro-preview-06-05", DisplayName: "Gemini 2.5 Pro Preview (06-05)", Description: "Accurate multimodal generation"},
-	{Name: "gemini-2.5-pro-preview-05-06", DisplayName: "Gemini 2.5 Pro Preview (05-06)", Description: "Accurate multimodal generation"},
-	{Name: "gemini-3-pro-preview-11-2025", DisplayName: "Gemini 3.0 Pro Preview (06-11)", Description: "NEW TEST"},
+	{Name: "gemini-2.5-flash", DisplayName: "Gemini 2.5 Flash", Description: "Fast multimodal generation", InputTokenLimit: 1048576, OutputTokenLimit: 65536, SupportsVision: true},
+	{Name: "gemini-2.5-pro", DisplayName: "Gemini 2.5 Pro", Description: "Accurate multimodal generation", InputTokenLimit: 1048576, OutputTokenLimit: 65536, SupportsVision: true},
+	{Name: "gemini-2.5-pro-preview-06-05", DisplayName: "Gemini 2.5 Pro Preview (06-05)", Description: "Accurate multimodal generation", InputTokenLimit: 1048576, OutputTokenLimit: 65536, SupportsVision: true},
+	{Name: "gemini-2.5-pro-preview-05-06", DisplayName: "Gemini 2.5 Pro Preview (05-06)", Description: "Accurate multimodal generation", InputTokenLimit: 1048576, OutputTokenLimit: 65536, SupportsVision: true},
+	{Name: "gemini-3-pro-preview-11-2025", DisplayName: "Gemini 3.0 Pro Preview (06-11)", Description: "NEW TEST", InputTokenLimit: 1048576, OutputTokenLimit: 65536, SupportsVision: true},
+	{Name: "gemini-2.0-flash", DisplayName: "Gemini 2.0 Flash", Description: "Fast multimodal generation", InputTokenLimit: 1048576, OutputTokenLimit: 8192, SupportsVision: true},
+	{Name: "gemini-2.0-flash-lite", DisplayName: "Gemini 2.0 Flash-Lite", Description: "Cost-efficient multimodal generation", InputTokenLimit: 1048576, OutputTokenLimit: 8192, SupportsVision: true},
 }
 
-// IsSupportedModel reports whether the given model name is supported.
-func IsSupportedModel(name string) bool {
+// modelAliases maps accepted alternative names to their SupportedModels entry.
+var modelAliases = map[string]string{
+	"gemini-2.0-flash-001":      "gemini-2.0-flash",
+	"gemini-2.0-flash-lite-001": "gemini-2.0-flash-lite",
+}
+
+// ResolveModel returns the canonical name for an alias, or name unchanged.
+func ResolveModel(name string) string {
+	if canonical, ok := modelAliases[name]; ok {
+		return canonical
+	}
+	return name
+}
+
+// LookupModel returns the metadata for the given model name, if supported.
+// Aliases resolve to their canonical entry.
+func LookupModel(name string) (ModelInfo, bool) {
+	name = ResolveModel(name)
 	for _, m := range SupportedModels {
 		if m.Name == name {
-			return true
+			return m, true
 		}
 	}
-	return false
+	return ModelInfo{}, false
+}
+
+// SupportedModelNames returns the names of all supported models in order.
+func SupportedModelNames() []string {
+	names := make([]string, 0, len(SupportedModels))
+	for _, m := range SupportedModels {
+		names = append(names, m.Name)
+	}
+	return names
+}
+
+// IsSupportedModel reports whether the given model name is supported.
+func IsSupportedModel(name string) bool {
+	_, ok := LookupModel(name)
+	return ok
 }
@@ -1,17 +1,251 @@
 package gemini
 
 import (
+	"fmt"
+	"regexp"
 	"strings"
 )
 
-// NormalizeGeminiRequest ensures roles are present.
-func NormalizeGeminiRequest(req GeminiRequest) GeminiRequest {
+// MaxContentsMode controls how NormalizeGeminiRequest handles requests with
+// more than NormalizeOptions.MaxContents entries.
+const (
+	MaxContentsReject = "reject"
+	MaxContentsTrim   = "trim"
+)
+
+// ContentFilterMode controls what NormalizeGeminiRequest does with text
+// matching NormalizeOptions.ContentFilters.
+const (
+	ContentFilterRedact = "redact"
+	ContentFilterReject = "reject"
+)
+
+// RedactedText replaces each content filter match in redact mode.
+const RedactedText = "[REDACTED]"
+
+// NormalizeOptions configures NormalizeGeminiRequest. The zero value only
+// fills in default roles.
+type NormalizeOptions struct {
+	// MaxContents caps the number of contents entries. Zero disables the cap.
+	MaxContents int
+	// MaxContentsMode is MaxContentsReject (default) or MaxContentsTrim.
+	MaxContentsMode string
+	// MaxPartsPerContent caps the parts of each contents entry (and of
+	// systemInstruction). Zero disables the cap.
+	MaxPartsPerContent int
+	// Model, when set, enables per-model validation of thinkingConfig.
+	Model string
+	// AllowedMimeTypes restricts the MIME types of inlineData and fileData
+	// parts; "type/*" matches a whole type. Empty allows every type.
+	AllowedMimeTypes []string
+	// ContentFilters are matched against the text parts of contents and
+	// systemInstruction. Empty disables filtering.
+	ContentFilters []*regexp.Regexp
+	// ContentFilterMode is ContentFilterRedact (default) or ContentFilterReject.
+	ContentFilterMode string
+	// CheckCapabilities rejects image parts sent to a Model without vision
+	// support, instead of leaving upstream to fail opaquely.
+	CheckCapabilities bool
+	// SupportsVision reports whether a model accepts image input. Nil uses
+	// the built-in model metadata.
+	SupportsVision func(model string) bool
+}
+
+// NormalizeGeminiRequest ensures roles are present and enforces the
+// conversation length cap. In trim mode the most recent MaxContents entries
+// are kept; systemInstruction is untouched and the latest user turn is
+// always kept. Contents with more than MaxPartsPerContent parts are rejected.
+// A thinkingBudget outside the model's accepted range is
+// rejected, as are media parts whose MIME type is not allowed. Text matching
+// a content filter is redacted or rejected according to ContentFilterMode.
+func NormalizeGeminiRequest(req GeminiRequest, opts NormalizeOptions) (GeminiRequest, error) {
 	for i := range req.Contents {
 		if strings.TrimSpace(req.Contents[i].Role) == "" {
 			req.Contents[i].Role = "user"
 		}
 	}
-	return req
+	if opts.MaxContents > 0 && len(req.Contents) > opts.MaxContents {
+		if opts.MaxContentsMode != MaxContentsTrim {
+			return req, fmt.Errorf("too many contents: %d exceeds maxContents %d", len(req.Contents), opts.MaxContents)
+		}
+		start := len(req.Contents) - opts.MaxContents
+		for i := len(req.Contents) - 1; i >= 0; i-- {
+			if req.Contents[i].Role == "user" {
+				if i < start {
+					start = i
+				}
+				break
+			}
+		}
+		req.Contents = req.Contents[start:]
+	}
+	if opts.MaxPartsPerContent > 0 {
+		if req.SystemInstruction != nil && len(req.SystemInstruction.Parts) > opts.MaxPartsPerContent {
+			return req, fmt.Errorf("too many parts in systemInstruction: %d exceeds maxPartsPerContent %d", len(req.SystemInstruction.Parts), opts.MaxPartsPerContent)
+		}
+		for i, c := range req.Contents {
+			if len(c.Parts) > opts.MaxPartsPerContent {
+				return req, fmt.Errorf("too many parts in contents[%d]: %d exceeds maxPartsPerContent %d", i, len(c.Parts), opts.MaxPartsPerContent)
+			}
+		}
+	}
+	if len(opts.AllowedMimeTypes) > 0 {
+		if err := checkMimeTypes(req, opts.AllowedMimeTypes); err != nil {
+			return req, err
+		}
+	}
+	if opts.CheckCapabilities && opts.Model != "" {
+		supports := opts.SupportsVision
+		if supports == nil {
+			supports = builtinVision
+		}
+		if err := checkVision(req, opts.Model, supports); err != nil {
+			return req, err
+		}
+	}
+	if len(opts.ContentFilters) > 0 {
+		var err error
+		if req, err = applyContentFilters(req, opts.ContentFilters, opts.ContentFilterMode); err != nil {
+			return req, err
+		}
+	}
+	if gc := req.GenerationConfig; gc != nil && gc.ThinkingConfig != nil && gc.ThinkingConfig.ThinkingBudget != nil && opts.Model != "" {
+		if err := validateThinkingBudget(opts.Model, *gc.ThinkingConfig.ThinkingBudget); err != nil {
+			return req, err
+		}
+	}
+	return req, nil
+}
+
+// checkMimeTypes rejects the first inlineData or fileData part whose MIME
+// type is not in allowed.
+func checkMimeTypes(req GeminiRequest, allowed []string) error {
+	contents := req.Contents
+	if req.SystemInstruction != nil {
+		contents = append([]GeminiContent{*req.SystemInstruction}, contents...)
+	}
+	for _, c := range contents {
+		for _, p := range c.Parts {
+			var mt string
+			switch {
+			case p.InlineData != nil:
+				mt = p.InlineData.MimeType
+			case p.FileData != nil:
+				mt = p.FileData.MimeType
+			default:
+				continue
+			}
+			if !mimeTypeAllowed(mt, allowed) {
+				return fmt.Errorf("mime type %q is not allowed", mt)
+			}
+		}
+	}
+	return nil
+}
+
+// builtinVision reports vision support from SupportedModels; unknown models
+// are assumed to support it.
+func builtinVision(model string) bool {
+	info, ok := LookupModel(model)
+	return !ok || info.SupportsVision
+}
+
+// checkVision rejects image inlineData/fileData parts when supports says
+// model has no vision support.
+func checkVision(req GeminiRequest, model string, supports func(string) bool) error {
+	if supports(model) {
+		return nil
+	}
+	contents := req.Contents
+	if req.SystemInstruction != nil {
+		contents = append([]GeminiContent{*req.SystemInstruction}, contents...)
+	}
+	for _, c := range contents {
+		for _, p := range c.Parts {
+			var mt string
+			switch {
+			case p.InlineData != nil:
+				mt = p.InlineData.MimeType
+			case p.FileData != nil:
+				mt = p.FileData.MimeType
+			default:
+				continue
+			}
+			if strings.HasPrefix(strings.ToLower(mt), "image/") {
+				return fmt.Errorf("model %s does not support image input (part with mime type %q)", model, mt)
+			}
+		}
+	}
+	return nil
+}
+
+// applyContentFilters redacts filter matches in text parts, or in reject mode
+// fails on the first match. The error names the filter, not the matched
+// text. Contents are copied before redaction so the caller's request (which
+// may be logged or replayed) keeps its original parts.
+func applyContentFilters(req GeminiRequest, filters []*regexp.Regexp, mode string) (GeminiRequest, error) {
+	filter := func(c GeminiContent) (GeminiContent, error) {
+		var parts []GeminiPart
+		for j, p := range c.Parts {
+			if p.Text == "" {
+				continue
+			}
+			text := p.Text
+			for i, re := range filters {
+				if !re.MatchString(text) {
+					continue
+				}
+				if mode == ContentFilterReject {
+					return c, fmt.Errorf("request text matches content filter %d", i)
+				}
+				text = re.ReplaceAllLiteralString(text, RedactedText)
+			}
+			if text == p.Text {
+				continue
+			}
+			if parts == nil {
+				parts = append([]GeminiPart(nil), c.Parts...)
+			}
+			parts[j].Text = text
+		}
+		if parts != nil {
+			c.Parts = parts
+		}
+		return c, nil
+	}
+	if req.SystemInstruction != nil {
+		si, err := filter(*req.SystemInstruction)
+		if err != nil {
+			return req, err
+		}
+		req.SystemInstruction = &si
+	}
+	contents := make([]GeminiContent, len(req.Contents))
+	for i, c := range req.Contents {
+		var err error
+		if contents[i], err = filter(c); err != nil {
+			return req, err
+		}
+	}
+	req.Contents = contents
+	return req, nil
+}
+
+// mimeTypeAllowed matches mt, ignoring case and parameters, against exact
+// entries and "type/*" wildcards.
+func mimeTypeAllowed(mt string, allowed []string) bool {
+	mt, _, _ = strings.Cut(mt, ";")
+	mt = strings.ToLower(strings.TrimSpace(mt))
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if a == mt {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(a, "/*"); ok && strings.HasPrefix(mt, prefix+"/") {
+			return true
+		}
+	}
+	return false
 }
 
 // System prompt injection removed.
@@ -2,6 +2,9 @@ package gemini
 
 import (
 	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
 	"testing"
 )
 
@@ -12,7 +15,10 @@ func TestNormalizeRoles_DefaultsOnly(t *testing.T) {
 			{Role: "user", Parts: []GeminiPart{{Text: "yo"}}},
 		},
 	}
-	got := NormalizeGeminiRequest(req)
+	got, err := NormalizeGeminiRequest(req, NormalizeOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
 	if got.Contents[0].Role != "user" {
 		t.Fatalf("expected default role 'user', got %q", got.Contents[0].Role)
 	}
@@ -20,10 +26,97 @@ func TestNormalizeRoles_DefaultsOnly(t *testing.T) {
 
 // System prompt from file feature removed; no tests required.
 
+func turns(roles ...string) []GeminiContent {
+	out := make([]GeminiContent, len(roles))
+	for i, r := range roles {
+		out[i] = GeminiContent{Role: r, Parts: []GeminiPart{{Text: fmt.Sprintf("%s-%d", r, i)}}}
+	}
+	return out
+}
+
+func TestMaxContents_Reject(t *testing.T) {
+	req := GeminiRequest{Contents: turns("user", "model", "user")}
+	if _, err := NormalizeGeminiRequest(req, NormalizeOptions{MaxContents: 3}); err != nil {
+		t.Fatalf("at the cap should pass: %v", err)
+	}
+	if _, err := NormalizeGeminiRequest(req, NormalizeOptions{MaxContents: 2}); err == nil {
+		t.Fatalf("expected rejection over the cap")
+	}
+}
+
+func TestMaxPartsPerContent(t *testing.T) {
+	parts := func(n int) []GeminiPart {
+		out := make([]GeminiPart, n)
+		for i := range out {
+			out[i] = GeminiPart{Text: "x"}
+		}
+		return out
+	}
+	opts := NormalizeOptions{MaxPartsPerContent: 3}
+	req := GeminiRequest{Contents: []GeminiContent{{Role: "user", Parts: parts(1)}, {Role: "model", Parts: parts(3)}}}
+	if _, err := NormalizeGeminiRequest(req, opts); err != nil {
+		t.Fatalf("at the cap should pass: %v", err)
+	}
+	req.Contents[1].Parts = parts(4)
+	if _, err := NormalizeGeminiRequest(req, opts); err == nil || !strings.Contains(err.Error(), "contents[1]") {
+		t.Fatalf("expected rejection over the cap, got %v", err)
+	}
+	req = GeminiRequest{SystemInstruction: &GeminiContent{Parts: parts(4)}, Contents: []GeminiContent{{Role: "user", Parts: parts(1)}}}
+	if _, err := NormalizeGeminiRequest(req, opts); err == nil {
+		t.Fatalf("expected systemInstruction over the cap to be rejected")
+	}
+	if _, err := NormalizeGeminiRequest(req, NormalizeOptions{}); err != nil {
+		t.Fatalf("zero must not limit parts: %v", err)
+	}
+}
+
+func TestMaxContents_Trim(t *testing.T) {
+	sys := &GeminiContent{Parts: []GeminiPart{{Text: "sys"}}}
+	req := GeminiRequest{SystemInstruction: sys, Contents: turns("user", "model", "user", "model", "user")}
+	got, err := NormalizeGeminiRequest(req, NormalizeOptions{MaxContents: 2, MaxContentsMode: MaxContentsTrim})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.SystemInstruction != sys {
+		t.Fatalf("systemInstruction must be kept")
+	}
+	if len(got.Contents) != 2 || got.Contents[0].Parts[0].Text != "model-3" || got.Contents[1].Parts[0].Text != "user-4" {
+		t.Fatalf("expected the 2 most recent turns, got %+v", got.Contents)
+	}
+
+	// Trailing model turns: the latest user turn is kept even beyond the cap
+	req = GeminiRequest{Contents: turns("user", "model", "user", "model", "model")}
+	got, err = NormalizeGeminiRequest(req, NormalizeOptions{MaxContents: 1, MaxContentsMode: MaxContentsTrim})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got.Contents) != 3 || got.Contents[0].Parts[0].Text != "user-2" {
+		t.Fatalf("expected trim to keep latest user turn, got %+v", got.Contents)
+	}
+}
+
+func TestGenerationConfig_ExplicitZeroTemperature(t *testing.T) {
+	var req GeminiRequest
+	if err := json.Unmarshal([]byte(`{"contents":[],"generationConfig":{"temperature":0}}`), &req); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if !strings.Contains(string(b), `"temperature":0`) {
+		t.Fatalf("explicit zero temperature dropped: %s", b)
+	}
+}
+
 func TestGenerationConfig_passthrough(t *testing.T) {
-	req := GeminiRequest{GenerationConfig: &GenerationConfig{Temperature: 0.4, MaxOutputTokens: 123, TopP: 0.9, StopSequences: []string{"STOP"}}}
-	got := NormalizeGeminiRequest(req)
-	if got.GenerationConfig == nil || got.GenerationConfig.MaxOutputTokens != 123 || got.GenerationConfig.TopP != 0.9 || got.GenerationConfig.Temperature != 0.4 {
+	temp := 0.4
+	req := GeminiRequest{GenerationConfig: &GenerationConfig{Temperature: &temp, MaxOutputTokens: 123, TopP: 0.9, StopSequences: []string{"STOP"}}}
+	got, err := NormalizeGeminiRequest(req, NormalizeOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.GenerationConfig == nil || got.GenerationConfig.MaxOutputTokens != 123 || got.GenerationConfig.TopP != 0.9 || got.GenerationConfig.Temperature == nil || *got.GenerationConfig.Temperature != 0.4 {
 		t.Fatalf("generation config altered: %+v", got.GenerationConfig)
 	}
 }
@@ -63,7 +156,7 @@ func TestGeminiRequest_UnknownFields(t *testing.T) {
 	if req.Contents[0].Role != "user" {
 		t.Fatalf("Expected role 'user', got %q", req.Contents[0].Role)
 	}
-	if req.GenerationConfig == nil || req.GenerationConfig.Temperature != 0.7 {
+	if req.GenerationConfig == nil || req.GenerationConfig.Temperature == nil || *req.GenerationConfig.Temperature != 0.7 {
 		t.Fatalf("GenerationConfig not properly set: %+v", req.GenerationConfig)
 	}
 
@@ -103,3 +196,132 @@ func TestGeminiRequest_UnknownFields(t *testing.T) {
 
 	t.Logf("Successfully handled unknown fields: %s", string(marshaledData))
 }
+
+func TestGenerationConfig_SeedPassthrough(t *testing.T) {
+	var req GeminiRequest
+	if err := json.Unmarshal([]byte(`{"contents":[],"generationConfig":{"seed":42,"temperature":0.5}}`), &req); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if req.GenerationConfig == nil || req.GenerationConfig.Seed == nil || *req.GenerationConfig.Seed != 42 {
+		t.Fatalf("seed not decoded: %+v", req.GenerationConfig)
+	}
+	out, _ := json.Marshal(&req)
+	if !strings.Contains(string(out), `"seed":42`) {
+		t.Fatalf("seed not forwarded: %s", out)
+	}
+}
+
+func TestGeminiRequest_UnknownFieldsKeepLargeIntegers(t *testing.T) {
+	// 2^53+1 is not representable as float64
+	in := `{"contents":[],"seed":9007199254740993,"labels":{"id":12345678901234567890}}`
+	var req GeminiRequest
+	if err := json.Unmarshal([]byte(in), &req); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	out, err := json.Marshal(&req)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	for _, want := range []string{`"seed":9007199254740993`, `"id":12345678901234567890`} {
+		if !strings.Contains(string(out), want) {
+			t.Fatalf("expected %s preserved, got %s", want, out)
+		}
+	}
+}
+
+func TestNormalize_AllowedMimeTypes(t *testing.T) {
+	opts := NormalizeOptions{AllowedMimeTypes: []string{"image/png", "audio/*"}}
+	for mt, wantErr := range map[string]bool{
+		"image/png":            false,
+		"IMAGE/PNG":            false,
+		"audio/wav":            false,
+		"image/png; charset=x": false,
+		"image/jpeg":           true,
+		"application/pdf":      true,
+		"audiox/wav":           true,
+		"":                     true,
+	} {
+		req := GeminiRequest{Contents: []GeminiContent{{Role: "user", Parts: []GeminiPart{{Text: "hi"}, {InlineData: &InlineData{MimeType: mt}}}}}}
+		if _, err := NormalizeGeminiRequest(req, opts); (err != nil) != wantErr {
+			t.Fatalf("inlineData %q: unexpected result %v", mt, err)
+		}
+	}
+	// fileData and systemInstruction parts are checked too
+	req := GeminiRequest{
+		SystemInstruction: &GeminiContent{Parts: []GeminiPart{{FileData: &FileData{MimeType: "video/mp4"}}}},
+		Contents:          []GeminiContent{{Role: "user", Parts: []GeminiPart{{Text: "hi"}}}},
+	}
+	if _, err := NormalizeGeminiRequest(req, opts); err == nil {
+		t.Fatal("expected disallowed fileData in systemInstruction to be rejected")
+	}
+	if _, err := NormalizeGeminiRequest(req, NormalizeOptions{}); err != nil {
+		t.Fatalf("empty allowlist must allow every type: %v", err)
+	}
+}
+
+func TestNormalize_CheckCapabilities(t *testing.T) {
+	textOnly := func(model string) bool { return model != "text-only-test" }
+	image := GeminiRequest{Contents: []GeminiContent{{Role: "user", Parts: []GeminiPart{{Text: "hi"}, {FileData: &FileData{MimeType: "IMAGE/png"}}}}}}
+	audio := GeminiRequest{Contents: []GeminiContent{{Role: "user", Parts: []GeminiPart{{InlineData: &InlineData{MimeType: "audio/wav"}}}}}}
+	for _, tc := range []struct {
+		model   string
+		req     GeminiRequest
+		check   bool
+		wantErr bool
+	}{
+		{"text-only-test", image, true, true},
+		{"text-only-test", image, false, false},
+		{"text-only-test", audio, true, false},
+		{"gemini-2.5-flash", image, true, false},
+	} {
+		_, err := NormalizeGeminiRequest(tc.req, NormalizeOptions{Model: tc.model, CheckCapabilities: tc.check, SupportsVision: textOnly})
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%s check=%v: unexpected result %v", tc.model, tc.check, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "does not support image input") {
+			t.Fatalf("unclear error: %v", err)
+		}
+	}
+}
+
+func TestNormalize_ContentFilters(t *testing.T) {
+	ssn := regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`)
+	mk := func() GeminiRequest {
+		return GeminiRequest{
+			SystemInstruction: &GeminiContent{Parts: []GeminiPart{{Text: "ssn 123-45-6789 on file"}}},
+			Contents: []GeminiContent{
+				{Role: "user", Parts: []GeminiPart{{Text: "my ssn is 123-45-6789 and 987-65-4321"}, {InlineData: &InlineData{MimeType: "image/png", Data: "123-45-6789"}}}},
+				{Role: "model", Parts: []GeminiPart{{Text: "call 555-1234 tomorrow"}}},
+			},
+		}
+	}
+
+	orig := mk()
+	out, err := NormalizeGeminiRequest(orig, NormalizeOptions{ContentFilters: []*regexp.Regexp{ssn}})
+	if err != nil {
+		t.Fatalf("redact: %v", err)
+	}
+	if got := out.Contents[0].Parts[0].Text; got != "my ssn is [REDACTED] and [REDACTED]" {
+		t.Fatalf("unexpected redaction %q", got)
+	}
+	if got := out.SystemInstruction.Parts[0].Text; got != "ssn [REDACTED] on file" {
+		t.Fatalf("systemInstruction not redacted: %q", got)
+	}
+	// Non-matching text and non-text parts are left alone
+	if out.Contents[1].Parts[0].Text != "call 555-1234 tomorrow" || out.Contents[0].Parts[1].InlineData.Data != "123-45-6789" {
+		t.Fatalf("unexpected changes: %+v", out.Contents)
+	}
+	// The caller's request is not modified
+	if orig.Contents[0].Parts[0].Text != mk().Contents[0].Parts[0].Text || orig.SystemInstruction.Parts[0].Text != mk().SystemInstruction.Parts[0].Text {
+		t.Fatalf("original request was mutated: %+v", orig)
+	}
+
+	_, err = NormalizeGeminiRequest(mk(), NormalizeOptions{ContentFilters: []*regexp.Regexp{regexp.MustCompile("nomatch"), ssn}, ContentFilterMode: ContentFilterReject})
+	if err == nil || !strings.Contains(err.Error(), "content filter 1") || strings.Contains(err.Error(), "123-45") {
+		t.Fatalf("expected rejection naming the filter only, got %v", err)
+	}
+	clean := GeminiRequest{Contents: []GeminiContent{{Role: "user", Parts: []GeminiPart{{Text: "hello"}}}}}
+	if _, err := NormalizeGeminiRequest(clean, NormalizeOptions{ContentFilters: []*regexp.Regexp{ssn}, ContentFilterMode: ContentFilterReject}); err != nil {
+		t.Fatalf("clean request rejected: %v", err)
+	}
+}
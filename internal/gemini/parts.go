@@ -0,0 +1,150 @@
+package gemini
+
+// isTextPart reports whether p carries text only (optionally flagged as a
+// thought) and no structured payload.
+func isTextPart(p GeminiPart) bool {
+	return p.InlineData == nil && p.FileData == nil && p.FunctionCall == nil && p.FunctionResp == nil
+}
+
+// CoalesceTextParts drops empty text parts and merges adjacent text parts of
+// each candidate in place. Thought text is only merged with thought text, and
+// non-text parts are kept as-is, so they still separate the text around them.
+func CoalesceTextParts(resp *GeminiAPIResponse) {
+	if resp == nil {
+		return
+	}
+	for i := range resp.Candidates {
+		parts := resp.Candidates[i].Content.Parts
+		if len(parts) == 0 {
+			continue
+		}
+		out := parts[:0]
+		for _, p := range parts {
+			if isTextPart(p) {
+				if p.Text == "" {
+					continue
+				}
+				if n := len(out); n > 0 && isTextPart(out[n-1]) && out[n-1].Thought == p.Thought {
+					out[n-1].Text += p.Text
+					continue
+				}
+			}
+			out = append(out, p)
+		}
+		resp.Candidates[i].Content.Parts = out
+	}
+}
+
+// SelectCandidate reduces a multi-candidate response to a single candidate in
+// place: the first one, or with best set the one with the highest
+// avgLogprobs. Candidates without avgLogprobs never beat one that has it, so
+// best falls back to the first candidate when upstream reports none.
+func SelectCandidate(resp *GeminiAPIResponse, best bool) {
+	if resp == nil || len(resp.Candidates) < 2 {
+		return
+	}
+	pick := 0
+	if best {
+		for i, c := range resp.Candidates {
+			if c.AvgLogprobs == nil {
+				continue
+			}
+			if cur := resp.Candidates[pick].AvgLogprobs; cur == nil || *c.AvgLogprobs > *cur {
+				pick = i
+			}
+		}
+	}
+	resp.Candidates = resp.Candidates[pick : pick+1]
+}
+
+// ResponseText returns the non-thought text of the first candidate.
+func ResponseText(resp *GeminiAPIResponse) string {
+	if resp == nil || len(resp.Candidates) == 0 {
+		return ""
+	}
+	var text string
+	for _, p := range resp.Candidates[0].Content.Parts {
+		if !p.Thought {
+			text += p.Text
+		}
+	}
+	return text
+}
+
+// HasContent reports whether any candidate of resp carries a non-empty part.
+func HasContent(resp *GeminiAPIResponse) bool {
+	if resp == nil {
+		return false
+	}
+	for _, c := range resp.Candidates {
+		for _, p := range c.Content.Parts {
+			if p.Text != "" || !isTextPart(p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// StopReasons returns the last candidate finishReason and the promptFeedback
+// blockReason of resp, each empty when upstream did not report one.
+func StopReasons(resp *GeminiAPIResponse) (finishReason, blockReason string) {
+	if resp == nil {
+		return "", ""
+	}
+	for _, c := range resp.Candidates {
+		if c.FinishReason != "" {
+			finishReason = c.FinishReason
+		}
+	}
+	if fb, ok := resp.PromptFeedback.(map[string]interface{}); ok {
+		blockReason, _ = fb["blockReason"].(string)
+	}
+	return finishReason, blockReason
+}
+
+// textOnly reports whether resp carries nothing but candidate text parts, so
+// it can be merged with a neighbouring chunk without losing structure.
+func textOnly(resp *GeminiAPIResponse) bool {
+	if len(resp.Candidates) == 0 || resp.PromptFeedback != nil || resp.AutomaticFunctionCalls != nil {
+		return false
+	}
+	for _, c := range resp.Candidates {
+		if c.AvgLogprobs != nil || c.CitationMetadata != nil || c.FinishReason != "" {
+			return false
+		}
+		for _, p := range c.Content.Parts {
+			if !isTextPart(p) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// TextOnly reports whether resp is a chunk MergeTextChunk can merge.
+func TextOnly(resp *GeminiAPIResponse) bool {
+	return resp != nil && textOnly(resp)
+}
+
+// MergeTextChunk appends the text of the streamed chunk src to dst, candidate
+// by candidate, coalescing adjacent text; src's usage and model version
+// replace dst's when set. It returns false and leaves dst unchanged unless
+// both chunks are TextOnly with the same number of candidates.
+func MergeTextChunk(dst *GeminiAPIResponse, src GeminiAPIResponse) bool {
+	if !TextOnly(dst) || !textOnly(&src) || len(dst.Candidates) != len(src.Candidates) {
+		return false
+	}
+	for i := range dst.Candidates {
+		parts := append([]GeminiPart(nil), dst.Candidates[i].Content.Parts...)
+		dst.Candidates[i].Content.Parts = append(parts, src.Candidates[i].Content.Parts...)
+	}
+	CoalesceTextParts(dst)
+	if src.UsageMetadata != nil {
+		dst.UsageMetadata = src.UsageMetadata
+	}
+	if src.ModelVersion != "" {
+		dst.ModelVersion = src.ModelVersion
+	}
+	return true
+}
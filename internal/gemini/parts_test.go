@@ -0,0 +1,106 @@
+package gemini
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCoalesceTextParts(t *testing.T) {
+	call := &FunctionCall{Name: "f"}
+	resp := &GeminiAPIResponse{Candidates: []Candidate{{}, {}}}
+	resp.Candidates[0].Content.Parts = []GeminiPart{
+		{Text: ""},
+		{Text: "thinking", Thought: true},
+		{Text: " more", Thought: true},
+		{Text: "Hello"},
+		{Text: ""},
+		{Text: ", world"},
+		{FunctionCall: call},
+		{Text: "after"},
+	}
+	resp.Candidates[1].Content.Parts = []GeminiPart{{Text: ""}}
+
+	CoalesceTextParts(resp)
+
+	want := []GeminiPart{
+		{Text: "thinking more", Thought: true},
+		{Text: "Hello, world"},
+		{FunctionCall: call},
+		{Text: "after"},
+	}
+	if got := resp.Candidates[0].Content.Parts; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected parts:\n got %+v\nwant %+v", got, want)
+	}
+	if got := resp.Candidates[1].Content.Parts; len(got) != 0 {
+		t.Fatalf("expected empty parts to be dropped, got %+v", got)
+	}
+}
+
+func TestSelectCandidate(t *testing.T) {
+	lp := func(v float64) *float64 { return &v }
+	mk := func(probs ...*float64) *GeminiAPIResponse {
+		resp := &GeminiAPIResponse{}
+		for _, p := range probs {
+			resp.Candidates = append(resp.Candidates, Candidate{AvgLogprobs: p})
+		}
+		return resp
+	}
+	for _, tc := range []struct {
+		name string
+		resp *GeminiAPIResponse
+		best bool
+		want *float64
+	}{
+		{"first", mk(lp(-0.9), lp(-0.1)), false, lp(-0.9)},
+		{"best", mk(lp(-0.9), nil, lp(-0.1), lp(-0.5)), true, lp(-0.1)},
+		{"best without logprobs", mk(nil, nil), true, nil},
+		{"best skips missing first", mk(nil, lp(-2)), true, lp(-2)},
+	} {
+		SelectCandidate(tc.resp, tc.best)
+		if len(tc.resp.Candidates) != 1 || !reflect.DeepEqual(tc.resp.Candidates[0].AvgLogprobs, tc.want) {
+			t.Fatalf("%s: got %+v", tc.name, tc.resp.Candidates)
+		}
+	}
+}
+
+func TestMergeTextChunk(t *testing.T) {
+	chunk := func(parts ...GeminiPart) GeminiAPIResponse {
+		resp := GeminiAPIResponse{Candidates: []Candidate{{}}}
+		resp.Candidates[0].Content.Parts = parts
+		return resp
+	}
+	dst := chunk(GeminiPart{Text: "think", Thought: true})
+	orig := dst.Candidates[0].Content.Parts
+	if !MergeTextChunk(&dst, chunk(GeminiPart{Text: "ing", Thought: true}, GeminiPart{Text: "Hi"})) {
+		t.Fatal("expected text chunks to merge")
+	}
+	src := chunk(GeminiPart{Text: " there"})
+	src.UsageMetadata = &UsageMetadata{TotalTokenCount: 3}
+	if !MergeTextChunk(&dst, src) {
+		t.Fatal("expected text chunks to merge")
+	}
+	want := []GeminiPart{{Text: "thinking", Thought: true}, {Text: "Hi there"}}
+	if got := dst.Candidates[0].Content.Parts; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected parts:\n got %+v\nwant %+v", got, want)
+	}
+	if dst.UsageMetadata == nil || dst.UsageMetadata.TotalTokenCount != 3 {
+		t.Fatalf("expected latest usage, got %+v", dst.UsageMetadata)
+	}
+	if orig[0].Text != "think" {
+		t.Fatalf("merge must not write through to the first chunk's parts")
+	}
+
+	before := dst.Candidates[0].Content.Parts
+	for _, other := range []GeminiAPIResponse{
+		chunk(GeminiPart{FunctionCall: &FunctionCall{Name: "f"}}),
+		{UsageMetadata: &UsageMetadata{TotalTokenCount: 9}},
+		{Candidates: []Candidate{{}, {}}},
+	} {
+		if MergeTextChunk(&dst, other) {
+			t.Fatalf("expected %+v not to merge", other)
+		}
+	}
+	if !reflect.DeepEqual(dst.Candidates[0].Content.Parts, before) || dst.UsageMetadata.TotalTokenCount != 3 {
+		t.Fatalf("failed merges must leave dst unchanged: %+v", dst)
+	}
+}
@@ -0,0 +1,139 @@
+package gemini
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ThinkingConfig holds the reasoning settings of a generation config. Fields
+// the proxy does not model (e.g. thinkingLevel) are kept in Extra and passed
+// through unchanged.
+type ThinkingConfig struct {
+	IncludeThoughts bool
+	// ThinkingBudget is nil when the client did not set one. Zero disables
+	// thinking and -1 asks for a dynamic budget.
+	ThinkingBudget *int
+	Extra          map[string]json.RawMessage
+}
+
+// UnmarshalJSON parses a thinkingConfig object leniently: snake_case keys,
+// quoted numbers and quoted booleans are accepted. Anything other than an
+// object is rejected so clients get a clear 400 instead of an upstream one.
+func (tc *ThinkingConfig) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("thinkingConfig must be an object like {\"thinkingBudget\": 1024, \"includeThoughts\": true}")
+	}
+	*tc = ThinkingConfig{}
+	for key, v := range raw {
+		switch key {
+		case "includeThoughts", "include_thoughts":
+			b, err := lenientBool(v)
+			if err != nil {
+				return fmt.Errorf("thinkingConfig.includeThoughts must be a boolean, got %s", v)
+			}
+			tc.IncludeThoughts = b
+		case "thinkingBudget", "thinking_budget":
+			n, err := lenientInt(v)
+			if err != nil {
+				return fmt.Errorf("thinkingConfig.thinkingBudget must be an integer, got %s", v)
+			}
+			tc.ThinkingBudget = &n
+		default:
+			if tc.Extra == nil {
+				tc.Extra = map[string]json.RawMessage{}
+			}
+			tc.Extra[key] = v
+		}
+	}
+	return nil
+}
+
+// MarshalJSON writes the modeled fields in their canonical camelCase form
+// alongside any passthrough fields.
+func (tc ThinkingConfig) MarshalJSON() ([]byte, error) {
+	out := make(map[string]any, len(tc.Extra)+2)
+	for k, v := range tc.Extra {
+		out[k] = v
+	}
+	if tc.IncludeThoughts {
+		out["includeThoughts"] = true
+	}
+	if tc.ThinkingBudget != nil {
+		out["thinkingBudget"] = *tc.ThinkingBudget
+	}
+	return json.Marshal(out)
+}
+
+func lenientBool(v json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(v, &b); err == nil {
+		return b, nil
+	}
+	var s string
+	if err := json.Unmarshal(v, &s); err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(strings.TrimSpace(s))
+}
+
+func lenientInt(v json.RawMessage) (int, error) {
+	var f float64
+	if err := json.Unmarshal(v, &f); err != nil {
+		var s string
+		if err := json.Unmarshal(v, &s); err != nil {
+			return 0, err
+		}
+		return strconv.Atoi(strings.TrimSpace(s))
+	}
+	if f != float64(int(f)) {
+		return 0, fmt.Errorf("not an integer: %v", f)
+	}
+	return int(f), nil
+}
+
+// thinkingBudgetRange is the accepted thinkingBudget range of a model family.
+// -1 (dynamic) is always accepted; 0 only when canDisable is set.
+type thinkingBudgetRange struct {
+	min, max   int
+	canDisable bool
+}
+
+// thinkingBudgetRanges is keyed by model name prefix. Models not listed here
+// are passed through unvalidated.
+var thinkingBudgetRanges = []struct {
+	prefix string
+	r      thinkingBudgetRange
+}{
+	{"gemini-2.5-pro", thinkingBudgetRange{min: 128, max: 32768}},
+	{"gemini-2.5-flash", thinkingBudgetRange{min: 1, max: 24576, canDisable: true}},
+}
+
+// validateThinkingBudget checks budget against the known range for model.
+func validateThinkingBudget(model string, budget int) error {
+	for _, e := range thinkingBudgetRanges {
+		if !strings.HasPrefix(model, e.prefix) {
+			continue
+		}
+		r := e.r
+		if budget == -1 || (budget >= r.min && budget <= r.max) || (budget == 0 && r.canDisable) {
+			return nil
+		}
+		if r.canDisable {
+			return fmt.Errorf("thinkingBudget %d out of range for %s: use -1 (dynamic), 0 (off) or %d..%d", budget, model, r.min, r.max)
+		}
+		return fmt.Errorf("thinkingBudget %d out of range for %s: use -1 (dynamic) or %d..%d", budget, model, r.min, r.max)
+	}
+	return nil
+}
+
+// String renders the config as JSON for logging.
+func (tc *ThinkingConfig) String() string {
+	if tc == nil {
+		return "<nil>"
+	}
+	b, _ := json.Marshal(tc)
+	return string(b)
+}
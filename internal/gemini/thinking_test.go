@@ -0,0 +1,60 @@
+package gemini
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestThinkingConfig_LenientParseAndPassthrough(t *testing.T) {
+	var req GeminiRequest
+	body := `{"contents":[],"generationConfig":{"thinkingConfig":{"thinking_budget":"1024","includeThoughts":"true","thinkingLevel":"high"}}}`
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	tc := req.GenerationConfig.ThinkingConfig
+	if tc == nil || !tc.IncludeThoughts || tc.ThinkingBudget == nil || *tc.ThinkingBudget != 1024 {
+		t.Fatalf("unexpected thinking config: %v", tc)
+	}
+	b, err := json.Marshal(tc)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	want := `{"includeThoughts":true,"thinkingBudget":1024,"thinkingLevel":"high"}`
+	if string(b) != want {
+		t.Fatalf("got %s, want %s", b, want)
+	}
+}
+
+func TestThinkingConfig_RejectsInvalidShapes(t *testing.T) {
+	for _, tc := range []string{`"high"`, `[1]`, `{"thinkingBudget":"lots"}`, `{"thinkingBudget":1.5}`, `{"includeThoughts":"maybe"}`} {
+		var req GeminiRequest
+		err := json.Unmarshal([]byte(`{"contents":[],"generationConfig":{"thinkingConfig":`+tc+`}}`), &req)
+		if err == nil || !strings.Contains(err.Error(), "thinkingConfig") {
+			t.Fatalf("%s: expected thinkingConfig error, got %v", tc, err)
+		}
+	}
+}
+
+func TestNormalize_ThinkingBudgetRange(t *testing.T) {
+	for _, tc := range []struct {
+		model   string
+		budget  int
+		wantErr bool
+	}{
+		{"gemini-2.5-pro", -1, false},
+		{"gemini-2.5-pro", 0, true},
+		{"gemini-2.5-pro", 64, true},
+		{"gemini-2.5-pro", 32768, false},
+		{"gemini-2.5-flash", 0, false},
+		{"gemini-2.5-flash", 24577, true},
+		{"gemini-3-pro-preview-11-2025", 100000, false},
+	} {
+		budget := tc.budget
+		req := GeminiRequest{GenerationConfig: &GenerationConfig{ThinkingConfig: &ThinkingConfig{ThinkingBudget: &budget}}}
+		_, err := NormalizeGeminiRequest(req, NormalizeOptions{Model: tc.model})
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%s budget=%d: unexpected result %v", tc.model, tc.budget, err)
+		}
+	}
+}
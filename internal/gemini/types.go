@@ -1,8 +1,10 @@
 package gemini
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	// "gcli2api/internal/utils"
 	// "github.com/sirupsen/logrus"
 )
@@ -48,12 +50,22 @@ type FunctionDeclaration struct {
 }
 
 type GenerationConfig struct {
-	Temperature     float64  `json:"temperature,omitempty"`
+	// Temperature is a pointer so an explicit 0 (greedy decoding) is sent
+	// rather than dropped as empty.
+	Temperature     *float64 `json:"temperature,omitempty"`
 	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
 	TopP            float64  `json:"topP,omitempty"`
 	StopSequences   []string `json:"stopSequences,omitempty"`
+	// CandidateCount asks upstream for several candidates, which
+	// candidateSelection then reduces to one.
+	CandidateCount *int `json:"candidateCount,omitempty"`
+	// ResponseLogprobs makes upstream report avgLogprobs per candidate, as
+	// candidateSelection "best" needs.
+	ResponseLogprobs *bool `json:"responseLogprobs,omitempty"`
+	// Seed fixes the sampling seed for reproducible outputs.
+	Seed *int64 `json:"seed,omitempty"`
 	// ThinkingConfig carries optional reasoning/thinking settings passed through to upstream APIs.
-	ThinkingConfig interface{} `json:"thinkingConfig,omitempty"`
+	ThinkingConfig *ThinkingConfig `json:"thinkingConfig,omitempty"`
 }
 
 type GeminiRequest struct {
@@ -74,6 +86,14 @@ type Candidate struct {
 	Content struct {
 		Parts []GeminiPart `json:"parts"`
 	} `json:"content"`
+	// AvgLogprobs is the candidate's average token log probability, when
+	// upstream reports it.
+	AvgLogprobs *float64 `json:"avgLogprobs,omitempty"`
+	// CitationMetadata carries upstream source attributions as-is.
+	CitationMetadata interface{} `json:"citationMetadata,omitempty"`
+	// FinishReason is why upstream stopped generating this candidate, e.g.
+	// "STOP" or "SAFETY".
+	FinishReason string `json:"finishReason,omitempty"`
 }
 
 type GeminiAPIResponse struct {
@@ -81,6 +101,8 @@ type GeminiAPIResponse struct {
 	UsageMetadata          *UsageMetadata `json:"usageMetadata,omitempty"`
 	PromptFeedback         interface{}    `json:"promptFeedback,omitempty"`
 	AutomaticFunctionCalls interface{}    `json:"automaticFunctionCallingHistory,omitempty"`
+	// ModelVersion identifies the exact backend model that served the response.
+	ModelVersion string `json:"modelVersion,omitempty"`
 }
 
 // UnmarshalJSON implements custom JSON unmarshaling for GeminiRequest
@@ -125,7 +147,7 @@ func (gr *GeminiRequest) UnmarshalJSON(data []byte) error {
 	for key, rawValue := range raw {
 		if !knownFields[key] {
 			var value interface{}
-			if err := json.Unmarshal(rawValue, &value); err != nil {
+			if err := UnmarshalUseNumber(rawValue, &value); err != nil {
 				return fmt.Errorf("failed to unmarshal unknown field %s: %v", key, err)
 			}
 			gr.UnknownFields[key] = value
@@ -158,7 +180,7 @@ func (gr *GeminiRequest) MarshalJSON() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := json.Unmarshal(tempData, &result); err != nil {
+	if err := UnmarshalUseNumber(tempData, &result); err != nil {
 		return nil, err
 	}
 
@@ -170,3 +192,18 @@ func (gr *GeminiRequest) MarshalJSON() ([]byte, error) {
 	// Marshal final result
 	return json.Marshal(result)
 }
+
+// UnmarshalUseNumber is json.Unmarshal with Decoder.UseNumber: numbers
+// landing in interface{} values decode as json.Number rather than float64,
+// so large integers such as seeds, ids and token counts round-trip exactly.
+func UnmarshalUseNumber(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("invalid data after top-level JSON value")
+	}
+	return nil
+}
@@ -2,12 +2,15 @@ package httpx
 
 import (
 	"context"
+	"errors"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	socks5proxy "golang.org/x/net/proxy"
 	"golang.org/x/oauth2"
 )
@@ -49,6 +52,85 @@ func NewOAuthHTTPClient(ts oauth2.TokenSource, proxyURL *url.URL) *http.Client {
 	}
 }
 
+// CheckProxyTCP verifies the proxy host accepts TCP connections within timeout.
+// A missing port defaults to 80 for http and 1080 for socks5.
+func CheckProxyTCP(proxyURL *url.URL, timeout time.Duration) error {
+	host := proxyURL.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		switch proxyURL.Scheme {
+		case "http":
+			host = net.JoinHostPort(host, "80")
+		case "socks5":
+			host = net.JoinHostPort(host, "1080")
+		}
+	}
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// ProxyMonitor periodically probes a proxy with CheckProxyTCP and caches the
+// last result so readiness checks never dial on the request path.
+type ProxyMonitor struct {
+	url      *url.URL
+	interval time.Duration
+	timeout  time.Duration
+
+	mu      sync.RWMutex
+	lastErr error
+	checked bool
+}
+
+// NewProxyMonitor creates a monitor for proxyURL probing every interval.
+func NewProxyMonitor(proxyURL *url.URL, interval time.Duration) *ProxyMonitor {
+	return &ProxyMonitor{url: proxyURL, interval: interval, timeout: 5 * time.Second}
+}
+
+// Start probes once immediately and then on every interval until ctx is done.
+func (m *ProxyMonitor) Start(ctx context.Context) {
+	go func() {
+		m.probe()
+		t := time.NewTicker(m.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				m.probe()
+			}
+		}
+	}()
+}
+
+func (m *ProxyMonitor) probe() {
+	err := CheckProxyTCP(m.url, m.timeout)
+	m.mu.Lock()
+	prevErr, prevChecked := m.lastErr, m.checked
+	m.lastErr, m.checked = err, true
+	m.mu.Unlock()
+	// Log transitions only to keep periodic probes quiet
+	switch {
+	case err != nil && (prevErr == nil || !prevChecked):
+		logrus.Warnf("proxy tcp check failed: %v", err)
+	case err == nil && (prevErr != nil || !prevChecked):
+		logrus.Info("tcp check for proxy is successful")
+	}
+}
+
+// Err reports the cached result of the last probe; nil means the proxy was
+// reachable. Before the first probe completes it returns a pending error.
+func (m *ProxyMonitor) Err() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !m.checked {
+		return errors.New("proxy check pending")
+	}
+	return m.lastErr
+}
+
 // WithRetries runs fn with exponential backoff w/ jitter.
 func WithRetries(ctx context.Context, max int, baseDelay time.Duration, fn func(attempt int) error) error {
 	var err error
@@ -63,17 +145,35 @@ func WithRetries(ctx context.Context, max int, baseDelay time.Duration, fn func(
 		if attempt == max {
 			break
 		}
-		// jitter: 1.0 to 1.2 multiplier
-		jitter := 1.0 + rand.Float64()*0.2
-		factor := 1 << uint(attempt)
-		delay := time.Duration(float64(baseDelay) * jitter * float64(factor))
-		t := time.NewTimer(delay)
-		select {
-		case <-ctx.Done():
-			t.Stop()
-			return ctx.Err()
-		case <-t.C:
+		if err := Sleep(ctx, Backoff(baseDelay, attempt, 0)); err != nil {
+			return err
 		}
 	}
 	return err
 }
+
+// Backoff returns the jittered exponential delay after the given zero-based
+// attempt: baseDelay * 2^attempt * [1.0, 1.2), capped at maxDelay when
+// maxDelay > 0.
+func Backoff(baseDelay time.Duration, attempt int, maxDelay time.Duration) time.Duration {
+	// jitter: 1.0 to 1.2 multiplier
+	jitter := 1.0 + rand.Float64()*0.2
+	factor := 1 << uint(min(attempt, 30))
+	delay := time.Duration(float64(baseDelay) * jitter * float64(factor))
+	if maxDelay > 0 && delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+// Sleep waits for d, returning early with ctx's error if it is done first.
+func Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
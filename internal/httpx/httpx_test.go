@@ -3,6 +3,8 @@ package httpx
 import (
 	"context"
 	"errors"
+	"net"
+	"net/url"
 	"testing"
 	"time"
 )
@@ -44,3 +46,53 @@ func TestWithRetries_StopsAfterMax(t *testing.T) {
 		t.Fatalf("unexpected attempts: %d", attempts)
 	}
 }
+
+func TestCheckProxyTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	if err := CheckProxyTCP(&url.URL{Scheme: "http", Host: addr}, time.Second); err != nil {
+		t.Fatalf("expected reachable proxy, got %v", err)
+	}
+	_ = ln.Close()
+	if err := CheckProxyTCP(&url.URL{Scheme: "socks5", Host: addr}, time.Second); err == nil {
+		t.Fatalf("expected error for closed listener")
+	}
+}
+
+func TestProxyMonitor_CachesResult(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	m := NewProxyMonitor(&url.URL{Scheme: "http", Host: ln.Addr().String()}, time.Hour)
+	if m.Err() == nil {
+		t.Fatalf("expected pending error before first probe")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.Start(ctx)
+	deadline := time.Now().Add(2 * time.Second)
+	for m.Err() != nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := m.Err(); err != nil {
+		t.Fatalf("expected healthy proxy, got %v", err)
+	}
+}
+
+func TestBackoff_Capped(t *testing.T) {
+	base := 100 * time.Millisecond
+	for attempt := 0; attempt < 40; attempt++ {
+		d := Backoff(base, attempt, time.Second)
+		if d < min(base<<min(attempt, 4), time.Second) || d > time.Second {
+			t.Fatalf("attempt %d: delay %v out of bounds", attempt, d)
+		}
+	}
+	if d := Backoff(base, 3, 0); d < 800*time.Millisecond || d > 960*time.Millisecond {
+		t.Fatalf("uncapped delay out of bounds: %v", d)
+	}
+}
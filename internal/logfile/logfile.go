@@ -0,0 +1,109 @@
+// Package logfile is a minimal size-rotated log file writer, so single-box
+// deployments can retain logs without pulling in a rotation library.
+package logfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// File is an io.WriteCloser appending to path. Once a write would grow the
+// file past maxBytes it is renamed to path.1 (shifting older backups up to
+// path.<maxBackups>, dropping the oldest) and a fresh file is started.
+type File struct {
+	mu         sync.Mutex
+	path       string
+	maxBytes   int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+// Open opens (or creates) path for appending. maxBytes <= 0 disables
+// rotation; maxBackups <= 0 keeps no backups, so rotation truncates.
+func Open(path string, maxBytes int64, maxBackups int) (*File, error) {
+	if dir := filepath.Dir(path); dir != "." && dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("create log directory %q: %w", dir, err)
+		}
+	}
+	lf := &File{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+func (lf *File) open() error {
+	f, err := os.OpenFile(lf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open log file: %w", err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat log file: %w", err)
+	}
+	lf.f, lf.size = f, st.Size()
+	return nil
+}
+
+// Write appends p, rotating first when it would exceed the size limit. A
+// single write larger than the limit still lands in one (fresh) file.
+func (lf *File) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.f == nil {
+		return 0, os.ErrClosed
+	}
+	if lf.maxBytes > 0 && lf.size > 0 && lf.size+int64(len(p)) > lf.maxBytes {
+		if err := lf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := lf.f.Write(p)
+	lf.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups and reopens an empty file. Callers hold mu.
+func (lf *File) rotate() error {
+	if err := lf.f.Close(); err != nil {
+		return fmt.Errorf("close log file: %w", err)
+	}
+	lf.f = nil
+	if lf.maxBackups <= 0 {
+		if err := os.Remove(lf.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove log file: %w", err)
+		}
+		return lf.open()
+	}
+	_ = os.Remove(lf.backup(lf.maxBackups))
+	for i := lf.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(lf.backup(i), lf.backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("rotate log file: %w", err)
+		}
+	}
+	if err := os.Rename(lf.path, lf.backup(1)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("rotate log file: %w", err)
+	}
+	return lf.open()
+}
+
+func (lf *File) backup(i int) string {
+	return fmt.Sprintf("%s.%d", lf.path, i)
+}
+
+// Close closes the current file. Later writes fail with os.ErrClosed.
+func (lf *File) Close() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.f == nil {
+		return nil
+	}
+	err := lf.f.Close()
+	lf.f = nil
+	return err
+}
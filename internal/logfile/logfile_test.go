@@ -0,0 +1,52 @@
+package logfile
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFile_RotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "proxy.log")
+	lf, err := Open(path, 10, 2)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer lf.Close()
+	for _, line := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if _, err := lf.Write([]byte(line)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	want := map[string]string{
+		path:        "dddddd\n",
+		path + ".1": "cccccc\n",
+		path + ".2": "bbbbbb\n",
+	}
+	for p, content := range want {
+		b, err := os.ReadFile(p)
+		if err != nil || string(b) != content {
+			t.Fatalf("%s: got %q (%v), want %q", p, b, err, content)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected only 2 backups, stat .3: %v", err)
+	}
+}
+
+func TestFile_AppendsAcrossOpens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	for _, line := range []string{"one\n", "two\n"} {
+		lf, err := Open(path, 0, 0)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		_, _ = lf.Write([]byte(line))
+		lf.Close()
+	}
+	b, _ := os.ReadFile(path)
+	if strings.Count(string(b), "\n") != 2 {
+		t.Fatalf("expected appended lines, got %q", b)
+	}
+}
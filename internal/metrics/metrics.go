@@ -0,0 +1,258 @@
+// Package metrics is a minimal Prometheus text-format exposition for the
+// handful of series the proxy exports. It avoids pulling in the full client
+// library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// collector is implemented by every metric kind.
+type collector interface {
+	name() string
+	write(w io.Writer)
+}
+
+// Registry holds metrics for exposition.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// Default is the process-wide registry served at /metrics.
+var Default = &Registry{}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteText writes all metrics in the Prometheus text format, sorted by name.
+func (r *Registry) WriteText(w io.Writer) {
+	r.mu.Lock()
+	cs := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+	sort.Slice(cs, func(i, j int) bool { return cs[i].name() < cs[j].name() })
+	for _, c := range cs {
+		c.write(w)
+	}
+}
+
+// Handler serves the registry in the Prometheus text format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteText(w)
+	})
+}
+
+// DefaultBuckets are latency buckets in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// vec holds per-label-set series of one metric.
+type vec[T any] struct {
+	mu     sync.Mutex
+	n      string
+	help   string
+	labels []string
+	series map[string]*T
+	values map[string][]string
+	newT   func() *T
+}
+
+func newVec[T any](name, help string, labels []string, newT func() *T) *vec[T] {
+	return &vec[T]{n: name, help: help, labels: labels, series: map[string]*T{}, values: map[string][]string{}, newT: newT}
+}
+
+func (v *vec[T]) name() string { return v.n }
+
+// get returns the series for labelValues, creating it if needed. The caller
+// must hold v.mu.
+func (v *vec[T]) get(labelValues []string) *T {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.n, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	t, ok := v.series[key]
+	if !ok {
+		t = v.newT()
+		v.series[key] = t
+		v.values[key] = append([]string(nil), labelValues...)
+	}
+	return t
+}
+
+// sortedKeys returns series keys in a stable order. The caller must hold v.mu.
+func (v *vec[T]) sortedKeys() []string {
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelString renders {a="x",b="y"} plus any extra pairs.
+func labelString(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, "%s=%q", n, values[i])
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if sb.Len() > 1 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, "%s=%q", extra[i], extra[i+1])
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct{ v *vec[float64] }
+
+// NewGaugeVec creates and registers a gauge with the given label names.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{v: newVec(name, help, labels, func() *float64 { return new(float64) })}
+	Default.register(g)
+	return g
+}
+
+// Set sets the gauge for labelValues.
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.v.mu.Lock()
+	defer g.v.mu.Unlock()
+	*g.v.get(labelValues) = value
+}
+
+// Delete removes the series for labelValues, if present.
+func (g *GaugeVec) Delete(labelValues ...string) {
+	g.v.mu.Lock()
+	defer g.v.mu.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	delete(g.v.series, key)
+	delete(g.v.values, key)
+}
+
+// Reset removes all series.
+func (g *GaugeVec) Reset() {
+	g.v.mu.Lock()
+	defer g.v.mu.Unlock()
+	g.v.series = map[string]*float64{}
+	g.v.values = map[string][]string{}
+}
+
+func (g *GaugeVec) name() string { return g.v.n }
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.v.mu.Lock()
+	defer g.v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.v.n, g.v.help, g.v.n)
+	for _, k := range g.v.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", g.v.n, labelString(g.v.labels, g.v.values[k]), formatFloat(*g.v.series[k]))
+	}
+}
+
+// CounterVec is a monotonically increasing counter partitioned by labels.
+type CounterVec struct{ v *vec[float64] }
+
+// NewCounterVec creates and registers a counter with the given label names.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{v: newVec(name, help, labels, func() *float64 { return new(float64) })}
+	Default.register(c)
+	return c
+}
+
+// Inc adds one to the counter for labelValues.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.v.mu.Lock()
+	defer c.v.mu.Unlock()
+	*c.v.get(labelValues)++
+}
+
+func (c *CounterVec) name() string { return c.v.n }
+
+func (c *CounterVec) write(w io.Writer) {
+	c.v.mu.Lock()
+	defer c.v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.v.n, c.v.help, c.v.n)
+	for _, k := range c.v.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.v.n, labelString(c.v.labels, c.v.values[k]), formatFloat(*c.v.series[k]))
+	}
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, non-cumulative
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	v       *vec[histogram]
+	buckets []float64
+}
+
+// NewHistogramVec creates and registers a histogram with the given upper
+// bounds and label names.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	h := &HistogramVec{buckets: b}
+	h.v = newVec(name, help, labels, func() *histogram { return &histogram{counts: make([]uint64, len(b))} })
+	Default.register(h)
+	return h
+}
+
+// Observe records value for labelValues.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.v.mu.Lock()
+	defer h.v.mu.Unlock()
+	s := h.v.get(labelValues)
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *HistogramVec) name() string { return h.v.n }
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.v.mu.Lock()
+	defer h.v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.v.n, h.v.help, h.v.n)
+	for _, k := range h.v.sortedKeys() {
+		s, lv := h.v.series[k], h.v.values[k]
+		var cum uint64
+		for i, ub := range h.buckets {
+			cum += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.v.n, labelString(h.v.labels, lv, "le", formatFloat(ub)), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.v.n, labelString(h.v.labels, lv, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.v.n, labelString(h.v.labels, lv), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.v.n, labelString(h.v.labels, lv), s.count)
+	}
+}
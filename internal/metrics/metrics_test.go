@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteText_HistogramAndGauge(t *testing.T) {
+	r := &Registry{}
+	h := &HistogramVec{buckets: []float64{0.1, 1}}
+	h.v = newVec("test_latency_seconds", "Latency.", []string{"model"}, func() *histogram { return &histogram{counts: make([]uint64, 2)} })
+	g := &GaugeVec{v: newVec("test_info", "Info.", []string{"credential", "project"}, func() *float64 { return new(float64) })}
+	r.register(h)
+	r.register(g)
+
+	h.Observe(0.05, "flash")
+	h.Observe(0.5, "flash")
+	h.Observe(5, "flash")
+	g.Set(1, "~/a.json", "p1")
+
+	var buf bytes.Buffer
+	r.WriteText(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{model="flash",le="0.1"} 1`,
+		`test_latency_seconds_bucket{model="flash",le="1"} 2`,
+		`test_latency_seconds_bucket{model="flash",le="+Inf"} 3`,
+		`test_latency_seconds_sum{model="flash"} 5.55`,
+		`test_latency_seconds_count{model="flash"} 3`,
+		"# TYPE test_info gauge",
+		`test_info{credential="~/a.json",project="p1"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in:\n%s", want, out)
+		}
+	}
+	// Sorted by metric name
+	if strings.Index(out, "test_info") > strings.Index(out, "test_latency_seconds") {
+		t.Fatalf("expected metrics sorted by name:\n%s", out)
+	}
+
+	g.Reset()
+	buf.Reset()
+	r.WriteText(&buf)
+	if strings.Contains(buf.String(), "p1") {
+		t.Fatalf("expected gauge series cleared after Reset:\n%s", buf.String())
+	}
+}
+
+func TestWriteText_Counter(t *testing.T) {
+	r := &Registry{}
+	c := &CounterVec{v: newVec("test_rejected_total", "Rejected.", []string{"reason"}, func() *float64 { return new(float64) })}
+	r.register(c)
+	c.Inc("model")
+	c.Inc("model")
+	c.Inc("concurrency")
+
+	var buf bytes.Buffer
+	r.WriteText(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE test_rejected_total counter",
+		`test_rejected_total{reason="concurrency"} 1`,
+		`test_rejected_total{reason="model"} 2`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in:\n%s", want, out)
+		}
+	}
+}
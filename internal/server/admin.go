@@ -0,0 +1,170 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"gcli2api/internal/buildinfo"
+	"gcli2api/internal/codeassist"
+	"gcli2api/internal/config"
+	"gcli2api/internal/metrics"
+)
+
+// registerAdmin adds the admin and metrics routes to mux.
+func (s *Server) registerAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/credentials", s.handleAdminCredentials)
+	mux.HandleFunc("/admin/credentials/", s.handleAdminDrain)
+	mux.HandleFunc("/admin/pause", s.handleAdminPause)
+	mux.HandleFunc("/admin/resume", s.handleAdminResume)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+}
+
+// adminOnMainListener reports whether the admin and metrics routes are served
+// on the main listener: only without a dedicated adminListen, and only when
+// the main listener is loopback unless adminOnPublicListener opts in.
+func (s *Server) adminOnMainListener() bool {
+	if s.cfg.AdminListen != "" {
+		return false
+	}
+	return config.IsLoopbackHost(s.cfg.Host) || s.cfg.AdminOnPublicListener
+}
+
+// credentialLister is implemented by clients that can report their pool
+// units (the MultiClient).
+type credentialLister interface {
+	Credentials() []codeassist.CredentialStatus
+}
+
+// handleAdminCredentials lists pool units with their configured or resolved
+// project ids.
+func (s *Server) handleAdminCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorizeAdmin(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	creds := []codeassist.CredentialStatus{}
+	if l, ok := s.caClient.(credentialLister); ok {
+		creds = l.Credentials()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"credentials": creds})
+}
+
+// credentialDrainer is implemented by clients whose pool units can be taken
+// out of rotation (the MultiClient).
+type credentialDrainer interface {
+	SetDraining(idx int, draining bool) error
+}
+
+// handleAdminDrain serves POST /admin/credentials/{index}/drain and
+// /undrain. A drained unit gets no new requests while in-flight ones finish,
+// so a credential can be rotated out without failing traffic.
+func (s *Server) handleAdminDrain(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/admin/credentials/")
+	idxStr, action, _ := strings.Cut(rest, "/")
+	idx, err := strconv.Atoi(idxStr)
+	if err != nil || (action != "drain" && action != "undrain") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorizeAdmin(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	d, ok := s.caClient.(credentialDrainer)
+	if !ok {
+		http.Error(w, "credential draining is not supported by this client", http.StatusNotImplemented)
+		return
+	}
+	draining := action == "drain"
+	if err := d.SetDraining(idx, draining); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"index": idx, "draining": draining})
+}
+
+// handleAdminPause puts the proxy into maintenance mode: generation requests
+// are rejected with 503 until resumed.
+func (s *Server) handleAdminPause(w http.ResponseWriter, r *http.Request) {
+	s.setPaused(w, r, true)
+}
+
+// handleAdminResume leaves maintenance mode.
+func (s *Server) handleAdminResume(w http.ResponseWriter, r *http.Request) {
+	s.setPaused(w, r, false)
+}
+
+func (s *Server) setPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorizeAdmin(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if s.paused.Swap(paused) != paused {
+		if paused {
+			logrus.Warnf("proxy paused by %s: generation requests now return 503", r.RemoteAddr)
+		} else {
+			logrus.Infof("proxy resumed by %s", r.RemoteAddr)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"paused": paused})
+}
+
+// writePaused answers a generation request while in maintenance mode.
+func (s *Server) writePaused(w http.ResponseWriter) {
+	msg := s.cfg.PausedMessage
+	if msg == "" {
+		msg = "service paused for maintenance"
+	}
+	if s.cfg.PausedRetryAfterSeconds > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(s.cfg.PausedRetryAfterSeconds))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"code":    http.StatusServiceUnavailable,
+			"status":  "UNAVAILABLE",
+			"message": msg,
+		},
+	})
+}
+
+// handleMetrics serves Prometheus metrics. Like the admin endpoints it
+// requires the API key when one is configured.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeAdmin(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	metrics.Default.Handler().ServeHTTP(w, r)
+}
+
+// handleVersion reports the running build. It is public unless
+// versionRequiresAuth is set.
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.VersionRequiresAuth && !s.authorize(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(buildinfo.Get())
+}
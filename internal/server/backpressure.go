@@ -0,0 +1,37 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"gcli2api/internal/metrics"
+)
+
+// Reasons reported in rateLimitReasonHeader when the proxy itself sheds
+// load, so clients and dashboards can tell which limit was hit.
+const (
+	reasonConcurrency = "concurrency" // server-wide maxConcurrentRequests
+	reasonModel       = "model"       // perModelConcurrency
+)
+
+const rateLimitReasonHeader = "X-RateLimit-Reason"
+
+var rejectedRequests = metrics.NewCounterVec("gcli2api_requests_rejected_total",
+	"Requests answered 429 by the proxy's own limiters.", "reason")
+
+// writeTooManyRequests answers a request shed by one of the proxy's limiters
+// with a 429 carrying the reason header and a Gemini-style error body.
+func writeTooManyRequests(w http.ResponseWriter, reason, msg string) {
+	rejectedRequests.Inc(reason)
+	w.Header().Set(rateLimitReasonHeader, reason)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"code":    http.StatusTooManyRequests,
+			"status":  "RESOURCE_EXHAUSTED",
+			"message": msg,
+			"reason":  reason,
+		},
+	})
+}
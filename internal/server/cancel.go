@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// cancelIDHeader carries a client-chosen id for a streaming request. POSTing
+// that id to /v1beta/cancel/{id} cancels the stream server-side, for clients
+// behind infrastructure that does not reliably propagate disconnects.
+const cancelIDHeader = "X-Cancel-Id"
+
+// maxCancelIDLen bounds client-supplied cancel ids.
+const maxCancelIDLen = 128
+
+// registerCancel makes cancel reachable through /v1beta/cancel/{id} until
+// the returned unregister func runs. An empty id registers nothing; an id
+// already in flight is rejected.
+func (s *Server) registerCancel(id string, cancel context.CancelFunc) (unregister func(), err error) {
+	if id == "" {
+		return func() {}, nil
+	}
+	if len(id) > maxCancelIDLen || strings.Contains(id, "/") {
+		return nil, fmt.Errorf("invalid %s", cancelIDHeader)
+	}
+	// The pointer identifies this registration, so unregistering never
+	// removes a later stream that reused the id after a cancel
+	h := &cancel
+	if _, loaded := s.cancels.LoadOrStore(id, h); loaded {
+		return nil, fmt.Errorf("%s %q is already in use", cancelIDHeader, id)
+	}
+	return func() { s.cancels.CompareAndDelete(id, h) }, nil
+}
+
+// handleCancel cancels the in-flight stream registered under the id in the
+// path, or reports 404 when none is (it finished or never existed).
+func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorize(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/v1beta/cancel/")
+	v, ok := s.cancels.LoadAndDelete(id)
+	if id == "" || !ok {
+		http.Error(w, "no in-flight request with that id", http.StatusNotFound)
+		return
+	}
+	(*v.(*context.CancelFunc))()
+	logrus.Infof("stream %q canceled by client request", id)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"canceled": id})
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gcli2api/internal/codeassist"
+)
+
+// credentialPinner is implemented by clients that can restrict a request to a
+// single pool unit (the MultiClient).
+type credentialPinner interface {
+	NumUnits() int
+}
+
+// applyDebugHeaders honors debug-only request headers when debugHeaders is
+// enabled and returns the context to use for the upstream call.
+//   - X-Credential-Index: pin the request to one pool unit (no rotation)
+//   - X-Debug-Raw-Response: true makes unary generation return the raw
+//     upstream envelope instead of the re-encoded response
+func (s *Server) applyDebugHeaders(ctx context.Context, r *http.Request) (context.Context, error) {
+	if !s.cfg.DebugHeaders {
+		return ctx, nil
+	}
+	if v := strings.TrimSpace(r.Header.Get("X-Credential-Index")); v != "" {
+		idx, err := strconv.Atoi(v)
+		if err != nil {
+			return ctx, fmt.Errorf("invalid X-Credential-Index %q", v)
+		}
+		if ctx, err = s.pinCredential(ctx, idx); err != nil {
+			return ctx, fmt.Errorf("X-Credential-Index: %w", err)
+		}
+	}
+	if v := strings.TrimSpace(r.Header.Get("X-Debug-Raw-Response")); v != "" {
+		raw, err := strconv.ParseBool(v)
+		if err != nil {
+			return ctx, fmt.Errorf("invalid X-Debug-Raw-Response %q", v)
+		}
+		if raw {
+			ctx = codeassist.WithRawResponse(ctx)
+		}
+	}
+	return ctx, nil
+}
+
+// pinCredential restricts requests made with the returned context to pool
+// unit idx.
+func (s *Server) pinCredential(ctx context.Context, idx int) (context.Context, error) {
+	p, ok := s.caClient.(credentialPinner)
+	if !ok {
+		return ctx, fmt.Errorf("credential pinning is not supported by this upstream")
+	}
+	if n := p.NumUnits(); idx < 0 || idx >= n {
+		return ctx, fmt.Errorf("credential index %d out of range (have %d units)", idx, n)
+	}
+	return codeassist.WithPinnedCredential(ctx, idx), nil
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"encoding/json"
+	"slices"
+)
+
+// filterResponseFields applies responseFieldAllowlist/responseFieldDenylist
+// to the top-level fields of v after marshalling. Without either list v is
+// returned unchanged; otherwise the result is a field map ready to encode.
+func (s *Server) filterResponseFields(v any) (any, error) {
+	allow, deny := s.cfg.ResponseFieldAllowlist, s.cfg.ResponseFieldDenylist
+	if len(allow) == 0 && len(deny) == 0 {
+		return v, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	for k := range fields {
+		if (len(allow) > 0 && !slices.Contains(allow, k)) || slices.Contains(deny, k) {
+			delete(fields, k)
+		}
+	}
+	return fields, nil
+}
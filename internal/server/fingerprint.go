@@ -0,0 +1,28 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"gcli2api/internal/gemini"
+)
+
+// fingerprintHeader carries requestFingerprint on generation responses so
+// clients can key their own caches and spot accidental duplicate requests.
+const fingerprintHeader = "X-Request-Fingerprint"
+
+// requestFingerprint hashes the resolved model and the normalized request
+// (after header overrides). Object keys marshal in sorted order, so the same
+// request always yields the same value regardless of client key order.
+func requestFingerprint(model string, req *gemini.GeminiRequest) string {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return ""
+	}
+	h := sha256.New()
+	h.Write([]byte(model))
+	h.Write([]byte{0})
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"gcli2api/internal/codeassist"
+)
+
+const headerUserProject = "X-Goog-User-Project"
+
+// applyForwardHeaders attaches the operator-allowlisted client headers, plus
+// the configured userProject default, to the context for the upstream call.
+func (s *Server) applyForwardHeaders(ctx context.Context, r *http.Request) context.Context {
+	h := http.Header{}
+	for _, name := range s.cfg.ForwardHeaders {
+		for _, v := range r.Header.Values(name) {
+			h.Add(name, v)
+		}
+	}
+	if s.cfg.UserProject != "" && h.Get(headerUserProject) == "" {
+		h.Set(headerUserProject, s.cfg.UserProject)
+	}
+	return codeassist.WithForwardHeaders(ctx, h)
+}
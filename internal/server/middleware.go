@@ -1,9 +1,13 @@
 package server
 
 import (
+	"context"
 	"net/http"
+	"strings"
 	"time"
 
+	"gcli2api/internal/gemini"
+
 	"github.com/sirupsen/logrus"
 )
 
@@ -18,6 +22,12 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter,
+// e.g. to extend write deadlines for streams.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 // Flush implements http.Flusher by forwarding to the underlying ResponseWriter
 func (rw *responseWriter) Flush() {
 	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
@@ -38,6 +48,43 @@ func (s *Server) withLogging(next http.Handler) http.Handler {
 	})
 }
 
+// withHTTPVersionCheck answers HTTP/1.0 requests with 505 when rejectHttp10
+// is set.
+func (s *Server) withHTTPVersionCheck(next http.Handler) http.Handler {
+	if !s.cfg.RejectHTTP10 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !r.ProtoAtLeast(1, 1) {
+			http.Error(w, "HTTP/1.1 or later required", http.StatusHTTPVersionNotSupported)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withRoutePrefix serves next only under routePrefix, stripping it so the
+// routes and path matchers stay prefix-agnostic. Other paths get 404, except
+// /health and /readyz when routePrefixExemptProbes is set.
+func (s *Server) withRoutePrefix(next http.Handler) http.Handler {
+	prefix := s.cfg.RoutePrefix
+	if prefix == "" {
+		return next
+	}
+	stripped := http.StripPrefix(prefix, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		switch {
+		case strings.HasPrefix(p, prefix+"/"):
+			stripped.ServeHTTP(w, r)
+		case s.cfg.RoutePrefixExemptProbes && (p == "/health" || p == "/readyz"):
+			next.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
 // withRecover adds a panic recovery layer to prevent leaking stack traces
 // and to ensure a clean 500 response is sent to the client.
 func (s *Server) withRecover(next http.Handler) http.Handler {
@@ -53,15 +100,69 @@ func (s *Server) withRecover(next http.Handler) http.Handler {
 	})
 }
 
-// withConcurrencyLimit adds simple server-wide concurrency limiting.
+// withConcurrencyLimit adds simple server-wide concurrency limiting. With
+// queueTimeoutMillis set, requests over the limit wait that long for a slot
+// before being rejected.
 func (s *Server) withConcurrencyLimit(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		select {
-		case s.sem <- struct{}{}:
-			defer func() { <-s.sem }()
-			next.ServeHTTP(w, r)
-		default:
-			http.Error(w, "too many concurrent requests", http.StatusTooManyRequests)
+		waitStart := time.Now()
+		if !s.acquireSlot(r.Context()) {
+			writeTooManyRequests(w, reasonConcurrency, "too many concurrent requests")
+			return
 		}
+		defer func() { <-s.sem }()
+		next.ServeHTTP(w, withQueueWait(r, time.Since(waitStart)))
 	})
 }
+
+// acquireSlot takes a server-wide slot, queueing for up to
+// queueTimeoutMillis when none is free. It reports false on timeout or when
+// the client goes away first.
+func (s *Server) acquireSlot(ctx context.Context) bool {
+	select {
+	case s.sem <- struct{}{}:
+		return true
+	default:
+	}
+	if s.cfg.QueueTimeoutMillis <= 0 {
+		return false
+	}
+	timer := time.NewTimer(time.Duration(s.cfg.QueueTimeoutMillis) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case s.sem <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// newModelSems builds one semaphore per perModelConcurrency entry, keyed by
+// the resolved model name so aliases share their target's limit.
+func newModelSems(limits map[string]int) map[string]chan struct{} {
+	sems := make(map[string]chan struct{}, len(limits))
+	for model, n := range limits {
+		if n > 0 {
+			sems[gemini.ResolveModel(model)] = make(chan struct{}, n)
+		}
+	}
+	return sems
+}
+
+// acquireModelSlot takes a slot from model's semaphore without waiting. It
+// reports false when the model is at its limit; models without a limit
+// always succeed. The returned release must be called once done.
+func (s *Server) acquireModelSlot(model string) (release func(), ok bool) {
+	sem, limited := s.modelSems[model]
+	if !limited {
+		return func() {}, true
+	}
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, true
+	default:
+		return nil, false
+	}
+}
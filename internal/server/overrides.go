@@ -0,0 +1,68 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gcli2api/internal/gemini"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	headerTemperature     = "X-Gemini-Temperature"
+	headerMaxOutputTokens = "X-Gemini-Max-Output-Tokens"
+)
+
+// applyGenerationOverrides applies generationConfig overrides from request
+// headers. Body values win unless forceHeaderOverride is set. Malformed or
+// out-of-range values are ignored with a warning.
+func (s *Server) applyGenerationOverrides(model string, r *http.Request, req *gemini.GeminiRequest) {
+	temp, hasTemp := headerTemperatureOverride(r)
+	maxTok, hasMax := headerMaxTokensOverride(model, r)
+	if !hasTemp && !hasMax {
+		return
+	}
+	if req.GenerationConfig == nil {
+		req.GenerationConfig = &gemini.GenerationConfig{}
+	}
+	gc := req.GenerationConfig
+	force := s.cfg.ForceHeaderOverride
+	if hasTemp && (force || gc.Temperature == nil) {
+		gc.Temperature = &temp
+	}
+	if hasMax && (force || gc.MaxOutputTokens == 0) {
+		gc.MaxOutputTokens = maxTok
+	}
+}
+
+func headerTemperatureOverride(r *http.Request) (float64, bool) {
+	v := strings.TrimSpace(r.Header.Get(headerTemperature))
+	if v == "" {
+		return 0, false
+	}
+	t, err := strconv.ParseFloat(v, 64)
+	if err != nil || t < 0 || t > 2 {
+		logrus.Warnf("ignoring %s %q: must be a number in [0, 2]", headerTemperature, v)
+		return 0, false
+	}
+	return t, true
+}
+
+func headerMaxTokensOverride(model string, r *http.Request) (int, bool) {
+	v := strings.TrimSpace(r.Header.Get(headerMaxOutputTokens))
+	if v == "" {
+		return 0, false
+	}
+	limit := 0
+	if info, ok := gemini.LookupModel(model); ok {
+		limit = info.OutputTokenLimit
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || (limit > 0 && n > limit) {
+		logrus.Warnf("ignoring %s %q: must be an integer in [1, %d]", headerMaxOutputTokens, v, limit)
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Replay sends a saved request body upstream the way the generate handlers
+// would: the model is routed (aliases, autoModel) and checked against
+// allowedModels, and the body is normalized with the same options. A
+// non-negative credIndex pins the request to that pool unit. Output is JSON
+// written to w, one line per chunk when streaming.
+func (s *Server) Replay(ctx context.Context, model string, stream bool, credIndex int, body io.Reader, w io.Writer) error {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/", body)
+	if err != nil {
+		return err
+	}
+	model, err = s.routeModel(model, r)
+	if err != nil {
+		return fmt.Errorf("parse request: %w", err)
+	}
+	if !s.validateModel(model) {
+		return fmt.Errorf("unknown model %q", model)
+	}
+	req, err := s.decodeGeminiRequest(model, r)
+	if err != nil {
+		return fmt.Errorf("parse request: %w", err)
+	}
+	if credIndex >= 0 {
+		if ctx, err = s.pinCredential(ctx, credIndex); err != nil {
+			return err
+		}
+	}
+	enc := json.NewEncoder(w)
+	if !stream {
+		resp, err := s.caClient.GenerateContent(ctx, model, "", req)
+		if err != nil {
+			return err
+		}
+		enc.SetIndent("", "  ")
+		return enc.Encode(resp)
+	}
+	out, errs := s.caClient.GenerateContentStream(ctx, model, "", req)
+	// The terminal error, if any, is delivered before out closes
+	for g := range out {
+		if err := enc.Encode(g); err != nil {
+			return err
+		}
+	}
+	return <-errs
+}
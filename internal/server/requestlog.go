@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gcli2api/internal/codeassist"
+	"gcli2api/internal/gemini"
+	"gcli2api/internal/state"
+
+	"github.com/sirupsen/logrus"
+)
+
+// statusClientClosedRequest records requests abandoned by the client
+// (nginx convention; never written to the wire).
+const statusClientClosedRequest = 499
+
+// SetStateStore attaches the state store used for durable request accounting.
+func (s *Server) SetStateStore(st *state.Store) {
+	s.store = st
+}
+
+// recordRequest logs a one-line summary of the request's outcome and, when
+// logRequestsToDb is enabled, persists a request_log row. The insert is
+// best-effort and asynchronous so accounting never delays the response.
+func (s *Server) recordRequest(model string, status int, usage *gemini.UsageMetadata, start time.Time, info *codeassist.RequestInfo) {
+	d := info.Details()
+	logrus.WithFields(logrus.Fields{
+		"model":      model,
+		"status":     status,
+		"attempts":   d.Attempts,
+		"credential": d.Credential,
+		"project":    d.Project,
+		"latency":    time.Since(start),
+	}).Info("request summary")
+	if !s.cfg.LogRequestsToDb || s.store == nil {
+		return
+	}
+	rl := state.RequestLog{
+		Timestamp: start,
+		TokenKey:  d.TokenKey,
+		Model:     model,
+		Status:    status,
+		LatencyMS: time.Since(start).Milliseconds(),
+	}
+	if usage != nil {
+		rl.PromptTokens = usage.PromptTokenCount
+		rl.CandidateTokens = usage.CandidatesTokenCount
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.store.InsertRequestLog(ctx, rl); err != nil {
+			logrus.Warnf("request log insert failed: %v", err)
+		}
+	}()
+}
+
+// setCredentialHeaders reports the unit that served the request when
+// credentialHeaders is enabled. It must run before the headers are written.
+func (s *Server) setCredentialHeaders(w http.ResponseWriter, info *codeassist.RequestInfo) {
+	if !s.cfg.CredentialHeaders {
+		return
+	}
+	d := info.Details()
+	if d.Attempts == 0 {
+		return
+	}
+	w.Header().Set("X-Credential-Used", d.Credential)
+	w.Header().Set("X-Project-Used", d.Project)
+	w.Header().Set("X-Attempts", strconv.Itoa(d.Attempts))
+}
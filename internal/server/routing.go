@@ -0,0 +1,43 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+
+	"gcli2api/internal/gemini"
+)
+
+// routeModel resolves the virtual autoModel to a concrete model: prompts whose
+// estimated token count exceeds autoModelThresholdTokens go to autoModelLong,
+// the rest to autoModelShort. Model aliases resolve to their canonical name
+// either way. The body is read here and restored so the handler can decode it
+// again.
+func (s *Server) routeModel(model string, r *http.Request) (string, error) {
+	if s.cfg.AutoModel == "" || model != s.cfg.AutoModel {
+		return gemini.ResolveModel(model), nil
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(b))
+	var req gemini.GeminiRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return "", err
+	}
+	tokens := countRequestTokens(req)
+	routed := s.cfg.AutoModelShort
+	if tokens > s.cfg.AutoModelThresholdTokens {
+		routed = s.cfg.AutoModelLong
+	}
+	logrus.WithFields(logrus.Fields{
+		"model":       model,
+		"routedTo":    routed,
+		"totalTokens": tokens,
+	}).Debug("routed virtual model")
+	return gemini.ResolveModel(routed), nil
+}
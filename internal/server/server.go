@@ -4,15 +4,22 @@ import (
 	"context"
 	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"gcli2api/internal/codeassist"
 	"gcli2api/internal/config"
 	"gcli2api/internal/gemini"
+	"gcli2api/internal/state"
 
 	// "gcli2api/internal/utils"
 
@@ -21,6 +28,7 @@ import (
 )
 
 var (
+	modelPathGet    = regexp.MustCompile(`^/v1beta/models/([^/:]+)$`)
 	modelPathUnary  = regexp.MustCompile(`^/v1beta/models/([^/]+):generateContent$`)
 	modelPathStream = regexp.MustCompile(`^/v1beta/models/([^/]+):streamGenerateContent$`)
 )
@@ -37,6 +45,23 @@ type Server struct {
 	caClient CodeAssist
 	// sem is a simple semaphore for concurrency limiting
 	sem chan struct{}
+	// store is optional; used for request accounting when enabled
+	store *state.Store
+	// readiness checks consulted by /readyz
+	readiness []readinessCheck
+	// paused rejects generation requests with 503 (maintenance mode)
+	paused atomic.Bool
+	// modelSems are per-model semaphores from perModelConcurrency, acquired
+	// in addition to sem
+	modelSems map[string]chan struct{}
+	// cancels maps client cancel ids (X-Cancel-Id) to in-flight streams
+	cancels sync.Map
+	// shadowSem bounds concurrent shadow calls (shadowMaxConcurrent)
+	shadowSem chan struct{}
+	// shadowLast is when the last shadow call started, in Unix nanoseconds
+	shadowLast atomic.Int64
+	// contentFilters are the compiled contentFilters patterns
+	contentFilters []*regexp.Regexp
 }
 
 func New(cfg config.Config, httpCli *http.Client) *Server {
@@ -53,12 +78,38 @@ func New(cfg config.Config, httpCli *http.Client) *Server {
 	if cfg.MaxConcurrentRequests == 0 {
 		cfg.MaxConcurrentRequests = 64
 	}
-	return &Server{
-		cfg:      cfg,
-		httpCli:  httpCli,
-		caClient: codeassist.NewCaClient(httpCli, cfg.RequestMaxRetries, time.Duration(cfg.RequestBaseDelayMillis)*time.Millisecond),
-		sem:      make(chan struct{}, cfg.MaxConcurrentRequests),
+	if cfg.Host == "" {
+		cfg.Host = "127.0.0.1"
+	}
+	caClient := codeassist.NewCaClient(httpCli, cfg.RequestMaxRetries, time.Duration(cfg.RequestBaseDelayMillis)*time.Millisecond)
+	caClient.SetMaxResponseBytes(cfg.MaxResponseBytes)
+	caClient.SetAPIVersion(cfg.APIVersion)
+	caClient.SetPluginType(cfg.DiscoveryPluginType)
+	caClient.SetEnvelopeResponseField(cfg.EnvelopeResponseField)
+	caClient.SetDiscoveryTimeout(time.Duration(cfg.DiscoveryTimeoutSeconds) * time.Second)
+	var ca CodeAssist = caClient
+	if cfg.MockUpstream {
+		ca = codeassist.NewMockClient(time.Duration(cfg.MockLatencyMillis) * time.Millisecond)
+	}
+	s := &Server{
+		cfg:            cfg,
+		httpCli:        httpCli,
+		caClient:       ca,
+		sem:            make(chan struct{}, cfg.MaxConcurrentRequests),
+		modelSems:      newModelSems(cfg.PerModelConcurrency),
+		shadowSem:      make(chan struct{}, max(cfg.ShadowMaxConcurrent, 1)),
+		contentFilters: cfg.CompiledContentFilters(),
+	}
+	s.paused.Store(cfg.StartPaused)
+	return s
+}
+
+// limitBody caps the request body at RequestMaxBodyBytes; -1 means unlimited.
+func (s *Server) limitBody(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.RequestMaxBodyBytes < 0 {
+		return
 	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.RequestMaxBodyBytes)
 }
 
 // NewWithCAClient allows injecting a custom CodeAssist client (for tests).
@@ -76,16 +127,39 @@ func NewWithCAClient(cfg config.Config, ca CodeAssist) *Server {
 	if cfg.MaxConcurrentRequests == 0 {
 		cfg.MaxConcurrentRequests = 64
 	}
-	return &Server{cfg: cfg, caClient: ca, sem: make(chan struct{}, cfg.MaxConcurrentRequests)}
+	if cfg.Host == "" {
+		cfg.Host = "127.0.0.1"
+	}
+	s := &Server{cfg: cfg, caClient: ca, sem: make(chan struct{}, cfg.MaxConcurrentRequests), modelSems: newModelSems(cfg.PerModelConcurrency), shadowSem: make(chan struct{}, max(cfg.ShadowMaxConcurrent, 1)), contentFilters: cfg.CompiledContentFilters()}
+	s.paused.Store(cfg.StartPaused)
+	return s
 }
 
 func (s *Server) Router() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", s.handleHealth)
-	mux.HandleFunc("/v1beta/models", s.handleListModels)
-	mux.HandleFunc("/v1beta/models/", s.handleModel)
-	// Order: recover (outermost) -> logging -> concurrency limiter -> handlers
-	return s.withRecover(s.withLogging(s.withConcurrencyLimit(mux)))
+	mux.HandleFunc("/readyz", s.handleReady)
+	// Only the model routes take a concurrency slot, so probes, cancels
+	// and admin stay reachable while the proxy is saturated
+	mux.Handle("/v1beta/models", s.withConcurrencyLimit(http.HandlerFunc(s.handleListModels)))
+	mux.Handle("/v1beta/models/", s.withConcurrencyLimit(http.HandlerFunc(s.handleModel)))
+	mux.HandleFunc("/v1beta/cancel/", s.handleCancel)
+	mux.HandleFunc("/version", s.handleVersion)
+	if s.adminOnMainListener() {
+		s.registerAdmin(mux)
+	}
+	// Order: recover (outermost) -> logging -> HTTP version check ->
+	// route prefix -> handlers
+	return s.withRecover(s.withLogging(s.withHTTPVersionCheck(s.withRoutePrefix(mux))))
+}
+
+// AdminRouter serves the admin and metrics endpoints on their own listener
+// (adminListen). It bypasses the request concurrency limiter so operators
+// can still reach it while the proxy is saturated.
+func (s *Server) AdminRouter() http.Handler {
+	mux := http.NewServeMux()
+	s.registerAdmin(mux)
+	return s.withRecover(s.withLogging(mux))
 }
 
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -94,8 +168,53 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
+// readinessCheck is a named dependency check; a nil error means ready.
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+// AddReadinessCheck registers a dependency consulted by /readyz. Checks must be
+// cheap (return cached state) since orchestrators poll readiness frequently.
+func (s *Server) AddReadinessCheck(name string, check func() error) {
+	s.readiness = append(s.readiness, readinessCheck{name: name, check: check})
+}
+
+// handleReady reports 503 with the failing checks when any registered
+// readiness check fails, otherwise 200.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	failed := map[string]string{}
+	for _, rc := range s.readiness {
+		if err := rc.check(); err != nil {
+			failed[rc.name] = err.Error()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if len(failed) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(map[string]any{"status": "not ready", "checks": failed})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "ready"})
+}
+
 func (s *Server) authorize(r *http.Request) bool {
-	key := s.cfg.AuthKey
+	return authorizeKey(r, s.cfg.AuthKey)
+}
+
+// authorizeAdmin checks admin and metrics requests against metricsAuthKey,
+// falling back to authKey when it is unset.
+func (s *Server) authorizeAdmin(r *http.Request) bool {
+	if s.cfg.MetricsAuthKey != "" {
+		return authorizeKey(r, s.cfg.MetricsAuthKey)
+	}
+	return s.authorize(r)
+}
+
+// authorizeKey accepts a request bearing key as a Bearer token or
+// x-goog-api-key. An empty key allows every request.
+func authorizeKey(r *http.Request, key string) bool {
 	if key == "" {
 		return true
 	}
@@ -126,7 +245,7 @@ func (s *Server) handleListModels(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(listModels())
+	_ = json.NewEncoder(w).Encode(s.listModels())
 }
 
 func (s *Server) handleModel(w http.ResponseWriter, r *http.Request) {
@@ -134,11 +253,23 @@ func (s *Server) handleModel(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
+	path := r.URL.Path
+	if r.Method == http.MethodGet {
+		if m := modelPathGet.FindStringSubmatch(path); m != nil {
+			s.handleGetModel(m[1], w, r)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	path := r.URL.Path
+	if s.paused.Load() {
+		s.writePaused(w)
+		return
+	}
 	if m := modelPathUnary.FindStringSubmatch(path); m != nil {
 		model := m[1]
 		s.handleGenerateContent(model, w, r)
@@ -152,66 +283,247 @@ func (s *Server) handleModel(w http.ResponseWriter, r *http.Request) {
 	http.NotFound(w, r)
 }
 
+// handleGetModel returns metadata for a single model, mirroring the
+// Gemini REST API's GET models/{model}.
+func (s *Server) handleGetModel(model string, w http.ResponseWriter, r *http.Request) {
+	info, ok := gemini.LookupModel(model)
+	if !ok || !s.cfg.ModelAllowed(model) {
+		http.Error(w, "model not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(newModelResource(info))
+}
+
 func (s *Server) validateModel(model string) bool {
-	return gemini.IsSupportedModel(model)
+	return gemini.IsSupportedModel(model) && s.cfg.ModelAllowed(model)
+}
+
+// servedModels returns the supported models that pass allowedModels.
+func (s *Server) servedModels() []gemini.ModelInfo {
+	out := make([]gemini.ModelInfo, 0, len(gemini.SupportedModels))
+	for _, m := range gemini.SupportedModels {
+		if s.cfg.ModelAllowed(m.Name) {
+			out = append(out, m)
+		}
+	}
+	return out
 }
 
-func (s *Server) decodeGeminiRequest(r *http.Request) (gemini.GeminiRequest, error) {
+// writeUnknownModel answers 400 with a Gemini-style JSON error that lists the
+// served model names.
+func (s *Server) writeUnknownModel(w http.ResponseWriter, model string) {
+	served := s.servedModels()
+	names := make([]string, 0, len(served))
+	for _, m := range served {
+		names = append(names, m.Name)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"code":            http.StatusBadRequest,
+			"status":          "INVALID_ARGUMENT",
+			"message":         fmt.Sprintf("unknown model %q", model),
+			"supportedModels": names,
+		},
+	})
+}
+
+func (s *Server) decodeGeminiRequest(model string, r *http.Request) (gemini.GeminiRequest, error) {
 	var req gemini.GeminiRequest
 	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
 	if err := dec.Decode(&req); err != nil {
 		return req, err
 	}
-	req = gemini.NormalizeGeminiRequest(req)
+	req, err := gemini.NormalizeGeminiRequest(req, gemini.NormalizeOptions{MaxContents: s.cfg.MaxContents, MaxContentsMode: s.cfg.MaxContentsMode, MaxPartsPerContent: s.cfg.MaxPartsPerContent, Model: model, AllowedMimeTypes: s.cfg.AllowedMimeTypes, ContentFilters: s.contentFilters, ContentFilterMode: s.cfg.ContentFilterMode, CheckCapabilities: s.cfg.CheckModelCapabilities(), SupportsVision: s.cfg.SupportsVision})
+	if err != nil {
+		return req, err
+	}
+	s.applyGenerationOverrides(model, r, &req)
 	return req, nil
 }
 
 func (s *Server) handleGenerateContent(model string, w http.ResponseWriter, r *http.Request) {
+	s.limitBody(w, r)
+	model, err := s.routeModel(model, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %v", err), http.StatusBadRequest)
+		return
+	}
 	if !s.validateModel(model) {
-		http.Error(w, "unknown model", http.StatusBadRequest)
+		s.writeUnknownModel(w, model)
 		return
 	}
-	// Limit request body size
-	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.RequestMaxBodyBytes)
-	req, err := s.decodeGeminiRequest(r)
+	release, ok := s.acquireModelSlot(model)
+	if !ok {
+		writeTooManyRequests(w, reasonModel, fmt.Sprintf("too many concurrent requests for %s", model))
+		return
+	}
+	defer release()
+	w.Header().Set("X-Model-Used", model)
+	req, err := s.decodeGeminiRequest(model, r)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("bad request: %v", err), http.StatusBadRequest)
 		return
 	}
-	// Enriched logging: model, thinking config, and total tokens
-	var thinking any
-	if req.GenerationConfig != nil {
-		thinking = req.GenerationConfig.ThinkingConfig
+	if fp := requestFingerprint(model, &req); fp != "" {
+		w.Header().Set(fingerprintHeader, fp)
+	}
+	baseCtx, err := s.applyDebugHeaders(s.applyForwardHeaders(r.Context(), r), r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Enriched logging: model, thinking config, sampling settings (to
+	// correlate nondeterministic outputs), and total tokens
+	var thinking, seed, temperature any
+	if gc := req.GenerationConfig; gc != nil {
+		thinking = gc.ThinkingConfig
+		if gc.Temperature != nil {
+			temperature = *gc.Temperature
+		}
+		if gc.Seed != nil {
+			seed = *gc.Seed
+		}
 	}
 	totalTokens := countRequestTokens(req)
 	logrus.WithFields(logrus.Fields{
 		"model":          model,
 		"thinkingConfig": thinking,
+		"temperature":    temperature,
+		"seed":           seed,
 		"totalTokens":    totalTokens,
 	}).Info("sending to upstream")
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	var primaryText string
+	if finishShadow := s.startShadow(model, req); finishShadow != nil {
+		defer func() { finishShadow(primaryText) }()
+	}
+	ctx, cancel := context.WithTimeout(baseCtx, 5*time.Minute)
 	defer cancel()
+	ctx, info := codeassist.WithRequestInfo(ctx)
+	start := time.Now()
+	defer s.observeTiming(r, model, start, info)
 	resp, err := s.caClient.GenerateContent(ctx, model, "", req)
+	s.setCredentialHeaders(w, info)
 	if err != nil {
-		http.Error(w, err.Error(), httpStatusFromError(err))
+		status := httpStatusFromError(err)
+		if r.Context().Err() != nil {
+			status = statusClientClosedRequest
+		}
+		s.recordRequest(model, status, nil, start, info)
+		setRateLimitHeaders(w, err)
+		http.Error(w, err.Error(), status)
 		return
 	}
+	s.recordRequest(model, http.StatusOK, resp.UsageMetadata, start, info)
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(resp)
+	if resp.ModelVersion != "" {
+		w.Header().Set("X-Model-Version", resp.ModelVersion)
+	}
+	if tier := info.Details().Tier; tier != "" {
+		w.Header().Set("X-Served-Tier", tier)
+	}
+	// Debug: hand back exactly what upstream sent, envelope included
+	if raw := codeassist.RawResponseFrom(ctx); raw != nil && raw.Bytes() != nil {
+		_, _ = w.Write(raw.Bytes())
+		return
+	}
+	if s.cfg.CoalesceEmptyParts {
+		gemini.CoalesceTextParts(resp)
+	}
+	if s.cfg.CandidateSelection != "" {
+		gemini.SelectCandidate(resp, s.cfg.CandidateSelection == config.CandidateBest)
+	}
+	primaryText = gemini.ResponseText(resp)
+	out, err := s.filterResponseFields(resp)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	enc := json.NewEncoder(w)
+	if s.prettyResponse(r) {
+		enc.SetIndent("", "  ")
+	}
+	_ = enc.Encode(out)
+}
+
+// prettyResponse reports whether a unary response is indented for human
+// readers: always with prettyResponses, or per request with ?pretty=1.
+func (s *Server) prettyResponse(r *http.Request) bool {
+	if s.cfg.PrettyResponses {
+		return true
+	}
+	pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty"))
+	return pretty
 }
 
+// streamErrorTrailer is the data of the terminal "error" SSE event. Partial
+// reports whether any content was streamed before the failure, so clients can
+// decide between retrying and keeping what they got.
+type streamErrorTrailer struct {
+	Error struct {
+		Message string `json:"message"`
+		Code    int    `json:"code"`
+	} `json:"error"`
+	FinishReason string `json:"finishReason"`
+	Partial      bool   `json:"partial"`
+	ChunksSent   int    `json:"chunksSent"`
+}
+
+// emptyStreamTrailer is the data of the terminal "empty" SSE event, sent
+// when a stream ends cleanly without any candidate content. FinishReason is
+// upstream's, or "NO_CONTENT" when it reported none.
+type emptyStreamTrailer struct {
+	FinishReason string `json:"finishReason"`
+	BlockReason  string `json:"blockReason,omitempty"`
+	ChunksSent   int    `json:"chunksSent"`
+}
+
+// errEmptyStream reports a stream that completed without content, for
+// emptyStreamMode "error".
+var errEmptyStream = errors.New("upstream returned no content")
+
 func (s *Server) handleStreamGenerateContent(model string, w http.ResponseWriter, r *http.Request) {
+	s.limitBody(w, r)
+	model, err := s.routeModel(model, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %v", err), http.StatusBadRequest)
+		return
+	}
 	if !s.validateModel(model) {
-		http.Error(w, "unknown model", http.StatusBadRequest)
+		s.writeUnknownModel(w, model)
 		return
 	}
-	// Limit request body size
-	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.RequestMaxBodyBytes)
-	req, err := s.decodeGeminiRequest(r)
+	release, ok := s.acquireModelSlot(model)
+	if !ok {
+		writeTooManyRequests(w, reasonModel, fmt.Sprintf("too many concurrent requests for %s", model))
+		return
+	}
+	defer release()
+	w.Header().Set("X-Model-Used", model)
+	req, err := s.decodeGeminiRequest(model, r)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("bad request: %v", err), http.StatusBadRequest)
 		return
 	}
+	if fp := requestFingerprint(model, &req); fp != "" {
+		w.Header().Set(fingerprintHeader, fp)
+	}
+	baseCtx, err := s.applyDebugHeaders(s.applyForwardHeaders(r.Context(), r), r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithCancel(baseCtx)
+	defer cancel()
+	unregister, err := s.registerCancel(r.Header.Get(cancelIDHeader), cancel)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	defer unregister()
 	// logrus.Infof("decoded request %s", utils.TruncateLongStringInObject(req, 100))
 	flusher, ok := w.(http.Flusher)
 	if !ok {
@@ -224,43 +536,313 @@ func (s *Server) handleStreamGenerateContent(model string, w http.ResponseWriter
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("X-Accel-Buffering", "no")
+	// The connection-wide WriteTimeout would cut long generations off; instead
+	// keep the write deadline a fixed idle window ahead of the last flush.
+	// With slowClientTimeoutSeconds the deadline is renewed before every
+	// write with that shorter window, so a client that stops reading is
+	// dropped (canceling upstream) instead of pinning a pool connection.
+	rc := http.NewResponseController(w)
+	window := time.Duration(s.cfg.StreamIdleTimeoutSeconds) * time.Second
+	slow := time.Duration(s.cfg.SlowClientTimeoutSeconds) * time.Second
+	if slow > 0 {
+		window = slow
+	}
+	extendDeadline := func() {
+		if window > 0 {
+			if err := rc.SetWriteDeadline(time.Now().Add(window)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				logrus.Debugf("extend stream write deadline: %v", err)
+			}
+		}
+	}
+	extendDeadline()
+	// beforeWrite renews the deadline for a write when slow clients are policed
+	beforeWrite := func() {
+		if slow > 0 {
+			extendDeadline()
+		}
+	}
 
-	ctx, cancel := context.WithCancel(r.Context())
-	defer cancel()
+	ctx, info := codeassist.WithRequestInfo(ctx)
+	start := time.Now()
+	status := http.StatusOK
+	var usage *gemini.UsageMetadata
+	defer func() { s.recordRequest(model, status, usage, start, info) }()
+	defer s.observeTiming(r, model, start, info)
 	out, errs := s.caClient.GenerateContentStream(ctx, model, "", req)
+	// Upstream is read ahead of the client through a bounded buffer; a
+	// client that leaves it full for slowClientTimeoutSeconds is dropped
+	bufChunks := max(s.cfg.StreamBufferChunks, 1)
+	out, errs = bufferStream(ctx, out, errs, bufChunks, slow, func() {
+		logrus.Warnf("dropping slow stream client %s: %d buffered chunks not consumed within %s", r.RemoteAddr, bufChunks, slow)
+		cancel()
+	})
+	// primaryText collects the streamed text for a shadow comparison
+	var primaryText *strings.Builder
+	if finishShadow := s.startShadow(model, req); finishShadow != nil {
+		primaryText = &strings.Builder{}
+		defer func() { finishShadow(primaryText.String()) }()
+	}
 
-	// Prepare enriched logging: model, thinking config, and total tokens
-	var thinking any
-	if req.GenerationConfig != nil {
-		thinking = req.GenerationConfig.ThinkingConfig
+	// Prepare enriched logging: model, thinking config, sampling settings,
+	// and total tokens
+	var thinking, seed, temperature any
+	if gc := req.GenerationConfig; gc != nil {
+		thinking = gc.ThinkingConfig
+		if gc.Temperature != nil {
+			temperature = *gc.Temperature
+		}
+		if gc.Seed != nil {
+			seed = *gc.Seed
+		}
 	}
 	totalTokens := countRequestTokens(req)
 	logrus.WithFields(logrus.Fields{
 		"model":          model,
 		"thinkingConfig": thinking,
+		"temperature":    temperature,
+		"seed":           seed,
 		"totalTokens":    totalTokens,
 	}).Info("sending to upstream")
 	enc := json.NewEncoder(w)
+	// chunks counts data events already written, so the error trailer can
+	// tell clients whether what they received is a partial answer.
+	chunks := 0
+	// contentSent records whether any written chunk carried candidate
+	// content; finishReason and blockReason are the last ones upstream
+	// reported, explaining an empty stream.
+	contentSent := false
+	var finishReason, blockReason string
+	// writeFailed logs a failed stream write; the caller then returns, which
+	// cancels the upstream stream.
+	writeFailed := func(what string, err error) {
+		if errors.Is(err, os.ErrDeadlineExceeded) && slow > 0 {
+			logrus.Warnf("dropping slow stream client %s: %s not consumed within %s", r.RemoteAddr, what, slow)
+			return
+		}
+		logrus.Errorf("error writing %s: %v", what, err)
+	}
+	// writeError emits the terminal error event
+	writeError := func(e error) {
+		if errors.Is(e, errSlowClient) {
+			// The client is not reading; leave it to the deadline
+			status = statusClientClosedRequest
+			return
+		}
+		status = httpStatusFromError(e)
+		if chunks == 0 {
+			s.setCredentialHeaders(w, info)
+			setRateLimitHeaders(w, e)
+		}
+		beforeWrite()
+		if _, err := fmt.Fprint(w, "event: error\n"); err != nil {
+			writeFailed("error event", err)
+			return
+		}
+		trailer := streamErrorTrailer{FinishReason: "ERROR", Partial: chunks > 0, ChunksSent: chunks}
+		trailer.Error.Message = e.Error()
+		trailer.Error.Code = status
+		b, _ := json.Marshal(trailer)
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+			writeFailed("error data", err)
+			return
+		}
+		extendDeadline()
+		flusher.Flush()
+	}
+	// Flush batching: flush every flushEveryNChunks chunks, and no later than
+	// flushIntervalMs after the first unflushed chunk. Terminal events always
+	// flush immediately.
+	flushEvery := max(s.cfg.FlushEveryNChunks, 1)
+	pending := 0
+	var flushTimer *time.Timer
+	var flushDue <-chan time.Time
+	flush := func() {
+		if flushTimer != nil {
+			flushTimer.Stop()
+			flushTimer, flushDue = nil, nil
+		}
+		pending = 0
+		extendDeadline()
+		flusher.Flush()
+	}
+	defer func() {
+		if flushTimer != nil {
+			flushTimer.Stop()
+		}
+	}()
+	// emit writes one data event, returning false once the stream must end
+	emit := func(g gemini.GeminiAPIResponse) bool {
+		// Headers are committed with the first chunk, so only its
+		// modelVersion and the serving unit can be surfaced as headers.
+		if chunks == 0 {
+			if g.ModelVersion != "" {
+				w.Header().Set("X-Model-Version", g.ModelVersion)
+			}
+			s.setCredentialHeaders(w, info)
+		}
+		chunk, err := s.filterResponseFields(g)
+		if err != nil {
+			writeError(err)
+			return false
+		}
+		beforeWrite()
+		if s.cfg.SSEEventName != "" {
+			if _, err := fmt.Fprintf(w, "event: %s\n", s.cfg.SSEEventName); err != nil {
+				writeFailed("event name", err)
+				return false
+			}
+		}
+		// SSE event - send raw response like TypeScript version
+		if _, err := fmt.Fprint(w, "data: "); err != nil {
+			writeFailed("data prefix", err)
+			return false
+		}
+		if err := enc.Encode(chunk); err != nil {
+			writeFailed("chunk", err)
+			return false
+		}
+		// enc.Encode writes a trailing newline
+		if _, err := fmt.Fprint(w, "\n"); err != nil {
+			writeFailed("newline", err)
+			return false
+		}
+		chunks++
+		if gemini.HasContent(&g) {
+			contentSent = true
+		}
+		pending++
+		if pending >= flushEvery {
+			flush()
+		} else if flushTimer == nil && s.cfg.FlushIntervalMs > 0 {
+			flushTimer = time.NewTimer(time.Duration(s.cfg.FlushIntervalMs) * time.Millisecond)
+			flushDue = flushTimer.C
+		}
+		return true
+	}
+	// Coalescing (coalesceStreamMs): text-only chunks are held and merged,
+	// then written once the window elapses, a chunk that cannot be merged
+	// (non-text parts, the usage-only final chunk) arrives, or the stream
+	// ends.
+	coalesce := time.Duration(s.cfg.CoalesceStreamMs) * time.Millisecond
+	var held *gemini.GeminiAPIResponse
+	var coalesceTimer *time.Timer
+	var coalesceDue <-chan time.Time
+	emitHeld := func() bool {
+		if coalesceTimer != nil {
+			coalesceTimer.Stop()
+			coalesceTimer, coalesceDue = nil, nil
+		}
+		if held == nil {
+			return true
+		}
+		g := *held
+		held = nil
+		return emit(g)
+	}
+	defer func() {
+		if coalesceTimer != nil {
+			coalesceTimer.Stop()
+		}
+	}()
 	for {
 		select {
+		case <-flushDue:
+			flush()
+		case <-coalesceDue:
+			if !emitHeld() {
+				return
+			}
 		case g, ok := <-out:
 			if !ok {
+				if !emitHeld() {
+					return
+				}
+				if pending > 0 {
+					flush()
+				}
+				// Producers deliver the terminal error before closing out;
+				// check for it so a failure is never mistaken for completion.
+				if errs != nil {
+					if e, ok := <-errs; ok && e != nil {
+						writeError(e)
+						return
+					}
+				}
+				// A clean end without content (typically an immediate
+				// block) gets an explanation instead of a silent close.
+				if !contentSent {
+					switch s.cfg.EmptyStreamMode {
+					case config.EmptyStreamNone:
+					case config.EmptyStreamError:
+						writeError(fmt.Errorf("%w (finishReason %q, blockReason %q)", errEmptyStream, finishReason, blockReason))
+						return
+					default:
+						if chunks == 0 {
+							s.setCredentialHeaders(w, info)
+						}
+						trailer := emptyStreamTrailer{FinishReason: finishReason, BlockReason: blockReason, ChunksSent: chunks}
+						if trailer.FinishReason == "" {
+							trailer.FinishReason = "NO_CONTENT"
+						}
+						b, _ := json.Marshal(trailer)
+						beforeWrite()
+						if _, err := fmt.Fprintf(w, "event: empty\ndata: %s\n\n", b); err != nil {
+							writeFailed("empty event", err)
+							return
+						}
+						flusher.Flush()
+					}
+				}
+				if s.cfg.SSEDoneEvent {
+					beforeWrite()
+					if _, err := fmt.Fprint(w, "event: done\ndata: [DONE]\n\n"); err != nil {
+						writeFailed("done event", err)
+						return
+					}
+					flusher.Flush()
+				}
 				return
 			}
-			// SSE event - send raw response like TypeScript version
-			if _, err := fmt.Fprint(w, "data: "); err != nil {
-				logrus.Errorf("error writing data prefix: %v", err)
-				return
+			fr, br := gemini.StopReasons(&g)
+			if fr != "" {
+				finishReason = fr
 			}
-			if err := enc.Encode(g); err != nil {
-				return
+			if br != "" {
+				blockReason = br
+			}
+			if s.cfg.CoalesceEmptyParts {
+				gemini.CoalesceTextParts(&g)
+			}
+			if primaryText != nil {
+				primaryText.WriteString(gemini.ResponseText(&g))
+			}
+			if s.cfg.StreamUsagePerChunk {
+				// Every chunk carries the latest cumulative (monotonic) usage
+				usage = mergeUsage(usage, g.UsageMetadata)
+				if usage != nil {
+					u := *usage
+					g.UsageMetadata = &u
+				}
+			} else if g.UsageMetadata != nil {
+				usage = g.UsageMetadata
+			}
+			if coalesce > 0 {
+				if held != nil && gemini.MergeTextChunk(held, g) {
+					continue
+				}
+				if !emitHeld() {
+					return
+				}
+				if gemini.TextOnly(&g) {
+					held = &g
+					coalesceTimer = time.NewTimer(coalesce)
+					coalesceDue = coalesceTimer.C
+					continue
+				}
 			}
-			// enc.Encode writes a trailing newline
-			if _, err := fmt.Fprint(w, "\n"); err != nil {
-				logrus.Errorf("error writing newline: %v", err)
+			if !emit(g) {
 				return
 			}
-			flusher.Flush()
 		case e, ok := <-errs:
 			// If the error channel is closed or yields a nil error,
 			// treat it as a normal end-of-stream signal but continue
@@ -270,18 +852,14 @@ func (s *Server) handleStreamGenerateContent(model string, w http.ResponseWriter
 				errs = nil
 				continue
 			}
-			// Non-nil error: emit error event then end
-			if _, err := fmt.Fprint(w, "event: error\n"); err != nil {
-				logrus.Errorf("error writing error event: %v", err)
+			// Non-nil error: emit what was received, then the error event
+			if !emitHeld() {
 				return
 			}
-			if _, err := fmt.Fprintf(w, "data: {\"error\":{\"message\":%q}}\n\n", e.Error()); err != nil {
-				logrus.Errorf("error writing error data: %v", err)
-				return
-			}
-			flusher.Flush()
+			writeError(e)
 			return
 		case <-ctx.Done():
+			status = statusClientClosedRequest
 			return
 		}
 	}
@@ -311,6 +889,12 @@ func countRequestTokens(req gemini.GeminiRequest) int {
 }
 
 func httpStatusFromError(err error) int {
+	if errors.Is(err, codeassist.ErrDiscoveryFailed) || errors.Is(err, codeassist.ErrResponseTooLarge) || errors.Is(err, errEmptyStream) {
+		return http.StatusBadGateway
+	}
+	if errors.Is(err, codeassist.ErrDailyCapReached) {
+		return http.StatusTooManyRequests
+	}
 	// Simple mapping; upstream errors already include status text sometimes.
 	s := err.Error()
 	if strings.Contains(s, "status 401") {
@@ -328,25 +912,52 @@ func httpStatusFromError(err error) int {
 	return http.StatusBadRequest
 }
 
-func listModels() interface{} {
-	type model struct {
-		Name                       string   `json:"name"`
-		Version                    string   `json:"version"`
-		DisplayName                string   `json:"displayName"`
-		Description                string   `json:"description"`
-		SupportedGenerationMethods []string `json:"supportedGenerationMethods"`
+// setRateLimitHeaders surfaces upstream rate-limit details of err to the
+// client: Retry-After (in whole seconds, rounded up) and any X-RateLimit-*
+// headers upstream sent, so clients sharing the pool can self-throttle.
+func setRateLimitHeaders(w http.ResponseWriter, err error) {
+	var ue *codeassist.UpstreamError
+	if !errors.As(err, &ue) {
+		return
+	}
+	if ue.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(ue.RetryAfter.Seconds()))))
+	}
+	for k, v := range ue.RateLimit {
+		w.Header()[k] = v
 	}
+}
+
+// modelResource is the wire shape of a model in the Gemini models API.
+type modelResource struct {
+	Name                       string   `json:"name"`
+	Version                    string   `json:"version"`
+	DisplayName                string   `json:"displayName"`
+	Description                string   `json:"description"`
+	InputTokenLimit            int      `json:"inputTokenLimit,omitempty"`
+	OutputTokenLimit           int      `json:"outputTokenLimit,omitempty"`
+	SupportedGenerationMethods []string `json:"supportedGenerationMethods"`
+}
+
+func newModelResource(m gemini.ModelInfo) modelResource {
+	return modelResource{
+		Name:                       "models/" + m.Name,
+		Version:                    "001",
+		DisplayName:                m.DisplayName,
+		Description:                m.Description,
+		InputTokenLimit:            m.InputTokenLimit,
+		OutputTokenLimit:           m.OutputTokenLimit,
+		SupportedGenerationMethods: []string{"generateContent", "streamGenerateContent"},
+	}
+}
+
+func (s *Server) listModels() interface{} {
+	served := s.servedModels()
 	out := struct {
-		Models []model `json:"models"`
-	}{Models: make([]model, 0, len(gemini.SupportedModels))}
-	for _, m := range gemini.SupportedModels {
-		out.Models = append(out.Models, model{
-			Name:                       "models/" + m.Name,
-			Version:                    "001",
-			DisplayName:                m.DisplayName,
-			Description:                m.Description,
-			SupportedGenerationMethods: []string{"generateContent", "streamGenerateContent"},
-		})
+		Models []modelResource `json:"models"`
+	}{Models: make([]modelResource, 0, len(served))}
+	for _, m := range served {
+		out.Models = append(out.Models, newModelResource(m))
 	}
 	return out
 }
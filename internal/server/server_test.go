@@ -4,17 +4,29 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
+	"gcli2api/internal/codeassist"
 	"gcli2api/internal/config"
 	"gcli2api/internal/gemini"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 )
 
 type fakeCA struct {
 	stream []gemini.GeminiAPIResponse
+	// err, if set, is delivered after the stream.
+	err error
 }
 
 func (f *fakeCA) GenerateContent(ctx context.Context, model, project string, req gemini.GeminiRequest) (*gemini.GeminiAPIResponse, error) {
@@ -34,12 +46,309 @@ func (f *fakeCA) GenerateContentStream(ctx context.Context, model, project strin
 			out <- g
 			time.Sleep(5 * time.Millisecond)
 		}
+		if f.err != nil {
+			errs <- f.err
+		}
+	}()
+	return out, errs
+}
+
+// slowCA streams n chunks spaced by delay.
+type slowCA struct {
+	fakeCA
+	n     int
+	delay time.Duration
+}
+
+func (f *slowCA) GenerateContentStream(ctx context.Context, model, project string, req gemini.GeminiRequest) (<-chan gemini.GeminiAPIResponse, <-chan error) {
+	out := make(chan gemini.GeminiAPIResponse)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(out)
+		defer close(errs)
+		for i := 0; i < f.n; i++ {
+			select {
+			case <-time.After(f.delay):
+			case <-ctx.Done():
+				return
+			}
+			out <- gemini.GeminiAPIResponse{ModelVersion: fmt.Sprint(i)}
+		}
 	}()
 	return out, errs
 }
 
+func TestStream_OutlivesServerWriteTimeout(t *testing.T) {
+	s := NewWithCAClient(config.Config{StreamIdleTimeoutSeconds: 1, SSEDoneEvent: true, EmptyStreamMode: config.EmptyStreamNone}, &slowCA{n: 6, delay: 100 * time.Millisecond})
+	ts := httptest.NewUnstartedServer(s.Router())
+	ts.Config.WriteTimeout = 250 * time.Millisecond
+	ts.Start()
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/v1beta/models/gemini-2.5-flash:streamGenerateContent", "application/json", bytes.NewBufferString(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("stream truncated after %d bytes: %v", len(body), err)
+	}
+	if n := bytes.Count(body, []byte("data: {")); n != 6 || !bytes.Contains(body, []byte("[DONE]")) {
+		t.Fatalf("expected 6 chunks and done event, got %d: %s", n, body)
+	}
+}
+
+// floodCA streams large chunks until the request is canceled, then closes
+// canceled.
+type floodCA struct {
+	fakeCA
+	canceled chan struct{}
+}
+
+func (f *floodCA) GenerateContentStream(ctx context.Context, model, project string, req gemini.GeminiRequest) (<-chan gemini.GeminiAPIResponse, <-chan error) {
+	out := make(chan gemini.GeminiAPIResponse)
+	errs := make(chan error, 1)
+	big := strings.Repeat("x", 256<<10)
+	go func() {
+		defer close(out)
+		defer close(errs)
+		defer close(f.canceled)
+		for {
+			select {
+			case out <- gemini.GeminiAPIResponse{ModelVersion: big}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, errs
+}
+
+func TestStream_DropsSlowClient(t *testing.T) {
+	ca := &floodCA{canceled: make(chan struct{})}
+	s := NewWithCAClient(config.Config{SlowClientTimeoutSeconds: 1}, ca)
+	ts := httptest.NewServer(s.Router())
+	defer ts.Close()
+
+	// A raw connection that sends the request and never reads the response.
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	body := `{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`
+	fmt.Fprintf(conn, "POST /v1beta/models/gemini-2.5-flash:streamGenerateContent HTTP/1.1\r\nHost: x\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+
+	select {
+	case <-ca.canceled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("upstream stream not canceled for a client that stopped reading")
+	}
+}
+
+func TestBufferStream(t *testing.T) {
+	// Chunks and the terminal error pass through in order
+	out := make(chan gemini.GeminiAPIResponse, 3)
+	errs := make(chan error, 1)
+	for range 3 {
+		out <- gemini.GeminiAPIResponse{}
+	}
+	errs <- errors.New("boom")
+	close(out)
+	bout, berrs := bufferStream(context.Background(), out, errs, 2, 0, nil)
+	n := 0
+	for range bout {
+		n++
+	}
+	if err := <-berrs; n != 3 || err == nil || err.Error() != "boom" {
+		t.Fatalf("got %d chunks and %v", n, err)
+	}
+
+	// A buffer left full for the slow timeout ends the stream
+	up := make(chan gemini.GeminiAPIResponse)
+	go func() {
+		defer close(up)
+		for range 4 {
+			up <- gemini.GeminiAPIResponse{}
+		}
+	}()
+	slowCalled := make(chan struct{})
+	bout, berrs = bufferStream(context.Background(), up, nil, 2, 20*time.Millisecond, func() { close(slowCalled) })
+	select {
+	case <-slowCalled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow client not detected")
+	}
+	if err := <-berrs; !errors.Is(err, errSlowClient) {
+		t.Fatalf("expected errSlowClient, got %v", err)
+	}
+	if n := len(bout); n != 2 {
+		t.Fatalf("expected the buffer bounded at 2 chunks, got %d", n)
+	}
+}
+
+// blockingCA holds unary calls until release is closed, signalling each
+// arrival on started.
+type blockingCA struct {
+	fakeCA
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingCA) GenerateContent(ctx context.Context, model, project string, req gemini.GeminiRequest) (*gemini.GeminiAPIResponse, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return &gemini.GeminiAPIResponse{}, nil
+}
+
+func TestPerModelConcurrency(t *testing.T) {
+	ca := &blockingCA{started: make(chan struct{}, 4), release: make(chan struct{})}
+	s := NewWithCAClient(config.Config{PerModelConcurrency: map[string]int{"gemini-2.5-pro": 1}}, ca)
+	h := s.Router()
+	post := func(model string) int {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1beta/models/"+model+":generateContent", bytes.NewBufferString(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`)))
+		return rr.Code
+	}
+	first := make(chan int, 1)
+	go func() { first <- post("gemini-2.5-pro") }()
+	<-ca.started
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-pro:generateContent", bytes.NewBufferString(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`)))
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("X-RateLimit-Reason") != "model" {
+		t.Fatalf("expected 429 with reason model over the pro limit, got %d %q", rr.Code, rr.Header().Get("X-RateLimit-Reason"))
+	}
+	var body struct {
+		Error struct {
+			Reason string `json:"reason"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || body.Error.Reason != "model" {
+		t.Fatalf("unexpected 429 body %q: %v", rr.Body.String(), err)
+	}
+	flash := make(chan int, 1)
+	go func() { flash <- post("gemini-2.5-flash") }()
+	<-ca.started // flash is not limited
+	close(ca.release)
+	if code := <-first; code != http.StatusOK {
+		t.Fatalf("first pro request: %d", code)
+	}
+	if code := <-flash; code != http.StatusOK {
+		t.Fatalf("flash request: %d", code)
+	}
+	if code := post("gemini-2.5-pro"); code != http.StatusOK {
+		t.Fatalf("expected pro slot released, got %d", code)
+	}
+}
+
+func TestConcurrencyQueueTimeout(t *testing.T) {
+	ca := &blockingCA{started: make(chan struct{}, 2), release: make(chan struct{})}
+	s := NewWithCAClient(config.Config{MaxConcurrentRequests: 1, QueueTimeoutMillis: 50}, ca)
+	h := s.Router()
+	post := func() int {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:generateContent", bytes.NewBufferString(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`)))
+		return rr.Code
+	}
+	first := make(chan int, 1)
+	go func() { first <- post() }()
+	<-ca.started
+
+	start := time.Now()
+	if code := post(); code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 after the queue timeout, got %d", code)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Fatalf("expected the request to queue for the timeout, rejected after %v", waited)
+	}
+
+	queued := make(chan int, 1)
+	go func() { queued <- post() }()
+	time.Sleep(10 * time.Millisecond)
+	close(ca.release)
+	if code := <-first; code != http.StatusOK {
+		t.Fatalf("first request: %d", code)
+	}
+	if code := <-queued; code != http.StatusOK {
+		t.Fatalf("expected the queued request to get the freed slot, got %d", code)
+	}
+}
+
+func TestConcurrencyLimitExemptsControlRoutes(t *testing.T) {
+	ca := &blockingCA{started: make(chan struct{}, 1), release: make(chan struct{})}
+	s := NewWithCAClient(config.Config{MaxConcurrentRequests: 1}, ca)
+	h := s.Router()
+	serve := func(method, path, body string) int {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return rr.Code
+	}
+	body := `{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`
+	first := make(chan int, 1)
+	go func() { first <- serve(http.MethodPost, "/v1beta/models/gemini-2.5-flash:generateContent", body) }()
+	<-ca.started
+	if code := serve(http.MethodPost, "/v1beta/models/gemini-2.5-flash:generateContent", body); code != http.StatusTooManyRequests {
+		t.Fatalf("expected the saturated server to reject generation, got %d", code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := s.registerCancel("job-1", cancel); err != nil {
+		t.Fatalf("register cancel: %v", err)
+	}
+	if code := serve(http.MethodPost, "/v1beta/cancel/job-1", ""); code != http.StatusOK || ctx.Err() == nil {
+		t.Fatalf("expected cancel to get through a saturated server, got %d", code)
+	}
+	for _, path := range []string{"/health", "/admin/credentials"} {
+		if code := serve(http.MethodGet, path, ""); code == http.StatusTooManyRequests {
+			t.Fatalf("expected %s to bypass the concurrency limit", path)
+		}
+	}
+	close(ca.release)
+	if code := <-first; code != http.StatusOK {
+		t.Fatalf("first request: %d", code)
+	}
+}
+
+func TestCredentialHeadersAndRequestSummary(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	body := `{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`
+	for _, method := range []string{"generateContent", "streamGenerateContent"} {
+		for _, enabled := range []bool{false, true} {
+			hook.Reset()
+			s := NewWithCAClient(config.Config{CredentialHeaders: enabled}, codeassist.NewMockClient(0))
+			rr := httptest.NewRecorder()
+			s.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:"+method, bytes.NewBufferString(body)))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("%s: unexpected status %d: %s", method, rr.Code, rr.Body.String())
+			}
+			want := map[string]string{"X-Credential-Used": "", "X-Project-Used": "", "X-Attempts": ""}
+			if enabled {
+				want = map[string]string{"X-Credential-Used": "mock", "X-Project-Used": "mock", "X-Attempts": "1"}
+			}
+			for h, v := range want {
+				if got := rr.Header().Get(h); got != v {
+					t.Fatalf("%s credentialHeaders=%v: expected %s %q, got %q", method, enabled, h, v, got)
+				}
+			}
+			var summary *logrus.Entry
+			for _, e := range hook.AllEntries() {
+				if e.Message == "request summary" {
+					summary = e
+				}
+			}
+			if summary == nil || summary.Data["credential"] != "mock" || summary.Data["attempts"] != 1 || summary.Data["status"] != http.StatusOK {
+				t.Fatalf("%s: unexpected request summary %v", method, summary)
+			}
+		}
+	}
+}
+
 func TestListModels_shape(t *testing.T) {
-	v := listModels()
+	v := NewWithCAClient(config.Config{}, &fakeCA{}).listModels()
 	b, _ := json.Marshal(v)
 	if !bytes.Contains(b, []byte("models/gemini-2.5-flash")) {
 		t.Fatalf("missing flash model: %s", string(b))
@@ -71,3 +380,1164 @@ func TestHandler_FlushBehavior(t *testing.T) {
 		t.Fatalf("expected SSE writes and flushes, flushed=%d body=%s", rr.flushed, string(body))
 	}
 }
+
+func TestResponseFieldFilter(t *testing.T) {
+	chunk := gemini.GeminiAPIResponse{
+		Candidates:             []gemini.Candidate{{}},
+		UsageMetadata:          &gemini.UsageMetadata{TotalTokenCount: 3},
+		AutomaticFunctionCalls: []any{"internal"},
+		ModelVersion:           "v1",
+	}
+	body := `{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`
+	for _, tc := range []struct {
+		name       string
+		cfg        config.Config
+		kept, gone []string
+	}{
+		{"deny", config.Config{ResponseFieldDenylist: []string{"automaticFunctionCallingHistory"}}, []string{"candidates", "usageMetadata", "modelVersion"}, []string{"automaticFunctionCallingHistory"}},
+		{"allow", config.Config{ResponseFieldAllowlist: []string{"candidates"}}, []string{"candidates"}, []string{"usageMetadata", "modelVersion", "automaticFunctionCallingHistory"}},
+	} {
+		s := NewWithCAClient(tc.cfg, &fakeCA{stream: []gemini.GeminiAPIResponse{chunk}})
+		for _, method := range []string{"generateContent", "streamGenerateContent"} {
+			rr := httptest.NewRecorder()
+			s.handleModel(rr, httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:"+method, bytes.NewBufferString(body)))
+			out := rr.Body.String()
+			for _, f := range tc.kept {
+				if !strings.Contains(out, `"`+f+`"`) {
+					t.Fatalf("%s %s: expected %s kept: %s", tc.name, method, f, out)
+				}
+			}
+			for _, f := range tc.gone {
+				if strings.Contains(out, `"`+f+`"`) {
+					t.Fatalf("%s %s: expected %s removed: %s", tc.name, method, f, out)
+				}
+			}
+		}
+	}
+}
+
+func TestGetModel_MetadataAndNotFound(t *testing.T) {
+	s := NewWithCAClient(config.Config{}, &fakeCA{})
+
+	rr := httptest.NewRecorder()
+	s.handleModel(rr, httptest.NewRequest(http.MethodGet, "/v1beta/models/gemini-2.5-pro", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	var m modelResource
+	if err := json.Unmarshal(rr.Body.Bytes(), &m); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if m.Name != "models/gemini-2.5-pro" || m.InputTokenLimit == 0 || len(m.SupportedGenerationMethods) == 0 {
+		t.Fatalf("bad model metadata: %+v", m)
+	}
+
+	rr = httptest.NewRecorder()
+	s.handleModel(rr, httptest.NewRequest(http.MethodGet, "/v1beta/models/no-such-model", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown model, got %d", rr.Code)
+	}
+}
+
+func TestNew_MockUpstream_UnaryAndStream(t *testing.T) {
+	s := New(config.Config{MockUpstream: true}, nil)
+	body := `{"contents":[{"role":"user","parts":[{"text":"ping pong"}]}]}`
+
+	rr := httptest.NewRecorder()
+	s.handleModel(rr, httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:generateContent", bytes.NewBufferString(body)))
+	if rr.Code != http.StatusOK || !bytes.Contains(rr.Body.Bytes(), []byte("ping pong")) {
+		t.Fatalf("unexpected unary mock response: %d %s", rr.Code, rr.Body.String())
+	}
+
+	fr := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	s.handleModel(fr, httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:streamGenerateContent", bytes.NewBufferString(body)))
+	if n := bytes.Count(fr.Body.Bytes(), []byte("data: ")); n < 2 {
+		t.Fatalf("expected several streamed mock chunks, got %d: %s", n, fr.Body.String())
+	}
+}
+
+type pinnableCA struct{ fakeCA }
+
+func (p *pinnableCA) NumUnits() int { return 2 }
+
+func TestDebugHeaders_CredentialIndex(t *testing.T) {
+	body := `{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`
+	send := func(s *Server, idx string) int {
+		req := httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:generateContent", bytes.NewBufferString(body))
+		req.Header.Set("X-Credential-Index", idx)
+		rr := httptest.NewRecorder()
+		s.handleModel(rr, req)
+		return rr.Code
+	}
+	// Ignored unless debugHeaders is enabled
+	if code := send(NewWithCAClient(config.Config{}, &pinnableCA{}), "7"); code != http.StatusOK {
+		t.Fatalf("expected header to be ignored when disabled, got %d", code)
+	}
+	s := NewWithCAClient(config.Config{DebugHeaders: true}, &pinnableCA{})
+	if code := send(s, "1"); code != http.StatusOK {
+		t.Fatalf("expected in-range index to succeed, got %d", code)
+	}
+	for _, bad := range []string{"2", "-1", "x"} {
+		if code := send(s, bad); code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for index %q, got %d", bad, code)
+		}
+	}
+}
+
+func TestStream_SSEEventNameAndDone(t *testing.T) {
+	s := NewWithCAClient(config.Config{SSEEventName: "message", SSEDoneEvent: true}, &fakeCA{stream: []gemini.GeminiAPIResponse{
+		{Candidates: []gemini.Candidate{{Content: struct {
+			Parts []gemini.GeminiPart `json:"parts"`
+		}{Parts: []gemini.GeminiPart{{Text: "a"}}}}}},
+	}})
+	rr := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:streamGenerateContent", bytes.NewBufferString(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`))
+	s.handleModel(rr, req)
+
+	body := rr.Body.String()
+	if !strings.HasPrefix(body, "event: message\ndata: {") {
+		t.Fatalf("expected named data event, got %q", body)
+	}
+	if !strings.HasSuffix(body, "event: done\ndata: [DONE]\n\n") {
+		t.Fatalf("expected trailing done event, got %q", body)
+	}
+}
+
+func TestReadyz_ReportsFailingChecks(t *testing.T) {
+	s := NewWithCAClient(config.Config{}, &fakeCA{})
+	rr := httptest.NewRecorder()
+	s.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 without checks, got %d", rr.Code)
+	}
+
+	var proxyErr error = errors.New("dial tcp: connection refused")
+	s.AddReadinessCheck("proxy", func() error { return proxyErr })
+	rr = httptest.NewRecorder()
+	s.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), "connection refused") {
+		t.Fatalf("expected 503 naming the proxy failure, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	proxyErr = nil
+	rr = httptest.NewRecorder()
+	s.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 after recovery, got %d", rr.Code)
+	}
+}
+
+type captureRT struct{ hdr http.Header }
+
+func (c *captureRT) RoundTrip(r *http.Request) (*http.Response, error) {
+	c.hdr = r.Header.Clone()
+	return &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": []string{"application/json"}}, Body: io.NopCloser(strings.NewReader(`{"response":{"candidates":[]}}`))}, nil
+}
+
+func TestForwardHeaders_AllowlistAndUserProject(t *testing.T) {
+	send := func(cfg config.Config, hdr map[string]string) http.Header {
+		rt := &captureRT{}
+		s := NewWithCAClient(cfg, codeassist.NewCaClient(&http.Client{Transport: rt}, 0, time.Millisecond))
+		req := httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:generateContent", bytes.NewBufferString(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`))
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		s.handleModel(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d: %s", rr.Code, rr.Body.String())
+		}
+		return rt.hdr
+	}
+
+	h := send(config.Config{}, map[string]string{"X-Goog-User-Project": "client-proj", "X-Other": "x"})
+	if h.Get("X-Goog-User-Project") != "" || h.Get("X-Other") != "" {
+		t.Fatalf("expected no forwarding without allowlist, got %v", h)
+	}
+	h = send(config.Config{UserProject: "cfg-proj"}, nil)
+	if h.Get("X-Goog-User-Project") != "cfg-proj" {
+		t.Fatalf("expected configured user project, got %v", h)
+	}
+	h = send(config.Config{UserProject: "cfg-proj", ForwardHeaders: []string{"x-goog-user-project"}}, map[string]string{"X-Goog-User-Project": "client-proj", "X-Other": "x"})
+	if h.Get("X-Goog-User-Project") != "client-proj" || h.Get("X-Other") != "" {
+		t.Fatalf("expected client user project to win and others dropped, got %v", h)
+	}
+	if h.Get("Content-Type") != "application/json" {
+		t.Fatalf("fixed headers must be preserved, got %v", h)
+	}
+}
+
+// errAfterCloseCA delivers its error and closes out at the same time, so the
+// handler may observe the closed out channel first.
+type errAfterCloseCA struct{ fakeCA }
+
+func (f *errAfterCloseCA) GenerateContentStream(ctx context.Context, model, project string, req gemini.GeminiRequest) (<-chan gemini.GeminiAPIResponse, <-chan error) {
+	out := make(chan gemini.GeminiAPIResponse)
+	errs := make(chan error, 1)
+	errs <- errors.New("upstream status 503: unavailable")
+	close(errs)
+	close(out)
+	return out, errs
+}
+
+func TestStream_ErrorNotMistakenForCompletion(t *testing.T) {
+	s := NewWithCAClient(config.Config{SSEDoneEvent: true}, &errAfterCloseCA{})
+	for i := 0; i < 20; i++ {
+		rr := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		req := httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:streamGenerateContent", bytes.NewBufferString(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`))
+		s.handleModel(rr, req)
+		body := rr.Body.String()
+		if !strings.Contains(body, "event: error") || strings.Contains(body, "[DONE]") {
+			t.Fatalf("expected error event without done marker, got %q", body)
+		}
+	}
+}
+
+type listingCA struct{ fakeCA }
+
+func (l *listingCA) Credentials() []codeassist.CredentialStatus {
+	return []codeassist.CredentialStatus{{Index: 0, Credential: "~/a.json", Project: "p1"}, {Index: 1, Credential: "~/b.json", Discovered: true}}
+}
+
+func TestAdminCredentials(t *testing.T) {
+	s := NewWithCAClient(config.Config{AuthKey: "k"}, &listingCA{})
+	rr := httptest.NewRecorder()
+	s.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/admin/credentials", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without key, got %d", rr.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/admin/credentials", nil)
+	req.Header.Set("Authorization", "Bearer k")
+	rr = httptest.NewRecorder()
+	s.Router().ServeHTTP(rr, req)
+	var got struct {
+		Credentials []codeassist.CredentialStatus `json:"credentials"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(got.Credentials) != 2 || got.Credentials[0].Project != "p1" || !got.Credentials[1].Discovered {
+		t.Fatalf("unexpected credentials: %+v", got.Credentials)
+	}
+}
+
+type drainingCA struct {
+	fakeCA
+	drained map[int]bool
+}
+
+func (d *drainingCA) SetDraining(idx int, draining bool) error {
+	if idx > 1 {
+		return fmt.Errorf("credential index %d out of range", idx)
+	}
+	d.drained[idx] = draining
+	return nil
+}
+
+func TestAdminDrain(t *testing.T) {
+	ca := &drainingCA{drained: map[int]bool{}}
+	s := NewWithCAClient(config.Config{AuthKey: "k"}, ca)
+	post := func(path string) int {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set("Authorization", "Bearer k")
+		rr := httptest.NewRecorder()
+		s.Router().ServeHTTP(rr, req)
+		return rr.Code
+	}
+	rr := httptest.NewRecorder()
+	s.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/admin/credentials/1/drain", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without key, got %d", rr.Code)
+	}
+	if code := post("/admin/credentials/1/drain"); code != http.StatusOK || !ca.drained[1] {
+		t.Fatalf("drain: code=%d drained=%v", code, ca.drained)
+	}
+	if code := post("/admin/credentials/1/undrain"); code != http.StatusOK || ca.drained[1] {
+		t.Fatalf("undrain: code=%d drained=%v", code, ca.drained)
+	}
+	if code := post("/admin/credentials/5/drain"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown index, got %d", code)
+	}
+	if code := post("/admin/credentials/x/drain"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for bad path, got %d", code)
+	}
+}
+
+func TestAdminRoutesPlacement(t *testing.T) {
+	get := func(h http.Handler, path, key string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	for _, tc := range []struct {
+		name string
+		cfg  config.Config
+		want int
+	}{
+		{"loopback", config.Config{Host: "127.0.0.1"}, http.StatusOK},
+		{"public hidden", config.Config{Host: "0.0.0.0"}, http.StatusNotFound},
+		{"public opt-in", config.Config{Host: "0.0.0.0", AdminOnPublicListener: true}, http.StatusOK},
+		{"dedicated listener", config.Config{Host: "127.0.0.1", AdminListen: "127.0.0.1:9090"}, http.StatusNotFound},
+	} {
+		h := NewWithCAClient(tc.cfg, &listingCA{}).Router()
+		for _, path := range []string{"/admin/credentials", "/metrics"} {
+			if code := get(h, path, ""); code != tc.want {
+				t.Fatalf("%s %s: got %d, want %d", tc.name, path, code, tc.want)
+			}
+		}
+	}
+
+	s := NewWithCAClient(config.Config{AuthKey: "k", MetricsAuthKey: "m", AdminListen: "127.0.0.1:9090"}, &listingCA{})
+	admin := s.AdminRouter()
+	if code := get(admin, "/admin/credentials", "k"); code != http.StatusUnauthorized {
+		t.Fatalf("expected authKey rejected when metricsAuthKey is set, got %d", code)
+	}
+	if code := get(admin, "/metrics", "m"); code != http.StatusOK {
+		t.Fatalf("expected metricsAuthKey accepted, got %d", code)
+	}
+}
+
+func TestRoutePrefix(t *testing.T) {
+	get := func(h http.Handler, path string) int {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr.Code
+	}
+	h := NewWithCAClient(config.Config{RoutePrefix: "/gemini"}, &listingCA{}).Router()
+	for path, want := range map[string]int{
+		"/gemini/health":                         http.StatusOK,
+		"/gemini/v1beta/models":                  http.StatusOK,
+		"/gemini/v1beta/models/gemini-2.5-flash": http.StatusOK,
+		"/gemini/admin/credentials":              http.StatusOK,
+		"/health":                                http.StatusNotFound,
+		"/v1beta/models":                         http.StatusNotFound,
+		"/geminiv1beta/models":                   http.StatusNotFound,
+	} {
+		if code := get(h, path); code != want {
+			t.Fatalf("%s: got %d, want %d", path, code, want)
+		}
+	}
+	h = NewWithCAClient(config.Config{RoutePrefix: "/gemini", RoutePrefixExemptProbes: true}, &listingCA{}).Router()
+	if code := get(h, "/health"); code != http.StatusOK {
+		t.Fatalf("exempt /health: got %d", code)
+	}
+	if code := get(h, "/v1beta/models"); code != http.StatusNotFound {
+		t.Fatalf("exemption must only cover probes, got %d", code)
+	}
+}
+
+func TestRejectHTTP10(t *testing.T) {
+	for _, reject := range []bool{false, true} {
+		h := NewWithCAClient(config.Config{RejectHTTP10: reject}, &fakeCA{}).Router()
+		req := httptest.NewRequest(http.MethodGet, "/health", nil)
+		req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/1.0", 1, 0
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		want := http.StatusOK
+		if reject {
+			want = http.StatusHTTPVersionNotSupported
+		}
+		if rr.Code != want {
+			t.Fatalf("rejectHttp10=%v: got %d, want %d", reject, rr.Code, want)
+		}
+	}
+}
+
+// modelsCA answers unary calls with the model name as text and reports
+// each call's model on calls.
+type modelsCA struct {
+	fakeCA
+	calls chan string
+}
+
+func (m *modelsCA) GenerateContent(ctx context.Context, model, project string, req gemini.GeminiRequest) (*gemini.GeminiAPIResponse, error) {
+	m.calls <- model
+	resp := &gemini.GeminiAPIResponse{Candidates: []gemini.Candidate{{}}}
+	resp.Candidates[0].Content.Parts = []gemini.GeminiPart{{Text: "from " + model}}
+	return resp, nil
+}
+
+func TestShadowModel(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	ca := &modelsCA{calls: make(chan string, 4)}
+	s := NewWithCAClient(config.Config{ShadowModel: "gemini-2.5-pro", ShadowSampleRate: 1}, ca)
+	rr := httptest.NewRecorder()
+	s.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:generateContent", bytes.NewBufferString(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`)))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "from gemini-2.5-flash") || strings.Contains(rr.Body.String(), "gemini-2.5-pro") {
+		t.Fatalf("client must only see the primary response: %d %s", rr.Code, rr.Body.String())
+	}
+	got := map[string]bool{}
+	for range 2 {
+		select {
+		case m := <-ca.calls:
+			got[m] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("missing upstream call, got %v", got)
+		}
+	}
+	if !got["gemini-2.5-pro"] {
+		t.Fatalf("shadow model not called: %v", got)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var entry *logrus.Entry
+		for _, e := range hook.AllEntries() {
+			if e.Message == "shadow comparison" {
+				entry = e
+			}
+		}
+		if entry != nil {
+			if entry.Data["primary"] != "from gemini-2.5-flash" || entry.Data["shadow"] != "from gemini-2.5-pro" {
+				t.Fatalf("unexpected comparison log: %v", entry.Data)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("shadow comparison not logged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAllowShadow(t *testing.T) {
+	s := NewWithCAClient(config.Config{ShadowMaxPerMinute: 2}, &fakeCA{})
+	now := time.Now()
+	if !s.allowShadow(now) {
+		t.Fatal("first shadow call must be allowed")
+	}
+	if s.allowShadow(now.Add(10 * time.Second)) {
+		t.Fatal("expected a call within 30s of the last to be skipped")
+	}
+	if !s.allowShadow(now.Add(30 * time.Second)) {
+		t.Fatal("expected a call 30s later to be allowed")
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	ue := &codeassist.UpstreamError{StatusCode: 429, Body: "quota", RetryAfter: 1500 * time.Millisecond, RateLimit: http.Header{"X-Ratelimit-Remaining-Requests": {"0"}}}
+	s := NewWithCAClient(config.Config{}, &fakeCA{err: fmt.Errorf("wrapped: %w", ue)})
+	rr := httptest.NewRecorder()
+	s.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:streamGenerateContent", bytes.NewBufferString(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`)))
+	if got := rr.Header().Get("Retry-After"); got != "2" {
+		t.Fatalf("Retry-After = %q, want 2", got)
+	}
+	if got := rr.Header().Get("X-RateLimit-Remaining-Requests"); got != "0" {
+		t.Fatalf("X-RateLimit-Remaining-Requests = %q", got)
+	}
+}
+
+func TestAdminPauseResume(t *testing.T) {
+	s := NewWithCAClient(config.Config{AuthKey: "k", PausedRetryAfterSeconds: 30, PausedMessage: "incident"}, &fakeCA{})
+	h := s.Router()
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`))
+		req.Header.Set("Authorization", "Bearer k")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	const gen = "/v1beta/models/gemini-2.5-flash:generateContent"
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/admin/pause", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without key, got %d", rr.Code)
+	}
+	if rr := do(http.MethodPost, "/admin/pause"); rr.Code != http.StatusOK {
+		t.Fatalf("pause: %d %s", rr.Code, rr.Body.String())
+	}
+	rr = do(http.MethodPost, gen)
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "30" || !strings.Contains(rr.Body.String(), "incident") {
+		t.Fatalf("expected paused 503, got %d %q %s", rr.Code, rr.Header().Get("Retry-After"), rr.Body.String())
+	}
+	if rr := do(http.MethodGet, "/health"); rr.Code != http.StatusOK {
+		t.Fatalf("health while paused: %d", rr.Code)
+	}
+	if rr := do(http.MethodPost, "/admin/resume"); rr.Code != http.StatusOK {
+		t.Fatalf("resume: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := do(http.MethodPost, gen); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 after resume, got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestStartPaused(t *testing.T) {
+	s := NewWithCAClient(config.Config{StartPaused: true}, &fakeCA{})
+	rr := httptest.NewRecorder()
+	s.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:streamGenerateContent", bytes.NewBufferString(`{}`)))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 when started paused, got %d", rr.Code)
+	}
+}
+
+type recordingCA struct {
+	fakeCA
+	last  gemini.GeminiRequest
+	model string
+}
+
+func (r *recordingCA) GenerateContent(ctx context.Context, model, project string, req gemini.GeminiRequest) (*gemini.GeminiAPIResponse, error) {
+	r.last, r.model = req, model
+	return r.fakeCA.GenerateContent(ctx, model, project, req)
+}
+
+func (r *recordingCA) GenerateContentStream(ctx context.Context, model, project string, req gemini.GeminiRequest) (<-chan gemini.GeminiAPIResponse, <-chan error) {
+	r.last, r.model = req, model
+	return r.fakeCA.GenerateContentStream(ctx, model, project, req)
+}
+
+func TestReplayMatchesHandler(t *testing.T) {
+	chunk := gemini.GeminiAPIResponse{Candidates: []gemini.Candidate{{Content: struct {
+		Parts []gemini.GeminiPart `json:"parts"`
+	}{Parts: []gemini.GeminiPart{{Text: "a"}}}}}}
+	ca := &recordingCA{fakeCA: fakeCA{stream: []gemini.GeminiAPIResponse{chunk, chunk}}}
+	cfg := config.Config{
+		MaxContents:              1,
+		AutoModel:                "gemini-auto",
+		AutoModelThresholdTokens: 50,
+		AutoModelShort:           "gemini-2.0-flash-001",
+		AutoModelLong:            "gemini-2.5-pro",
+		AllowedModels:            []string{"gemini-2.0-flash"},
+	}
+	s := NewWithCAClient(cfg, ca)
+	ctx := context.Background()
+	body := `{"contents":[{"role":"user","parts":[{"text":"a"}]}]}`
+	var out bytes.Buffer
+	// The virtual model routes to an alias, which resolves like in the handlers
+	if err := s.Replay(ctx, "gemini-auto", false, -1, strings.NewReader(body), &out); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if ca.model != "gemini-2.0-flash" || !strings.Contains(out.String(), `"text": "a"`) {
+		t.Fatalf("unexpected replay of model %q: %s", ca.model, out.String())
+	}
+	if err := s.Replay(ctx, "gemini-2.5-pro", false, -1, strings.NewReader(body), io.Discard); err == nil {
+		t.Fatal("expected allowedModels to be enforced")
+	}
+	two := `{"contents":[{"role":"user","parts":[{"text":"a"}]},{"role":"user","parts":[{"text":"b"}]}]}`
+	if err := s.Replay(ctx, "gemini-2.0-flash", false, -1, strings.NewReader(two), io.Discard); err == nil {
+		t.Fatal("expected maxContents to be enforced")
+	}
+	out.Reset()
+	if err := s.Replay(ctx, "gemini-2.0-flash", true, -1, strings.NewReader(body), &out); err != nil {
+		t.Fatalf("stream replay: %v", err)
+	}
+	if n := strings.Count(out.String(), "\n"); n != 2 {
+		t.Fatalf("expected one line per chunk, got %d: %s", n, out.String())
+	}
+
+	// A credential index pins through the client's unit pinning
+	if err := s.Replay(ctx, "gemini-2.0-flash", false, 0, strings.NewReader(body), io.Discard); err == nil {
+		t.Fatal("expected pinning to fail on a client without units")
+	}
+	p := NewWithCAClient(config.Config{}, &pinnableCA{})
+	if err := p.Replay(ctx, "gemini-2.5-flash", false, 1, strings.NewReader(body), io.Discard); err != nil {
+		t.Fatalf("pinned replay: %v", err)
+	}
+	if err := p.Replay(ctx, "gemini-2.5-flash", false, 2, strings.NewReader(body), io.Discard); err == nil {
+		t.Fatal("expected an out-of-range credential index to fail")
+	}
+}
+
+func TestCandidateSelectionBest(t *testing.T) {
+	low, high := -1.5, -0.2
+	resp := gemini.GeminiAPIResponse{Candidates: []gemini.Candidate{{AvgLogprobs: &low}, {AvgLogprobs: &high}}}
+	resp.Candidates[0].Content.Parts = []gemini.GeminiPart{{Text: "worse"}}
+	resp.Candidates[1].Content.Parts = []gemini.GeminiPart{{Text: "better"}}
+	ca := &recordingCA{fakeCA: fakeCA{stream: []gemini.GeminiAPIResponse{resp}}}
+	s := NewWithCAClient(config.Config{CandidateSelection: config.CandidateBest}, ca)
+	body := `{"contents":[{"role":"user","parts":[{"text":"hi"}]}],"generationConfig":{"candidateCount":2,"responseLogprobs":true}}`
+	rr := httptest.NewRecorder()
+	s.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:generateContent", bytes.NewBufferString(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rr.Code, rr.Body.String())
+	}
+	gc := ca.last.GenerationConfig
+	if gc == nil || gc.CandidateCount == nil || *gc.CandidateCount != 2 || gc.ResponseLogprobs == nil || !*gc.ResponseLogprobs {
+		t.Fatalf("candidateCount/responseLogprobs not forwarded upstream: %+v", gc)
+	}
+	var out gemini.GeminiAPIResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &out); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if len(out.Candidates) != 1 || gemini.ResponseText(&out) != "better" {
+		t.Fatalf("expected only the higher-logprob candidate, got %s", rr.Body.String())
+	}
+}
+
+func ptrTo[T any](v T) *T { return &v }
+
+func TestGenerationOverrideHeaders(t *testing.T) {
+	cases := []struct {
+		name     string
+		force    bool
+		body     string
+		headers  map[string]string
+		wantTemp *float64
+		wantMax  int
+	}{
+		{"applied when body unset", false, `{}`, map[string]string{"X-Gemini-Temperature": "0.7", "X-Gemini-Max-Output-Tokens": "128"}, ptrTo(0.7), 128},
+		{"body wins", false, `{"temperature":0.2,"maxOutputTokens":64}`, map[string]string{"X-Gemini-Temperature": "0.7", "X-Gemini-Max-Output-Tokens": "128"}, ptrTo(0.2), 64},
+		{"explicit zero body wins", false, `{"temperature":0}`, map[string]string{"X-Gemini-Temperature": "0.7"}, ptrTo(0.0), 0},
+		{"forced", true, `{"temperature":0.2,"maxOutputTokens":64}`, map[string]string{"X-Gemini-Temperature": "0.7", "X-Gemini-Max-Output-Tokens": "128"}, ptrTo(0.7), 128},
+		{"malformed ignored", false, `{}`, map[string]string{"X-Gemini-Temperature": "hot", "X-Gemini-Max-Output-Tokens": "9999999"}, nil, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ca := &recordingCA{}
+			s := NewWithCAClient(config.Config{ForceHeaderOverride: c.force}, ca)
+			body := `{"contents":[{"role":"user","parts":[{"text":"hi"}]}],"generationConfig":` + c.body + `}`
+			req := httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:generateContent", bytes.NewBufferString(body))
+			for k, v := range c.headers {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+			s.handleModel(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("unexpected status %d", rr.Code)
+			}
+			gc := ca.last.GenerationConfig
+			if gc == nil || (gc.Temperature == nil) != (c.wantTemp == nil) || (gc.Temperature != nil && *gc.Temperature != *c.wantTemp) || gc.MaxOutputTokens != c.wantMax {
+				t.Fatalf("got %+v, want temperature=%v maxOutputTokens=%d", gc, c.wantTemp, c.wantMax)
+			}
+		})
+	}
+}
+
+func TestStream_UsagePerChunkMonotonic(t *testing.T) {
+	chunk := func(text string, u *gemini.UsageMetadata) gemini.GeminiAPIResponse {
+		g := gemini.GeminiAPIResponse{UsageMetadata: u}
+		var c gemini.Candidate
+		c.Content.Parts = []gemini.GeminiPart{{Text: text}}
+		g.Candidates = []gemini.Candidate{c}
+		return g
+	}
+	s := NewWithCAClient(config.Config{StreamUsagePerChunk: true}, &fakeCA{stream: []gemini.GeminiAPIResponse{
+		chunk("a", nil),
+		chunk("b", &gemini.UsageMetadata{PromptTokenCount: 5, CandidatesTokenCount: 2, TotalTokenCount: 7}),
+		chunk("c", nil),
+		// A regressing intermediate report must not lower the totals
+		chunk("d", &gemini.UsageMetadata{PromptTokenCount: 5, CandidatesTokenCount: 1, TotalTokenCount: 6}),
+		chunk("e", &gemini.UsageMetadata{PromptTokenCount: 5, CandidatesTokenCount: 4, TotalTokenCount: 9}),
+	}})
+	rr := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req := httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:streamGenerateContent", bytes.NewBufferString(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`))
+	s.handleModel(rr, req)
+
+	var totals []int
+	for _, line := range strings.Split(rr.Body.String(), "\n") {
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var g gemini.GeminiAPIResponse
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &g); err != nil {
+			t.Fatalf("decode chunk: %v", err)
+		}
+		if g.UsageMetadata == nil {
+			totals = append(totals, 0)
+			continue
+		}
+		totals = append(totals, g.UsageMetadata.TotalTokenCount)
+	}
+	want := []int{0, 7, 7, 7, 9}
+	if fmt.Sprint(totals) != fmt.Sprint(want) {
+		t.Fatalf("got totals %v, want %v", totals, want)
+	}
+}
+
+func TestStream_FlushEveryNChunks(t *testing.T) {
+	var chunks []gemini.GeminiAPIResponse
+	for i := 0; i < 5; i++ {
+		chunks = append(chunks, gemini.GeminiAPIResponse{})
+	}
+	for _, c := range []struct{ every, want int }{{0, 5}, {2, 3}, {10, 1}} {
+		s := NewWithCAClient(config.Config{FlushEveryNChunks: c.every, EmptyStreamMode: config.EmptyStreamNone}, &fakeCA{stream: chunks})
+		rr := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		req := httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:streamGenerateContent", bytes.NewBufferString(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`))
+		s.handleModel(rr, req)
+		if got := strings.Count(rr.Body.String(), "data: "); got != 5 {
+			t.Fatalf("every=%d: expected 5 chunks, got %d", c.every, got)
+		}
+		if rr.flushed != c.want {
+			t.Fatalf("every=%d: expected %d flushes, got %d", c.every, c.want, rr.flushed)
+		}
+	}
+}
+
+func TestStream_CoalesceStreamMs(t *testing.T) {
+	text := func(t string) gemini.GeminiAPIResponse {
+		var c gemini.Candidate
+		c.Content.Parts = []gemini.GeminiPart{{Text: t}}
+		return gemini.GeminiAPIResponse{Candidates: []gemini.Candidate{c}}
+	}
+	call := text("")
+	call.Candidates[0].Content.Parts = []gemini.GeminiPart{{FunctionCall: &gemini.FunctionCall{Name: "f"}}}
+	final := gemini.GeminiAPIResponse{UsageMetadata: &gemini.UsageMetadata{TotalTokenCount: 7}}
+	stream := []gemini.GeminiAPIResponse{text("He"), text("l"), text("lo"), call, text("!"), final}
+
+	for _, tc := range []struct {
+		ms   int
+		want []string
+	}{
+		{0, []string{`"He"`, `"l"`, `"lo"`, `"f"`, `"!"`, `"totalTokenCount":7`}},
+		{10000, []string{`"Hello"`, `"f"`, `"!"`, `"totalTokenCount":7`}},
+	} {
+		s := NewWithCAClient(config.Config{CoalesceStreamMs: tc.ms}, &fakeCA{stream: stream})
+		rr := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		req := httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:streamGenerateContent", bytes.NewBufferString(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`))
+		s.handleModel(rr, req)
+		var events []string
+		for _, line := range strings.Split(rr.Body.String(), "\n") {
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				events = append(events, data)
+			}
+		}
+		if len(events) != len(tc.want) {
+			t.Fatalf("ms=%d: expected %d events, got %d:\n%s", tc.ms, len(tc.want), len(events), rr.Body.String())
+		}
+		for i, want := range tc.want {
+			if !strings.Contains(events[i], want) {
+				t.Fatalf("ms=%d: event %d = %s, want it to contain %s", tc.ms, i, events[i], want)
+			}
+		}
+	}
+}
+
+func TestStream_EmptyStreamMode(t *testing.T) {
+	blocked := gemini.GeminiAPIResponse{PromptFeedback: map[string]interface{}{"blockReason": "SAFETY"}}
+	for _, tc := range []struct {
+		mode   string
+		stream []gemini.GeminiAPIResponse
+		want   string
+	}{
+		{"", []gemini.GeminiAPIResponse{blocked}, `event: empty` + "\n" + `data: {"finishReason":"NO_CONTENT","blockReason":"SAFETY","chunksSent":1}`},
+		{"", nil, `event: empty` + "\n" + `data: {"finishReason":"NO_CONTENT","chunksSent":0}`},
+		{config.EmptyStreamError, []gemini.GeminiAPIResponse{blocked}, `"code":502`},
+		{config.EmptyStreamNone, []gemini.GeminiAPIResponse{blocked}, ""},
+	} {
+		s := NewWithCAClient(config.Config{EmptyStreamMode: tc.mode}, &fakeCA{stream: tc.stream})
+		rr := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		req := httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:streamGenerateContent", bytes.NewBufferString(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`))
+		s.handleModel(rr, req)
+		body := rr.Body.String()
+		if tc.want == "" {
+			if strings.Contains(body, "event:") {
+				t.Fatalf("mode %q: expected no terminal event, got:\n%s", tc.mode, body)
+			}
+			continue
+		}
+		if !strings.Contains(body, tc.want) {
+			t.Fatalf("mode %q: expected %s, got:\n%s", tc.mode, tc.want, body)
+		}
+	}
+}
+
+func TestGenerate_PrettyResponses(t *testing.T) {
+	for _, tc := range []struct {
+		cfg    config.Config
+		query  string
+		pretty bool
+	}{
+		{config.Config{}, "", false},
+		{config.Config{}, "?pretty=1", true},
+		{config.Config{PrettyResponses: true}, "", true},
+	} {
+		s := NewWithCAClient(tc.cfg, &fakeCA{})
+		rr := httptest.NewRecorder()
+		s.handleModel(rr, httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:generateContent"+tc.query, bytes.NewBufferString(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`)))
+		if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("%+v: status %d, content type %q", tc, rr.Code, rr.Header().Get("Content-Type"))
+		}
+		if got := strings.Contains(rr.Body.String(), "\n  "); got != tc.pretty {
+			t.Fatalf("query %q: indented=%v, want %v: %s", tc.query, got, tc.pretty, rr.Body.String())
+		}
+	}
+}
+
+func TestUnknownModel_ListsSupportedModels(t *testing.T) {
+	s := NewWithCAClient(config.Config{}, &fakeCA{})
+	req := httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-9-ultra:generateContent", bytes.NewBufferString(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`))
+	rr := httptest.NewRecorder()
+	s.handleModel(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rr.Code)
+	}
+	var body struct {
+		Error struct {
+			Message         string   `json:"message"`
+			SupportedModels []string `json:"supportedModels"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("expected JSON error body: %v (%s)", err, rr.Body.String())
+	}
+	if !strings.Contains(body.Error.Message, "gemini-9-ultra") {
+		t.Fatalf("message should name the model: %q", body.Error.Message)
+	}
+	for _, m := range gemini.SupportedModels {
+		if !slices.Contains(body.Error.SupportedModels, m.Name) {
+			t.Fatalf("missing %s in supportedModels %v", m.Name, body.Error.SupportedModels)
+		}
+	}
+}
+
+func TestAllowedModels_FiltersServedSet(t *testing.T) {
+	s := NewWithCAClient(config.Config{AllowedModels: []string{"gemini-2.5-flash", "gemini-2.0-flash-lite-001"}}, &fakeCA{})
+	body := `{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`
+
+	rr := httptest.NewRecorder()
+	s.handleListModels(rr, httptest.NewRequest(http.MethodGet, "/v1beta/models", nil))
+	var list struct {
+		Models []modelResource `json:"models"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(list.Models) != 2 || list.Models[0].Name != "models/gemini-2.5-flash" || list.Models[1].Name != "models/gemini-2.0-flash-lite" {
+		t.Fatalf("unexpected model list: %+v", list.Models)
+	}
+
+	rr = httptest.NewRecorder()
+	s.handleModel(rr, httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-pro:generateContent", bytes.NewBufferString(body)))
+	if rr.Code != http.StatusBadRequest || strings.Contains(rr.Body.String(), `"gemini-2.5-pro"]`) {
+		t.Fatalf("expected 400 for filtered model, got %d %s", rr.Code, rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	s.handleModel(rr, httptest.NewRequest(http.MethodGet, "/v1beta/models/gemini-2.5-pro", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for filtered model metadata, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	s.handleModel(rr, httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.0-flash-lite:generateContent", bytes.NewBufferString(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for allowed model, got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestMetrics_TimingHistograms(t *testing.T) {
+	s := NewWithCAClient(config.Config{}, &fakeCA{})
+	req := httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-pro:generateContent", bytes.NewBufferString(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`))
+	s.Router().ServeHTTP(httptest.NewRecorder(), req)
+
+	rr := httptest.NewRecorder()
+	s.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rr.Body.String()
+	for _, name := range []string{"gcli2api_request_queue_wait_seconds", "gcli2api_request_discovery_seconds", "gcli2api_request_upstream_seconds"} {
+		if !strings.Contains(body, name+`_count{model="gemini-2.5-pro"}`) {
+			t.Fatalf("missing %s series in:\n%s", name, body)
+		}
+	}
+}
+
+func TestRequestMaxBodyBytes_LimitAndUnlimited(t *testing.T) {
+	body := `{"contents":[{"role":"user","parts":[{"text":"` + strings.Repeat("x", 4096) + `"}]}]}`
+	for _, tc := range []struct {
+		limit int64
+		want  int
+	}{{1024, http.StatusBadRequest}, {-1, http.StatusOK}} {
+		s := NewWithCAClient(config.Config{RequestMaxBodyBytes: tc.limit}, &fakeCA{})
+		rr := httptest.NewRecorder()
+		s.handleModel(rr, httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:generateContent", bytes.NewBufferString(body)))
+		if rr.Code != tc.want {
+			t.Fatalf("limit %d: expected %d, got %d (%s)", tc.limit, tc.want, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestStream_ErrorTrailerReportsPartial(t *testing.T) {
+	chunk := gemini.GeminiAPIResponse{Candidates: []gemini.Candidate{{}}}
+	upstreamErr := errors.New("upstream status 503: unavailable")
+	for _, tc := range []struct {
+		stream  []gemini.GeminiAPIResponse
+		partial bool
+	}{{nil, false}, {[]gemini.GeminiAPIResponse{chunk, chunk}, true}} {
+		s := NewWithCAClient(config.Config{}, &fakeCA{stream: tc.stream, err: upstreamErr})
+		rr := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		s.handleModel(rr, httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:streamGenerateContent", bytes.NewBufferString(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`)))
+		body := rr.Body.String()
+		_, data, ok := strings.Cut(body, "event: error\ndata: ")
+		if !ok {
+			t.Fatalf("missing error event: %q", body)
+		}
+		var trailer streamErrorTrailer
+		if err := json.Unmarshal([]byte(strings.TrimSpace(data)), &trailer); err != nil {
+			t.Fatalf("bad trailer %q: %v", data, err)
+		}
+		if trailer.FinishReason != "ERROR" || trailer.Partial != tc.partial || trailer.ChunksSent != len(tc.stream) {
+			t.Fatalf("unexpected trailer: %+v", trailer)
+		}
+		if trailer.Error.Code != httpStatusFromError(upstreamErr) || !strings.Contains(trailer.Error.Message, "unavailable") {
+			t.Fatalf("unexpected trailer error: %+v", trailer.Error)
+		}
+	}
+}
+
+func TestAutoModel_RoutesByPromptSize(t *testing.T) {
+	cfg := config.Config{AutoModel: "gemini-auto", AutoModelThresholdTokens: 50, AutoModelShort: "gemini-2.5-flash", AutoModelLong: "gemini-2.5-pro"}
+	rec := &recordingCA{}
+	s := NewWithCAClient(cfg, rec)
+	for _, tc := range []struct {
+		text, want string
+	}{{"hi", "gemini-2.5-flash"}, {strings.Repeat("word ", 200), "gemini-2.5-pro"}} {
+		for _, method := range []string{"generateContent", "streamGenerateContent"} {
+			body := `{"contents":[{"role":"user","parts":[{"text":"` + tc.text + `"}]}]}`
+			rr := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+			s.handleModel(rr, httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-auto:"+method, bytes.NewBufferString(body)))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("%s: unexpected status %d: %s", method, rr.Code, rr.Body.String())
+			}
+			if got := rr.Header().Get("X-Model-Used"); got != tc.want {
+				t.Fatalf("%s: X-Model-Used = %q, want %q", method, got, tc.want)
+			}
+			if rec.model != tc.want {
+				t.Fatalf("%s: upstream model = %q, want %q", method, rec.model, tc.want)
+			}
+		}
+	}
+}
+
+func TestModelAlias_ForwardsCanonicalName(t *testing.T) {
+	rec := &recordingCA{}
+	s := NewWithCAClient(config.Config{}, rec)
+	body := `{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`
+	rr := httptest.NewRecorder()
+	s.handleModel(rr, httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.0-flash-001:generateContent", bytes.NewBufferString(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rr.Code, rr.Body.String())
+	}
+	if rec.model != "gemini-2.0-flash" || rr.Header().Get("X-Model-Used") != "gemini-2.0-flash" {
+		t.Fatalf("alias not resolved: upstream=%q header=%q", rec.model, rr.Header().Get("X-Model-Used"))
+	}
+
+	rr = httptest.NewRecorder()
+	s.handleModel(rr, httptest.NewRequest(http.MethodGet, "/v1beta/models/gemini-2.0-flash-lite-001", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"models/gemini-2.0-flash-lite"`) {
+		t.Fatalf("alias metadata lookup failed: %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestUnary_ClientCancelPropagatesUpstream(t *testing.T) {
+	started := make(chan struct{})
+	upstreamDone := make(chan struct{})
+	rt := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		close(started)
+		<-r.Context().Done()
+		close(upstreamDone)
+		return nil, r.Context().Err()
+	})
+	s := NewWithCAClient(config.Config{}, codeassist.NewCaClient(&http.Client{Transport: rt}, 0, time.Millisecond))
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:generateContent", bytes.NewBufferString(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`)).WithContext(ctx)
+	rr := httptest.NewRecorder()
+	handled := make(chan struct{})
+	go func() {
+		s.handleModel(rr, req)
+		close(handled)
+	}()
+	<-started
+	cancel()
+	select {
+	case <-upstreamDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream request context was not canceled after the client went away")
+	}
+	select {
+	case <-handled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler did not return after the client went away")
+	}
+	if rr.Code != statusClientClosedRequest {
+		t.Fatalf("expected %d for an abandoned request, got %d", statusClientClosedRequest, rr.Code)
+	}
+}
+
+func TestCoalesceEmptyParts(t *testing.T) {
+	body := `{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`
+	for _, coalesce := range []bool{false, true} {
+		var chunk gemini.GeminiAPIResponse
+		if err := json.Unmarshal([]byte(`{"candidates":[{"content":{"parts":[{"text":""},{"text":"a"},{"text":"b"}]}}]}`), &chunk); err != nil {
+			t.Fatal(err)
+		}
+		want := `[{},{"text":"a"},{"text":"b"}]`
+		if coalesce {
+			want = `[{"text":"ab"}]`
+		}
+		s := NewWithCAClient(config.Config{CoalesceEmptyParts: coalesce}, &fakeCA{stream: []gemini.GeminiAPIResponse{chunk}})
+
+		rr := httptest.NewRecorder()
+		s.handleModel(rr, httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:generateContent", bytes.NewBufferString(body)))
+		if !strings.Contains(rr.Body.String(), `"parts":`+want) {
+			t.Fatalf("coalesce=%v unary: expected parts %s, got %s", coalesce, want, rr.Body.String())
+		}
+		fr := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		s.handleModel(fr, httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:streamGenerateContent", bytes.NewBufferString(body)))
+		if !strings.Contains(fr.Body.String(), `"parts":`+want) {
+			t.Fatalf("coalesce=%v stream: expected parts %s, got %s", coalesce, want, fr.Body.String())
+		}
+	}
+}
+
+func TestHTTPStatusFromError_DiscoveryFailed(t *testing.T) {
+	err := fmt.Errorf("%w on all 1 unit(s): idx=0 cred=a.json: upstream status 403: denied", codeassist.ErrDiscoveryFailed)
+	if got := httpStatusFromError(err); got != http.StatusBadGateway {
+		t.Fatalf("expected 502 for discovery failures, got %d", got)
+	}
+}
+
+func TestDebugHeaders_RawResponse(t *testing.T) {
+	raw := `{"response":{"candidates":[{"content":{"parts":[{"text":"ok"}]},"citationMetadata":{"citations":[]}}],"modelVersion":"gemini-2.5-flash-001"},"traceId":"t1"}`
+	rt := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"application/json"}}, Body: io.NopCloser(strings.NewReader(raw))}, nil
+	})
+	ca := codeassist.NewCaClient(&http.Client{Transport: rt}, 0, time.Millisecond)
+	body := `{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`
+	for _, tc := range []struct {
+		debug   bool
+		wantRaw bool
+	}{{false, false}, {true, true}} {
+		s := NewWithCAClient(config.Config{DebugHeaders: tc.debug}, ca)
+		req := httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:generateContent", bytes.NewBufferString(body))
+		req.Header.Set("X-Debug-Raw-Response", "true")
+		rr := httptest.NewRecorder()
+		s.handleModel(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("debug=%v: unexpected status %d: %s", tc.debug, rr.Code, rr.Body.String())
+		}
+		if got := rr.Body.String() == raw; got != tc.wantRaw {
+			t.Fatalf("debug=%v: raw body returned = %v, body %s", tc.debug, got, rr.Body.String())
+		}
+	}
+}
+
+func TestModelVersionHeader(t *testing.T) {
+	s := NewWithCAClient(config.Config{}, &fakeCA{stream: []gemini.GeminiAPIResponse{{Candidates: []gemini.Candidate{{}}, ModelVersion: "gemini-2.5-flash-001"}}})
+	body := `{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`
+	for _, method := range []string{"generateContent", "streamGenerateContent"} {
+		rr := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		s.handleModel(rr, httptest.NewRequest(http.MethodPost, "/v1beta/models/gemini-2.5-flash:"+method, bytes.NewBufferString(body)))
+		if got := rr.Result().Header.Get("X-Model-Version"); got != "gemini-2.5-flash-001" {
+			t.Fatalf("%s: X-Model-Version = %q", method, got)
+		}
+		if !strings.Contains(rr.Body.String(), `"modelVersion":"gemini-2.5-flash-001"`) {
+			t.Fatalf("%s: modelVersion missing from body: %s", method, rr.Body.String())
+		}
+	}
+}
+
+func TestVersion_PublicUnlessGuarded(t *testing.T) {
+	for _, guarded := range []bool{false, true} {
+		s := NewWithCAClient(config.Config{AuthKey: "k", VersionRequiresAuth: guarded}, &fakeCA{})
+		rr := httptest.NewRecorder()
+		s.Router().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/version", nil))
+		if guarded {
+			if rr.Code != http.StatusUnauthorized {
+				t.Fatalf("expected 401 when guarded, got %d", rr.Code)
+			}
+			continue
+		}
+		var info struct {
+			Version   string `json:"version"`
+			GoVersion string `json:"goVersion"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &info); err != nil || info.Version == "" || !strings.HasPrefix(info.GoVersion, "go") {
+			t.Fatalf("unexpected version response %d %s (%v)", rr.Code, rr.Body.String(), err)
+		}
+	}
+}
+
+func TestStream_CancelByID(t *testing.T) {
+	ca := &floodCA{canceled: make(chan struct{})}
+	s := NewWithCAClient(config.Config{AuthKey: "k"}, ca)
+	ts := httptest.NewServer(s.Router())
+	defer ts.Close()
+
+	post := func(path, cancelID string, body string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer k")
+		if cancelID != "" {
+			req.Header.Set(cancelIDHeader, cancelID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("post %s: %v", path, err)
+		}
+		return resp
+	}
+	const body = `{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`
+	stream := post("/v1beta/models/gemini-2.5-flash:streamGenerateContent", "abc", body)
+	defer stream.Body.Close()
+
+	dup := post("/v1beta/models/gemini-2.5-flash:streamGenerateContent", "abc", body)
+	dup.Body.Close()
+	if dup.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 for an in-flight id, got %d", dup.StatusCode)
+	}
+	if resp := post("/v1beta/cancel/abc", "", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("cancel: %d", resp.StatusCode)
+	}
+	select {
+	case <-ca.canceled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("upstream stream not canceled")
+	}
+	_, _ = io.Copy(io.Discard, stream.Body)
+	if resp := post("/v1beta/cancel/abc", "", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 once the stream ended, got %d", resp.StatusCode)
+	}
+}
+
+func TestRegisterCancel_UnregisterKeepsReusedID(t *testing.T) {
+	s := NewWithCAClient(config.Config{}, &fakeCA{})
+	unregisterA, err := s.registerCancel("abc", func() {})
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	// A cancel removes the entry, so a new stream can reuse the id
+	s.cancels.Delete("abc")
+	canceledB := false
+	if _, err := s.registerCancel("abc", func() { canceledB = true }); err != nil {
+		t.Fatalf("reuse id: %v", err)
+	}
+	unregisterA()
+	rr := httptest.NewRecorder()
+	s.handleCancel(rr, httptest.NewRequest(http.MethodPost, "/v1beta/cancel/abc", nil))
+	if rr.Code != http.StatusOK || !canceledB {
+		t.Fatalf("the first stream's unregister removed the second stream's id: %d", rr.Code)
+	}
+}
+
+func TestRequestFingerprintHeader(t *testing.T) {
+	s := NewWithCAClient(config.Config{}, &recordingCA{})
+	fingerprint := func(method, model, body string) string {
+		rr := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		s.handleModel(rr, httptest.NewRequest(http.MethodPost, "/v1beta/models/"+model+":"+method, bytes.NewBufferString(body)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d: %s", method, rr.Code, rr.Body.String())
+		}
+		return rr.Header().Get("X-Request-Fingerprint")
+	}
+	a := `{"contents":[{"role":"user","parts":[{"text":"hi"}]}],"generationConfig":{"temperature":0.5,"topK":3}}`
+	// Same request with different key order and a defaulted role
+	b := `{"generationConfig":{"topK":3,"temperature":0.5},"contents":[{"parts":[{"text":"hi"}]}]}`
+	fa := fingerprint("generateContent", "gemini-2.5-flash", a)
+	if len(fa) != 64 {
+		t.Fatalf("expected a sha256 hex fingerprint, got %q", fa)
+	}
+	if fb := fingerprint("streamGenerateContent", "gemini-2.5-flash", b); fb != fa {
+		t.Fatalf("equivalent requests differ: %q vs %q", fa, fb)
+	}
+	if fp := fingerprint("generateContent", "gemini-2.5-pro", a); fp == fa {
+		t.Fatalf("fingerprint must depend on the model")
+	}
+	if fp := fingerprint("generateContent", "gemini-2.5-flash", strings.Replace(a, "hi", "hello", 1)); fp == fa {
+		t.Fatalf("fingerprint must depend on the contents")
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"gcli2api/internal/codeassist"
+	"gcli2api/internal/gemini"
+
+	"github.com/sirupsen/logrus"
+)
+
+// shadowTimeout bounds a shadow call, and how long it waits for the
+// primary's output before logging.
+const shadowTimeout = 5 * time.Minute
+
+// startShadow samples the request by shadowSampleRate and, when picked,
+// sends the same prompt to shadowModel in the background on the shadow
+// credentials. The returned func hands over the primary output (empty on
+// failure) and must be called exactly once; the comparison is logged once
+// both results are in. It returns nil when the request is not shadowed,
+// including when shadowMaxPerMinute or shadowMaxConcurrent is reached.
+func (s *Server) startShadow(model string, req gemini.GeminiRequest) func(primary string) {
+	if s.cfg.ShadowModel == "" || rand.Float64() >= s.cfg.ShadowSampleRate {
+		return nil
+	}
+	if !s.allowShadow(time.Now()) {
+		logrus.Debugf("shadow call to %s skipped: over %d per minute", s.cfg.ShadowModel, s.cfg.ShadowMaxPerMinute)
+		return nil
+	}
+	select {
+	case s.shadowSem <- struct{}{}:
+	default:
+		logrus.Debugf("shadow call to %s skipped: %d already running", s.cfg.ShadowModel, cap(s.shadowSem))
+		return nil
+	}
+	primaryCh := make(chan string, 1)
+	go func() {
+		defer func() { <-s.shadowSem }()
+		// Detached from the client request: the shadow never delays or
+		// follows the primary response.
+		ctx, cancel := context.WithTimeout(codeassist.WithShadowCredentials(context.Background()), shadowTimeout)
+		defer cancel()
+		start := time.Now()
+		resp, err := s.caClient.GenerateContent(ctx, s.cfg.ShadowModel, "", req)
+		latency := time.Since(start)
+		var primary string
+		select {
+		case primary = <-primaryCh:
+		case <-ctx.Done():
+		}
+		n := s.cfg.ShadowLogMaxChars
+		fields := logrus.Fields{
+			"model":         model,
+			"shadowModel":   s.cfg.ShadowModel,
+			"primary":       truncateText(primary, n),
+			"shadowLatency": latency.String(),
+		}
+		if err != nil {
+			fields["shadowError"] = err.Error()
+		} else {
+			fields["shadow"] = truncateText(gemini.ResponseText(resp), n)
+		}
+		logrus.WithFields(fields).Info("shadow comparison")
+	}()
+	return func(primary string) { primaryCh <- primary }
+}
+
+// allowShadow reports whether a shadow call may start at now, spacing calls
+// at least 60s/shadowMaxPerMinute apart.
+func (s *Server) allowShadow(now time.Time) bool {
+	if s.cfg.ShadowMaxPerMinute <= 0 {
+		return true
+	}
+	interval := time.Minute / time.Duration(s.cfg.ShadowMaxPerMinute)
+	last := s.shadowLast.Load()
+	if last != 0 && now.Sub(time.Unix(0, last)) < interval {
+		return false
+	}
+	return s.shadowLast.CompareAndSwap(last, now.UnixNano())
+}
+
+// truncateText cuts s to n runes; n <= 0 keeps it whole.
+func truncateText(s string, n int) string {
+	if n <= 0 {
+		return s
+	}
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n]) + "..."
+}
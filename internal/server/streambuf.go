@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gcli2api/internal/gemini"
+)
+
+// errSlowClient ends a stream whose client fell behind by a full buffer for
+// slowClientTimeoutSeconds. Nothing more is written to such a client.
+var errSlowClient = errors.New("client too slow to consume the stream")
+
+// bufferStream relays an upstream stream through a buffer of n chunks, so
+// upstream is read ahead of a client that is briefly slow without the
+// proxy holding an unbounded backlog. When slow is positive and the buffer
+// stays full that long, the relay stops, calls onSlow and ends the stream
+// with errSlowClient. As with upstream, the terminal error is delivered
+// before the returned output closes.
+func bufferStream(ctx context.Context, out <-chan gemini.GeminiAPIResponse, errs <-chan error, n int, slow time.Duration, onSlow func()) (<-chan gemini.GeminiAPIResponse, <-chan error) {
+	buf := make(chan gemini.GeminiAPIResponse, max(n, 1))
+	berrs := make(chan error, 1)
+	go func() {
+		defer close(buf)
+		defer close(berrs)
+		for g := range out {
+			select {
+			case buf <- g:
+				continue
+			default:
+			}
+			var timer *time.Timer
+			var full <-chan time.Time
+			if slow > 0 {
+				timer = time.NewTimer(slow)
+				full = timer.C
+			}
+			select {
+			case buf <- g:
+				if timer != nil {
+					timer.Stop()
+				}
+			case <-full:
+				onSlow()
+				berrs <- errSlowClient
+				return
+			case <-ctx.Done():
+				berrs <- ctx.Err()
+				return
+			}
+		}
+		if errs == nil {
+			return
+		}
+		if e, ok := <-errs; ok && e != nil {
+			berrs <- e
+		}
+	}()
+	return buf, berrs
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"gcli2api/internal/codeassist"
+	"gcli2api/internal/metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	queueWaitSeconds = metrics.NewHistogramVec("gcli2api_request_queue_wait_seconds",
+		"Time spent acquiring the concurrency limiter slot.", metrics.DefaultBuckets, "model")
+	discoverySeconds = metrics.NewHistogramVec("gcli2api_request_discovery_seconds",
+		"Time spent in upstream project discovery per request.", metrics.DefaultBuckets, "model")
+	upstreamSeconds = metrics.NewHistogramVec("gcli2api_request_upstream_seconds",
+		"Time spent in upstream generation calls, excluding discovery.", metrics.DefaultBuckets, "model")
+)
+
+type queueWaitKey struct{}
+
+// withQueueWait records the concurrency limiter wait on the request context.
+func withQueueWait(r *http.Request, d time.Duration) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), queueWaitKey{}, d))
+}
+
+// observeTiming logs and exports the request's latency breakdown: limiter
+// wait, project discovery, and upstream time since start.
+func (s *Server) observeTiming(r *http.Request, model string, start time.Time, info *codeassist.RequestInfo) {
+	queueWait, _ := r.Context().Value(queueWaitKey{}).(time.Duration)
+	discovery := info.Details().Discovery
+	upstream := max(time.Since(start)-discovery, 0)
+	queueWaitSeconds.Observe(queueWait.Seconds(), model)
+	discoverySeconds.Observe(discovery.Seconds(), model)
+	upstreamSeconds.Observe(upstream.Seconds(), model)
+	logrus.WithFields(logrus.Fields{
+		"model":     model,
+		"queueWait": queueWait,
+		"discovery": discovery,
+		"upstream":  upstream,
+	}).Info("request timing")
+}
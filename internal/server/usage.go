@@ -0,0 +1,20 @@
+package server
+
+import "gcli2api/internal/gemini"
+
+// mergeUsage returns the field-wise maximum of prev and cur so streamed
+// usage totals never decrease. Either argument may be nil.
+func mergeUsage(prev, cur *gemini.UsageMetadata) *gemini.UsageMetadata {
+	if cur == nil {
+		return prev
+	}
+	if prev == nil {
+		u := *cur
+		return &u
+	}
+	return &gemini.UsageMetadata{
+		PromptTokenCount:     max(prev.PromptTokenCount, cur.PromptTokenCount),
+		CandidatesTokenCount: max(prev.CandidatesTokenCount, cur.CandidatesTokenCount),
+		TotalTokenCount:      max(prev.TotalTokenCount, cur.TotalTokenCount),
+	}
+}
@@ -16,17 +16,20 @@ import (
 
 // Store manages persistence of derived metadata like token_key -> project_id.
 type Store struct {
-	db     *sql.DB
-	mem    map[string]string // fallback when db unavailable
-	memRR  map[string]uint64 // in-memory round-robin counters
-	mu     sync.RWMutex
-	closed bool
+	db      *sql.DB
+	mem     map[string]string // fallback when db unavailable
+	memTier map[string]string // in-memory tier ids
+	memRR   map[string]uint64 // in-memory round-robin counters
+	mu      sync.RWMutex
+	closed  bool
+	// memDaily holds in-memory daily request counts keyed by token_key and day
+	memDaily map[string]int
 }
 
 // Open opens a SQLite database at path and ensures schema. If opening fails, a
 // memory-only store is returned with db == nil.
 func Open(path string) (*Store, error) {
-	s := &Store{mem: make(map[string]string), memRR: make(map[string]uint64)}
+	s := &Store{mem: make(map[string]string), memTier: make(map[string]string), memRR: make(map[string]uint64)}
 	// Ensure parent directory exists if path contains directories
 	if dir := filepath.Dir(path); dir != "." && dir != "" {
 		if err := os.MkdirAll(dir, 0o700); err != nil {
@@ -62,6 +65,15 @@ CREATE TABLE IF NOT EXISTS token_project (
 CREATE INDEX IF NOT EXISTS idx_token_project_client ON token_project(client_id);
 CREATE INDEX IF NOT EXISTS idx_token_project_last_used ON token_project(last_used_at);
 
+-- Code Assist tier resolved during discovery, per credential. Kept apart from
+-- token_project so it survives cleanup of stale project mappings; Cleanup
+-- drops it on a later run, once it is stale and its mapping is gone.
+CREATE TABLE IF NOT EXISTS token_tier (
+  token_key TEXT PRIMARY KEY,
+  tier_id TEXT NOT NULL,
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
 -- Round-robin counter per (provider, client_id)
 CREATE TABLE IF NOT EXISTS rr_counter (
   provider TEXT NOT NULL,
@@ -70,6 +82,30 @@ CREATE TABLE IF NOT EXISTS rr_counter (
   updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
   PRIMARY KEY(provider, client_id)
 );
+
+-- Per-request accounting, written only when logRequestsToDb is enabled
+CREATE TABLE IF NOT EXISTS request_log (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  ts TIMESTAMP NOT NULL,
+  token_key TEXT,
+  model TEXT,
+  status INTEGER,
+  prompt_tokens INTEGER,
+  candidate_tokens INTEGER,
+  latency_ms INTEGER
+);
+CREATE INDEX IF NOT EXISTS idx_request_log_ts ON request_log(ts);
+
+-- Upstream requests per credential and UTC day (YYYY-MM-DD), for
+-- dailyRequestCap. Kept apart from request_log, which is optional, written
+-- after the fact and holds one row per client request rather than per
+-- upstream attempt.
+CREATE TABLE IF NOT EXISTS daily_requests (
+  token_key TEXT NOT NULL,
+  day TEXT NOT NULL,
+  count INTEGER NOT NULL,
+  PRIMARY KEY(token_key, day)
+);
 `
 	_, err := db.Exec(ddl)
 	return err
@@ -86,6 +122,12 @@ func (s *Store) Close() error {
 	return nil
 }
 
+// Persistent reports whether the store is backed by SQLite rather than the
+// in-memory fallback.
+func (s *Store) Persistent() bool {
+	return s.db != nil
+}
+
 // GetProjectID returns the project id for tokenKey, and whether it was found.
 func (s *Store) GetProjectID(ctx context.Context, tokenKey string) (string, bool, error) {
 	if s.db == nil {
@@ -103,10 +145,20 @@ func (s *Store) GetProjectID(ctx context.Context, tokenKey string) (string, bool
 		return "", false, err
 	}
 	// Best-effort last_used update, ignore error
-	_, _ = s.db.ExecContext(ctx, `UPDATE token_project SET last_used_at = ? WHERE token_key = ?`, time.Now(), tokenKey)
+	_ = s.TouchProjectID(ctx, tokenKey)
 	return pid, true, nil
 }
 
+// TouchProjectID marks the mapping for tokenKey as used now, so Cleanup keeps
+// mappings that are served from memory and not looked up again.
+func (s *Store) TouchProjectID(ctx context.Context, tokenKey string) error {
+	if s.db == nil {
+		return nil
+	}
+	_, err := s.db.ExecContext(ctx, `UPDATE token_project SET last_used_at = ? WHERE token_key = ?`, time.Now().UTC(), tokenKey)
+	return err
+}
+
 // UpsertProjectID stores or updates the mapping for tokenKey.
 func (s *Store) UpsertProjectID(ctx context.Context, tokenKey, provider, clientID, projectID string) error {
 	if s.db == nil {
@@ -118,7 +170,42 @@ func (s *Store) UpsertProjectID(ctx context.Context, tokenKey, provider, clientI
 	_, err := s.db.ExecContext(ctx, `INSERT INTO token_project (token_key, provider, client_id, project_id, last_used_at)
         VALUES (?, ?, ?, ?, ?)
         ON CONFLICT(token_key) DO UPDATE SET project_id=excluded.project_id, last_used_at=excluded.last_used_at`,
-		tokenKey, provider, clientID, projectID, time.Now())
+		tokenKey, provider, clientID, projectID, time.Now().UTC())
+	return err
+}
+
+// GetTierID returns the Code Assist tier id stored for tokenKey, and whether
+// it was found.
+func (s *Store) GetTierID(ctx context.Context, tokenKey string) (string, bool, error) {
+	if s.db == nil {
+		s.mu.RLock()
+		tier, ok := s.memTier[tokenKey]
+		s.mu.RUnlock()
+		return tier, ok, nil
+	}
+	var tier string
+	err := s.db.QueryRowContext(ctx, `SELECT tier_id FROM token_tier WHERE token_key = ?`, tokenKey).Scan(&tier)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return tier, true, nil
+}
+
+// UpsertTierID stores or updates the tier id for tokenKey.
+func (s *Store) UpsertTierID(ctx context.Context, tokenKey, tierID string) error {
+	if s.db == nil {
+		s.mu.Lock()
+		s.memTier[tokenKey] = tierID
+		s.mu.Unlock()
+		return nil
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT INTO token_tier (token_key, tier_id, updated_at)
+        VALUES (?, ?, ?)
+        ON CONFLICT(token_key) DO UPDATE SET tier_id=excluded.tier_id, updated_at=excluded.updated_at`,
+		tokenKey, tierID, time.Now().UTC())
 	return err
 }
 
@@ -161,6 +248,149 @@ func (s *Store) SetRRCounter(ctx context.Context, provider, clientID string, val
 	_, err := s.db.ExecContext(ctx, `INSERT INTO rr_counter (provider, client_id, value, updated_at)
         VALUES (?, ?, ?, ?)
         ON CONFLICT(provider, client_id) DO UPDATE SET value=excluded.value, updated_at=excluded.updated_at`,
-		provider, clientID, value, time.Now())
+		provider, clientID, value, time.Now().UTC())
 	return err
 }
+
+// GetDailyRequests returns the upstream requests counted for tokenKey on day
+// (UTC, formatted YYYY-MM-DD).
+func (s *Store) GetDailyRequests(ctx context.Context, tokenKey, day string) (int, error) {
+	if s.db == nil {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return s.memDaily[tokenKey+"\x00"+day], nil
+	}
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT count FROM daily_requests WHERE token_key = ? AND day = ?`, tokenKey, day).Scan(&n)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return n, err
+}
+
+// IncrDailyRequests adds one to the count for tokenKey on day.
+func (s *Store) IncrDailyRequests(ctx context.Context, tokenKey, day string) error {
+	if s.db == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.memDaily == nil {
+			s.memDaily = map[string]int{}
+		}
+		s.memDaily[tokenKey+"\x00"+day]++
+		return nil
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT INTO daily_requests (token_key, day, count) VALUES (?, ?, 1)
+        ON CONFLICT(token_key, day) DO UPDATE SET count = count + 1`, tokenKey, day)
+	return err
+}
+
+// RequestLog is a single row of per-request accounting.
+type RequestLog struct {
+	Timestamp       time.Time
+	TokenKey        string
+	Model           string
+	Status          int
+	PromptTokens    int
+	CandidateTokens int
+	LatencyMS       int64
+}
+
+// InsertRequestLog appends a request_log row. It is a no-op for memory-only stores.
+func (s *Store) InsertRequestLog(ctx context.Context, rl RequestLog) error {
+	if s.db == nil {
+		return nil
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT INTO request_log (ts, token_key, model, status, prompt_tokens, candidate_tokens, latency_ms)
+        VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		rl.Timestamp.UTC(), rl.TokenKey, rl.Model, rl.Status, rl.PromptTokens, rl.CandidateTokens, rl.LatencyMS)
+	return err
+}
+
+// PruneRequestLogs deletes request_log rows older than before and returns the
+// number of rows removed.
+func (s *Store) PruneRequestLogs(ctx context.Context, before time.Time) (int64, error) {
+	if s.db == nil {
+		return 0, nil
+	}
+	res, err := s.db.ExecContext(ctx, `DELETE FROM request_log WHERE ts < ?`, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// CleanupResult reports the rows removed by Cleanup.
+type CleanupResult struct {
+	TokenProjects int64
+	RequestLogs   int64
+}
+
+// Cleanup deletes token_project mappings not used since before, token_tier
+// rows older than before whose mapping an earlier run already deleted, and
+// request_log and daily_requests rows older than before. Deleted project
+// mappings and tiers are simply rediscovered on next use. It is a no-op for
+// memory-only stores.
+func (s *Store) Cleanup(ctx context.Context, before time.Time) (CleanupResult, error) {
+	var out CleanupResult
+	if s.db == nil {
+		return out, nil
+	}
+	// Timestamps are stored in UTC; compare in UTC so the text comparison
+	// holds whatever the caller's zone. Tiers go before mappings, so a tier
+	// outlives the run that prunes its mapping and rediscovery can reuse it.
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM token_tier WHERE updated_at < ?
+        AND token_key NOT IN (SELECT token_key FROM token_project)`, before.UTC()); err != nil {
+		return out, fmt.Errorf("cleanup token_tier: %w", err)
+	}
+	res, err := s.db.ExecContext(ctx, `DELETE FROM token_project WHERE last_used_at < ?`, before.UTC())
+	if err != nil {
+		return out, fmt.Errorf("cleanup token_project: %w", err)
+	}
+	out.TokenProjects, _ = res.RowsAffected()
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM daily_requests WHERE day < ?`, before.UTC().Format(time.DateOnly)); err != nil {
+		return out, fmt.Errorf("cleanup daily_requests: %w", err)
+	}
+	out.RequestLogs, err = s.PruneRequestLogs(ctx, before)
+	if err != nil {
+		return out, fmt.Errorf("cleanup request_log: %w", err)
+	}
+	return out, nil
+}
+
+// Size returns the database size in bytes as reported by SQLite
+// (page_count * page_size), excluding the WAL file.
+func (s *Store) Size(ctx context.Context) (int64, error) {
+	if s.db == nil {
+		return 0, nil
+	}
+	var pages, pageSize int64
+	if err := s.db.QueryRowContext(ctx, `PRAGMA page_count`).Scan(&pages); err != nil {
+		return 0, err
+	}
+	if err := s.db.QueryRowContext(ctx, `PRAGMA page_size`).Scan(&pageSize); err != nil {
+		return 0, err
+	}
+	return pages * pageSize, nil
+}
+
+// Compact checkpoints the WAL and vacuums the database when it exceeds
+// thresholdBytes. It reports whether compaction ran.
+func (s *Store) Compact(ctx context.Context, thresholdBytes int64) (bool, error) {
+	if s.db == nil || thresholdBytes <= 0 {
+		return false, nil
+	}
+	size, err := s.Size(ctx)
+	if err != nil {
+		return false, err
+	}
+	if size <= thresholdBytes {
+		return false, nil
+	}
+	if _, err := s.db.ExecContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		return false, fmt.Errorf("wal checkpoint: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, `VACUUM`); err != nil {
+		return false, fmt.Errorf("vacuum: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,165 @@
+package state
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRequestLog_InsertAndPrune(t *testing.T) {
+	st, err := Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer st.Close()
+	ctx := context.Background()
+	now := time.Now()
+	for _, ts := range []time.Time{now.AddDate(0, 0, -10), now.Add(-time.Hour)} {
+		if err := st.InsertRequestLog(ctx, RequestLog{Timestamp: ts, TokenKey: "k", Model: "m", Status: 200, PromptTokens: 3, CandidateTokens: 5, LatencyMS: 42}); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	n, err := st.PruneRequestLogs(ctx, now.AddDate(0, 0, -7))
+	if err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 pruned row, got %d", n)
+	}
+	if got := countRows(t, st.db, "request_log"); got != 1 {
+		t.Fatalf("expected 1 remaining row, got %d", got)
+	}
+}
+
+func countRows(t *testing.T, db *sql.DB, table string) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil {
+		t.Fatalf("count %s: %v", table, err)
+	}
+	return n
+}
+
+func TestCleanup_RemovesStaleRowsAndCompacts(t *testing.T) {
+	st, err := Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer st.Close()
+	ctx := context.Background()
+	if err := st.UpsertProjectID(ctx, "fresh", "p", "c", "proj-1"); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if _, err := st.db.Exec(`INSERT INTO token_project (token_key, provider, client_id, project_id, last_used_at) VALUES (?, ?, ?, ?, ?)`,
+		"stale", "p", "c", "proj-2", time.Now().UTC().AddDate(0, 0, -30)); err != nil {
+		t.Fatalf("insert stale: %v", err)
+	}
+	if _, err := st.db.Exec(`INSERT INTO token_project (token_key, provider, client_id, project_id, last_used_at) VALUES (?, ?, ?, ?, ?)`,
+		"busy", "p", "c", "proj-3", time.Now().UTC().AddDate(0, 0, -30)); err != nil {
+		t.Fatalf("insert busy: %v", err)
+	}
+	// A mapping served from memory is kept alive by touches alone
+	if err := st.TouchProjectID(ctx, "busy"); err != nil {
+		t.Fatalf("touch: %v", err)
+	}
+	res, err := st.Cleanup(ctx, time.Now().In(time.FixedZone("UTC+8", 8*3600)).AddDate(0, 0, -7))
+	if err != nil {
+		t.Fatalf("cleanup: %v", err)
+	}
+	if res.TokenProjects != 1 {
+		t.Fatalf("expected 1 stale mapping removed, got %d", res.TokenProjects)
+	}
+	for _, key := range []string{"fresh", "busy"} {
+		if _, ok, _ := st.GetProjectID(ctx, key); !ok {
+			t.Fatalf("%s mapping should survive cleanup", key)
+		}
+	}
+	if ran, err := st.Compact(ctx, 1); err != nil || !ran {
+		t.Fatalf("expected compaction to run, ran=%v err=%v", ran, err)
+	}
+	if ran, _ := st.Compact(ctx, 1<<40); ran {
+		t.Fatalf("compaction should not run below threshold")
+	}
+}
+
+func TestTierID_UpsertAndGet(t *testing.T) {
+	ctx := context.Background()
+	dbStore, err := Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer dbStore.Close()
+	memStore := &Store{mem: map[string]string{}, memTier: map[string]string{}, memRR: map[string]uint64{}}
+	for name, st := range map[string]*Store{"sqlite": dbStore, "memory": memStore} {
+		if _, ok, err := st.GetTierID(ctx, "k"); err != nil || ok {
+			t.Fatalf("%s: expected miss, got ok=%v err=%v", name, ok, err)
+		}
+		for _, tier := range []string{"free-tier", "standard-tier"} {
+			if err := st.UpsertTierID(ctx, "k", tier); err != nil {
+				t.Fatalf("%s: upsert: %v", name, err)
+			}
+			if got, ok, err := st.GetTierID(ctx, "k"); err != nil || !ok || got != tier {
+				t.Fatalf("%s: expected %q, got %q ok=%v err=%v", name, tier, got, ok, err)
+			}
+		}
+	}
+	// A tier outlives the run that prunes its project mapping.
+	if err := dbStore.UpsertProjectID(ctx, "k", "p", "c", "proj"); err != nil {
+		t.Fatalf("upsert project: %v", err)
+	}
+	if _, err := dbStore.db.Exec(`UPDATE token_project SET last_used_at = ?`, time.Now().UTC().AddDate(0, 0, -30)); err != nil {
+		t.Fatalf("age mapping: %v", err)
+	}
+	if _, err := dbStore.Cleanup(ctx, time.Now().AddDate(0, 0, -7)); err != nil {
+		t.Fatalf("cleanup: %v", err)
+	}
+	if _, ok, _ := dbStore.GetProjectID(ctx, "k"); ok {
+		t.Fatalf("stale mapping should be pruned")
+	}
+	if _, ok, _ := dbStore.GetTierID(ctx, "k"); !ok {
+		t.Fatalf("tier should survive the cleanup of its mapping")
+	}
+	if _, err := dbStore.Cleanup(ctx, time.Now().AddDate(0, 0, -7)); err != nil {
+		t.Fatalf("cleanup: %v", err)
+	}
+	if _, ok, _ := dbStore.GetTierID(ctx, "k"); !ok {
+		t.Fatalf("fresh tier should survive cleanup")
+	}
+	if _, err := dbStore.Cleanup(ctx, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("cleanup: %v", err)
+	}
+	if _, ok, _ := dbStore.GetTierID(ctx, "k"); ok {
+		t.Fatalf("stale tier without a mapping should be pruned")
+	}
+}
+
+func TestDailyRequests_Count(t *testing.T) {
+	ctx := context.Background()
+	dbStore, err := Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer dbStore.Close()
+	memStore := &Store{mem: map[string]string{}, memTier: map[string]string{}, memRR: map[string]uint64{}}
+	for name, st := range map[string]*Store{"sqlite": dbStore, "memory": memStore} {
+		for k := 0; k < 3; k++ {
+			if err := st.IncrDailyRequests(ctx, "k", "2026-03-01"); err != nil {
+				t.Fatalf("%s: incr: %v", name, err)
+			}
+		}
+		if n, err := st.GetDailyRequests(ctx, "k", "2026-03-01"); err != nil || n != 3 {
+			t.Fatalf("%s: expected 3, got %d err=%v", name, n, err)
+		}
+		if n, err := st.GetDailyRequests(ctx, "k", "2026-03-02"); err != nil || n != 0 {
+			t.Fatalf("%s: expected a fresh day to be 0, got %d err=%v", name, n, err)
+		}
+	}
+	if _, err := dbStore.Cleanup(ctx, time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("cleanup: %v", err)
+	}
+	if n, _ := dbStore.GetDailyRequests(ctx, "k", "2026-03-01"); n != 0 {
+		t.Fatalf("expected old daily counts pruned, got %d", n)
+	}
+}
@@ -1,18 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
-	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"gcli2api/internal/auth"
 	"gcli2api/internal/codeassist"
 	"gcli2api/internal/config"
+	"gcli2api/internal/httpx"
+	"gcli2api/internal/logfile"
 	"gcli2api/internal/server"
 	"gcli2api/internal/state"
 	"gcli2api/internal/utils"
@@ -71,97 +81,99 @@ func main() {
 			if err := cfg.Validate(cfgPath); err != nil {
 				return err
 			}
+			if cfg.LogFile != "" {
+				lf, err := openLogFile(cfg)
+				if err != nil {
+					return err
+				}
+				defer func() {
+					logrus.SetOutput(os.Stderr)
+					_ = lf.Close()
+				}()
+			}
 
-			// Parse optional proxy and kick off async TCP liveness check
+			// Parse optional proxy and check TCP liveness (sync when failFastOnProxy),
+			// then keep probing it in the background for readiness
 			var proxyURL *url.URL
+			var proxyMon *httpx.ProxyMonitor
 			if cfg.Proxy != "" {
 				u, err := url.Parse(cfg.Proxy)
 				if err != nil {
 					return fmt.Errorf("invalid proxy URL: %w", err)
 				}
-				logrus.Infof("using upstream proxy: %s", cfg.Proxy)
+				logrus.Infof("using upstream proxy: %s", u.Redacted())
 				proxyURL = u
-				go func(u *url.URL) {
-					host := u.Host
-					// Ensure port; if missing, default based on scheme
-					_, _, err := net.SplitHostPort(host)
-					if err != nil {
-						if u.Scheme == "http" {
-							host = net.JoinHostPort(host, "80")
-						} else if u.Scheme == "socks5" {
-							host = net.JoinHostPort(host, "1080")
-						}
+				if cfg.FailFastOnProxy {
+					if err := httpx.CheckProxyTCP(u, 5*time.Second); err != nil {
+						return fmt.Errorf("proxy %s unreachable: %w", u.Host, err)
 					}
-					conn, err := net.DialTimeout("tcp", host, 5*time.Second)
-					if err != nil {
-						logrus.Warnf("proxy tcp check failed: %v", err)
-						return
-					}
-					_ = conn.Close()
-					logrus.Info("tcp check for proxy is successful")
-				}(u)
-			}
-
-			// OAuth2 setup (used for all credentials)
-			oauthCfg := oauth2.Config{
-				ClientID:     oauthClientID,
-				ClientSecret: oauthClientSecret,
-				Scopes:       []string{"https://www.googleapis.com/auth/cloud-platform"},
-				Endpoint:     google.Endpoint,
+				}
+				proxyMon = httpx.NewProxyMonitor(u, time.Duration(cfg.ProxyCheckIntervalSeconds)*time.Second)
+				proxyMon.Start(context.Background())
 			}
 
-			// Determine credential sources (multi-credential only)
-			var sources []codeassist.CredSource
-			if len(cfg.GeminiCredsFilePaths) == 0 {
-				return fmt.Errorf("no geminiOauthCredsFiles configured; provide at least one path")
+			// Initialize SQLite state store
+			st, err := openStateStore(cfg)
+			if err != nil {
+				return err
 			}
-			for _, p := range cfg.GeminiCredsFilePaths {
-				if p == "" {
-					continue
-				}
-				rt, xp, err := auth.LoadRawTokenFromFile(p)
-				if err != nil {
-					logrus.Errorf("failed to load credential %q: %v", p, err)
-					continue
+			// Prune old request accounting rows
+			if cfg.RequestLogRetentionDays > 0 {
+				cutoff := time.Now().AddDate(0, 0, -cfg.RequestLogRetentionDays)
+				if n, err := st.PruneRequestLogs(context.Background(), cutoff); err != nil {
+					logrus.Warnf("request log pruning failed: %v", err)
+				} else if n > 0 {
+					logrus.Infof("pruned %d request log row(s) older than %d day(s)", n, cfg.RequestLogRetentionDays)
 				}
-				sources = append(sources, codeassist.CredSource{Path: xp, Raw: rt, Persist: true})
 			}
-			if len(sources) == 0 {
-				return fmt.Errorf("no usable credentials from geminiOauthCredsFiles")
+			// Opt-in state retention: run once now, and on an interval once
+			// serving (see below)
+			if cfg.StateRetentionDays > 0 {
+				runStateMaintenance(context.Background(), st, cfg)
 			}
 
-			// Ensure SQLitePath parent directory exists
-			if dir := filepath.Dir(cfg.SQLitePath); dir != "." && dir != "" {
-				if err := os.MkdirAll(dir, 0o700); err != nil {
-					return fmt.Errorf("failed to create SQLite directory %q: %w", dir, err)
+			// Select the upstream: canned local responses in mock mode, otherwise
+			// a MultiClient (works for both single and multi-cred cases)
+			var ca server.CodeAssist
+			var mc *codeassist.MultiClient
+			credCount := 0
+			if cfg.MockUpstream {
+				logrus.Warn("mockUpstream enabled: serving canned responses without contacting upstream")
+				ca = codeassist.NewMockClient(time.Duration(cfg.MockLatencyMillis) * time.Millisecond)
+			} else {
+				// Determine credential sources (multi-credential only)
+				sources, err := loadCredSources(cfg)
+				if err != nil {
+					return err
 				}
-			}
-
-			// Initialize SQLite state store
-			st, err := state.Open(cfg.SQLitePath)
-			if err != nil {
-				logrus.Warnf("SQLite open error (using memory-only cache): %v", err)
-			}
-
-			// Normalize projectIds map keys via ~ expansion only (no symlink resolution)
-			normalizedProjectMap := make(map[string][]string)
-			for k, v := range cfg.ProjectIds {
-				xp, err := utils.ExpandUser(k)
+				credCount = len(sources)
+				mc, err = buildMultiClient(cfg, sources, proxyURL, st)
 				if err != nil {
-					// Should have been validated; continue with raw key on error
-					xp = k
+					return err
 				}
-				normalizedProjectMap[xp] = v
-			}
-
-			// Build MultiClient (works for both single and multi-cred cases)
-			mc, err := codeassist.NewMultiClient(oauthCfg, sources, cfg.RequestMaxRetries, time.Duration(cfg.RequestBaseDelayMillis)*time.Millisecond, st, proxyURL, normalizedProjectMap)
-			if err != nil {
-				return fmt.Errorf("failed to init client: %w", err)
+				if cfg.SelfTestOnStartup {
+					if err := selfTestTokens(mc, cfg.SelfTestStrict); err != nil {
+						return err
+					}
+				}
+				if cfg.WarmOnStartup {
+					go mc.WarmProjects(context.Background(), time.Duration(cfg.DiscoveryWarmJitterMs)*time.Millisecond)
+				}
+				if cfg.KeepWarmSeconds > 0 {
+					go mc.KeepWarm(context.Background(), time.Duration(cfg.KeepWarmSeconds)*time.Second, cfg.KeepWarmMaxPings)
+				}
+				if cfg.WatchCredentialFiles {
+					mc.WatchCredentialFiles(context.Background(), time.Duration(cfg.CredentialWatchIntervalSeconds)*time.Second)
+				}
+				ca = mc
 			}
 
 			// Build server using injected CodeAssist client
-			srv := server.NewWithCAClient(cfg, mc)
+			srv := server.NewWithCAClient(cfg, ca)
+			srv.SetStateStore(st)
+			if proxyMon != nil {
+				srv.AddReadinessCheck("proxy", proxyMon.Err)
+			}
 
 			addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.ServerPort)
 			httpSrv := &http.Server{
@@ -174,20 +186,488 @@ func main() {
 				ErrorLog:          log.New(logrus.StandardLogger().WriterLevel(logrus.ErrorLevel), "http: ", 0),
 			}
 
-			logrus.Infof("gcli2api listening on http://%s", addr)
-			if err := httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				return fmt.Errorf("server error: %w", err)
+			scheme := "http"
+			if cfg.TLSCertFile != "" {
+				scheme = "https"
+				httpSrv.TLSConfig = &tls.Config{MinVersion: cfg.InboundTLSVersion()}
+				if cfg.InboundClientCAFile != "" {
+					pool, err := cfg.ClientCAPool()
+					if err != nil {
+						return err
+					}
+					httpSrv.TLSConfig.ClientCAs = pool
+					httpSrv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+			}
+
+			logStartupSummary(cfg, mc, credCount, proxyURL, st, addr)
+			logrus.Infof("gcli2api listening on %s://%s", scheme, addr)
+			sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			// Periodic state cleanup stops with the server
+			if cfg.StateRetentionDays > 0 && cfg.StateCleanupIntervalMinutes > 0 {
+				go func() {
+					t := time.NewTicker(time.Duration(cfg.StateCleanupIntervalMinutes) * time.Minute)
+					defer t.Stop()
+					for {
+						select {
+						case <-t.C:
+							runStateMaintenance(sigCtx, st, cfg)
+						case <-sigCtx.Done():
+							return
+						}
+					}
+				}()
+			}
+			serveErr := make(chan error, 2)
+			go func() {
+				if cfg.TLSCertFile != "" {
+					serveErr <- httpSrv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+					return
+				}
+				serveErr <- httpSrv.ListenAndServe()
+			}()
+			if cfg.AdminListen != "" {
+				adminSrv := &http.Server{
+					Addr:              cfg.AdminListen,
+					Handler:           srv.AdminRouter(),
+					ReadHeaderTimeout: 10 * time.Second,
+					ErrorLog:          log.New(logrus.StandardLogger().WriterLevel(logrus.ErrorLevel), "http: ", 0),
+				}
+				defer adminSrv.Close()
+				logrus.Infof("admin and metrics listening on http://%s", cfg.AdminListen)
+				go func() {
+					if err := adminSrv.ListenAndServe(); err != http.ErrServerClosed {
+						serveErr <- fmt.Errorf("admin listener: %w", err)
+					}
+				}()
+			} else if !config.IsLoopbackHost(cfg.Host) && !cfg.AdminOnPublicListener {
+				logrus.Infof("admin and metrics endpoints disabled on public listener %s; set adminListen to serve them", addr)
+			}
+			select {
+			case err := <-serveErr:
+				if err != nil && err != http.ErrServerClosed {
+					return fmt.Errorf("server error: %w", err)
+				}
+				return nil
+			case <-sigCtx.Done():
+			}
+			return shutdown(httpSrv, mc, time.Duration(cfg.ShutdownGraceSeconds)*time.Second)
+		},
+	}
+
+	// replay command: run a saved request through the production client path
+	var (
+		replayModel     string
+		replayStream    bool
+		replayCredIndex int
+	)
+	replayCmd := &cobra.Command{
+		Use:   "replay <request.json>",
+		Short: "Replay a saved Gemini request against the upstream",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.LoadConfig(cfgPath)
+			if err != nil {
+				return err
+			}
+			if err := cfg.Validate(cfgPath); err != nil {
+				return err
+			}
+			// Full logging for offline reproduction; logs go to stderr
+			logrus.SetLevel(logrus.DebugLevel)
+
+			b, err := os.ReadFile(args[0])
+			if err != nil {
+				return fmt.Errorf("read request: %w", err)
+			}
+
+			var proxyURL *url.URL
+			if cfg.Proxy != "" {
+				if proxyURL, err = url.Parse(cfg.Proxy); err != nil {
+					return fmt.Errorf("invalid proxy URL: %w", err)
+				}
+			}
+			sources, err := loadCredSources(cfg)
+			if err != nil {
+				return err
+			}
+			st, err := openStateStore(cfg)
+			if err != nil {
+				return err
+			}
+			defer st.Close()
+			mc, err := buildMultiClient(cfg, sources, proxyURL, st)
+			if err != nil {
+				return err
+			}
+			ctx, cancel := context.WithTimeout(cmd.Context(), 5*time.Minute)
+			defer cancel()
+			// Replay through the server so the model is routed and the
+			// request normalized exactly as they would have been when served
+			return server.NewWithCAClient(cfg, mc).Replay(ctx, replayModel, replayStream, replayCredIndex, bytes.NewReader(b), cmd.OutOrStdout())
+		},
+	}
+	replayCmd.Flags().StringVarP(&replayModel, "model", "m", "gemini-2.5-flash", "Model to send the request to")
+	replayCmd.Flags().BoolVarP(&replayStream, "stream", "s", false, "Use streamGenerateContent and print each chunk")
+	replayCmd.Flags().IntVar(&replayCredIndex, "credential-index", -1, "Pin the request to the pool unit at this index (-1 = rotate as usual)")
+
+	// config init: write a commented example config with every key
+	var initOutput string
+	var initForce bool
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Config file helpers",
+	}
+	configInitCmd := &cobra.Command{
+		Use:   "init",
+		Short: "Write a commented example config listing every key with its default",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if initOutput == "-" {
+				return config.WriteExample(cmd.OutOrStdout())
+			}
+			flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+			if initForce {
+				flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+			}
+			f, err := os.OpenFile(initOutput, flags, 0o600)
+			if errors.Is(err, fs.ErrExist) {
+				return fmt.Errorf("%s already exists; use --force to overwrite", initOutput)
+			}
+			if err != nil {
+				return err
 			}
+			if err := config.WriteExample(f); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "wrote %s; set authKey and geminiOauthCredsFiles, then run: check -c %s\n", initOutput, initOutput)
 			return nil
 		},
 	}
+	configInitCmd.Flags().StringVarP(&initOutput, "output", "o", "config.json5", "File to write (- for stdout)")
+	configInitCmd.Flags().BoolVar(&initForce, "force", false, "Overwrite an existing file")
+	configCmd.AddCommand(configInitCmd)
 
 	rootCmd.AddCommand(serverCmd)
 	rootCmd.AddCommand(checkCmd)
+	rootCmd.AddCommand(replayCmd)
+	rootCmd.AddCommand(configCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		logrus.Fatalf("%v", err)
 	}
 }
 
-// no extra helpers needed; cobra commands wire directly to server startup.
+// shutdown stops accepting connections and lets in-flight requests finish
+// for up to grace. Past that, pending discovery is aborted and the remaining
+// connections are closed.
+func shutdown(httpSrv *http.Server, mc *codeassist.MultiClient, grace time.Duration) error {
+	logrus.Infof("shutting down; waiting up to %s for in-flight requests", grace)
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	err := httpSrv.Shutdown(ctx)
+	if err == nil {
+		return nil
+	}
+	logrus.Warnf("shutdown grace period exceeded; aborting in-flight requests: %v", err)
+	if mc != nil {
+		mc.Close()
+	}
+	return httpSrv.Close()
+}
+
+// loadCredSources loads all configured credential files into pool sources.
+func loadCredSources(cfg config.Config) ([]codeassist.CredSource, error) {
+	var sources []codeassist.CredSource
+	if len(cfg.GeminiCredsFilePaths) == 0 {
+		return nil, fmt.Errorf("no geminiOauthCredsFiles configured; provide at least one path")
+	}
+	tiers := expandCredKeys(cfg.CredentialTiers)
+	timeouts := expandCredKeys(cfg.CredentialTimeouts)
+	names := expandCredKeys(cfg.CredentialNames)
+	backends := expandCredKeys(cfg.CredentialBackends)
+	dailyCaps := expandCredKeys(cfg.CredentialDailyRequestCaps)
+	// priorities ranks priorityOrder entries (paths or names) from 1
+	priorities := make(map[string]int, len(cfg.PriorityOrder))
+	for i, k := range cfg.PriorityOrder {
+		if xp, err := utils.ExpandUser(k); err == nil {
+			k = xp
+		}
+		priorities[k] = i + 1
+	}
+	source := func(file, path string, raw auth.RawToken, persist bool) codeassist.CredSource {
+		src := codeassist.CredSource{
+			Path:    path,
+			Raw:     raw,
+			Persist: persist,
+			Backup:  lookupCred(tiers, file, path) == config.TierBackup,
+			Shadow:  lookupCred(tiers, file, path) == config.TierShadow,
+			Timeout: time.Duration(lookupCred(timeouts, file, path)) * time.Second,
+			Name:    credName(names, file, path),
+		}
+		if src.DailyRequestCap = lookupCred(dailyCaps, file, path); src.DailyRequestCap == 0 {
+			src.DailyRequestCap = cfg.DailyRequestCap
+		}
+		src.Priority = credPriority(priorities, names, file, path, src.Name)
+		if lookupCred(backends, file, path) == config.BackendVertex {
+			src.VertexLocation = cfg.VertexLocation
+		}
+		return src
+	}
+	var missingScope []string
+	// usable skips (and records) credentials minted without the required scope;
+	// tokens that record no scopes cannot be checked and are kept.
+	usable := func(path string, rt auth.RawToken) bool {
+		if has, ok := rt.HasScope(auth.CloudPlatformScope); ok && !has {
+			missingScope = append(missingScope, path)
+			return false
+		}
+		return true
+	}
+	for _, p := range cfg.GeminiCredsFilePaths {
+		if p == "" {
+			continue
+		}
+		entries, xp, combined, err := auth.LoadRawTokensFromFile(p)
+		if err != nil {
+			logrus.Errorf("failed to load credential %q: %v", p, err)
+			continue
+		}
+		if !combined {
+			if usable(xp, entries[0].Raw) {
+				sources = append(sources, source(xp, xp, entries[0].Raw, true))
+			}
+			continue
+		}
+		// Combined file: one source per token, addressed as "<path>#<name>".
+		// Refreshed tokens are not written back since a single element
+		// cannot be rewritten atomically.
+		logrus.Infof("loaded %d credential(s) from combined file %s", len(entries), xp)
+		for _, ce := range entries {
+			if usable(xp+"#"+ce.Name, ce.Raw) {
+				sources = append(sources, source(xp, xp+"#"+ce.Name, ce.Raw, false))
+			}
+		}
+	}
+	if len(missingScope) > 0 {
+		logrus.Warnf("skipping %d credential(s) lacking scope %s: %s", len(missingScope), auth.CloudPlatformScope, strings.Join(missingScope, ", "))
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no usable credentials from geminiOauthCredsFiles")
+	}
+	return sources, nil
+}
+
+// expandCredKeys normalizes the keys of a credential-keyed config map via ~
+// expansion only (no symlink resolution).
+func expandCredKeys[V any](m map[string]V) map[string]V {
+	out := make(map[string]V, len(m))
+	for k, v := range m {
+		xp, err := utils.ExpandUser(k)
+		if err != nil {
+			// Should have been validated; continue with raw key on error
+			xp = k
+		}
+		out[xp] = v
+	}
+	return out
+}
+
+// lookupCred resolves a credential-keyed setting for a source path; entries
+// of combined files inherit the file's value unless they have their own.
+func lookupCred[V any](m map[string]V, file, path string) V {
+	if v, ok := m[path]; ok {
+		return v
+	}
+	return m[file]
+}
+
+// credPriority returns the priorityOrder rank of a source: listed by its
+// path, its name, its combined file or that file's name, in that order.
+// Zero means unlisted.
+func credPriority(priorities map[string]int, names map[string]string, file, path, name string) int {
+	for _, k := range []string{path, name, file, names[file]} {
+		if p := priorities[k]; k != "" && p > 0 {
+			return p
+		}
+	}
+	return 0
+}
+
+// credName returns the credentialNames label for path. A name given to a
+// whole combined file is suffixed with "#<entry>" so its entries stay
+// distinguishable.
+func credName(names map[string]string, file, path string) string {
+	if n, ok := names[path]; ok {
+		return n
+	}
+	if n := names[file]; n != "" && path != file {
+		return n + strings.TrimPrefix(path, file)
+	}
+	return names[file]
+}
+
+// buildMultiClient constructs the MultiClient pool over the given sources.
+func buildMultiClient(cfg config.Config, sources []codeassist.CredSource, proxyURL *url.URL, st *state.Store) (*codeassist.MultiClient, error) {
+	// OAuth2 setup (used for all credentials)
+	oauthCfg := oauth2.Config{
+		ClientID:     oauthClientID,
+		ClientSecret: oauthClientSecret,
+		Scopes:       []string{auth.CloudPlatformScope},
+		Endpoint:     google.Endpoint,
+	}
+
+	// Normalize projectIds map keys via ~ expansion only (no symlink resolution)
+	normalizedProjectMap := expandCredKeys(cfg.ProjectIds)
+
+	opts := codeassist.MultiClientOptions{
+		DiscoveryRetries:       cfg.DiscoveryTransportRetries,
+		DiscoveryBaseDelay:     time.Duration(cfg.DiscoveryBaseDelayMillis) * time.Millisecond,
+		DiscoveryTimeout:       time.Duration(cfg.DiscoveryTimeoutSeconds) * time.Second,
+		MaxRotations:           cfg.MaxRotations,
+		RotationBackoff:        time.Duration(cfg.RotationBackoffMillis) * time.Millisecond,
+		RotationBackoffMax:     time.Duration(cfg.RotationBackoffMaxMillis) * time.Millisecond,
+		HealthWeighted:         cfg.RotationStrategy == config.RotationHealth,
+		RetryOnEmptyCandidates: cfg.RetryOnEmptyCandidates,
+		MaxResponseBytes:       cfg.MaxResponseBytes,
+		APIVersion:             cfg.APIVersion,
+		PluginType:             cfg.DiscoveryPluginType,
+		EnvelopeResponseField:  cfg.EnvelopeResponseField,
+		NonRetryableReasons:    cfg.NonRetryableReasons,
+		DedupeProjects:         cfg.DedupeProjectIds,
+		LogSampleRate:          cfg.LogSampleRate,
+		MaxDiscoveryAttempts:   cfg.MaxDiscoveryAttemptsPerRequest,
+	}
+	mc, err := codeassist.NewMultiClient(oauthCfg, sources, cfg.RequestMaxRetries, time.Duration(cfg.RequestBaseDelayMillis)*time.Millisecond, st, proxyURL, normalizedProjectMap, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init client: %w", err)
+	}
+	return mc, nil
+}
+
+// logStartupSummary logs the effective configuration as one structured line
+// so a deployment can be verified at a glance. mc is nil in mock mode.
+func logStartupSummary(cfg config.Config, mc *codeassist.MultiClient, credCount int, proxyURL *url.URL, st *state.Store, addr string) {
+	fields := logrus.Fields{
+		"listen":                addr,
+		"maxConcurrentRequests": cfg.MaxConcurrentRequests,
+		"requestMaxRetries":     cfg.RequestMaxRetries,
+		"proxy":                 "none",
+		"state":                 "memory",
+	}
+	if proxyURL != nil {
+		fields["proxy"] = proxyURL.Redacted()
+	}
+	if st.Persistent() {
+		fields["state"] = "sqlite:" + cfg.SQLitePath
+	}
+	if mc == nil {
+		fields["upstream"] = "mock"
+	} else {
+		backup, shadow := 0, 0
+		for _, c := range mc.Credentials() {
+			if c.Backup {
+				backup++
+			}
+			if c.Shadow {
+				shadow++
+			}
+		}
+		fields["upstream"] = "codeassist"
+		fields["credentials"] = credCount
+		fields["units"] = mc.NumUnits()
+		fields["backupUnits"] = backup
+		if shadow > 0 {
+			fields["shadowUnits"] = shadow
+		}
+		fields["rotation"] = cfg.RotationStrategy
+		if cfg.MaxRotations > 0 {
+			fields["maxRotations"] = cfg.MaxRotations
+		}
+		if cfg.RotationBackoffMillis > 0 {
+			fields["rotationBackoffMillis"] = cfg.RotationBackoffMillis
+		}
+	}
+	logrus.WithFields(fields).Info("startup summary")
+}
+
+// selfTestTokens forces a token refresh for every credential and logs the
+// outcome of each. In strict mode it fails when none of them refresh.
+func selfTestTokens(mc *codeassist.MultiClient, strict bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	results := mc.CheckTokens(ctx)
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			logrus.Errorf("self-test: token refresh failed for %s: %v", r.Credential, r.Err)
+			continue
+		}
+		logrus.Infof("self-test: token refresh ok for %s", r.Credential)
+	}
+	if failed > 0 && failed == len(results) && strict {
+		return fmt.Errorf("self-test: token refresh failed for all %d credential(s)", failed)
+	}
+	return nil
+}
+
+// openLogFile routes logs to cfg.LogFile with size-based rotation, mirrored
+// to the console unless logFileOnly is set.
+func openLogFile(cfg config.Config) (*logfile.File, error) {
+	lf, err := logfile.Open(cfg.LogFile, int64(cfg.LogFileMaxSizeMB)<<20, cfg.LogFileMaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.LogFileOnly {
+		logrus.SetOutput(lf)
+	} else {
+		logrus.SetOutput(io.MultiWriter(logrus.StandardLogger().Out, lf))
+	}
+	logrus.Infof("logging to %s (rotating at %d MB, keeping %d backups)", cfg.LogFile, cfg.LogFileMaxSizeMB, cfg.LogFileMaxBackups)
+	return lf, nil
+}
+
+// openStateStore opens the SQLite state store, falling back to a memory-only
+// store when the database cannot be opened.
+func openStateStore(cfg config.Config) (*state.Store, error) {
+	// Ensure SQLitePath parent directory exists
+	if dir := filepath.Dir(cfg.SQLitePath); dir != "." && dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create SQLite directory %q: %w", dir, err)
+		}
+	}
+	st, err := state.Open(cfg.SQLitePath)
+	if err != nil {
+		logrus.Warnf("SQLite open error (using memory-only cache): %v", err)
+	}
+	return st, nil
+}
+
+// runStateMaintenance deletes state rows older than the configured retention
+// and compacts the database once it exceeds the vacuum threshold.
+func runStateMaintenance(ctx context.Context, st *state.Store, cfg config.Config) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	cutoff := time.Now().AddDate(0, 0, -cfg.StateRetentionDays)
+	res, err := st.Cleanup(ctx, cutoff)
+	if err != nil {
+		logrus.Warnf("state cleanup failed: %v", err)
+		return
+	}
+	if res.TokenProjects > 0 || res.RequestLogs > 0 {
+		logrus.Infof("state cleanup removed %d project mapping(s) and %d request log row(s)", res.TokenProjects, res.RequestLogs)
+	}
+	compacted, err := st.Compact(ctx, int64(cfg.StateVacuumThresholdMB)*1024*1024)
+	if err != nil {
+		logrus.Warnf("state compaction failed: %v", err)
+		return
+	}
+	if compacted {
+		logrus.Info("state database compacted")
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestCredPriority(t *testing.T) {
+	priorities := map[string]int{"/c/team.json#bob": 1, "alice-work": 2, "team": 3, "/c/solo.json": 4}
+	names := map[string]string{"/c/team.json": "team", "/c/team.json#alice": "alice-work"}
+	for _, tc := range []struct {
+		file, path, name string
+		want             int
+	}{
+		{"/c/team.json", "/c/team.json#bob", "team#bob", 1},
+		{"/c/team.json", "/c/team.json#alice", "alice-work", 2},
+		// A combined file listed by its name ranks its unlisted entries
+		{"/c/team.json", "/c/team.json#carol", "team#carol", 3},
+		{"/c/solo.json", "/c/solo.json", "", 4},
+		{"/c/other.json", "/c/other.json", "", 0},
+	} {
+		if got := credPriority(priorities, names, tc.file, tc.path, tc.name); got != tc.want {
+			t.Fatalf("credPriority(%q): expected %d, got %d", tc.path, tc.want, got)
+		}
+	}
+}